@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+
+	"platform/hooks"
+)
+
+// addContractsCommand registers `contracts`, the parent of the commands that
+// work with Thing Type message contracts, and returns it so they can be added
+// alongside each other.
+func addContractsCommand(app *pocketbase.PocketBase) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "contracts",
+		Short: "Work with Thing Type message contracts",
+	}
+	app.RootCmd.AddCommand(cmd)
+	return cmd
+}
+
+// addContractsValidateCommand registers `contracts validate`, which runs the
+// bus-side contract validator in the foreground, without the HTTP server.
+//
+// It is the same service contracts.validator.enabled starts inside `serve`, for
+// deployments that want it in its own process — on another host, with its own
+// restart policy, or only while a firmware rollout is being watched. It reads
+// the same database, so it must run where that is reachable; rules are re-read
+// every contracts.validator.reload_interval, since record hooks in another
+// process cannot reach it.
+func addContractsValidateCommand(app *pocketbase.PocketBase, parent *cobra.Command, opts hooks.ContractValidatorOptions) {
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check live NATS traffic against message contracts and publish violations",
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			svc := hooks.NewContractValidator(app, opts)
+			log.Printf("✅ Contract validator running against %s (violations on %s.>, stats on %s)",
+				opts.ServerURL, opts.Config.ViolationPrefix, opts.Config.StatsSubject)
+			if err := svc.Run(ctx); err != nil {
+				log.Fatalf("❌ Contract validator stopped: %v", err)
+			}
+		},
+	}
+	parent.AddCommand(cmd)
+}
+
+// addContractsAsyncAPICommand registers `contracts asyncapi`, which writes an
+// organization's AsyncAPI document — the same one GET /api/org/contracts/asyncapi
+// serves — to stdout or a file, for a partner hand-off or a docs build that
+// runs next to the database rather than through the API.
+func addContractsAsyncAPICommand(app *pocketbase.PocketBase, parent *cobra.Command, opts hooks.ContractExportOptions) {
+	cmd := &cobra.Command{
+		Use:   "asyncapi",
+		Short: "Export an organization's message contracts as an AsyncAPI 3.0 document",
+		Run: func(cmd *cobra.Command, args []string) {
+			orgRef, _ := cmd.Flags().GetString("org")
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+
+			if orgRef == "" {
+				log.Fatalf("❌ --org is required")
+			}
+			org, err := app.FindFirstRecordByFilter(opts.OrgCollection,
+				"id = {:ref} || name = {:ref}", dbx.Params{"ref": orgRef})
+			if err != nil {
+				log.Fatalf("❌ Organization %q not found", orgRef)
+			}
+
+			doc, err := hooks.BuildContractDocument(app, opts, org.Id)
+			if err != nil {
+				log.Fatalf("❌ Building the document failed: %v", err)
+			}
+			body, _, err := hooks.EncodeContractDocument(doc, format)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+
+			if output == "" || output == "-" {
+				if _, err := os.Stdout.Write(body); err != nil {
+					log.Fatalf("❌ %v", err)
+				}
+				return
+			}
+			if err := os.WriteFile(output, body, 0o644); err != nil {
+				log.Fatalf("❌ Writing %s failed: %v", output, err)
+			}
+			log.Printf("✅ Wrote %s (AsyncAPI %s, version %s)", output, doc.AsyncAPI, doc.Info.Version)
+		},
+	}
+
+	cmd.Flags().String("org", "", "Organization to export (id or name)")
+	cmd.Flags().String("format", "yaml", "Output format: yaml or json")
+	cmd.Flags().StringP("output", "o", "", "Write to this file instead of stdout")
+
+	parent.AddCommand(cmd)
+}
+
+// addContractsGenerateCommand registers `contracts generate`, which writes a Go
+// package from an organization's contracts (internal/codegen): payload types
+// and validators per message schema version, subject constants and builders per
+// Thing Type operation. The output is deterministic, so a service can check it
+// in and a CI job can regenerate it and fail on a diff — which is the point:
+// hand-written copies of these drifted from the records.
+func addContractsGenerateCommand(app *pocketbase.PocketBase, parent *cobra.Command, opts hooks.ContractExportOptions) {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate a Go package of payload types, validators and subjects from an organization's contracts",
+		Run: func(cmd *cobra.Command, args []string) {
+			orgRef, _ := cmd.Flags().GetString("org")
+			pkg, _ := cmd.Flags().GetString("package")
+			output, _ := cmd.Flags().GetString("output")
+
+			if orgRef == "" {
+				log.Fatalf("❌ --org is required")
+			}
+			org, err := app.FindFirstRecordByFilter(opts.OrgCollection,
+				"id = {:ref} || name = {:ref}", dbx.Params{"ref": orgRef})
+			if err != nil {
+				log.Fatalf("❌ Organization %q not found", orgRef)
+			}
+
+			src, err := hooks.GenerateContractCode(app, opts, org.Id, pkg)
+			if err != nil {
+				log.Fatalf("❌ Generating code failed: %v", err)
+			}
+
+			if output == "" || output == "-" {
+				if _, err := os.Stdout.Write(src); err != nil {
+					log.Fatalf("❌ %v", err)
+				}
+				return
+			}
+			if err := os.WriteFile(output, src, 0o644); err != nil {
+				log.Fatalf("❌ Writing %s failed: %v", output, err)
+			}
+			log.Printf("✅ Wrote package %s to %s", pkg, output)
+		},
+	}
+
+	cmd.Flags().String("org", "", "Organization to generate for (id or name)")
+	cmd.Flags().String("package", "contracts", "Go package name of the generated file")
+	cmd.Flags().StringP("output", "o", "", "Write to this file instead of stdout")
+
+	parent.AddCommand(cmd)
+}
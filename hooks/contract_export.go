@@ -0,0 +1,220 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/asyncapi"
+	"platform/internal/codegen"
+	"platform/internal/subjectresolver"
+)
+
+// ContractExportOptions configures the AsyncAPI export. The server URLs become
+// the document's servers; they are the addresses a device dials, which is what
+// a partner integrating with those devices needs too.
+type ContractExportOptions struct {
+	ThingRoutesOptions
+
+	NatsServerURL     string
+	NatsWebsocketURLs []string
+}
+
+// RegisterContractExportRoutes adds the AsyncAPI export of the caller's
+// organization:
+//
+//	GET /api/org/contracts/asyncapi[?format=yaml|json]
+//
+// Integration partners ask for an AsyncAPI document and were given one written
+// by hand from the console, which was out of date by the next operation anyone
+// added. This renders it from the records: one channel per Thing Type operation,
+// its address the resolved subject with {thing} and {location} as channel
+// parameters, the operation's capability as the action, and the referenced
+// message_schemas document as the payload. internal/asyncapi describes the
+// mapping; BuildContractDocument below is the part that reads records, shared
+// with `stone-age contracts asyncapi`.
+//
+// YAML unless ?format=json. Readable by the audience of the contract routes
+// (hooks/thing_contract_routes.go) — members of the active organization and
+// its leaf nodes — since it is the same information in another shape.
+func RegisterContractExportRoutes(app *pocketbase.PocketBase, opts ContractExportOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.GET("/api/org/contracts/asyncapi", func(re *core.RequestEvent) error {
+			format := re.Request.URL.Query().Get("format")
+			if format == "" {
+				format = "yaml"
+			}
+			if format != "yaml" && format != "json" {
+				return re.BadRequestError("format must be yaml or json", nil)
+			}
+
+			orgID, err := contractReaderOrg(re, opts.ThingRoutesOptions)
+			if err != nil {
+				return err
+			}
+			doc, err := BuildContractDocument(re.App, opts, orgID)
+			if err != nil {
+				return re.InternalServerError("the contract document could not be built", err)
+			}
+
+			body, contentType, err := EncodeContractDocument(doc, format)
+			if err != nil {
+				return re.InternalServerError("the contract document could not be encoded", err)
+			}
+			return re.Blob(200, contentType, body)
+		}).Bind(apis.RequireAuth("users", opts.LeafNodeCollection))
+
+		return se.Next()
+	})
+}
+
+// EncodeContractDocument renders doc as "yaml" or "json", with its content type.
+func EncodeContractDocument(doc *asyncapi.Document, format string) ([]byte, string, error) {
+	switch format {
+	case "yaml":
+		b, err := doc.YAML()
+		return b, "application/yaml", err
+	case "json":
+		b, err := doc.JSON()
+		return b, "application/json", err
+	}
+	return nil, "", fmt.Errorf("unknown format %q", format)
+}
+
+// BuildContractDocument renders an organization's Thing Types as an AsyncAPI
+// document.
+func BuildContractDocument(app core.App, opts ContractExportOptions, orgID string) (*asyncapi.Document, error) {
+	contract, err := LoadContract(app, opts, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return asyncapi.Build(contract)
+}
+
+// GenerateContractCode renders an organization's contracts as the source of a
+// Go package named pkg: every json_schema version in message_schemas, whether
+// or not an operation references it yet, and every Thing Type's subjects.
+func GenerateContractCode(app core.App, opts ContractExportOptions, orgID, pkg string) ([]byte, error) {
+	contract, err := LoadContract(app, opts, orgID)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := app.FindRecordsByFilter(opts.MessageSchemaCollection,
+		"organization = {:org}", "", 0, 0, dbx.Params{"org": orgID})
+	if err != nil {
+		return nil, err
+	}
+	in := codegen.Input{Package: pkg, Source: contract.Org, Types: contract.Types}
+	for _, s := range schemas {
+		in.Schemas = append(in.Schemas, *exportSchema(&resolvedSchema{
+			ID:        s.Id,
+			Namespace: s.GetString("namespace"),
+			Name:      s.GetString("name"),
+			Version:   s.GetString("version"),
+			Format:    s.GetString("format"),
+			Schema:    s.Get("schema"),
+		}))
+	}
+	return codegen.Generate(in)
+}
+
+// LoadContract reads an organization's Thing Types, operations and schemas into
+// the model internal/asyncapi and internal/codegen render.
+//
+// Subjects are resolved as the type contract route resolves them, except that
+// {thing} and {location} stay in the address as channel parameters rather than
+// becoming "*". An operation whose subject does not resolve to a valid one is
+// left out — no identity is granted it either — and logged. So is an
+// operation's schema if it belongs to another organization.
+func LoadContract(app core.App, opts ContractExportOptions, orgID string) (asyncapi.Contract, error) {
+	org, err := app.FindRecordById(opts.OrgCollection, orgID)
+	if err != nil {
+		return asyncapi.Contract{}, err
+	}
+	orgName := org.GetString("name")
+
+	contract := asyncapi.Contract{
+		Org:         orgName,
+		Title:       orgName + " message contracts",
+		Description: "Thing Type operations of " + orgName + ", generated from the platform's contract records.",
+	}
+	if opts.NatsServerURL != "" {
+		contract.Servers = append(contract.Servers, asyncapi.Server{Name: "nats", URL: opts.NatsServerURL})
+	}
+	for i, u := range opts.NatsWebsocketURLs {
+		contract.Servers = append(contract.Servers, asyncapi.Server{Name: fmt.Sprintf("websocket-%d", i+1), URL: u})
+	}
+
+	types, err := app.FindRecordsByFilter(opts.ThingTypeCollection,
+		"organization = {:org}", "", 0, 0, dbx.Params{"org": orgID})
+	if err != nil {
+		return asyncapi.Contract{}, err
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Id < types[j].Id })
+
+	for _, tt := range types {
+		ops, err := typeOperations(app, opts.ThingRoutesOptions, orgID, tt)
+		if err != nil {
+			log.Printf("⚠️ contracts: type %s left out: %v", tt.GetString("code"), err)
+			continue
+		}
+
+		ctx := subjectresolver.RolePatternContext{Org: orgName, ThingTypeCode: tt.GetString("code")}
+		defs := make([]subjectresolver.Operation, 0, len(ops))
+		for _, op := range ops {
+			defs = append(defs, subjectresolver.Operation{
+				Name:       op.GetString("name"),
+				Capability: op.GetString("capability"),
+				Suffix:     op.GetString("subject_suffix"),
+			})
+		}
+		_, problems := subjectresolver.DeriveRolePattern(tt.GetString("subject_prefix"), ctx, defs)
+
+		resolved := resolveOperations(app, opts.ThingRoutesOptions, orgID, tt, ops, problems,
+			func(tmpl string) string {
+				return subjectresolver.ResolveThing(tmpl, subjectresolver.ThingContext{Org: ctx.Org, ThingTypeCode: ctx.ThingTypeCode})
+			})
+
+		key := tt.GetString("code")
+		if key == "" {
+			key = tt.Id
+		}
+		t := asyncapi.ThingType{Key: key, Name: tt.GetString("name"), Description: tt.GetString("description")}
+		for _, r := range resolved {
+			if r.Problem != "" {
+				log.Printf("⚠️ contracts: %s/%s left out: %s", key, r.Name, r.Problem)
+				continue
+			}
+			op := asyncapi.Operation{Name: r.Name, Capability: r.Capability, Description: r.Description, Address: r.Subject}
+			if r.Schema != nil {
+				op.Schema = exportSchema(r.Schema)
+			}
+			t.Operations = append(t.Operations, op)
+		}
+		contract.Types = append(contract.Types, t)
+	}
+
+	return contract, nil
+}
+
+// exportSchema decodes a schema document into the plain form asyncapi renders.
+func exportSchema(s *resolvedSchema) *asyncapi.Schema {
+	raw, err := json.Marshal(s.Schema)
+	var doc any
+	if err == nil {
+		err = json.Unmarshal(raw, &doc)
+	}
+	if err != nil {
+		doc = nil
+	}
+	return &asyncapi.Schema{
+		Namespace: s.Namespace, Name: s.Name, Version: s.Version,
+		Format: s.Format, MessageType: s.MessageType, Document: doc,
+	}
+}
@@ -0,0 +1,314 @@
+package hooks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/contractcheck"
+	"platform/internal/enrollment"
+	"platform/internal/jsonvalidate"
+	"platform/internal/msgformat"
+	"platform/internal/subjectresolver"
+)
+
+// ContractValidatorOptions configures the bus-side contract validator.
+type ContractValidatorOptions struct {
+	OrgCollection                string
+	NatsAccountCollection        string
+	ThingTypeCollection          string
+	ThingTypeOperationCollection string
+	MessageSchemaCollection      string
+
+	// Enabled turns the validator on inside `serve`. Off by default: it holds a
+	// subscription on every contracted subject of every organization, which is
+	// a cost an operator should choose.
+	Enabled bool
+
+	// ServerURL is nats.server_url, the address the validator dials.
+	ServerURL string
+
+	Config contractcheck.Config
+}
+
+// validatorJWTLifetime bounds the credential of an in-process account service —
+// the validator, the schema registry. It is re-signed on every (re)connect, so
+// the lifetime only limits how long a leaked one is good.
+const validatorJWTLifetime = time.Hour
+
+// contractSchemas caches compiled message schemas across reloads.
+var contractSchemas = jsonvalidate.NewCache(1024)
+
+// RegisterContractValidator runs the contract validator (internal/contractcheck)
+// inside `serve` when contracts.validator.enabled is set, and reloads its rules
+// whenever a record they are derived from changes. `stone-age contracts
+// validate` runs the same thing without the HTTP server.
+//
+// What it watches, per organization with an active NATS account: every
+// operation of every Thing Type that references a message schema, on the
+// subject pattern all Things of that type use for it — the type's subject_prefix
+// joined with the operation's subject_suffix, {org} and {thing_type_code}
+// substituted and {thing} and {location} widened to "*" (ResolveRolePattern, the
+// same resolution a role grant uses). An operation with no schema has nothing to
+// check and is not subscribed to.
+//
+// How it gets into each account. Central PocketBase is the NATS operator and
+// its own connection lives in the SYSTEM account, which cannot see an
+// organization's subjects. So the validator signs itself a user in each account
+// with that account's key: subscribe on the watched patterns, publish on the
+// violation and stats subjects, nothing else, valid for an hour and re-signed on
+// each reconnect. The credential exists only in this process's memory; there is
+// no nats_users record for it, and an account whose seed is encrypted at rest is
+// skipped, as enrollment refuses to sign with one.
+//
+// Observational only, and never fatal: load and connect failures are logged and
+// retried on the next reload, and nothing here can reject a message.
+func RegisterContractValidator(app *pocketbase.PocketBase, opts ContractValidatorOptions) {
+	if !opts.Enabled {
+		return
+	}
+
+	svc := NewContractValidator(app, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		go func() {
+			defer close(done)
+			_ = svc.Run(ctx)
+		}()
+		log.Printf("✅ Contract validator started (violations on %s.>, stats on %s)",
+			opts.Config.ViolationPrefix, opts.Config.StatsSubject)
+		return se.Next()
+	})
+
+	app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		return e.Next()
+	})
+
+	reload := func(e *core.RecordEvent) error {
+		svc.Reload()
+		return e.Next()
+	}
+	watched := []string{
+		opts.OrgCollection, opts.NatsAccountCollection, opts.ThingTypeCollection,
+		opts.ThingTypeOperationCollection, opts.MessageSchemaCollection,
+	}
+	app.OnRecordAfterCreateSuccess(watched...).BindFunc(reload)
+	app.OnRecordAfterUpdateSuccess(watched...).BindFunc(reload)
+	app.OnRecordAfterDeleteSuccess(watched...).BindFunc(reload)
+}
+
+// NewContractValidator builds the validator service over app's records.
+func NewContractValidator(app core.App, opts ContractValidatorOptions) *contractcheck.Service {
+	load := func(ctx context.Context) ([]contractcheck.Account, error) {
+		return loadContractAccounts(app, opts)
+	}
+	connect := func(ctx context.Context, acct contractcheck.Account, cfg contractcheck.Config) (*nats.Conn, error) {
+		return connectContractValidator(app, opts, acct, cfg)
+	}
+	return contractcheck.New(opts.Config, load, connect)
+}
+
+// loadContractAccounts reads every organization's watchable rules.
+func loadContractAccounts(app core.App, opts ContractValidatorOptions) ([]contractcheck.Account, error) {
+	accounts, err := app.FindRecordsByFilter(opts.NatsAccountCollection,
+		"active = true && organization != ''", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []contractcheck.Account
+	for _, acctRec := range accounts {
+		orgID := acctRec.GetString("organization")
+		org, err := app.FindRecordById(opts.OrgCollection, orgID)
+		if err != nil {
+			continue
+		}
+		rules, err := orgContractRules(app, opts, org)
+		if err != nil {
+			log.Printf("⚠️ contract validator: org %s: %v", org.GetString("name"), err)
+			continue
+		}
+		out = append(out, contractcheck.Account{
+			Org:       orgID,
+			OrgName:   org.GetString("name"),
+			PublicKey: acctRec.GetString("public_key"),
+			Rules:     rules,
+		})
+	}
+	return out, nil
+}
+
+// orgContractRules turns an organization's Thing Types into validator rules.
+// Protobuf and Avro schemas are checked by decoding the payload as the
+// schema's message type. An operation that cannot be watched — no schema, a
+// schema in another organization or one that does not compile, a subject that
+// does not resolve — is logged and left out; the rest of the type is still
+// watched.
+func orgContractRules(app core.App, opts ContractValidatorOptions, org *core.Record) ([]contractcheck.Rule, error) {
+	types, err := app.FindRecordsByFilter(opts.ThingTypeCollection,
+		"organization = {:org}", "", 0, 0, dbx.Params{"org": org.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []contractcheck.Rule
+	for _, tt := range types {
+		ids := tt.GetStringSlice("operations")
+		if len(ids) == 0 {
+			continue
+		}
+		ops, err := app.FindRecordsByIds(opts.ThingTypeOperationCollection, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			schemaID := op.GetString("schema")
+			if schemaID == "" || op.GetString("organization") != org.Id {
+				continue
+			}
+			skip := func(reason string) {
+				log.Printf("⚠️ contract validator: %s/%s not watched: %s", tt.GetString("code"), op.GetString("name"), reason)
+			}
+
+			subject := subjectresolver.ResolveRolePattern(
+				subjectresolver.Join(tt.GetString("subject_prefix"), op.GetString("subject_suffix")),
+				subjectresolver.RolePatternContext{Org: org.GetString("name"), ThingTypeCode: tt.GetString("code")},
+			)
+			if vars := subjectresolver.Unresolved(subject); len(vars) > 0 {
+				skip("unresolved " + strings.Join(vars, ", "))
+				continue
+			}
+			if err := subjectresolver.Valid(subject); err != nil {
+				skip(err.Error())
+				continue
+			}
+
+			schema, err := app.FindRecordById(opts.MessageSchemaCollection, schemaID)
+			if err != nil || schema.GetString("organization") != org.Id {
+				skip("schema not found in this organization")
+				continue
+			}
+			var validator contractcheck.Validator
+			if schema.GetString("format") == msgformat.JSONSchema {
+				raw := jsonFieldBytes(schema, "schema")
+				if jsonvalidate.IsEmpty(raw) {
+					continue
+				}
+				compiled, err := contractSchemas.Compile(raw)
+				if err != nil {
+					skip("schema does not compile: " + err.Error())
+					continue
+				}
+				validator = compiled
+			} else {
+				codec, err := compileMessageSchema(schema)
+				if err != nil {
+					skip(fmt.Sprintf("%s schema does not compile: %v", schema.GetString("format"), err))
+					continue
+				}
+				validator = codec
+			}
+
+			rules = append(rules, contractcheck.Rule{
+				Subject:    subject,
+				ThingType:  tt.GetString("code"),
+				Operation:  op.GetString("name"),
+				Capability: op.GetString("capability"),
+				Schema: contractcheck.SchemaRef{
+					ID:        schema.Id,
+					Namespace: schema.GetString("namespace"),
+					Name:      schema.GetString("name"),
+					Version:   schema.GetString("version"),
+				},
+				Validator:    validator,
+				SchemaDigest: messageSchemaDigest(schema),
+			})
+		}
+	}
+	contractcheck.SortRules(rules)
+	return rules, nil
+}
+
+// messageSchemaDigest hashes what a message schema's validator is compiled from,
+// for contractcheck.Rule.SchemaDigest.
+func messageSchemaDigest(schema *core.Record) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", schema.GetString("format"), schema.GetString("message_type"))
+	h.Write(jsonFieldBytes(schema, "schema"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// connectContractValidator dials the NATS server as a validator user of acct's
+// account, signing a fresh JWT for it on every connect.
+func connectContractValidator(app core.App, opts ContractValidatorOptions, acct contractcheck.Account, cfg contractcheck.Config) (*nats.Conn, error) {
+	subs := make([]string, 0, len(acct.Rules))
+	for _, r := range acct.Rules {
+		subs = append(subs, r.Subject)
+	}
+	return connectAccountService(app, opts.NatsAccountCollection, acct.Org, opts.ServerURL,
+		"stone-age contract validator ("+acct.OrgName+")",
+		enrollment.UserSpec{
+			Name:     "contract-validator",
+			PubAllow: []string{cfg.ViolationPrefix + ".>", cfg.StatsSubject},
+			SubAllow: subs,
+		})
+}
+
+// connectAccountService dials serverURL as a user of orgID's account that
+// exists only in this process: a fresh key pair, and a JWT with spec's
+// permissions signed with the account key on every (re)connect and valid for
+// validatorJWTLifetime. Limits are unlimited. An account whose keys are
+// encrypted at rest cannot sign, and is refused with errKeyUnreadable.
+func connectAccountService(app core.App, accountCollection, orgID, serverURL, connName string, spec enrollment.UserSpec) (*nats.Conn, error) {
+	accountRec, err := app.FindFirstRecordByFilter(accountCollection,
+		"organization = {:org} && active = true", dbx.Params{"org": orgID})
+	if err != nil {
+		return nil, fmt.Errorf("account: %w", err)
+	}
+	seed := accountRec.GetString("seed")
+	if !strings.HasPrefix(seed, "SA") {
+		seed = accountRec.GetString("signing_seed")
+	}
+	if !strings.HasPrefix(seed, "SA") {
+		return nil, errKeyUnreadable
+	}
+
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, err
+	}
+	userPub, err := user.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	spec.PublicKey = userPub
+	spec.Subs, spec.Data, spec.Payload = -1, -1, -1
+	sign := func() (string, error) {
+		spec.Expires = time.Now().Add(validatorJWTLifetime)
+		return enrollment.SignUserJWT(seed, accountRec.GetString("public_key"), spec)
+	}
+
+	return nats.Connect(serverURL,
+		nats.Name(connName),
+		nats.UserJWT(sign, func(nonce []byte) ([]byte, error) { return user.Sign(nonce) }),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+}
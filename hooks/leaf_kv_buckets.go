@@ -0,0 +1,42 @@
+package hooks
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/leafsync"
+)
+
+// LeafKVBucketsOptions names the leaf node collection, so a deployment that
+// renamed it via config.yaml still works.
+type LeafKVBucketsOptions struct {
+	LeafNodeCollection string
+}
+
+// RegisterLeafKVBuckets validates leaf_nodes.kv_buckets, the per-collection
+// settings of the KV buckets leaf-sync mirrors into on that leaf node (history,
+// storage, replicas, max_bytes, compression; see
+// internal/leafsync/buckets.go).
+//
+// leaf-sync reads the field at startup, and a value it cannot parse is ignored
+// there with a warning, since an edge that stops syncing over a typo is worse
+// than one with default buckets. That warning lands in a log on a box nobody is
+// looking at, though, so the same parser runs here and the typo is a form error
+// on the console instead. Empty (null) is valid: every bucket keeps the
+// leaf-sync.yaml or built-in shape.
+func RegisterLeafKVBuckets(app *pocketbase.PocketBase, opts LeafKVBucketsOptions) {
+	check := func(e *core.RecordEvent) error {
+		var raw any
+		if err := json.Unmarshal(jsonFieldBytes(e.Record, "kv_buckets"), &raw); err != nil {
+			return fieldError("kv_buckets", err)
+		}
+		if err := leafsync.ValidateBucketSettings(raw); err != nil {
+			return fieldError("kv_buckets", err)
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(opts.LeafNodeCollection).BindFunc(check)
+	app.OnRecordUpdate(opts.LeafNodeCollection).BindFunc(check)
+}
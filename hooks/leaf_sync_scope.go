@@ -0,0 +1,113 @@
+package hooks
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// LeafSyncScopeOptions names the collections involved, so a deployment that
+// renamed them via config.yaml still works.
+type LeafSyncScopeOptions struct {
+	LeafNodeCollection string
+	LocationCollection string
+}
+
+// leafScopeLocation is the leaf_nodes.sync_scope value that limits a leaf node
+// to its location's subtree. Empty and "organization" both mean the whole
+// organization, which is what every leaf node saw before the field existed.
+const leafScopeLocation = "location"
+
+// RegisterLeafSyncScope keeps what the location-scoped leaf-node read rules
+// depend on true.
+//
+// A leaf node with sync_scope = "location" may read only the locations at or
+// below its own location, the things at those locations, and the types,
+// operations and schemas those things and locations use. The rules enforce it
+// server-side, so a leaf-sync binary that asks for more, or a stolen leaf-node
+// password, gets no more than the site it serves. The custom routes that read
+// the same records for a leaf node (contracts, the AsyncAPI export, schema
+// conversion) refuse a scoped one outright; see contractReaderOrg. "At or below" needs the whole
+// parent chain, which an API rule cannot walk, so every location carries it:
+// `locations.ancestors`, a hidden relation listing every location above it.
+// The rules then ask `ancestors ?= @request.auth.location`.
+//
+// The field is hidden, so only a server-side Save can write it, and it is
+// recomputed on every save from the parent's own ancestors, never read from the
+// request. Moving a location rewrites its descendants in the same save, each
+// from its newly saved parent. The same check refuses a parent chain that would
+// loop, which also keeps the chain finite for everything that walks it.
+//
+// A leaf node scoped to its location must have one. The rules refuse such a
+// leaf node everything anyway — `@request.auth.location != ""` is part of the
+// scoped branch, or `location = ""` would match every unplaced Thing — but a
+// leaf node that silently mirrors nothing is worse than a form error.
+func RegisterLeafSyncScope(app *pocketbase.PocketBase, opts LeafSyncScopeOptions) {
+	app.OnRecordCreate(opts.LocationCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := setAncestors(e.App, opts.LocationCollection, e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+
+	app.OnRecordUpdate(opts.LocationCollection).BindFunc(func(e *core.RecordEvent) error {
+		before := e.Record.Original().GetStringSlice("ancestors")
+		if err := setAncestors(e.App, opts.LocationCollection, e.Record); err != nil {
+			return err
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		if slices.Equal(before, e.Record.GetStringSlice("ancestors")) {
+			return nil
+		}
+		// Each child's save recomputes from this record and cascades further.
+		children, err := e.App.FindRecordsByFilter(opts.LocationCollection,
+			"parent = {:id}", "", 0, 0, dbx.Params{"id": e.Record.Id})
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := e.App.Save(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	checkScope := func(e *core.RecordEvent) error {
+		if e.Record.GetString("sync_scope") == leafScopeLocation && e.Record.GetString("location") == "" {
+			return fieldError("location", errors.New("a leaf node scoped to its location needs a location"))
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(opts.LeafNodeCollection).BindFunc(checkScope)
+	app.OnRecordUpdate(opts.LeafNodeCollection).BindFunc(checkScope)
+}
+
+// setAncestors sets a location's `ancestors` from its parent: the parent's own
+// ancestors, then the parent. A parent that is the location itself or one of its
+// descendants is refused.
+func setAncestors(app core.App, col string, rec *core.Record) error {
+	parentID := rec.GetString("parent")
+	if parentID == "" {
+		rec.Set("ancestors", []string{})
+		return nil
+	}
+	if parentID == rec.Id {
+		return fieldError("parent", errors.New("a location cannot be its own parent"))
+	}
+	parent, err := app.FindRecordById(col, parentID)
+	if err != nil {
+		return fieldError("parent", errors.New("parent location not found"))
+	}
+	chain := append(parent.GetStringSlice("ancestors"), parent.Id)
+	if rec.Id != "" && slices.Contains(chain, rec.Id) {
+		return fieldError("parent", errors.New("a location cannot be placed under one of its own descendants"))
+	}
+	rec.Set("ancestors", chain)
+	return nil
+}
@@ -0,0 +1,278 @@
+package hooks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	validation "github.com/pocketbase/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"platform/internal/schemacompat"
+)
+
+// MessageSchemaCompatOptions configures the compatibility check on
+// message_schemas.
+type MessageSchemaCompatOptions struct {
+	MessageSchemaCollection string
+	NamespaceCollection     string
+
+	// DefaultMode applies in a namespace with no message_schema_namespaces
+	// record: contracts.compatibility.default, "backward" unless configured.
+	DefaultMode string
+}
+
+// schemaVersionRef names the version a schema was compared with.
+type schemaVersionRef struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// schemaCompatibility is what is stored in message_schemas.compatibility.
+// Changes lists every difference from Previous, breaking or not, each marked
+// with the direction it breaks; NextChanges those from this version to Next,
+// and EditChanges those from the document this version had before the write.
+// Compatible says whether none of them breaks Mode.
+type schemaCompatibility struct {
+	Mode        string                `json:"mode"`
+	Previous    *schemaVersionRef     `json:"previous"`
+	Compatible  bool                  `json:"compatible"`
+	Overridden  bool                  `json:"overridden"`
+	Changes     []schemacompat.Change `json:"changes"`
+	Next        *schemaVersionRef     `json:"next,omitempty"`
+	NextChanges []schemacompat.Change `json:"next_changes,omitempty"`
+	EditChanges []schemacompat.Change `json:"edit_changes,omitempty"`
+	Note        string                `json:"note,omitempty"`
+	CheckedAt   types.DateTime        `json:"checked_at"`
+}
+
+// RegisterMessageSchemaCompat checks every new message schema version against
+// the version before it, and refuses one that breaks the namespace's
+// compatibility mode.
+//
+// message_schemas are keyed by namespace/name/version, and nothing stopped
+// 1.1.0 from dropping a field 1.0.0 required or turning a number into a string.
+// Consumers built against the old version find out from the bus. A version
+// number is a promise about compatibility; this makes the platform hold the
+// author to it.
+//
+// The previous version is the highest semantic version below this one with the
+// same organization, namespace and name; a first version has nothing to be
+// compared with and passes. A version inserted below an existing one — 1.1.0
+// between 1.0.0 and 2.0.0 — must also be one the next version up is compatible
+// with, since that is now its predecessor. And an edit of a version's schema
+// in place, version unchanged, must be compatible with the document it
+// replaces: consumers may already be using that version, and a comparison with
+// the version below would let it break them. The mode is per namespace, from
+// message_schema_namespaces (backward, forward, full or none — see
+// internal/schemacompat for what each promises), falling back to DefaultMode.
+// A breaking change is refused with a field error on `schema` listing each break
+// by JSON pointer:
+//
+//	{"data": {"schema": {"code": "validation_incompatible_schema",
+//	  "message": "not backward compatible with 1.0.0: /required: property \"site\" is now required; ..."}}}
+//
+// Setting allow_breaking on the write publishes it anyway. The flag is a
+// one-shot override for this write, not a property of the record: it is cleared
+// before saving, and the result records overridden: true so the decision stays
+// visible.
+//
+// The result is stored in `compatibility` on every checked write, compatible or
+// not. It is the server's statement, so a client cannot set it: a write that is
+// not re-checked keeps the stored value. The check runs on create, and on an
+// update that changes schema, version, namespace, name or format — editing a
+// description re-checks nothing. Changing a namespace's mode does not re-check
+// the versions already in it.
+//
+// json_schema documents are compiled first, so one that does not compile is
+// refused here rather than skipped by the bus-side validator. Other formats are
+// compiled by RegisterMessageSchemaFormats and stored here with a note that they
+// were not compared.
+func RegisterMessageSchemaCompat(app *pocketbase.PocketBase, opts MessageSchemaCompatOptions) {
+	app.OnRecordCreate(opts.MessageSchemaCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := checkSchemaCompatibility(e.App, opts, e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+	app.OnRecordUpdate(opts.MessageSchemaCollection).BindFunc(func(e *core.RecordEvent) error {
+		if !changed(e.Record, "schema", "version", "namespace", "name", "format") {
+			e.Record.Set("compatibility", e.Record.Original().Get("compatibility"))
+			e.Record.Set("allow_breaking", false)
+			return e.Next()
+		}
+		if err := checkSchemaCompatibility(e.App, opts, e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+}
+
+// checkSchemaCompatibility compares rec with its neighbouring versions, and
+// with its own document before an in-place edit, and stores the result on rec,
+// or returns the field error that refuses it.
+func checkSchemaCompatibility(app core.App, opts MessageSchemaCompatOptions, rec *core.Record) error {
+	override := rec.GetBool("allow_breaking")
+	rec.Set("allow_breaking", false)
+
+	result := schemaCompatibility{
+		Mode:       namespaceCompatibilityMode(app, opts, rec),
+		Compatible: true,
+		Changes:    []schemacompat.Change{},
+		CheckedAt:  types.NowDateTime(),
+	}
+
+	format := rec.GetString("format")
+	raw := jsonFieldBytes(rec, "schema")
+	if format == "json_schema" {
+		if _, err := contractSchemas.Compile(raw); err != nil {
+			return fieldError("schema", err)
+		}
+	}
+
+	prev, next, err := neighbourSchemaVersions(app, opts, rec)
+	if err != nil {
+		return err
+	}
+
+	// compare records one comparison the write must pass, older then newer
+	// document, and what to say if it breaks the mode.
+	var breaks []string
+	compare := func(older, newer []byte, refusal string) ([]schemacompat.Change, error) {
+		changes, err := schemacompat.Compare(older, newer)
+		if err != nil {
+			return nil, fieldError("schema", err)
+		}
+		if breaking := schemacompat.Breaking(changes, result.Mode); len(breaking) > 0 {
+			breaks = append(breaks, refusal+": "+schemacompat.Describe(breaking))
+		}
+		return changes, nil
+	}
+
+	switch {
+	case prev == nil:
+		result.Note = "first version"
+	case format != "json_schema" || prev.GetString("format") != format:
+		result.Previous = &schemaVersionRef{ID: prev.Id, Version: prev.GetString("version")}
+		result.Note = fmt.Sprintf("%s schemas are not compared", format)
+		if prev.GetString("format") != format {
+			result.Note = fmt.Sprintf("format changed from %s to %s; not compared", prev.GetString("format"), format)
+		}
+	default:
+		result.Previous = &schemaVersionRef{ID: prev.Id, Version: prev.GetString("version")}
+		result.Changes, err = compare(jsonFieldBytes(prev, "schema"), raw,
+			fmt.Sprintf("not %s compatible with %s", result.Mode, result.Previous.Version))
+		if err != nil {
+			return err
+		}
+	}
+
+	if next != nil && format == "json_schema" && next.GetString("format") == format {
+		result.Next = &schemaVersionRef{ID: next.Id, Version: next.GetString("version")}
+		result.NextChanges, err = compare(raw, jsonFieldBytes(next, "schema"),
+			fmt.Sprintf("%s would not be %s compatible with it", result.Next.Version, result.Mode))
+		if err != nil {
+			return err
+		}
+	}
+
+	if original := rec.Original(); !rec.IsNew() && format == "json_schema" &&
+		original.GetString("format") == format && changed(rec, "schema") && !changed(rec, "version", "namespace", "name") {
+		result.EditChanges, err = compare(jsonFieldBytes(original, "schema"), raw,
+			fmt.Sprintf("not %s compatible with %s as published", result.Mode, rec.GetString("version")))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(breaks) > 0 {
+		result.Compatible = false
+		if !override {
+			return validation.Errors{"schema": validation.NewError("validation_incompatible_schema",
+				strings.Join(breaks, "; ")+" (set allow_breaking to publish it anyway)")}
+		}
+		result.Overridden = true
+	}
+
+	rec.Set("compatibility", result)
+	return nil
+}
+
+// namespaceCompatibilityMode returns the mode configured for rec's namespace.
+func namespaceCompatibilityMode(app core.App, opts MessageSchemaCompatOptions, rec *core.Record) string {
+	ns, err := app.FindFirstRecordByFilter(opts.NamespaceCollection,
+		"organization = {:org} && namespace = {:ns}",
+		dbx.Params{"org": rec.GetString("organization"), "ns": rec.GetString("namespace")})
+	if err == nil {
+		if m := ns.GetString("compatibility"); schemacompat.ValidMode(m) {
+			return m
+		}
+	}
+	return opts.DefaultMode
+}
+
+// neighbourSchemaVersions returns the highest version of rec's schema below
+// rec's own and the lowest above it, either nil if there is none.
+func neighbourSchemaVersions(app core.App, opts MessageSchemaCompatOptions, rec *core.Record) (prev, next *core.Record, err error) {
+	own, ok := parseSemver(rec.GetString("version"))
+	if !ok {
+		return nil, nil, nil // the field's own pattern rejects it
+	}
+	siblings, err := app.FindRecordsByFilter(opts.MessageSchemaCollection,
+		"organization = {:org} && namespace = {:ns} && name = {:name} && id != {:id}", "", 0, 0,
+		dbx.Params{
+			"org":  rec.GetString("organization"),
+			"ns":   rec.GetString("namespace"),
+			"name": rec.GetString("name"),
+			"id":   rec.Id,
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var prevV, nextV [3]int
+	for _, s := range siblings {
+		v, ok := parseSemver(s.GetString("version"))
+		switch {
+		case !ok:
+		case semverLess(v, own):
+			if prev == nil || semverLess(prevV, v) {
+				prev, prevV = s, v
+			}
+		case semverLess(own, v):
+			if next == nil || semverLess(v, nextV) {
+				next, nextV = s, v
+			}
+		}
+	}
+	return prev, next, nil
+}
+
+// parseSemver reads the MAJOR.MINOR.PATCH form message_schemas.version allows.
+func parseSemver(s string) ([3]int, bool) {
+	var v [3]int
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+func semverLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package hooks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/msgformat"
+)
+
+// messageSchemaConvertRequest is the body of the convert route: a JSON sample
+// to encode, or a base64 payload to decode. Exactly one is set.
+type messageSchemaConvertRequest struct {
+	JSON    json.RawMessage `json:"json"`
+	Payload string          `json:"payload"`
+}
+
+// RegisterMessageSchemaFormats makes Protobuf and Avro first-class formats of
+// message_schemas (internal/msgformat), next to JSON Schema:
+//
+//   - On save, a protobuf or avro document is compiled, and refused with a field
+//     error on `schema` if it does not compile, or on `message_type` if the
+//     message type it names is not in it — or it names none and the document
+//     declares several. The resolved, fully qualified name is stored in
+//     message_type, so everything downstream reads the same type. A json_schema
+//     record may not set message_type; its document is compiled by the
+//     compatibility check (RegisterMessageSchemaCompat). Writes that change
+//     neither schema, format nor message_type are not re-checked.
+//
+//   - POST /api/org/message-schemas/{id}/convert turns a JSON sample into the
+//     schema's wire encoding and back, for testing a device or a consumer
+//     against the contract:
+//
+//     {"json": {...}}         → {"payload": "<base64>", "json": {...}}
+//     {"payload": "<base64>"} → {"payload": "<base64>", "json": {...}}
+//
+//     "json" in the response is always the decoded payload, so a sample comes
+//     back in the format's canonical JSON — Protobuf's camelCase field names,
+//     say. A sample or payload that does not conform is a 400 naming why.
+//
+// The convert route is read-only and open to the audience of the contract
+// routes: members of the active organization and its leaf nodes. A schema of
+// another organization is not found.
+func RegisterMessageSchemaFormats(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnRecordCreate(opts.MessageSchemaCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := checkMessageSchemaFormat(e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+	app.OnRecordUpdate(opts.MessageSchemaCollection).BindFunc(func(e *core.RecordEvent) error {
+		if changed(e.Record, "schema", "format", "message_type") {
+			if err := checkMessageSchemaFormat(e.Record); err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.POST("/api/org/message-schemas/{id}/convert", func(re *core.RequestEvent) error {
+			var body messageSchemaConvertRequest
+			if err := re.BindBody(&body); err != nil {
+				return re.BadRequestError("invalid request body", err)
+			}
+			hasJSON := len(body.JSON) > 0 && string(body.JSON) != "null"
+			if hasJSON == (body.Payload != "") {
+				return re.BadRequestError("send exactly one of json and payload", nil)
+			}
+
+			orgID, err := contractReaderOrg(re, opts)
+			if err != nil {
+				return err
+			}
+			rec, err := re.App.FindRecordById(opts.MessageSchemaCollection, re.Request.PathValue("id"))
+			if err != nil || rec.GetString("organization") != orgID {
+				return re.NotFoundError("message schema not found", nil)
+			}
+			codec, err := compileMessageSchema(rec)
+			if err != nil {
+				return re.BadRequestError("the schema does not compile: "+err.Error(), nil)
+			}
+
+			var payload []byte
+			if hasJSON {
+				if payload, err = codec.Encode(body.JSON); err != nil {
+					return re.BadRequestError("the sample does not conform: "+err.Error(), nil)
+				}
+			} else if payload, err = base64.StdEncoding.DecodeString(body.Payload); err != nil {
+				return re.BadRequestError("payload is not base64", nil)
+			}
+			decoded, err := codec.Decode(payload)
+			if err != nil {
+				return re.BadRequestError("the payload does not conform: "+err.Error(), nil)
+			}
+
+			return re.JSON(200, map[string]any{
+				"format":       codec.Format(),
+				"message_type": codec.MessageType(),
+				"payload":      base64.StdEncoding.EncodeToString(payload),
+				"json":         json.RawMessage(decoded),
+			})
+		}).Bind(apis.RequireAuth("users", opts.LeafNodeCollection))
+
+		return se.Next()
+	})
+}
+
+// checkMessageSchemaFormat compiles a protobuf or avro record and stores the
+// message type it resolved, or returns the field error that refuses it.
+func checkMessageSchemaFormat(rec *core.Record) error {
+	if rec.GetString("format") == msgformat.JSONSchema {
+		if rec.GetString("message_type") != "" {
+			return fieldError("message_type", errors.New("json_schema documents do not name a message type"))
+		}
+		return nil
+	}
+	codec, err := compileMessageSchema(rec)
+	if errors.Is(err, msgformat.ErrMessageType) {
+		return fieldError("message_type", err)
+	}
+	if err != nil {
+		return fieldError("schema", err)
+	}
+	rec.Set("message_type", codec.MessageType())
+	return nil
+}
+
+// compileMessageSchema compiles a message_schemas record in its own format.
+func compileMessageSchema(rec *core.Record) (msgformat.Codec, error) {
+	return msgformat.Compile(rec.GetString("format"), jsonFieldBytes(rec, "schema"), rec.GetString("message_type"))
+}
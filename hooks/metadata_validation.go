@@ -0,0 +1,290 @@
+package hooks
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	validation "github.com/pocketbase/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/jsonvalidate"
+)
+
+// MetadataValidationOptions names the collections involved, so a deployment that
+// renamed them via config.yaml still works.
+type MetadataValidationOptions struct {
+	ThingCollection        string
+	ThingTypeCollection    string
+	LocationCollection     string
+	LocationTypeCollection string
+	MembershipCollection   string
+}
+
+// metadataPairs lists each collection whose `metadata` is governed by the
+// `metadata_schema` of the record its `type` relation points at.
+func (o MetadataValidationOptions) metadataPairs() [][2]string {
+	return [][2]string{
+		{o.ThingCollection, o.ThingTypeCollection},
+		{o.LocationCollection, o.LocationTypeCollection},
+	}
+}
+
+// metadataSchemas caches compiled metadata schemas by content; see
+// jsonvalidate.Cache. A few hundred types per deployment is already generous.
+var metadataSchemas = jsonvalidate.NewCache(512)
+
+// RegisterMetadataValidation enforces a type's metadata_schema on the metadata of
+// the Things and Locations of that type, on every write path.
+//
+// The schemas were introduced as a rendering aid only, for the reason the
+// migration that added them gives: validating on save would make editing a
+// type's schema retroactively invalidate existing records, and the member making
+// an unrelated edit would be refused for something they did not cause. The
+// console validates in the form; the record API and POST /api/org/things accepted
+// anything, which made the schema advice rather than a contract.
+//
+// This enforces it without that failure mode. Validation runs only when the
+// record's metadata or its type is being set — on create, or on an update that
+// touches one of the two. Renaming a Thing, moving it, deactivating it: none of
+// those re-check metadata, so a schema change never blocks them. The records a
+// schema change left behind are found by the conformance report instead
+// (GET /api/org/metadata/conformance and the `metadata-check` command), and fixed
+// deliberately.
+//
+// Errors are PocketBase field errors under `metadata`, keyed by the JSON pointer
+// of the offending value without its leading slash:
+//
+//	{"data": {"metadata": {"serial": {"code": "validation_metadata", "message": "required"}}}}
+//
+// A type's own metadata_schema is checked when it is saved, so a schema that
+// does not compile — or that $refs a file or URL, which the validator refuses —
+// is rejected by the type form rather than discovered by every later Thing save.
+// An absent, null or empty schema constrains nothing, as it always has.
+func RegisterMetadataValidation(app *pocketbase.PocketBase, opts MetadataValidationOptions) {
+	for _, pair := range opts.metadataPairs() {
+		recordCol, typeCol := pair[0], pair[1]
+
+		app.OnRecordCreate(recordCol).BindFunc(func(e *core.RecordEvent) error {
+			if err := validateRecordMetadata(e.App, typeCol, e.Record); err != nil {
+				return err
+			}
+			return e.Next()
+		})
+		app.OnRecordUpdate(recordCol).BindFunc(func(e *core.RecordEvent) error {
+			if changed(e.Record, "metadata", "type") {
+				if err := validateRecordMetadata(e.App, typeCol, e.Record); err != nil {
+					return err
+				}
+			}
+			return e.Next()
+		})
+
+		checkSchema := func(e *core.RecordEvent) error {
+			raw := jsonFieldBytes(e.Record, "metadata_schema")
+			if !jsonvalidate.IsEmpty(raw) {
+				if _, err := metadataSchemas.Compile(raw); err != nil {
+					return fieldError("metadata_schema", err)
+				}
+			}
+			return e.Next()
+		}
+		app.OnRecordCreate(typeCol).BindFunc(checkSchema)
+		app.OnRecordUpdate(typeCol).BindFunc(func(e *core.RecordEvent) error {
+			if !changed(e.Record, "metadata_schema") {
+				return e.Next()
+			}
+			return checkSchema(e)
+		})
+	}
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.GET("/api/org/metadata/conformance", func(re *core.RequestEvent) error {
+			if re.Auth == nil || re.Auth.Collection().Name != "users" {
+				return re.UnauthorizedError("user authentication required", nil)
+			}
+			orgID := re.Auth.GetString("current_organization")
+			if orgID == "" {
+				return re.BadRequestError("no active organization selected", nil)
+			}
+			if m, _ := re.App.FindFirstRecordByFilter(opts.MembershipCollection,
+				"user = {:user} && organization = {:org}",
+				dbx.Params{"user": re.Auth.Id, "org": orgID}); m == nil {
+				return re.ForbiddenError("membership in the active organization required", nil)
+			}
+
+			report, err := MetadataConformance(re.App, opts, orgID)
+			if err != nil {
+				return re.InternalServerError("conformance check failed", err)
+			}
+			return re.JSON(200, report)
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// validateRecordMetadata checks one record's metadata against its type's schema.
+// A record with no type, a type that cannot be loaded, or a type with no schema
+// passes. So does a type whose schema does not compile: that is the type
+// author's error, and is logged rather than charged to whoever saves the Thing.
+func validateRecordMetadata(app core.App, typeCol string, rec *core.Record) error {
+	typeID := rec.GetString("type")
+	if typeID == "" {
+		return nil
+	}
+	t, err := app.FindRecordById(typeCol, typeID)
+	if err != nil {
+		return nil
+	}
+	raw := jsonFieldBytes(t, "metadata_schema")
+	if jsonvalidate.IsEmpty(raw) {
+		return nil
+	}
+	schema, err := metadataSchemas.Compile(raw)
+	if err != nil {
+		log.Printf("⚠️ %s '%s' has a metadata_schema that does not compile, not enforcing it: %v",
+			typeCol, t.GetString("name"), err)
+		return nil
+	}
+
+	violations := schema.Validate(metadataBytes(rec))
+	if len(violations) == 0 {
+		return nil
+	}
+	return metadataFieldErrors(violations)
+}
+
+// metadataFieldErrors turns violations into PocketBase's nested field-error shape.
+// A violation of the document as a whole (metadata is not an object, say) is
+// reported on `metadata` itself.
+func metadataFieldErrors(violations []jsonvalidate.Violation) error {
+	messages := map[string][]string{}
+	for _, v := range violations {
+		key := strings.TrimPrefix(v.Pointer, "/")
+		messages[key] = append(messages[key], v.Message)
+	}
+	if root, ok := messages[""]; ok {
+		return validation.Errors{"metadata": validation.NewError("validation_metadata", strings.Join(root, "; "))}
+	}
+	nested := validation.Errors{}
+	for key, msgs := range messages {
+		nested[key] = validation.NewError("validation_metadata", strings.Join(msgs, "; "))
+	}
+	return validation.Errors{"metadata": nested}
+}
+
+// jsonFieldBytes returns a JSON field's value as JSON text, "null" when unset.
+func jsonFieldBytes(rec *core.Record, field string) []byte {
+	b, err := json.Marshal(rec.Get(field))
+	if err != nil {
+		return []byte("null")
+	}
+	return b
+}
+
+// metadataBytes is jsonFieldBytes for `metadata`, reading an unset value as the
+// empty object. A record that carries no metadata under a schema with required
+// fields should be told which fields, not that null is not an object.
+func metadataBytes(rec *core.Record) []byte {
+	b := jsonFieldBytes(rec, "metadata")
+	if jsonvalidate.IsEmpty(b) {
+		return []byte("{}")
+	}
+	return b
+}
+
+// MetadataReport lists, per type with a schema, the records whose metadata does
+// not conform to it.
+type MetadataReport struct {
+	Types         []MetadataTypeReport `json:"types"`
+	Checked       int                  `json:"checked"`
+	NonConforming int                  `json:"non_conforming"`
+}
+
+// MetadataTypeReport is one type's section of a MetadataReport.
+type MetadataTypeReport struct {
+	Collection    string                 `json:"collection"` // the records' collection, e.g. things
+	TypeID        string                 `json:"type_id"`
+	TypeCode      string                 `json:"type_code"`
+	TypeName      string                 `json:"type_name"`
+	Organization  string                 `json:"organization"`
+	SchemaError   string                 `json:"schema_error,omitempty"`
+	Checked       int                    `json:"checked"`
+	NonConforming []MetadataRecordReport `json:"non_conforming"`
+}
+
+// MetadataRecordReport is one non-conforming record.
+type MetadataRecordReport struct {
+	ID         string                   `json:"id"`
+	Code       string                   `json:"code"`
+	Name       string                   `json:"name"`
+	Violations []jsonvalidate.Violation `json:"violations"`
+}
+
+// MetadataConformance checks every Thing and Location whose type has a schema
+// against it. orgID limits the check to one organization; "" checks them all,
+// which is what the CLI does for an operator.
+func MetadataConformance(app core.App, opts MetadataValidationOptions, orgID string) (*MetadataReport, error) {
+	report := &MetadataReport{Types: []MetadataTypeReport{}}
+
+	for _, pair := range opts.metadataPairs() {
+		recordCol, typeCol := pair[0], pair[1]
+
+		filter, params := "1=1", dbx.Params{}
+		if orgID != "" {
+			filter, params = "organization = {:org}", dbx.Params{"org": orgID}
+		}
+		types, err := app.FindRecordsByFilter(typeCol, filter, "name", 0, 0, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range types {
+			raw := jsonFieldBytes(t, "metadata_schema")
+			if jsonvalidate.IsEmpty(raw) {
+				continue
+			}
+			tr := MetadataTypeReport{
+				Collection:    recordCol,
+				TypeID:        t.Id,
+				TypeCode:      t.GetString("code"),
+				TypeName:      t.GetString("name"),
+				Organization:  t.GetString("organization"),
+				NonConforming: []MetadataRecordReport{},
+			}
+
+			schema, err := metadataSchemas.Compile(raw)
+			if err != nil {
+				tr.SchemaError = err.Error()
+				report.Types = append(report.Types, tr)
+				continue
+			}
+
+			recs, err := app.FindRecordsByFilter(recordCol, "type = {:t}", "code", 0, 0, dbx.Params{"t": t.Id})
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range recs {
+				tr.Checked++
+				if v := schema.Validate(metadataBytes(r)); len(v) > 0 {
+					tr.NonConforming = append(tr.NonConforming, MetadataRecordReport{
+						ID: r.Id, Code: r.GetString("code"), Name: r.GetString("name"), Violations: v,
+					})
+				}
+			}
+			report.Checked += tr.Checked
+			report.NonConforming += len(tr.NonConforming)
+			report.Types = append(report.Types, tr)
+		}
+	}
+
+	sort.SliceStable(report.Types, func(i, j int) bool {
+		return report.Types[i].Collection < report.Types[j].Collection
+	})
+	return report, nil
+}
@@ -0,0 +1,308 @@
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	validation "github.com/pocketbase/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/ipam"
+)
+
+// NebulaIPAMOptions names the collections involved, so a deployment that renamed
+// them via config.yaml still works.
+type NebulaIPAMOptions struct {
+	NetworkCollection    string
+	HostCollection       string
+	MembershipCollection string
+}
+
+// RegisterNebulaIPAM makes a Nebula network's cidr_range an address pool the
+// platform manages, rather than a label next to addresses picked by hand.
+//
+// Until now nothing read cidr_range at all. An overlay_ip was whatever the
+// operator typed, checked only for an exact duplicate on the network by the
+// unique index, so a host could be given an address outside the network, or its
+// broadcast address, and receive a certificate for it — Nebula signs what it is
+// asked to sign. Teams kept spreadsheets to pick free addresses.
+//
+// Three pieces:
+//
+//   - Validation, as record hooks on both collections so every write path gets it
+//     — the console's host form, the record API, POST /api/org/things and the
+//     bulk import alike. A host's overlay_ip must lie inside its network, must not
+//     be the network or broadcast address, and must not fall in one of the
+//     network's reserved_ranges. A network's reserved_ranges must parse and lie
+//     inside its cidr_range, and a cidr_range change is refused if it would strand
+//     a host outside the new range.
+//   - Allocation. A host created with no overlay_ip is given the lowest free
+//     address on its network. Callers that want the address in hand before the
+//     save (resolveNebulaHost) use allocateOverlayIP directly.
+//   - GET /api/org/nebula-networks/{id}/addresses, owner/admin: the network's
+//     used, reserved and free addresses, and the one allocation would pick next.
+//
+// Allocation is "read the used set, take the lowest gap", which is only safe
+// because PocketBase serialises writes through a single SQLite write connection;
+// two allocations cannot interleave. The unique index on (network_id,
+// overlay_ip) stays the backstop either way.
+//
+// Only IPv4 networks are managed (see internal/ipam). A network whose cidr_range
+// does not parse as one is left exactly as unmanaged as it was before, rather than
+// having its existing hosts start failing saves.
+func RegisterNebulaIPAM(app *pocketbase.PocketBase, opts NebulaIPAMOptions) {
+	app.OnRecordCreate(opts.NetworkCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := validateNetworkAddressing(e.App, opts, e.Record, true); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+	app.OnRecordUpdate(opts.NetworkCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := validateNetworkAddressing(e.App, opts, e.Record, false); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+
+	app.OnRecordCreate(opts.HostCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := assignOverlayIP(e.App, opts, e.Record, true); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+	app.OnRecordUpdate(opts.HostCollection).BindFunc(func(e *core.RecordEvent) error {
+		if err := assignOverlayIP(e.App, opts, e.Record, false); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.GET("/api/org/nebula-networks/{id}/addresses", func(re *core.RequestEvent) error {
+			network, err := resolveOwnOrgNetwork(re, opts, re.Request.PathValue("id"))
+			if err != nil {
+				return err
+			}
+
+			pool, err := overlayPool(network)
+			if err != nil {
+				return re.BadRequestError(fmt.Sprintf("network %q is not managed: %v", network.GetString("name"), err), nil)
+			}
+			used, err := overlayIPsInUse(re.App, opts.HostCollection, network.Id)
+			if err != nil {
+				return re.InternalServerError("failed to list hosts", err)
+			}
+
+			usage := pool.Usage(used)
+			next := ""
+			if a, err := pool.Next(used); err == nil {
+				next = a.String()
+			}
+			return re.JSON(200, map[string]any{
+				"network_id": network.Id,
+				"name":       network.GetString("name"),
+				"next":       next,
+				"addresses":  usage,
+			})
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// validateNetworkAddressing checks a network's cidr_range and reserved_ranges,
+// returning field-level errors so the console can put the message next to the
+// input that caused it.
+//
+// A cidr_range that IPAM does not manage is only refused when it is being set. An
+// existing network with one keeps saving as before; it just gets no allocation.
+func validateNetworkAddressing(app core.App, opts NebulaIPAMOptions, network *core.Record, isNew bool) error {
+	cidr := network.GetString("cidr_range")
+	cidrChanged := isNew || network.Original().GetString("cidr_range") != cidr
+
+	reserved, err := reservedRanges(network)
+	if err != nil {
+		return fieldError("reserved_ranges", err)
+	}
+
+	bare, err := ipam.NewPool(cidr, nil)
+	if err != nil {
+		switch {
+		case errors.Is(err, ipam.ErrUnsupported) && len(reserved) == 0:
+			return nil
+		case errors.Is(err, ipam.ErrUnsupported):
+			return fieldError("reserved_ranges", fmt.Errorf("reserved ranges need an IPv4 cidr_range: %w", err))
+		case !cidrChanged:
+			return nil
+		}
+		return fieldError("cidr_range", err)
+	}
+	if _, err := ipam.NewPool(cidr, reserved); err != nil {
+		return fieldError("reserved_ranges", err)
+	}
+
+	// Narrowing or moving the range must not strand hosts that already hold
+	// certificates for addresses in the old one. Reservations are not part of
+	// this check: reserving an address a host already holds is how an operator
+	// marks it for migration, and the addresses endpoint reports it.
+	if cidrChanged && !isNew {
+		used, err := overlayIPsInUse(app, opts.HostCollection, network.Id)
+		if err != nil {
+			return err
+		}
+		var stranded []string
+		for _, ip := range used {
+			if _, err := bare.Check(ip); err != nil {
+				stranded = append(stranded, ip)
+			}
+		}
+		if len(stranded) > 0 {
+			if len(stranded) > 5 {
+				stranded = append(stranded[:5], fmt.Sprintf("and %d more", len(stranded)-5))
+			}
+			return fieldError("cidr_range", fmt.Errorf(
+				"%s would leave hosts outside the network: %s", bare.Prefix(), strings.Join(stranded, ", ")))
+		}
+	}
+	return nil
+}
+
+// assignOverlayIP validates a host's overlay_ip against its network when it is
+// new or changed, and fills it in on create when it was left empty.
+func assignOverlayIP(app core.App, opts NebulaIPAMOptions, host *core.Record, isNew bool) error {
+	networkID := host.GetString("network_id")
+	ip := strings.TrimSpace(host.GetString("overlay_ip"))
+	if networkID == "" {
+		return nil // the required-field validator reports it
+	}
+	if !isNew && host.Original().GetString("overlay_ip") == ip && host.Original().GetString("network_id") == networkID {
+		return nil
+	}
+	network, err := app.FindRecordById(opts.NetworkCollection, networkID)
+	if err != nil {
+		return nil // the relation validator reports it
+	}
+
+	if ip == "" {
+		if !isNew {
+			return nil
+		}
+		allocated, err := allocateOverlayIP(app, opts.HostCollection, network)
+		if err != nil {
+			return fieldError("overlay_ip", err)
+		}
+		host.Set("overlay_ip", allocated)
+		log.Printf("✅ overlay IP %s allocated on network '%s' for host '%s'",
+			allocated, network.GetString("name"), host.GetString("hostname"))
+		return nil
+	}
+
+	if err := checkOverlayIP(network, ip); err != nil {
+		return fieldError("overlay_ip", err)
+	}
+	return nil
+}
+
+// overlayPool builds the address pool for a network record.
+func overlayPool(network *core.Record) (*ipam.Pool, error) {
+	reserved, err := reservedRanges(network)
+	if err != nil {
+		return nil, err
+	}
+	return ipam.NewPool(network.GetString("cidr_range"), reserved)
+}
+
+// checkOverlayIP reports whether ip may be given to a host on network. A network
+// IPAM does not manage accepts anything, as it always has.
+func checkOverlayIP(network *core.Record, ip string) error {
+	pool, err := overlayPool(network)
+	if err != nil {
+		return nil
+	}
+	_, err = pool.Check(ip)
+	return err
+}
+
+// allocateOverlayIP returns the lowest free address on network. Called inside a
+// transaction, it sees hosts that transaction has already created, so a batch
+// allocating several in a row gets consecutive addresses rather than the same one.
+func allocateOverlayIP(app core.App, hostCollection string, network *core.Record) (string, error) {
+	pool, err := overlayPool(network)
+	if err != nil {
+		return "", fmt.Errorf("network %q cannot allocate addresses; pass an overlay IP (%v)", network.GetString("name"), err)
+	}
+	used, err := overlayIPsInUse(app, hostCollection, network.Id)
+	if err != nil {
+		return "", err
+	}
+	a, err := pool.Next(used)
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
+
+// overlayIPsInUse lists the overlay_ip of every host on a network.
+func overlayIPsInUse(app core.App, hostCollection, networkID string) ([]string, error) {
+	hosts, err := app.FindRecordsByFilter(hostCollection, "network_id = {:n}", "", 0, 0, dbx.Params{"n": networkID})
+	if err != nil {
+		return nil, err
+	}
+	used := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		used = append(used, h.GetString("overlay_ip"))
+	}
+	return used, nil
+}
+
+// reservedRanges reads nebula_networks.reserved_ranges, which must be a list of
+// strings. Anything else is an error rather than "no reservations", since the
+// field exists to protect addresses.
+func reservedRanges(network *core.Record) ([]string, error) {
+	var out []string
+	if err := network.UnmarshalJSONField("reserved_ranges", &out); err != nil {
+		return nil, errors.New("reserved_ranges must be a list of addresses, CIDR blocks or first-last ranges")
+	}
+	return out, nil
+}
+
+// fieldError wraps err as a PocketBase field validation error, so the record API
+// returns it under data.<field> like any built-in validator would.
+func fieldError(field string, err error) error {
+	return validation.Errors{field: validation.NewError("validation_"+field, err.Error())}
+}
+
+// resolveOwnOrgNetwork returns a Nebula network in the caller's active
+// organization, provided the caller is an owner or admin there — the same
+// audience nebula_networks.viewRule allows. A network in another organization is
+// reported as not found.
+func resolveOwnOrgNetwork(re *core.RequestEvent, opts NebulaIPAMOptions, id string) (*core.Record, error) {
+	if re.Auth == nil || re.Auth.Collection().Name != "users" {
+		return nil, re.UnauthorizedError("user authentication required", nil)
+	}
+
+	orgID := re.Auth.GetString("current_organization")
+	if orgID == "" {
+		return nil, re.BadRequestError("no active organization selected", nil)
+	}
+
+	membership, err := re.App.FindFirstRecordByFilter(
+		opts.MembershipCollection,
+		"user = {:user} && organization = {:org} && (role = 'owner' || role = 'admin')",
+		dbx.Params{"user": re.Auth.Id, "org": orgID},
+	)
+	if err != nil || membership == nil {
+		return nil, re.ForbiddenError("owner or admin of the active organization required", nil)
+	}
+
+	network, err := re.App.FindRecordById(opts.NetworkCollection, id)
+	if err != nil || network.GetString("organization") != orgID {
+		return nil, re.NotFoundError("network not found", nil)
+	}
+	return network, nil
+}
@@ -0,0 +1,207 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/enrollment"
+	"platform/internal/schemaregistry"
+	"platform/internal/subjectresolver"
+)
+
+// SchemaRegistryOptions configures the NATS schema registry.
+type SchemaRegistryOptions struct {
+	OrgCollection                string
+	NatsAccountCollection        string
+	ThingTypeCollection          string
+	ThingTypeOperationCollection string
+	MessageSchemaCollection      string
+
+	// Enabled turns the registry on inside `serve`. Off by default, like the
+	// contract validator: it holds a connection into every organization's
+	// account.
+	Enabled bool
+
+	// ServerURL is nats.server_url, the address the registry dials.
+	ServerURL string
+
+	Config schemaregistry.Config
+}
+
+// RegisterSchemaRegistry serves message_schemas over NATS request-reply in
+// every organization's account (internal/schemaregistry), when
+// contracts.registry.enabled is set.
+//
+// Devices, rule-router instances and anything else on the bus cannot call the
+// HTTP API, yet they are the ones holding a message and needing its schema.
+// The registry answers them where they already are: schemas.get for a version,
+// schemas.list for what exists, and schemas.resolve for the operations, and
+// schemas, behind a concrete subject. The data is exactly what the organization's
+// leaf nodes could read over HTTP — its schemas, and the subject patterns of its
+// Thing Types' operations — served only inside its own account.
+//
+// It gets into each account as the contract validator does (see
+// RegisterContractValidator): a user that exists only in this process, signed
+// with the account key, here allowed to subscribe under the prefix and $SRV and
+// to publish nothing but replies. Accounts whose keys are encrypted at rest are
+// skipped.
+//
+// Answers are cached per organization and the cache is dropped whenever a
+// record the data is built from changes: the hooks below ask for a reload, and
+// the reload swaps in a new snapshot.
+func RegisterSchemaRegistry(app *pocketbase.PocketBase, opts SchemaRegistryOptions) {
+	if !opts.Enabled {
+		return
+	}
+
+	svc := NewSchemaRegistry(app, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		go func() {
+			defer close(done)
+			_ = svc.Run(ctx)
+		}()
+		log.Printf("✅ Schema registry started (%s.get, %s.list, %s.resolve)",
+			opts.Config.Prefix, opts.Config.Prefix, opts.Config.Prefix)
+		return se.Next()
+	})
+
+	app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		return e.Next()
+	})
+
+	reload := func(e *core.RecordEvent) error {
+		svc.Reload()
+		return e.Next()
+	}
+	watched := []string{
+		opts.OrgCollection, opts.NatsAccountCollection, opts.ThingTypeCollection,
+		opts.ThingTypeOperationCollection, opts.MessageSchemaCollection,
+	}
+	app.OnRecordAfterCreateSuccess(watched...).BindFunc(reload)
+	app.OnRecordAfterUpdateSuccess(watched...).BindFunc(reload)
+	app.OnRecordAfterDeleteSuccess(watched...).BindFunc(reload)
+}
+
+// NewSchemaRegistry builds the registry service over app's records.
+func NewSchemaRegistry(app core.App, opts SchemaRegistryOptions) *schemaregistry.Service {
+	load := func(ctx context.Context) ([]schemaregistry.Registry, error) {
+		return loadSchemaRegistries(app, opts)
+	}
+	connect := func(ctx context.Context, reg schemaregistry.Registry, cfg schemaregistry.Config) (*nats.Conn, error) {
+		return connectAccountService(app, opts.NatsAccountCollection, reg.Org, opts.ServerURL,
+			"stone-age schema registry ("+reg.OrgName+")",
+			enrollment.UserSpec{
+				Name:           "schema-registry",
+				PubDeny:        []string{">"},
+				SubAllow:       []string{cfg.Prefix + ".>", "$SRV.>"},
+				AllowResponses: true,
+			})
+	}
+	return schemaregistry.New(opts.Config, load, connect)
+}
+
+// loadSchemaRegistries reads every organization with an active account.
+func loadSchemaRegistries(app core.App, opts SchemaRegistryOptions) ([]schemaregistry.Registry, error) {
+	accounts, err := app.FindRecordsByFilter(opts.NatsAccountCollection,
+		"active = true && organization != ''", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []schemaregistry.Registry
+	for _, acctRec := range accounts {
+		org, err := app.FindRecordById(opts.OrgCollection, acctRec.GetString("organization"))
+		if err != nil {
+			continue
+		}
+		reg, err := orgSchemaRegistry(app, opts, org)
+		if err != nil {
+			log.Printf("⚠️ schema registry: org %s: %v", org.GetString("name"), err)
+			continue
+		}
+		reg.PublicKey = acctRec.GetString("public_key")
+		out = append(out, reg)
+	}
+	return out, nil
+}
+
+// orgSchemaRegistry collects one organization's schemas, and the subject
+// pattern of every operation that references one of them.
+func orgSchemaRegistry(app core.App, opts SchemaRegistryOptions, org *core.Record) (schemaregistry.Registry, error) {
+	reg := schemaregistry.Registry{Org: org.Id, OrgName: org.GetString("name")}
+
+	schemas, err := app.FindRecordsByFilter(opts.MessageSchemaCollection,
+		"organization = {:org}", "", 0, 0, dbx.Params{"org": org.Id})
+	if err != nil {
+		return reg, err
+	}
+	handles := map[string]string{} // id -> handle
+	for _, s := range schemas {
+		entry := schemaregistry.Schema{
+			ID:          s.Id,
+			Namespace:   s.GetString("namespace"),
+			Name:        s.GetString("name"),
+			Version:     s.GetString("version"),
+			Format:      s.GetString("format"),
+			MessageType: s.GetString("message_type"),
+			Document:    json.RawMessage(jsonFieldBytes(s, "schema")),
+		}
+		handles[s.Id] = entry.Handle()
+		reg.Schemas = append(reg.Schemas, entry)
+	}
+	sort.Slice(reg.Schemas, func(i, j int) bool { return reg.Schemas[i].Handle() < reg.Schemas[j].Handle() })
+
+	types, err := app.FindRecordsByFilter(opts.ThingTypeCollection,
+		"organization = {:org}", "", 0, 0, dbx.Params{"org": org.Id})
+	if err != nil {
+		return reg, err
+	}
+	for _, tt := range types {
+		ids := tt.GetStringSlice("operations")
+		if len(ids) == 0 {
+			continue
+		}
+		ops, err := app.FindRecordsByIds(opts.ThingTypeOperationCollection, ids)
+		if err != nil {
+			return reg, err
+		}
+		for _, op := range ops {
+			handle, ok := handles[op.GetString("schema")]
+			if !ok || op.GetString("organization") != org.Id {
+				continue
+			}
+			subject := subjectresolver.ResolveRolePattern(
+				subjectresolver.Join(tt.GetString("subject_prefix"), op.GetString("subject_suffix")),
+				subjectresolver.RolePatternContext{Org: reg.OrgName, ThingTypeCode: tt.GetString("code")},
+			)
+			if len(subjectresolver.Unresolved(subject)) > 0 || subjectresolver.Valid(subject) != nil {
+				continue
+			}
+			reg.Bindings = append(reg.Bindings, schemaregistry.Binding{
+				Subject:    subject,
+				ThingType:  tt.GetString("code"),
+				Operation:  op.GetString("name"),
+				Capability: op.GetString("capability"),
+				Schema:     handle,
+			})
+		}
+	}
+	schemaregistry.SortBindings(reg.Bindings)
+	return reg, nil
+}
@@ -0,0 +1,344 @@
+package hooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"platform/internal/bundle"
+)
+
+// ThingBundleOptions adds to the Thing collections what a bundle tells the
+// device about the deployment, and where the download is recorded.
+type ThingBundleOptions struct {
+	ThingRoutesOptions
+
+	AuditCollection string
+
+	// NatsServerURL is nats.server_url and NatsWebsocketURLs nats.websocket_urls,
+	// copied into the manifest as given. See ClientConfigRoutesOptions for why
+	// they differ; a device behind NAT may need neither, which is the installer's
+	// call, not the server's.
+	NatsServerURL     string
+	NatsWebsocketURLs []string
+}
+
+// bundleManifestVersion is bumped when manifest.json changes incompatibly.
+const bundleManifestVersion = 1
+
+// auditEventDownload is the audit_logs event_type for a served secret-bearing
+// download. pb-audit records writes; a download is a read, so it is logged here.
+const auditEventDownload = "download"
+
+type bundleRef struct {
+	ID   string `json:"id"`
+	Code string `json:"code,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type bundleNats struct {
+	UserID           string            `json:"user_id"`
+	Username         string            `json:"username"`
+	AccountPublicKey string            `json:"account_public_key,omitempty"`
+	ServerURL        string            `json:"server_url,omitempty"`
+	WebsocketURLs    []string          `json:"websocket_urls"`
+	Creds            string            `json:"creds,omitempty"` // file in the bundle
+	JWT              string            `json:"jwt,omitempty"`   // file, when the key is on the device
+	KeyOnDevice      bool              `json:"key_on_device"`
+	Subjects         []contractSubject `json:"subjects"`
+	Publish          []string          `json:"publish"`
+	Subscribe        []string          `json:"subscribe"`
+	AllowResponses   bool              `json:"allow_responses"`
+	InboxPrefix      string            `json:"inbox_prefix,omitempty"` // set it as the client's custom inbox prefix
+}
+
+type bundleNebula struct {
+	HostID      string            `json:"host_id"`
+	Hostname    string            `json:"hostname"`
+	OverlayIP   string            `json:"overlay_ip"`
+	Network     bundleRef         `json:"network"`
+	CIDR        string            `json:"cidr"`
+	Files       map[string]string `json:"files"` // role → file in the bundle
+	KeyOnDevice bool              `json:"key_on_device"`
+}
+
+type bundleManifest struct {
+	FormatVersion int           `json:"format_version"`
+	GeneratedAt   string        `json:"generated_at"`
+	Thing         bundleRef     `json:"thing"`
+	Organization  bundleRef     `json:"organization"`
+	Type          *bundleRef    `json:"type"`
+	Location      *bundleRef    `json:"location"`
+	Nats          *bundleNats   `json:"nats"`
+	Nebula        *bundleNebula `json:"nebula"`
+	Warnings      []string      `json:"warnings"`
+}
+
+// RegisterThingBundleRoutes adds GET /api/org/things/{id}/bundle: everything a
+// field install needs for one Thing, as a single tar.gz (default) or zip
+// (?format=zip).
+//
+// Installers were assembling each device by hand from four views — the NATS
+// user's creds download, the Nebula host's certificate and config, the CA from
+// the network — and a device that arrived with the creds of the Thing next to it
+// was found only when it started publishing as that Thing. The bundle is built
+// from the Thing's own relations, so it cannot mix two devices up.
+//
+//	<code>/manifest.json       what this is and how to reach the bus
+//	<code>/nats/user.creds     nats_users.creds_file           (0600)
+//	<code>/nats/user.jwt       instead, when the seed is on the device
+//	<code>/nebula/host.crt     nebula_hosts.certificate
+//	<code>/nebula/host.key     nebula_hosts.private_key        (0600)
+//	<code>/nebula/ca.crt       nebula_hosts.ca_certificate
+//	<code>/nebula/config.yml   nebula_hosts.config_yaml        (0600)
+//
+// The manifest names the Thing, its organization, type and location, the NATS
+// server and WebSocket URLs from config.yaml, and the subjects its type's
+// contract resolves to for it with the publish/subscribe lists derived from them,
+// whether it may answer requests, and the inbox prefix its requests must use
+// (hooks/thing_permissions.go). A file that cannot be included — an identity
+// enrolled with a device-held key has no server-side secret to ship, and a
+// column encrypted at rest is unreadable here — is left out and the manifest
+// says why, rather than the route failing or shipping ciphertext.
+//
+// The download is recorded in audit_logs (event_type "download") with the file
+// list and the archive's SHA-256, BEFORE the bytes are sent: if the record cannot
+// be written, nothing is served. An archive carrying a seed and a host key is
+// the most sensitive thing the console hands out and must not leave unrecorded.
+//
+// SECURITY: owner/admin only. A member can read a Thing, but attaching and
+// reading identities is owner/admin everywhere else (things.updateRule), and
+// this route returns their secrets.
+func RegisterThingBundleRoutes(app *pocketbase.PocketBase, opts ThingBundleOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.GET("/api/org/things/{id}/bundle", func(re *core.RequestEvent) error {
+			format := re.Request.URL.Query().Get("format")
+			if format == "" {
+				format = bundle.TarGz
+			}
+			contentType := bundle.ContentType(format)
+			if contentType == "" {
+				return re.BadRequestError(fmt.Sprintf("format must be %s or %s", bundle.TarGz, bundle.Zip), nil)
+			}
+
+			thing, err := loadManagedThing(re, opts.ThingRoutesOptions, re.Request.PathValue("id"))
+			if err != nil {
+				return err
+			}
+			if thing.GetString("nats_user") == "" && thing.GetString("nebula_host") == "" {
+				return re.BadRequestError("nothing to bundle: the thing has no NATS or Nebula identity", nil)
+			}
+
+			now := time.Now().UTC()
+			manifest, files, err := buildThingBundle(re.App, opts, thing, now)
+			if err != nil {
+				return re.InternalServerError("failed to assemble bundle", err)
+			}
+
+			manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+			if err != nil {
+				return re.InternalServerError("failed to assemble bundle", err)
+			}
+			files = append([]bundle.File{{Name: "manifest.json", Data: append(manifestJSON, '\n')}}, files...)
+
+			root := bundleRoot(thing)
+			archive, err := bundle.Bytes(format, root, now, files)
+			if err != nil {
+				return re.InternalServerError("failed to write bundle", err)
+			}
+
+			names := make([]string, 0, len(files))
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			sum := sha256.Sum256(archive)
+			if err := recordDownload(re, opts, thing, map[string]any{
+				"action":      "provisioning_bundle",
+				"format":      format,
+				"files":       names,
+				"sha256":      hex.EncodeToString(sum[:]),
+				"nats_user":   thing.GetString("nats_user"),
+				"nebula_host": thing.GetString("nebula_host"),
+			}); err != nil {
+				return re.InternalServerError("the download could not be recorded, so it was not served", err)
+			}
+
+			log.Printf("📦 provisioning bundle for thing '%s' downloaded by %s", thing.GetString("code"), re.Auth.Id)
+			re.Response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, root, format))
+			re.Response.Header().Set("Cache-Control", "no-store")
+			return re.Blob(200, contentType, archive)
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// buildThingBundle reads the Thing's identities and returns the manifest and the
+// files other than manifest.json.
+func buildThingBundle(app core.App, opts ThingBundleOptions, thing *core.Record, now time.Time) (*bundleManifest, []bundle.File, error) {
+	orgID := thing.GetString("organization")
+	m := &bundleManifest{
+		FormatVersion: bundleManifestVersion,
+		GeneratedAt:   now.Format(time.RFC3339),
+		Thing:         bundleRef{ID: thing.Id, Code: thing.GetString("code"), Name: thing.GetString("name")},
+		Organization:  bundleRef{ID: orgID},
+		Warnings:      []string{},
+	}
+	if org, err := app.FindRecordById(opts.OrgCollection, orgID); err == nil {
+		m.Organization.Name = org.GetString("name")
+	}
+	if id := thing.GetString("type"); id != "" {
+		if t, err := app.FindRecordById(opts.ThingTypeCollection, id); err == nil {
+			m.Type = &bundleRef{ID: t.Id, Code: t.GetString("code"), Name: t.GetString("name")}
+		}
+	}
+	if id := thing.GetString("location"); id != "" {
+		if l, err := app.FindRecordById(opts.LocationCollection, id); err == nil {
+			m.Location = &bundleRef{ID: l.Id, Code: l.GetString("code"), Name: l.GetString("name")}
+		}
+	}
+
+	prov := getProvisioned(thing)
+	var files []bundle.File
+
+	if id := thing.GetString("nats_user"); id != "" {
+		u, err := app.FindRecordById(opts.NatsUserCollection, id)
+		if err != nil || u.GetString("organization") != orgID {
+			m.Warnings = append(m.Warnings, "the linked NATS identity is missing or belongs to another organization; not included")
+		} else {
+			n := &bundleNats{
+				UserID:        u.Id,
+				Username:      u.GetString("nats_username"),
+				ServerURL:     opts.NatsServerURL,
+				WebsocketURLs: opts.NatsWebsocketURLs,
+				KeyOnDevice:   ownsNatsUser(thing) && prov.NatsDeviceKey,
+				Subjects:      []contractSubject{},
+				Publish:       []string{},
+				Subscribe:     []string{},
+			}
+			if n.WebsocketURLs == nil {
+				n.WebsocketURLs = []string{}
+			}
+			if acct, err := app.FindRecordById(opts.NatsAccountCollection, u.GetString("account_id")); err == nil {
+				n.AccountPublicKey = acct.GetString("public_key")
+			}
+
+			creds := u.GetString("creds_file")
+			switch {
+			case n.KeyOnDevice:
+				n.JWT = "nats/user.jwt"
+				files = append(files, bundle.File{Name: n.JWT, Data: []byte(u.GetString("jwt") + "\n")})
+			case strings.Contains(creds, "BEGIN NATS USER JWT") && strings.Contains(creds, "SEED"):
+				n.Creds = "nats/user.creds"
+				files = append(files, bundle.File{Name: n.Creds, Data: []byte(creds), Secret: true})
+			default:
+				m.Warnings = append(m.Warnings, "the NATS creds file is not available (not generated yet, or encrypted at rest); not included")
+			}
+
+			contract, err := loadThingContract(app, opts.ThingRoutesOptions, orgID,
+				thing.GetString("type"), thing.GetString("location"), thingRef(thing))
+			if err != nil {
+				m.Warnings = append(m.Warnings, "contract: "+err.Error())
+			} else if contract != nil {
+				n.Subjects = contract.Subjects()
+				n.Publish = nonNil(contract.Perms.Publish)
+				n.Subscribe = nonNil(contract.Perms.Subscribe)
+				n.AllowResponses = contract.Perms.AllowResponses
+				n.InboxPrefix = contract.Perms.InboxPrefix
+			}
+			m.Nats = n
+		}
+	}
+
+	if id := thing.GetString("nebula_host"); id != "" {
+		h, err := app.FindRecordById(opts.NebulaHostCollection, id)
+		if err != nil || h.GetString("organization") != orgID {
+			m.Warnings = append(m.Warnings, "the linked Nebula host is missing or belongs to another organization; not included")
+		} else {
+			nb := &bundleNebula{
+				HostID:      h.Id,
+				Hostname:    h.GetString("hostname"),
+				OverlayIP:   h.GetString("overlay_ip"),
+				Files:       map[string]string{},
+				KeyOnDevice: ownsNebulaHost(thing) && prov.NebulaDeviceKey,
+			}
+			if network, err := app.FindRecordById(opts.NebulaNetworkCollection, h.GetString("network_id")); err == nil {
+				nb.Network = bundleRef{ID: network.Id, Name: network.GetString("name")}
+				nb.CIDR = network.GetString("cidr_range")
+			}
+
+			add := func(role, name, value string, secret bool) {
+				if strings.TrimSpace(value) == "" {
+					return
+				}
+				nb.Files[role] = name
+				files = append(files, bundle.File{Name: name, Data: []byte(value), Secret: secret})
+			}
+			add("certificate", "nebula/host.crt", h.GetString("certificate"), false)
+			add("ca_certificate", "nebula/ca.crt", h.GetString("ca_certificate"), false)
+			add("config", "nebula/config.yml", h.GetString("config_yaml"), true)
+
+			key := h.GetString("private_key")
+			switch {
+			case nb.KeyOnDevice:
+			case strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN"):
+				add("private_key", "nebula/host.key", key, true)
+			default:
+				m.Warnings = append(m.Warnings, "the Nebula host key is not available (encrypted at rest); not included")
+			}
+			if _, ok := nb.Files["certificate"]; !ok {
+				m.Warnings = append(m.Warnings, "the Nebula host has no certificate yet")
+			}
+			m.Nebula = nb
+		}
+	}
+
+	return m, files, nil
+}
+
+// recordDownload writes one audit_logs entry for a served download.
+func recordDownload(re *core.RequestEvent, opts ThingBundleOptions, thing *core.Record, details map[string]any) error {
+	col, err := re.App.FindCollectionByNameOrId(opts.AuditCollection)
+	if err != nil {
+		return err
+	}
+	rec := core.NewRecord(col)
+	rec.Set("event_type", auditEventDownload)
+	rec.Set("collection_name", opts.ThingCollection)
+	rec.Set("record_id", thing.Id)
+	rec.Set("user", re.Auth.Id)
+	rec.Set("request_method", re.Request.Method)
+	rec.Set("request_ip", re.RealIP())
+	rec.Set("request_url", re.Request.URL.String())
+	rec.Set("timestamp", types.NowDateTime())
+	rec.Set("after_changes", details)
+	return re.App.Save(rec)
+}
+
+var bundleRootPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// bundleRoot is the archive's top-level directory: the Thing's code when it is a
+// plain file name, its id otherwise.
+func bundleRoot(thing *core.Record) string {
+	if code := thing.GetString("code"); bundleRootPattern.MatchString(code) {
+		return code
+	}
+	return thing.Id
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,252 @@
+package hooks
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/subjectresolver"
+)
+
+// resolvedSchema is the message_schemas record an operation references, with
+// its document.
+type resolvedSchema struct {
+	ID          string `json:"id"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Format      string `json:"format"`
+	MessageType string `json:"message_type,omitempty"` // Protobuf message or Avro type; empty for json_schema
+	Schema      any    `json:"schema"`
+}
+
+// resolvedOperation is one operation of a resolved contract. Problem is set when
+// the subject did not resolve to a valid one; such an operation is not in the
+// permissions.
+type resolvedOperation struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Capability  string          `json:"capability"`
+	Description string          `json:"description"`
+	Subject     string          `json:"subject"`
+	Problem     string          `json:"problem,omitempty"`
+	Schema      *resolvedSchema `json:"schema"`
+}
+
+// RegisterThingContractRoutes adds the resolved contract of a Thing, and of a
+// Thing Type:
+//
+//	GET /api/org/things/{id}/contract
+//	GET /api/org/thing-types/{id}/contract[?location=<id>]
+//
+// Each returns the type's operations in the type's order, each with its
+// capability, its subject, and the message_schemas document it references, plus
+// the NATS allow lists that performing them needs. Consumers — a dashboard
+// wiring up a widget, firmware tooling, an integration — otherwise join four
+// collections and re-implement subject resolution, and a copy that substitutes
+// one variable differently subscribes to a subject nothing publishes on.
+//
+// Both are computed by the code that grants the permissions: the Thing variant
+// uses loadThingContract, so its subjects and permissions are exactly what an
+// auto-provisioned identity for it holds (hooks/thing_permissions.go). The type
+// variant resolves as a role grant does — {thing}, and {location} unless
+// ?location= names one, become "*" — giving the patterns every Thing of the
+// type publishes and subscribes on.
+//
+// Reads follow the underlying collections' list rules: a user sees contracts in
+// their active organization, and a leaf node in its own — unless it is scoped to
+// its location (hooks/leaf_sync_scope.go), which these routes refuse. A Thing authenticating
+// as itself can read its own record but not thing_types or message_schemas, so
+// it cannot read a contract here either.
+func RegisterThingContractRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.GET("/api/org/things/{id}/contract", func(re *core.RequestEvent) error {
+			orgID, err := contractReaderOrg(re, opts)
+			if err != nil {
+				return err
+			}
+			thing, err := re.App.FindRecordById(opts.ThingCollection, re.Request.PathValue("id"))
+			if err != nil || thing.GetString("organization") != orgID {
+				return re.NotFoundError("thing not found", nil)
+			}
+
+			result := map[string]any{
+				"thing":       map[string]any{"id": thing.Id, "code": thing.GetString("code"), "name": thing.GetString("name")},
+				"type":        nil,
+				"operations":  []resolvedOperation{},
+				"permissions": subjectresolver.Permissions{Publish: []string{}, Subscribe: []string{}},
+			}
+
+			contract, err := loadThingContract(re.App, opts, orgID,
+				thing.GetString("type"), thing.GetString("location"), thingRef(thing))
+			if err != nil {
+				return re.BadRequestError("the thing's contract cannot be resolved", err)
+			}
+			if contract == nil {
+				return re.JSON(200, result)
+			}
+
+			ctx := contract.Context
+			result["type"] = contractTypeSummary(contract.Type)
+			result["context"] = ctx
+			result["operations"] = resolveOperations(re.App, opts, orgID, contract.Type, contract.Operations, contract.Problems,
+				func(tmpl string) string { return subjectresolver.ResolveThing(tmpl, ctx) })
+			result["permissions"] = nonNilPermissions(contract.Perms)
+			return re.JSON(200, result)
+		}).Bind(apis.RequireAuth("users", opts.LeafNodeCollection))
+
+		se.Router.GET("/api/org/thing-types/{id}/contract", func(re *core.RequestEvent) error {
+			orgID, err := contractReaderOrg(re, opts)
+			if err != nil {
+				return err
+			}
+			tt, err := re.App.FindRecordById(opts.ThingTypeCollection, re.Request.PathValue("id"))
+			if err != nil || tt.GetString("organization") != orgID {
+				return re.NotFoundError("thing type not found", nil)
+			}
+
+			ctx := subjectresolver.RolePatternContext{ThingTypeCode: tt.GetString("code")}
+			if org, err := re.App.FindRecordById(opts.OrgCollection, orgID); err == nil {
+				ctx.Org = org.GetString("name")
+			}
+			if locationID := re.Request.URL.Query().Get("location"); locationID != "" {
+				loc, err := re.App.FindRecordById(opts.LocationCollection, locationID)
+				if err != nil || loc.GetString("organization") != orgID {
+					return re.NotFoundError("location not found", nil)
+				}
+				ctx.Location = loc.GetString("code")
+			}
+
+			ops, err := typeOperations(re.App, opts, orgID, tt)
+			if err != nil {
+				return re.BadRequestError("the type's contract cannot be resolved", err)
+			}
+			defs := make([]subjectresolver.Operation, 0, len(ops))
+			for _, op := range ops {
+				defs = append(defs, subjectresolver.Operation{
+					Name:       op.GetString("name"),
+					Capability: op.GetString("capability"),
+					Suffix:     op.GetString("subject_suffix"),
+				})
+			}
+			perms, problems := subjectresolver.DeriveRolePattern(tt.GetString("subject_prefix"), ctx, defs)
+
+			return re.JSON(200, map[string]any{
+				"type":    contractTypeSummary(tt),
+				"context": ctx,
+				"operations": resolveOperations(re.App, opts, orgID, tt, ops, problems,
+					func(tmpl string) string { return subjectresolver.ResolveRolePattern(tmpl, ctx) }),
+				"permissions": nonNilPermissions(perms),
+			})
+		}).Bind(apis.RequireAuth("users", opts.LeafNodeCollection))
+
+		return se.Next()
+	})
+}
+
+// contractReaderOrg returns the organization whose contracts the caller may
+// read: a user's active organization, if they are a member of it, or a leaf
+// node's own.
+//
+// A leaf node with sync_scope = "location" is refused. The routes that call
+// this answer for the whole organization (the AsyncAPI document), or for any
+// record in it named by id, and checking each answer against the leaf node's
+// subtree would be a second copy of the scoped API rules to keep in step. Its
+// mirror already holds every contract in its scope.
+func contractReaderOrg(re *core.RequestEvent, opts ThingRoutesOptions) (string, error) {
+	if re.Auth == nil {
+		return "", re.UnauthorizedError("authentication required", nil)
+	}
+	switch re.Auth.Collection().Name {
+	case "users":
+		orgID := re.Auth.GetString("current_organization")
+		if orgID == "" {
+			return "", re.BadRequestError("no active organization selected", nil)
+		}
+		if m, _ := re.App.FindFirstRecordByFilter(opts.MembershipCollection,
+			"user = {:user} && organization = {:org}",
+			dbx.Params{"user": re.Auth.Id, "org": orgID}); m == nil {
+			return "", re.ForbiddenError("membership in the active organization required", nil)
+		}
+		return orgID, nil
+	case opts.LeafNodeCollection:
+		if re.Auth.GetString("sync_scope") == leafScopeLocation {
+			return "", re.ForbiddenError("a leaf node scoped to its location cannot read organization-wide contracts; read its mirror", nil)
+		}
+		return re.Auth.GetString("organization"), nil
+	}
+	return "", re.ForbiddenError("this identity type cannot read contracts", nil)
+}
+
+// typeOperations loads a type's operations in the type's order, refusing one
+// outside orgID for the reason loadThingContract gives.
+func typeOperations(app core.App, opts ThingRoutesOptions, orgID string, tt *core.Record) ([]*core.Record, error) {
+	c, err := loadThingContract(app, opts, orgID, tt.Id, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return c.Operations, nil
+}
+
+// resolveOperations renders ops in the type's declared order, each with its
+// subject and schema.
+func resolveOperations(
+	app core.App, opts ThingRoutesOptions, orgID string, tt *core.Record, ops []*core.Record,
+	problems []subjectresolver.Problem, resolve func(string) string,
+) []resolvedOperation {
+	reasons := map[string]string{}
+	for _, p := range problems {
+		reasons[p.Operation] = p.Reason
+	}
+	byID := make(map[string]*core.Record, len(ops))
+	for _, op := range ops {
+		byID[op.Id] = op
+	}
+
+	prefix := tt.GetString("subject_prefix")
+	out := make([]resolvedOperation, 0, len(ops))
+	for _, id := range tt.GetStringSlice("operations") {
+		op := byID[id]
+		if op == nil {
+			continue
+		}
+		r := resolvedOperation{
+			ID:          op.Id,
+			Name:        op.GetString("name"),
+			Capability:  op.GetString("capability"),
+			Description: op.GetString("description"),
+			Subject:     resolve(subjectresolver.Join(prefix, op.GetString("subject_suffix"))),
+			Problem:     reasons[op.GetString("name")],
+		}
+		if schemaID := op.GetString("schema"); schemaID != "" {
+			if s, err := app.FindRecordById(opts.MessageSchemaCollection, schemaID); err == nil && s.GetString("organization") == orgID {
+				r.Schema = &resolvedSchema{
+					ID:          s.Id,
+					Namespace:   s.GetString("namespace"),
+					Name:        s.GetString("name"),
+					Version:     s.GetString("version"),
+					Format:      s.GetString("format"),
+					MessageType: s.GetString("message_type"),
+					Schema:      s.Get("schema"),
+				}
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func contractTypeSummary(tt *core.Record) map[string]any {
+	return map[string]any{
+		"id":             tt.Id,
+		"code":           tt.GetString("code"),
+		"name":           tt.GetString("name"),
+		"subject_prefix": tt.GetString("subject_prefix"),
+	}
+}
+
+func nonNilPermissions(p subjectresolver.Permissions) subjectresolver.Permissions {
+	p.Publish, p.Subscribe = nonNil(p.Publish), nonNil(p.Subscribe)
+	return p
+}
@@ -0,0 +1,156 @@
+package hooks
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// thingCredentialResetRequest is the body of
+// POST /api/org/things/{id}/credentials/reset. An empty body resets the
+// password alone.
+type thingCredentialResetRequest struct {
+	RotateNats bool `json:"rotate_nats"`
+}
+
+// RegisterThingCredentialRoutes adds POST /api/org/things/{id}/credentials/reset:
+// give a Thing a new API password, and optionally a new NATS key pair, without
+// recreating it.
+//
+// The password POST /api/org/things generates is returned once and stored only
+// as a hash, so a device that is re-flashed or replaced had no way back in short
+// of the superuser panel, which is not something an organization owner has.
+// Recreating the Thing instead loses its id, and with it every reference and
+// every history entry keyed on it.
+//
+// The reset does what a leaked password needs, not just what a forgotten one
+// does: the tokenKey is refreshed in the same save, so every auth token issued
+// under the old password stops working now rather than when it expires a week
+// later (the same reasoning as hooks/active_flag.go).
+//
+// With rotate_nats, the linked NATS identity gets a new key pair in the same
+// transaction, through pb-nats's `revoke` — its "these credentials leaked"
+// path, which revokes the old public key on the account and signs a working
+// replacement. `regenerate` would not do: it re-signs a JWT for the SAME key, so
+// a creds file copied off the old device would keep working. An identity whose
+// contract lets it answer requests is then regenerated as well, so the
+// platform re-signs the new key with the response permission pb-nats cannot
+// sign (RegisterThingPermissions). Two kinds of
+// identity are refused rather than rotated:
+//
+//   - a linked one, not minted for this Thing. It may be shared, and rotating it
+//     would cut off whatever else uses it. Rotate it on its own record.
+//   - one enrolled with a device-held key. The server has no key pair to rotate;
+//     issue a claim token and let the device enroll a new one.
+//
+// The response carries the new password, once. The new creds file is on the
+// nats_users record, where it always is.
+//
+// SECURITY: owner/admin only, as for every other route that hands out a Thing's
+// credentials. The writes use app.Save(), which bypasses the things and nats_users
+// update rules; the organization check is loadManagedThing's, and the identity is
+// verified to belong to the same organization before it is touched.
+func RegisterThingCredentialRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.POST("/api/org/things/{id}/credentials/reset", func(re *core.RequestEvent) error {
+			var body thingCredentialResetRequest
+			if re.Request.ContentLength != 0 {
+				if err := re.BindBody(&body); err != nil {
+					return re.BadRequestError("invalid request body", err)
+				}
+			}
+
+			thing, err := loadManagedThing(re, opts, re.Request.PathValue("id"))
+			if err != nil {
+				return err
+			}
+
+			var natsUser *core.Record
+			if body.RotateNats {
+				natsUser, err = rotatableNatsUser(re, opts, thing)
+				if err != nil {
+					return err
+				}
+			}
+
+			password, err := randomSecret(16)
+			if err != nil {
+				return re.InternalServerError("failed to generate credential", err)
+			}
+
+			txErr := re.App.RunInTransaction(func(txApp core.App) error {
+				thing.SetPassword(password)
+				// PocketBase would change the key on a password change anyway;
+				// said outright because killing live sessions is half the point.
+				thing.RefreshTokenKey()
+				if err := txApp.Save(thing); err != nil {
+					return re.BadRequestError("failed to reset password", err)
+				}
+
+				if natsUser != nil {
+					natsUser.Set("revoke", true)
+					if err := txApp.Save(natsUser); err != nil {
+						return re.InternalServerError("failed to rotate NATS credential", err)
+					}
+					// pb-nats signed the new key's JWT without the response
+					// permission; sign it again (RegisterThingPermissions).
+					if natsUser.GetBool("allow_responses") {
+						rotated, err := txApp.FindRecordById(opts.NatsUserCollection, natsUser.Id)
+						if err == nil {
+							rotated.Set("regenerate", true)
+							err = txApp.Save(rotated)
+						}
+						if err != nil {
+							return re.InternalServerError("failed to sign the rotated NATS credential's response permission", err)
+						}
+					}
+				}
+				return nil
+			})
+			if txErr != nil {
+				return txErr
+			}
+
+			log.Printf("🔑 thing '%s' credentials reset by %s (nats rotated: %t)",
+				thing.GetString("code"), re.Auth.Id, natsUser != nil)
+
+			result := map[string]any{
+				"id":           thing.Id,
+				"code":         thing.GetString("code"),
+				"email":        thing.GetString("email"),
+				"password":     password,
+				"nats_rotated": natsUser != nil,
+			}
+			if natsUser != nil {
+				result["nats_user"] = natsUser.Id
+			}
+			// As at creation: the password is shown here and nowhere else.
+			return re.JSON(200, result)
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// rotatableNatsUser returns the Thing's NATS identity if the server can rotate
+// it: attached, minted for this Thing, in its organization, and not holding a
+// device's key.
+func rotatableNatsUser(re *core.RequestEvent, opts ThingRoutesOptions, thing *core.Record) (*core.Record, error) {
+	id := thing.GetString("nats_user")
+	if id == "" {
+		return nil, re.BadRequestError("rotate_nats: the thing has no NATS identity", nil)
+	}
+	if !ownsNatsUser(thing) {
+		return nil, re.BadRequestError("rotate_nats: the NATS identity is linked, not provisioned for this thing; rotate it on its own record", nil)
+	}
+	if getProvisioned(thing).NatsDeviceKey {
+		return nil, re.BadRequestError("rotate_nats: the NATS key is held by the device; issue a claim token to re-enroll it", nil)
+	}
+	rec, err := re.App.FindRecordById(opts.NatsUserCollection, id)
+	if err != nil || rec.GetString("organization") != thing.GetString("organization") {
+		return nil, re.NotFoundError("linked NATS identity not found", nil)
+	}
+	return rec, nil
+}
@@ -0,0 +1,257 @@
+package hooks
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// provisionedIdentities is the shape of things.provisioned_identities: the ids of
+// the identities the server minted for a Thing. An id here that no longer matches
+// the Thing's relation means the relation was re-pointed since, and the current
+// identity is treated as linked.
+//
+// The *DeviceKey flags mark an identity minted by enrollment around a public key
+// the device holds the private half of (hooks/thing_enrollment.go). The server
+// cannot re-issue such a credential the usual way, since it has no key to issue
+// it for, so it must know which ones they are.
+type provisionedIdentities struct {
+	NatsUser        string `json:"nats_user,omitempty"`
+	NebulaHost      string `json:"nebula_host,omitempty"`
+	NatsDeviceKey   bool   `json:"nats_device_key,omitempty"`
+	NebulaDeviceKey bool   `json:"nebula_device_key,omitempty"`
+}
+
+// getProvisioned reads things.provisioned_identities. A missing or unreadable
+// value is the zero value — "nothing was minted here" — which is the answer that
+// keeps decommissioning from deleting an identity it cannot account for.
+func getProvisioned(thing *core.Record) provisionedIdentities {
+	var p provisionedIdentities
+	_ = thing.UnmarshalJSONField("provisioned_identities", &p)
+	return p
+}
+
+func setProvisioned(thing *core.Record, p provisionedIdentities) {
+	if p == (provisionedIdentities{}) {
+		thing.Set("provisioned_identities", nil)
+		return
+	}
+	thing.Set("provisioned_identities", p)
+}
+
+// ownsNatsUser reports whether the Thing's current NATS identity was minted for
+// it. Both halves must agree: the provenance id and the live relation.
+func ownsNatsUser(thing *core.Record) bool {
+	id := thing.GetString("nats_user")
+	return id != "" && getProvisioned(thing).NatsUser == id
+}
+
+// ownsNebulaHost is ownsNatsUser for the Nebula side.
+func ownsNebulaHost(thing *core.Record) bool {
+	id := thing.GetString("nebula_host")
+	return id != "" && getProvisioned(thing).NebulaHost == id
+}
+
+// identityOutcome is one identity's line in the decommission report.
+type identityOutcome struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`           // "removed" or "kept"
+	Reason string `json:"reason,omitempty"` // why it was kept
+}
+
+// RegisterThingDecommissionRoutes adds DELETE /api/org/things/{id}: remove a
+// Thing together with the identities that were provisioned for it, in one
+// transaction.
+//
+// The record API's delete removes the Thing and nothing else. RegisterThingRoutes
+// creates the Thing, its nats_users record and its nebula_hosts record as one
+// unit, so deleting only the first third left a signed NATS credential and a
+// Nebula host certificate behind with nothing referencing them — the same orphan
+// the create route was written to stop producing, arriving by the other door.
+//
+// What is removed follows how each identity got there:
+//
+//   - minted by the server (`mode: auto`, recorded in
+//     things.provisioned_identities) — it belongs to this Thing and goes with it.
+//   - attached with `mode: link`, or attached before provenance was recorded —
+//     kept, unless the caller passes ?include_linked=true. A linked identity may be
+//     shared, or older than the Thing, and deleting it silently would break
+//     whatever else authenticates with it.
+//
+// Even with include_linked, an identity still referenced by another Thing, a leaf
+// node or a membership is kept and reported. That is not a judgement the caller
+// can override from here; detach it from the other holder first.
+//
+// Revocation, not just deletion, for NATS. A .creds file copied onto a device
+// keeps working until its JWT expires unless its key is on the account's
+// revocation list, and deleting the record does not put it there. Setting
+// `active = false` first is pb-nats's revoke path (the same edge
+// hooks/active_flag.go relies on), so the key is revoked before the record goes.
+//
+// Owner/admin only, matching things.deleteRule. Writes go through app.Save and
+// app.Delete, so pb-audit records every removed record as usual.
+func RegisterThingDecommissionRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.DELETE("/api/org/things/{id}", func(re *core.RequestEvent) error {
+			includeLinked := re.Request.URL.Query().Get("include_linked") == "true"
+
+			thing, err := loadManagedThing(re, opts, re.Request.PathValue("id"))
+			if err != nil {
+				return err
+			}
+
+			report := map[string]any{"thing": thing.Id, "code": thing.GetString("code")}
+
+			txErr := re.App.RunInTransaction(func(txApp core.App) error {
+				natsUserID := thing.GetString("nats_user")
+				nebulaHostID := thing.GetString("nebula_host")
+				ownsNats := ownsNatsUser(thing)
+				ownsNebula := ownsNebulaHost(thing)
+
+				// The Thing goes first, so the identities below are no longer
+				// referenced by it when their own reference checks run.
+				if err := txApp.Delete(thing); err != nil {
+					return re.BadRequestError("failed to delete thing", err)
+				}
+
+				if natsUserID != "" {
+					out, err := retireNatsUser(re, txApp, opts, natsUserID, ownsNats || includeLinked)
+					if err != nil {
+						return err
+					}
+					report["nats_user"] = out
+				}
+				if nebulaHostID != "" {
+					out, err := retireNebulaHost(re, txApp, opts, nebulaHostID, ownsNebula || includeLinked)
+					if err != nil {
+						return err
+					}
+					report["nebula_host"] = out
+				}
+				return nil
+			})
+			if txErr != nil {
+				return txErr
+			}
+
+			log.Printf("🗑️ thing '%s' decommissioned by %s", thing.GetString("code"), re.Auth.Id)
+			return re.JSON(200, report)
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// loadManagedThing returns a Thing in the caller's active organization, provided
+// the caller is an owner or admin there. A Thing in another organization is
+// reported as not found, the same answer an API rule would give.
+func loadManagedThing(re *core.RequestEvent, opts ThingRoutesOptions, id string) (*core.Record, error) {
+	orgID, role, err := resolveInventoryRole(re, opts)
+	if err != nil {
+		return nil, err
+	}
+	if role != "owner" && role != "admin" {
+		return nil, re.ForbiddenError("owner or admin of the active organization required", nil)
+	}
+	thing, err := re.App.FindRecordById(opts.ThingCollection, id)
+	if err != nil || thing.GetString("organization") != orgID {
+		return nil, re.NotFoundError("thing not found", nil)
+	}
+	return thing, nil
+}
+
+// retireNatsUser revokes and deletes a NATS identity when remove is set and
+// nothing else still uses it; otherwise it leaves the identity alone and says
+// why. It must run inside the caller's transaction, after the Thing that held
+// the identity has been deleted or detached.
+func retireNatsUser(re *core.RequestEvent, txApp core.App, opts ThingRoutesOptions, id string, remove bool) (identityOutcome, error) {
+	out := identityOutcome{ID: id, Action: "kept"}
+	if !remove {
+		out.Reason = "linked, not provisioned for this thing"
+		return out, nil
+	}
+	if holder := natsUserHolder(txApp, opts, id); holder != "" {
+		out.Reason = "still used by " + holder
+		return out, nil
+	}
+
+	rec, err := txApp.FindRecordById(opts.NatsUserCollection, id)
+	if err != nil {
+		// Already gone. Nothing to revoke, and nothing to report as removed.
+		out.Reason = "not found"
+		return out, nil
+	}
+
+	// Revoke before delete. See RegisterThingDecommissionRoutes.
+	if rec.GetBool("active") {
+		rec.Set("active", false)
+		if err := txApp.Save(rec); err != nil {
+			return out, re.BadRequestError("failed to revoke NATS identity", err)
+		}
+	}
+	if err := txApp.Delete(rec); err != nil {
+		return out, re.BadRequestError("failed to delete NATS identity", err)
+	}
+	out.Action = "removed"
+	return out, nil
+}
+
+// retireNebulaHost is retireNatsUser for the Nebula side. A Nebula certificate
+// has no revocation list to join here — it stops being useful when the host
+// record, and with it the host's entry in every generated config, is gone.
+func retireNebulaHost(re *core.RequestEvent, txApp core.App, opts ThingRoutesOptions, id string, remove bool) (identityOutcome, error) {
+	out := identityOutcome{ID: id, Action: "kept"}
+	if !remove {
+		out.Reason = "linked, not provisioned for this thing"
+		return out, nil
+	}
+	if holder := nebulaHostHolder(txApp, opts, id); holder != "" {
+		out.Reason = "still used by " + holder
+		return out, nil
+	}
+
+	rec, err := txApp.FindRecordById(opts.NebulaHostCollection, id)
+	if err != nil {
+		out.Reason = "not found"
+		return out, nil
+	}
+	if err := txApp.Delete(rec); err != nil {
+		return out, re.BadRequestError("failed to delete Nebula host", err)
+	}
+	out.Action = "removed"
+	return out, nil
+}
+
+// natsUserHolder names the first remaining record that references a NATS
+// identity, or returns "" when nothing does. Every relation to nats_users in
+// schema.json is listed here; a new one must be added, or decommissioning will
+// delete an identity out from under it.
+func natsUserHolder(app core.App, opts ThingRoutesOptions, id string) string {
+	for _, c := range []struct{ collection, label string }{
+		{opts.ThingCollection, "thing"},
+		{opts.LeafNodeCollection, "leaf node"},
+		{opts.MembershipCollection, "membership"},
+	} {
+		if rec, _ := app.FindFirstRecordByFilter(c.collection, "nats_user = {:id}", dbx.Params{"id": id}); rec != nil {
+			return fmt.Sprintf("%s %s", c.label, rec.Id)
+		}
+	}
+	return ""
+}
+
+// nebulaHostHolder is natsUserHolder for nebula_hosts.
+func nebulaHostHolder(app core.App, opts ThingRoutesOptions, id string) string {
+	for _, c := range []struct{ collection, label string }{
+		{opts.ThingCollection, "thing"},
+		{opts.LeafNodeCollection, "leaf node"},
+	} {
+		if rec, _ := app.FindFirstRecordByFilter(c.collection, "nebula_host = {:id}", dbx.Params{"id": id}); rec != nil {
+			return fmt.Sprintf("%s %s", c.label, rec.Id)
+		}
+	}
+	return ""
+}
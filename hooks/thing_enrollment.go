@@ -0,0 +1,548 @@
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"platform/internal/enrollment"
+)
+
+const (
+	claimTokenDefaultTTL = time.Hour
+	claimTokenMaxTTL     = 7 * 24 * time.Hour
+
+	// A device enrolls once; a person retrying a typo a few times more. Ten a
+	// minute from one address is well above either.
+	enrollAttemptsPerWindow = 10
+	enrollAttemptWindow     = time.Minute
+)
+
+// errClaimRefused is the single answer an enrolling device gets for any token
+// that cannot be used. Which of unknown, expired, used or revoked it was goes to
+// the log, not to whoever is holding the token.
+const errClaimRefused = "claim token is invalid, expired, used or revoked"
+
+// claimTokenRequest is the body of POST /api/org/things/{id}/claim-tokens.
+type claimTokenRequest struct {
+	TTLMinutes      int    `json:"ttl_minutes"`       // default 60, at most 7 days
+	NebulaNetworkID string `json:"nebula_network_id"` // enroll a Nebula host on this network too
+}
+
+// enrollRequest is the body of POST /api/enroll.
+type enrollRequest struct {
+	Token           string `json:"token"`
+	NatsPublicKey   string `json:"nats_public_key"`   // nkey user public key, "U…"
+	NebulaPublicKey string `json:"nebula_public_key"` // PEM from `nebula-cert keygen`
+}
+
+// RegisterThingEnrollment adds zero-touch enrollment: an owner/admin issues a
+// one-time claim token for a Thing, and the device redeems it with public keys it
+// generated itself, receiving credentials signed for those keys.
+//
+// POST /api/org/things returns a plaintext password and a server-generated NATS
+// seed, which a human then copies onto the device — so the device's secret has
+// existed on the server, in the database, and in transit before the device ever
+// holds it. With enrollment the private keys are created on the device and never
+// leave it. What crosses the wire is a token that is worthless once used and
+// public keys that are worthless without their private halves.
+//
+//   - POST /api/org/things/{id}/claim-tokens (owner/admin) issues a token bound to
+//     that Thing, valid for ttl_minutes (default 60, at most 7 days), and revokes
+//     any earlier unused one for the same Thing: a Thing has at most one live
+//     token. nebula_network_id makes the token enroll a Nebula host as well. The
+//     token is in this response and nowhere else; only its hash is stored.
+//   - POST /api/org/claim-tokens/{id}/revoke (owner/admin) revokes an unused one.
+//   - POST /api/enroll (no authentication: the token is the credential) takes the
+//     token and the device's public keys. Each address gets 10 attempts a
+//     minute, counted in memory, and a 429 past that. In one transaction it marks the token
+//     used, retires the Thing's current identities by the decommission rules,
+//     mints new ones with the create route's own resolveNatsUser/
+//     resolveNebulaHost, and re-keys them to the device's keys: the NATS user JWT
+//     and the Nebula host certificate are signed here for the device's public
+//     keys, and the server-generated seed and host key are discarded. Any
+//     failure rolls the whole thing back, token included, so a device that sent
+//     a malformed key can retry with the same token.
+//
+// A redeemed token records when, from which address and with which NATS key, and
+// the thing_claim_tokens record is never deleted, so with pb-audit's record of
+// every change the collection is the enrollment history. It outlives the Thing:
+// deleting a Thing clears the relation and leaves thing_code, the code at issue,
+// to say which one it was. Deleting the organization deletes its tokens. Refused redemptions of
+// a known token are logged with the reason and the caller's address; the caller
+// is told only errClaimRefused.
+//
+// The server no longer holds a key for a device-keyed NATS identity, so it cannot
+// let pb-nats re-issue one: `regenerate` (set by a credential rotation or a
+// contract change, hooks/thing_permissions.go) is intercepted ahead of pb-nats and
+// the JWT re-signed here for the same device key. Rotating the key itself is the
+// device's act — it re-enrolls with a new token.
+//
+// Signing needs the organization's account seed and the network CA's private
+// key as stored. With nats.encryption_key or nebula.encryption_key set those
+// columns hold ciphertext only the libraries can open, and enrollment refuses
+// with a message saying so rather than guessing at the envelope.
+//
+// SECURITY: the enroll route's whole authority is the token, so it is 256 random
+// bits, single-use, short-lived, bound to one Thing, and checked and consumed in
+// the same transaction that uses it. It can only give the Thing it names new
+// identities in that Thing's organization, shaped exactly as "auto" at creation
+// would shape them — the caller chooses keys, never permissions.
+func RegisterThingEnrollment(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.POST("/api/org/things/{id}/claim-tokens", func(re *core.RequestEvent) error {
+			var body claimTokenRequest
+			if err := re.BindBody(&body); err != nil {
+				return re.BadRequestError("invalid request body", err)
+			}
+			ttl := claimTokenDefaultTTL
+			if body.TTLMinutes < 0 || time.Duration(body.TTLMinutes)*time.Minute > claimTokenMaxTTL {
+				return re.BadRequestError(fmt.Sprintf("ttl_minutes must be between 1 and %d", int(claimTokenMaxTTL.Minutes())), nil)
+			}
+			if body.TTLMinutes > 0 {
+				ttl = time.Duration(body.TTLMinutes) * time.Minute
+			}
+
+			thing, err := loadManagedThing(re, opts, re.Request.PathValue("id"))
+			if err != nil {
+				return err
+			}
+			orgID := thing.GetString("organization")
+			if thing.GetString("code") == "" {
+				return re.BadRequestError("the thing has no code; give it one first — enrolled identities are named after it", nil)
+			}
+			if !thing.GetBool("active") {
+				return re.BadRequestError("the thing is inactive", nil)
+			}
+			if body.NebulaNetworkID != "" {
+				network, err := re.App.FindRecordById(opts.NebulaNetworkCollection, body.NebulaNetworkID)
+				if err != nil || network.GetString("organization") != orgID {
+					return re.BadRequestError("nebula_network_id is not a network in this organization", nil)
+				}
+			}
+
+			token, hash, err := enrollment.NewClaimToken()
+			if err != nil {
+				return re.InternalServerError("failed to generate claim token", err)
+			}
+			expires := time.Now().Add(ttl)
+
+			var tok *core.Record
+			txErr := re.App.RunInTransaction(func(txApp core.App) error {
+				live, err := txApp.FindRecordsByFilter(opts.ClaimTokenCollection,
+					"thing = {:t} && used_at = '' && revoked_at = ''", "", 0, 0, dbx.Params{"t": thing.Id})
+				if err != nil {
+					return err
+				}
+				for _, old := range live {
+					old.Set("revoked_at", types.NowDateTime())
+					old.Set("revoked_by", re.Auth.Id)
+					if err := txApp.Save(old); err != nil {
+						return err
+					}
+				}
+
+				col, err := txApp.FindCollectionByNameOrId(opts.ClaimTokenCollection)
+				if err != nil {
+					return err
+				}
+				tok = core.NewRecord(col)
+				tok.Set("organization", orgID)
+				tok.Set("thing", thing.Id)
+				tok.Set("thing_code", thing.GetString("code"))
+				tok.Set("token_hash", hash)
+				tok.Set("nebula_network", body.NebulaNetworkID)
+				tok.Set("expires_at", expires)
+				tok.Set("created_by", re.Auth.Id)
+				return txApp.Save(tok)
+			})
+			if txErr != nil {
+				return re.InternalServerError("failed to issue claim token", txErr)
+			}
+
+			log.Printf("🔑 claim token issued for thing '%s' by %s, expires %s",
+				thing.GetString("code"), re.Auth.Id, expires.UTC().Format(time.RFC3339))
+			return re.JSON(201, map[string]any{
+				"id":                tok.Id,
+				"token":             token,
+				"thing":             thing.Id,
+				"code":              thing.GetString("code"),
+				"nebula_network_id": body.NebulaNetworkID,
+				"expires_at":        tok.GetDateTime("expires_at"),
+			})
+		}).Bind(apis.RequireAuth("users"))
+
+		se.Router.POST("/api/org/claim-tokens/{id}/revoke", func(re *core.RequestEvent) error {
+			orgID, role, err := resolveInventoryRole(re, opts)
+			if err != nil {
+				return err
+			}
+			if role != "owner" && role != "admin" {
+				return re.ForbiddenError("owner or admin of the active organization required", nil)
+			}
+			tok, err := re.App.FindRecordById(opts.ClaimTokenCollection, re.Request.PathValue("id"))
+			if err != nil || tok.GetString("organization") != orgID {
+				return re.NotFoundError("claim token not found", nil)
+			}
+			if !tok.GetDateTime("used_at").IsZero() {
+				return re.BadRequestError("the claim token has already been used; decommission or re-key the thing instead", nil)
+			}
+			if tok.GetDateTime("revoked_at").IsZero() {
+				tok.Set("revoked_at", types.NowDateTime())
+				tok.Set("revoked_by", re.Auth.Id)
+				if err := re.App.Save(tok); err != nil {
+					return re.InternalServerError("failed to revoke claim token", err)
+				}
+				log.Printf("🔒 claim token %s revoked by %s", tok.Id, re.Auth.Id)
+			}
+			return re.JSON(200, map[string]any{"id": tok.Id, "revoked_at": tok.GetDateTime("revoked_at")})
+		}).Bind(apis.RequireAuth("users"))
+
+		limiter := enrollment.NewLimiter(enrollAttemptsPerWindow, enrollAttemptWindow)
+		se.Router.POST("/api/enroll", func(re *core.RequestEvent) error {
+			if ip := re.RealIP(); !limiter.Allow(ip, time.Now()) {
+				log.Printf("🔒 enrollment refused from %s: too many attempts", ip)
+				return re.TooManyRequestsError("too many enrollment attempts; try again in a minute", nil)
+			}
+			return enrollThing(re, opts)
+		})
+
+		return se.Next()
+	})
+
+	// Ahead of pb-nats: a device-keyed identity's JWT is re-signed here, for the
+	// device's key, and pb-nats never sees the regenerate flag.
+	app.OnRecordUpdate(opts.NatsUserCollection).Bind(&hook.Handler[*core.RecordEvent]{
+		Priority: -100,
+		Func: func(e *core.RecordEvent) error {
+			if !e.Record.GetBool("regenerate") || !deviceKeyedNatsUser(e.App, opts, e.Record.Id) {
+				return e.Next()
+			}
+			token, err := signNatsUserJWT(e.App, opts, e.Record)
+			if err != nil {
+				return fmt.Errorf("NATS identity %q holds a device key and could not be re-signed: %w",
+					e.Record.GetString("nats_username"), err)
+			}
+			e.Record.Set("jwt", token)
+			e.Record.Set("regenerate", false)
+			return e.Next()
+		},
+	})
+}
+
+// enrollThing is POST /api/enroll. See RegisterThingEnrollment.
+func enrollThing(re *core.RequestEvent, opts ThingRoutesOptions) error {
+	var body enrollRequest
+	if err := re.BindBody(&body); err != nil {
+		return re.BadRequestError("invalid request body", err)
+	}
+	body.Token = strings.TrimSpace(body.Token)
+	body.NatsPublicKey = strings.TrimSpace(body.NatsPublicKey)
+	if body.Token == "" || body.NatsPublicKey == "" {
+		return re.BadRequestError("token and nats_public_key are required", nil)
+	}
+	if err := enrollment.ValidateUserKey(body.NatsPublicKey); err != nil {
+		return re.BadRequestError("nats_public_key: "+err.Error(), nil)
+	}
+	hash := enrollment.HashClaimToken(body.Token)
+	ip := re.RealIP()
+
+	var thing, natsUser, nebulaHost *core.Record
+	var caCert string
+
+	txErr := re.App.RunInTransaction(func(txApp core.App) error {
+		tok, _ := txApp.FindFirstRecordByFilter(opts.ClaimTokenCollection, "token_hash = {:h}", dbx.Params{"h": hash})
+		if tok == nil {
+			log.Printf("🔒 enrollment refused from %s: unknown claim token", ip)
+			return re.UnauthorizedError(errClaimRefused, nil)
+		}
+		if reason := claimTokenUnusable(tok); reason != "" {
+			log.Printf("🔒 enrollment refused from %s: claim token %s is %s", ip, tok.Id, reason)
+			return re.UnauthorizedError(errClaimRefused, nil)
+		}
+
+		var err error
+		thing, err = txApp.FindRecordById(opts.ThingCollection, tok.GetString("thing"))
+		orgID := tok.GetString("organization")
+		if err != nil || thing.GetString("organization") != orgID || !thing.GetBool("active") || thing.GetString("code") == "" {
+			log.Printf("🔒 enrollment refused from %s: claim token %s names a thing that is gone, moved or inactive", ip, tok.Id)
+			return re.UnauthorizedError(errClaimRefused, nil)
+		}
+
+		networkID := tok.GetString("nebula_network")
+		nebulaKey := []byte(strings.TrimSpace(body.NebulaPublicKey))
+		if networkID != "" && len(nebulaKey) == 0 {
+			return re.BadRequestError("this claim token enrolls a Nebula host too; nebula_public_key is required", nil)
+		}
+		if networkID == "" && len(nebulaKey) > 0 {
+			return re.BadRequestError("this claim token does not enroll a Nebula host; omit nebula_public_key", nil)
+		}
+
+		tok.Set("used_at", types.NowDateTime())
+		tok.Set("used_ip", ip)
+		tok.Set("used_nats_key", body.NatsPublicKey)
+		if err := txApp.Save(tok); err != nil {
+			return re.InternalServerError("failed to redeem claim token", err)
+		}
+
+		orgSlug, err := orgSlugFor(re, opts, orgID)
+		if err != nil {
+			return err
+		}
+		var req createThingRequest
+		req.Code = thing.GetString("code")
+		req.Type = thing.GetString("type")
+		req.Location = thing.GetString("location")
+		req.Nebula.NetworkID = networkID
+
+		// Detach, then retire, then mint — the identity route's order, for the
+		// same reason: the replacement takes the outgoing identity's name.
+		prov := getProvisioned(thing)
+		oldNats, oldNebula := thing.GetString("nats_user"), thing.GetString("nebula_host")
+		ownsNats, ownsNebula := ownsNatsUser(thing), ownsNebulaHost(thing)
+		thing.Set("nats_user", "")
+		prov.NatsUser, prov.NatsDeviceKey = "", false
+		if networkID != "" {
+			thing.Set("nebula_host", "")
+			prov.NebulaHost, prov.NebulaDeviceKey = "", false
+		}
+		setProvisioned(thing, prov)
+		if err := txApp.Save(thing); err != nil {
+			return re.InternalServerError("failed to update thing", err)
+		}
+		if oldNats != "" {
+			if _, err := retireNatsUser(re, txApp, opts, oldNats, ownsNats); err != nil {
+				return err
+			}
+		}
+		if networkID != "" && oldNebula != "" {
+			if _, err := retireNebulaHost(re, txApp, opts, oldNebula, ownsNebula); err != nil {
+				return err
+			}
+		}
+
+		natsID, err := resolveNatsUser(re, txApp, opts, modeAuto, req, orgID, orgSlug)
+		if err != nil {
+			return err
+		}
+		natsUser, err = txApp.FindRecordById(opts.NatsUserCollection, natsID)
+		if err != nil {
+			return re.InternalServerError("NATS identity vanished after creation", err)
+		}
+		natsUser.Set("public_key", body.NatsPublicKey)
+		natsUser.Set("seed", "")
+		natsUser.Set("private_key", "")
+		natsUser.Set("creds_file", "")
+		token, err := signNatsUserJWT(txApp, opts, natsUser)
+		if err != nil {
+			return re.BadRequestError("cannot sign a NATS credential for this organization: "+err.Error(), nil)
+		}
+		natsUser.Set("jwt", token)
+		if err := txApp.Save(natsUser); err != nil {
+			return re.InternalServerError("failed to re-key NATS identity", err)
+		}
+		thing.Set("nats_user", natsUser.Id)
+		prov.NatsUser, prov.NatsDeviceKey = natsUser.Id, true
+
+		if networkID != "" {
+			hostID, err := resolveNebulaHost(re, txApp, opts, modeAuto, req, orgID, orgSlug)
+			if err != nil {
+				return err
+			}
+			nebulaHost, err = txApp.FindRecordById(opts.NebulaHostCollection, hostID)
+			if err != nil {
+				return re.InternalServerError("Nebula host vanished after creation", err)
+			}
+			certPEM, notAfter, ca, err := signDeviceHostCert(txApp, opts, nebulaHost, nebulaKey)
+			if err != nil {
+				return re.BadRequestError("cannot sign a Nebula certificate: "+err.Error(), nil)
+			}
+			caCert = ca
+			// The rendered config_yaml embeds the key pb-nebula generated, which
+			// no longer matches the certificate; the device writes its own.
+			nebulaHost.Set("certificate", string(certPEM))
+			nebulaHost.Set("private_key", "")
+			nebulaHost.Set("config_yaml", "")
+			nebulaHost.Set("ca_certificate", ca)
+			nebulaHost.Set("expires_at", notAfter)
+			if err := txApp.Save(nebulaHost); err != nil {
+				return re.InternalServerError("failed to re-key Nebula host", err)
+			}
+			thing.Set("nebula_host", nebulaHost.Id)
+			prov.NebulaHost, prov.NebulaDeviceKey = nebulaHost.Id, true
+		}
+
+		setProvisioned(thing, prov)
+		if err := txApp.Save(thing); err != nil {
+			return re.InternalServerError("failed to update thing", err)
+		}
+		return nil
+	})
+	if txErr != nil {
+		return txErr
+	}
+
+	log.Printf("✅ thing '%s' enrolled from %s with a device-held key", thing.GetString("code"), ip)
+
+	resp := map[string]any{
+		"thing": map[string]any{
+			"id":   thing.Id,
+			"code": thing.GetString("code"),
+			"name": thing.GetString("name"),
+		},
+		"nats": map[string]any{
+			"user_id":  natsUser.Id,
+			"username": natsUser.GetString("nats_username"),
+			"jwt":      natsUser.GetString("jwt"),
+		},
+	}
+	if nebulaHost != nil {
+		resp["nebula"] = map[string]any{
+			"host_id":        nebulaHost.Id,
+			"hostname":       nebulaHost.GetString("hostname"),
+			"overlay_ip":     nebulaHost.GetString("overlay_ip"),
+			"certificate":    nebulaHost.GetString("certificate"),
+			"ca_certificate": caCert,
+			"expires_at":     nebulaHost.GetDateTime("expires_at"),
+		}
+	}
+	return re.JSON(200, resp)
+}
+
+// claimTokenUnusable says why a token cannot be redeemed, or "" if it can.
+func claimTokenUnusable(tok *core.Record) string {
+	switch {
+	case !tok.GetDateTime("revoked_at").IsZero():
+		return "revoked"
+	case !tok.GetDateTime("used_at").IsZero():
+		return "already used"
+	case !tok.GetDateTime("expires_at").Time().After(time.Now()):
+		return "expired"
+	}
+	return ""
+}
+
+// deviceKeyedNatsUser reports whether the NATS identity was enrolled with a key
+// its device holds, per its Thing's provenance.
+func deviceKeyedNatsUser(app core.App, opts ThingRoutesOptions, natsUserID string) bool {
+	thing, _ := app.FindFirstRecordByFilter(opts.ThingCollection, "nats_user = {:id}", dbx.Params{"id": natsUserID})
+	if thing == nil {
+		return false
+	}
+	p := getProvisioned(thing)
+	return p.NatsUser == natsUserID && p.NatsDeviceKey
+}
+
+// errKeyUnreadable explains a stored signing key the platform cannot use.
+var errKeyUnreadable = errors.New("the signing key is not stored in a form the platform can read (at-rest encryption is on?)")
+
+// signNatsUserJWT signs the JWT for a NATS identity the platform signs itself —
+// a device-keyed one, or one that answers requests (hooks/thing_permissions.go)
+// — from its record: the role's grants and limits together with the identity's
+// own, which is how pb-nats composes them, plus the response permission pb-nats
+// has no field for. A zero limit on the role reads as unset.
+func signNatsUserJWT(app core.App, opts ThingRoutesOptions, natsUser *core.Record) (string, error) {
+	account, err := app.FindRecordById(opts.NatsAccountCollection, natsUser.GetString("account_id"))
+	if err != nil {
+		return "", fmt.Errorf("account: %w", err)
+	}
+	role, err := app.FindRecordById(opts.NatsRoleCollection, natsUser.GetString("role_id"))
+	if err != nil {
+		return "", fmt.Errorf("role: %w", err)
+	}
+
+	seed := account.GetString("seed")
+	if !strings.HasPrefix(seed, "SA") {
+		seed = account.GetString("signing_seed")
+	}
+	if !strings.HasPrefix(seed, "SA") {
+		return "", errKeyUnreadable
+	}
+
+	limit := func(field string) int64 {
+		if v := int64(role.GetInt(field)); v != 0 {
+			return v
+		}
+		return -1
+	}
+	union := func(field string) []string {
+		var a, b []string
+		_ = role.UnmarshalJSONField(field, &a)
+		_ = natsUser.UnmarshalJSONField(field, &b)
+		return append(a, b...)
+	}
+
+	spec := enrollment.UserSpec{
+		PublicKey:   natsUser.GetString("public_key"),
+		Name:        natsUser.GetString("nats_username"),
+		PubAllow:    union("publish_permissions"),
+		PubDeny:     union("publish_deny_permissions"),
+		SubAllow:    union("subscribe_permissions"),
+		SubDeny:     union("subscribe_deny_permissions"),
+		Subs:        limit("max_subscriptions"),
+		Data:        limit("max_data"),
+		Payload:     limit("max_payload"),
+		BearerToken: natsUser.GetBool("bearer_token"),
+
+		AllowResponses: natsUser.GetBool("allow_responses"),
+	}
+	if exp := natsUser.GetDateTime("jwt_expires_at"); !exp.IsZero() {
+		spec.Expires = exp.Time()
+	}
+	return enrollment.SignUserJWT(seed, account.GetString("public_key"), spec)
+}
+
+// signDeviceHostCert signs a Nebula host certificate for a device-held key with
+// the host's network CA, returning it with its expiry and the CA certificate.
+func signDeviceHostCert(app core.App, opts ThingRoutesOptions, host *core.Record, publicKeyPEM []byte) ([]byte, time.Time, string, error) {
+	network, err := app.FindRecordById(opts.NebulaNetworkCollection, host.GetString("network_id"))
+	if err != nil {
+		return nil, time.Time{}, "", fmt.Errorf("network: %w", err)
+	}
+	ca, err := app.FindRecordById(opts.NebulaCACollection, network.GetString("ca_id"))
+	if err != nil {
+		return nil, time.Time{}, "", fmt.Errorf("CA: %w", err)
+	}
+	caKey := ca.GetString("private_key")
+	if !strings.HasPrefix(strings.TrimSpace(caKey), "-----BEGIN") {
+		return nil, time.Time{}, "", errKeyUnreadable
+	}
+
+	prefix, err := netip.ParsePrefix(network.GetString("cidr_range"))
+	if err != nil {
+		return nil, time.Time{}, "", fmt.Errorf("network cidr_range: %w", err)
+	}
+	addr, err := netip.ParseAddr(host.GetString("overlay_ip"))
+	if err != nil {
+		return nil, time.Time{}, "", fmt.Errorf("overlay_ip: %w", err)
+	}
+	var groups []string
+	_ = host.UnmarshalJSONField("groups", &groups)
+
+	var notAfter time.Time
+	if years := host.GetInt("validity_years"); years > 0 {
+		notAfter = time.Now().AddDate(years, 0, 0)
+	}
+
+	certPEM, expires, err := enrollment.SignHostCert([]byte(ca.GetString("certificate")), []byte(caKey), enrollment.HostSpec{
+		Name:      host.GetString("hostname"),
+		Network:   netip.PrefixFrom(addr, prefix.Bits()),
+		Groups:    groups,
+		PublicKey: publicKeyPEM,
+		NotAfter:  notAfter,
+	})
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+	return certPEM, expires, ca.GetString("certificate"), nil
+}
@@ -0,0 +1,190 @@
+package hooks
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// thingIdentityRequest is the body of PATCH /api/org/things/{id}/identity. Each
+// block uses the create route's shape; an absent mode leaves that identity as it
+// is, and "none" detaches it.
+type thingIdentityRequest struct {
+	Nats struct {
+		Mode   string `json:"mode"`
+		UserID string `json:"user_id"` // link
+		RoleID string `json:"role_id"` // auto
+	} `json:"nats"`
+
+	Nebula struct {
+		Mode      string `json:"mode"`
+		HostID    string `json:"host_id"`    // link
+		NetworkID string `json:"network_id"` // auto
+		OverlayIP string `json:"overlay_ip"` // auto
+	} `json:"nebula"`
+}
+
+// RegisterThingIdentityRoutes adds PATCH /api/org/things/{id}/identity: attach,
+// replace or detach a Thing's NATS and Nebula identities after it exists, in one
+// transaction.
+//
+// The auto/link/none choice used to exist only at creation. A Thing created with
+// `nats.mode: none` could only be given a credential later by creating a
+// nats_users record by hand, then editing the Thing to point at it — the same
+// unguarded multi-collection sequence POST /api/org/things was written to
+// replace. This route runs the create route's own resolveNatsUser and
+// resolveNebulaHost, so "auto" here mints exactly what "auto" at creation does.
+//
+// Per identity, the mode means:
+//
+//   - absent — leave it alone.
+//   - auto   — mint a new one for this Thing, replacing any current one.
+//   - link   — point at an existing one in this organization. Linking the one
+//     already attached is a no-op, not a swap.
+//   - none   — detach.
+//
+// The identity being replaced or detached is retired by the same rules as
+// DELETE /api/org/things/{id}: one minted for this Thing is revoked and deleted,
+// a linked one is kept unless ?include_linked=true, and one still used elsewhere
+// is always kept. It is retired BEFORE the new one is minted, inside the same
+// transaction, because the replacement takes the same name — hostname and NATS
+// username are both the Thing's code — and would otherwise collide with its
+// predecessor.
+//
+// SECURITY: owner/admin only, the boundary things.updateRule draws by freezing
+// nats_user/nebula_host for members. Writes use app.Save(), so the organization
+// checks the rules would apply are restated in resolveNatsUser/resolveNebulaHost.
+func RegisterThingIdentityRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.PATCH("/api/org/things/{id}/identity", func(re *core.RequestEvent) error {
+			var body thingIdentityRequest
+			if err := re.BindBody(&body); err != nil {
+				return re.BadRequestError("invalid request body", err)
+			}
+			includeLinked := re.Request.URL.Query().Get("include_linked") == "true"
+
+			// "" stays "" here — absent means untouched, not "none" as it does at
+			// creation. Anything else must be a mode defaultMode recognises.
+			natsMode, nebulaMode := body.Nats.Mode, body.Nebula.Mode
+			if natsMode != "" && defaultMode(natsMode) == "" {
+				return re.BadRequestError("nats.mode must be auto, link, or none", nil)
+			}
+			if nebulaMode != "" && defaultMode(nebulaMode) == "" {
+				return re.BadRequestError("nebula.mode must be auto, link, or none", nil)
+			}
+			if natsMode == "" && nebulaMode == "" {
+				return re.BadRequestError("nothing to change: set nats.mode or nebula.mode", nil)
+			}
+
+			thing, err := loadManagedThing(re, opts, re.Request.PathValue("id"))
+			if err != nil {
+				return err
+			}
+			orgID := thing.GetString("organization")
+
+			// Linking the identity that is already attached changes nothing, and
+			// must not retire it on the way.
+			if natsMode == modeLink && body.Nats.UserID != "" && body.Nats.UserID == thing.GetString("nats_user") {
+				natsMode = ""
+			}
+			if nebulaMode == modeLink && body.Nebula.HostID != "" && body.Nebula.HostID == thing.GetString("nebula_host") {
+				nebulaMode = ""
+			}
+
+			orgSlug, err := orgSlugFor(re, opts, orgID)
+			if err != nil {
+				return err
+			}
+
+			// resolveNatsUser/resolveNebulaHost take a create request; the Thing's
+			// code is the name anything minted for it is given, and its type and
+			// location are what a minted credential's permissions derive from.
+			var req createThingRequest
+			req.Code = thing.GetString("code")
+			req.Type = thing.GetString("type")
+			req.Location = thing.GetString("location")
+			req.Nats = body.Nats
+			req.Nebula = body.Nebula
+
+			retired := map[string]identityOutcome{}
+
+			txErr := re.App.RunInTransaction(func(txApp core.App) error {
+				prov := getProvisioned(thing)
+				oldNats, oldNebula := thing.GetString("nats_user"), thing.GetString("nebula_host")
+				ownsNats, ownsNebula := ownsNatsUser(thing), ownsNebulaHost(thing)
+
+				// Detach first, so the outgoing identities are unreferenced when
+				// their retirement checks run.
+				if natsMode != "" {
+					thing.Set("nats_user", "")
+					prov.NatsUser, prov.NatsDeviceKey = "", false
+				}
+				if nebulaMode != "" {
+					thing.Set("nebula_host", "")
+					prov.NebulaHost, prov.NebulaDeviceKey = "", false
+				}
+				setProvisioned(thing, prov)
+				if err := txApp.Save(thing); err != nil {
+					return re.BadRequestError("failed to update thing", err)
+				}
+
+				if natsMode != "" && oldNats != "" {
+					out, err := retireNatsUser(re, txApp, opts, oldNats, ownsNats || includeLinked)
+					if err != nil {
+						return err
+					}
+					retired["nats_user"] = out
+				}
+				if nebulaMode != "" && oldNebula != "" {
+					out, err := retireNebulaHost(re, txApp, opts, oldNebula, ownsNebula || includeLinked)
+					if err != nil {
+						return err
+					}
+					retired["nebula_host"] = out
+				}
+
+				if natsMode != "" {
+					id, err := resolveNatsUser(re, txApp, opts, natsMode, req, orgID, orgSlug)
+					if err != nil {
+						return err
+					}
+					thing.Set("nats_user", id)
+					if natsMode == modeAuto {
+						prov.NatsUser = id
+					}
+				}
+				if nebulaMode != "" {
+					id, err := resolveNebulaHost(re, txApp, opts, nebulaMode, req, orgID, orgSlug)
+					if err != nil {
+						return err
+					}
+					thing.Set("nebula_host", id)
+					if nebulaMode == modeAuto {
+						prov.NebulaHost = id
+					}
+				}
+				setProvisioned(thing, prov)
+				if err := txApp.Save(thing); err != nil {
+					return re.BadRequestError("failed to update thing", err)
+				}
+				return nil
+			})
+			if txErr != nil {
+				return txErr
+			}
+
+			log.Printf("🔑 thing '%s' identities updated by %s", thing.GetString("code"), re.Auth.Id)
+			return re.JSON(200, map[string]any{
+				"id":          thing.Id,
+				"code":        thing.GetString("code"),
+				"nats_user":   thing.GetString("nats_user"),
+				"nebula_host": thing.GetString("nebula_host"),
+				"retired":     retired,
+			})
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
@@ -0,0 +1,634 @@
+package hooks
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// thingImportMaxRows caps one import. An all-or-nothing import is a single
+// SQLite write transaction, and every other writer on the platform waits behind
+// it; the largest site onboarding we plan for is around two thousand devices, so
+// this leaves headroom without letting one request hold the database for minutes.
+const thingImportMaxRows = 5000
+
+// Import modes. Atomic is the default because it is the one that cannot leave
+// half an import behind — which is the failure this route exists to remove.
+const (
+	importAtomic     = "atomic"
+	importBestEffort = "best_effort"
+)
+
+// Per-row outcomes in the import report.
+const (
+	rowOK         = "ok"          // dry run: the row would be created
+	rowCreated    = "created"     // written
+	rowFailed     = "failed"      // this row is why it was not written
+	rowRolledBack = "rolled_back" // atomic: fine on its own, undone by another row
+)
+
+// thingImportColumns maps a CSV header to the createThingRequest field it fills.
+// The names are the JSON paths of the single-create body, so a row reads the same
+// in either format. An unknown header is rejected rather than ignored: a column
+// silently dropped for a typo ("nats.mdoe") would import the row with no identity
+// and report success.
+var thingImportColumns = map[string]func(*createThingRequest, string){
+	"name":              func(b *createThingRequest, v string) { b.Name = v },
+	"description":       func(b *createThingRequest, v string) { b.Description = v },
+	"code":              func(b *createThingRequest, v string) { b.Code = v },
+	"type":              func(b *createThingRequest, v string) { b.Type = v },
+	"location":          func(b *createThingRequest, v string) { b.Location = v },
+	"nats.mode":         func(b *createThingRequest, v string) { b.Nats.Mode = v },
+	"nats.user_id":      func(b *createThingRequest, v string) { b.Nats.UserID = v },
+	"nats.role_id":      func(b *createThingRequest, v string) { b.Nats.RoleID = v },
+	"nebula.mode":       func(b *createThingRequest, v string) { b.Nebula.Mode = v },
+	"nebula.host_id":    func(b *createThingRequest, v string) { b.Nebula.HostID = v },
+	"nebula.network_id": func(b *createThingRequest, v string) { b.Nebula.NetworkID = v },
+	"nebula.overlay_ip": func(b *createThingRequest, v string) { b.Nebula.OverlayIP = v },
+	// metadata is handled separately: it is a JSON object in one cell.
+}
+
+// importRow is one parsed line of the upload. Line is the 1-based line number in
+// the body, which is what the operator will look for in their spreadsheet.
+type importRow struct {
+	Line     int
+	Body     createThingRequest
+	ParseErr string
+}
+
+// thingImportResult is one row of the report.
+type thingImportResult struct {
+	Line       int      `json:"line"`
+	Code       string   `json:"code,omitempty"`
+	Status     string   `json:"status"`
+	Errors     []string `json:"errors,omitempty"`
+	ID         string   `json:"id,omitempty"`
+	Email      string   `json:"email,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	NatsUser   string   `json:"nats_user,omitempty"`
+	NebulaHost string   `json:"nebula_host,omitempty"`
+	OverlayIP  string   `json:"overlay_ip,omitempty"` // planned on a dry run, assigned on a write
+}
+
+// RegisterThingImportRoutes adds POST /api/org/things/import: create many Things
+// from one CSV or NDJSON upload, each row shaped exactly like the body of
+// POST /api/org/things, identity modes included.
+//
+// Looping over the single-create route from a script is what this replaces, and
+// the loop's problem is not speed. Each call commits on its own, so a site import
+// that fails at row 412 leaves 411 Things — with signed credentials and allocated
+// overlay IPs — behind, and the script has to work out what it already did before
+// it can be re-run. Here the caller picks:
+//
+//   - mode=atomic (default): every row in ONE transaction. Any failure rolls the
+//     whole import back, and for the reason RegisterThingRoutes gives, a rollback
+//     means pb-nats never signed or published anything.
+//   - mode=best_effort: one transaction per row. Rows that fail are reported and
+//     skipped; the rest are created.
+//
+// and dry_run=true runs every check — code clashes, NATS username and identifier
+// email clashes, the role an identity would be put on, overlay IP and hostname
+// clashes, link targets, the owner/admin gate — against the
+// database AND against the other rows of the upload, then writes nothing. The
+// same checks run before a real import too, so an atomic import with a clash in
+// row 1,900 fails before row 1 is written rather than after.
+//
+// The report carries each created row's password. As with the single-create
+// route it is the only copy: PocketBase keeps the hash.
+//
+// SECURITY: the same as RegisterThingRoutes, because it is the same code path —
+// each row goes through createThing, and the organization comes from the caller.
+func RegisterThingImportRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.POST("/api/org/things/import", func(re *core.RequestEvent) error {
+			q := re.Request.URL.Query()
+			dryRun := q.Get("dry_run") == "true" || q.Get("dry_run") == "1"
+			mode := q.Get("mode")
+			if mode == "" {
+				mode = importAtomic
+			}
+			if mode != importAtomic && mode != importBestEffort {
+				return re.BadRequestError(`mode must be "atomic" or "best_effort"`, nil)
+			}
+
+			orgID, role, err := resolveInventoryRole(re, opts)
+			if err != nil {
+				return err
+			}
+
+			rows, err := parseThingImport(re)
+			if err != nil {
+				return re.BadRequestError(err.Error(), nil)
+			}
+			if len(rows) == 0 {
+				return re.BadRequestError("the upload contains no rows", nil)
+			}
+			if len(rows) > thingImportMaxRows {
+				return re.BadRequestError(fmt.Sprintf(
+					"an import is limited to %d rows (got %d); split the file", thingImportMaxRows, len(rows)), nil)
+			}
+
+			orgSlug, err := orgSlugFor(re, opts, orgID)
+			if err != nil {
+				return err
+			}
+
+			results, modes, err := planThingImport(re, opts, orgID, orgSlug, role, rows)
+			if err != nil {
+				return re.InternalServerError("failed to plan the import", err)
+			}
+			failed := countStatus(results, rowFailed)
+
+			report := map[string]any{
+				"dry_run": dryRun,
+				"mode":    mode,
+				"rows":    results,
+			}
+
+			if dryRun {
+				report["would_create"] = len(rows) - failed
+				report["failed"] = failed
+				return re.JSON(200, report)
+			}
+
+			if mode == importAtomic {
+				if failed > 0 {
+					markRolledBack(results)
+					report["created"] = 0
+					report["failed"] = failed
+					return re.JSON(400, report)
+				}
+				importAtomically(re, opts, orgID, orgSlug, rows, modes, results)
+			} else {
+				importBestEffortRows(re, opts, orgID, orgSlug, rows, modes, results)
+			}
+
+			created := countStatus(results, rowCreated)
+			report["created"] = created
+			report["failed"] = countStatus(results, rowFailed)
+			status := 200
+			if created == 0 {
+				status = 400
+			}
+			return re.JSON(status, report)
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// rowModes is the normalised (nats, nebula) mode pair prepareThingRequest
+// returned for a row.
+type rowModes struct{ nats, nebula string }
+
+// importAtomically writes every row in one transaction. The first failure
+// aborts it; that row is reported as the cause and every other row as rolled
+// back, with its password withheld — a credential for a Thing that does not
+// exist is worse than none.
+func importAtomically(
+	re *core.RequestEvent, opts ThingRoutesOptions, orgID, orgSlug string,
+	rows []importRow, modes []rowModes, results []thingImportResult,
+) {
+	failedAt := -1
+	txErr := re.App.RunInTransaction(func(txApp core.App) error {
+		for i, row := range rows {
+			if err := importOneRow(re, txApp, opts, orgID, orgSlug, row, modes[i], &results[i]); err != nil {
+				failedAt = i
+				return err
+			}
+		}
+		return nil
+	})
+	if txErr == nil {
+		return
+	}
+	for i := range results {
+		if i == failedAt {
+			results[i].Status = rowFailed
+			results[i].Errors = append(results[i].Errors, describeError(txErr))
+			clearCredentials(&results[i])
+			continue
+		}
+		results[i].Status = rowRolledBack
+		clearCredentials(&results[i])
+	}
+	if failedAt == -1 {
+		// The commit itself failed; no row is to blame more than another.
+		for i := range results {
+			results[i].Errors = append(results[i].Errors, describeError(txErr))
+		}
+	}
+}
+
+// importBestEffortRows gives every row that passed planning its own transaction,
+// so one row failing at write time undoes only itself.
+func importBestEffortRows(
+	re *core.RequestEvent, opts ThingRoutesOptions, orgID, orgSlug string,
+	rows []importRow, modes []rowModes, results []thingImportResult,
+) {
+	for i, row := range rows {
+		if results[i].Status == rowFailed {
+			continue
+		}
+		txErr := re.App.RunInTransaction(func(txApp core.App) error {
+			return importOneRow(re, txApp, opts, orgID, orgSlug, row, modes[i], &results[i])
+		})
+		if txErr != nil {
+			results[i].Status = rowFailed
+			results[i].Errors = append(results[i].Errors, describeError(txErr))
+			clearCredentials(&results[i])
+		}
+	}
+}
+
+// importOneRow creates one row's Thing and fills its report entry.
+func importOneRow(
+	re *core.RequestEvent, txApp core.App, opts ThingRoutesOptions, orgID, orgSlug string,
+	row importRow, m rowModes, result *thingImportResult,
+) error {
+	password, err := randomSecret(16)
+	if err != nil {
+		return re.InternalServerError("failed to generate credential", err)
+	}
+	thing, err := createThing(re, txApp, opts, row.Body, m.nats, m.nebula, orgID, orgSlug, password)
+	if err != nil {
+		return err
+	}
+	result.Status = rowCreated
+	result.ID = thing.Id
+	result.Email = thing.GetString("email")
+	result.Password = password
+	result.NatsUser = thing.GetString("nats_user")
+	result.NebulaHost = thing.GetString("nebula_host")
+	result.OverlayIP = ""
+	if result.NebulaHost != "" {
+		if host, err := txApp.FindRecordById(opts.NebulaHostCollection, result.NebulaHost); err == nil {
+			result.OverlayIP = host.GetString("overlay_ip")
+		}
+	}
+	return nil
+}
+
+// plannedNetwork is one network as the import plan sees it.
+type plannedNetwork struct {
+	record *core.Record
+	used   []string
+}
+
+func clearCredentials(r *thingImportResult) {
+	r.ID, r.Email, r.Password, r.NatsUser, r.NebulaHost, r.OverlayIP = "", "", "", "", "", ""
+}
+
+func markRolledBack(results []thingImportResult) {
+	for i := range results {
+		if results[i].Status != rowFailed {
+			results[i].Status = rowRolledBack
+		}
+	}
+}
+
+func countStatus(results []thingImportResult, status string) int {
+	n := 0
+	for _, r := range results {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// planThingImport runs every read-only check on every row and returns the
+// report with each row marked ok or failed, plus the normalised modes.
+//
+// Clashes are checked twice over: against what the database already holds, and
+// against the rows earlier in the same upload. The second half is the one a loop
+// over the single-create route never had — two rows both claiming code "S01"
+// each pass on their own, and only the write tells you.
+//
+// The checks are the ones createThing makes, restated read-only; a dry run that
+// passes a row the write then refuses is the failure this exists to prevent.
+// The error is for a database read that failed, not for a row.
+func planThingImport(
+	re *core.RequestEvent, opts ThingRoutesOptions, orgID, orgSlug, role string, rows []importRow,
+) ([]thingImportResult, []rowModes, error) {
+	results := make([]thingImportResult, len(rows))
+	modes := make([]rowModes, len(rows))
+
+	seenCode := map[string]int{}    // code -> first line
+	seenNats := map[string]int{}    // nats username -> first line
+	seenOverlay := map[string]int{} // network|ip -> first line
+	seenHost := map[string]int{}    // network|hostname -> first line
+
+	// Networks the upload allocates on, with the addresses already held plus the
+	// ones earlier rows will take, so a row that leaves overlay_ip empty is told
+	// the address the write will actually give it.
+	networks := map[string]*plannedNetwork{}
+
+	// Looked up once: every auto row lands in the same account.
+	var natsAccountID string
+	if acct, _ := re.App.FindFirstRecordByFilter(
+		opts.NatsAccountCollection,
+		"organization = {:org} && active = true",
+		dbx.Params{"org": orgID},
+	); acct != nil {
+		natsAccountID = acct.Id
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		res := &results[i]
+		res.Line = row.Line
+		res.Status = rowOK
+
+		fail := func(msg string) {
+			res.Status = rowFailed
+			res.Errors = append(res.Errors, msg)
+		}
+
+		if row.ParseErr != "" {
+			fail(row.ParseErr)
+			continue
+		}
+
+		natsMode, nebulaMode, err := prepareThingRequest(re, &row.Body, role)
+		res.Code = row.Body.Code
+		if err != nil {
+			fail(describeError(err))
+			continue
+		}
+		modes[i] = rowModes{natsMode, nebulaMode}
+		b := row.Body
+
+		if first, dup := seenCode[b.Code]; dup {
+			fail(fmt.Sprintf("code %q is also used on line %d of this upload", b.Code, first))
+		} else {
+			seenCode[b.Code] = row.Line
+			if err := assertThingCodeFree(re, opts, orgID, b.Code); err != nil {
+				fail(describeError(err))
+			}
+		}
+		// Emails are unique across organizations, and two organizations can
+		// share a slug (resolveNatsUser says how).
+		email := fmt.Sprintf("%s@%s.thing.local", b.Code, orgSlug)
+		if clash, _ := re.App.FindFirstRecordByFilter(
+			opts.ThingCollection, "email = {:e}", dbx.Params{"e": email},
+		); clash != nil {
+			fail(fmt.Sprintf("identifier %q is already in use, most likely by an organization whose name also shortens to %q",
+				email, orgSlug))
+		}
+
+		switch natsMode {
+		case modeLink:
+			if !recordInOrg(re.App, opts.NatsUserCollection, b.Nats.UserID, orgID) {
+				fail("nats.user_id is not a NATS identity in this organization")
+			}
+		case modeAuto:
+			if natsAccountID == "" {
+				fail("no active NATS account for this organization")
+				break
+			}
+			if b.Nats.RoleID != "" {
+				if !recordInOrg(re.App, opts.NatsRoleCollection, b.Nats.RoleID, orgID) {
+					fail("nats.role_id is not a role in this organization")
+				}
+			} else if contract, err := loadThingContract(re.App, opts, orgID, b.Type, b.Location, b.Code); err != nil {
+				fail(err.Error())
+			} else if _, err := plannedContractRole(re.App, opts, orgID, contract); err != nil {
+				fail(err.Error())
+			}
+			natsEmail := fmt.Sprintf("%s@%s.nats.local", b.Code, orgSlug)
+			if clash, _ := re.App.FindFirstRecordByFilter(
+				opts.NatsUserCollection, "email = {:e}", dbx.Params{"e": natsEmail},
+			); clash != nil {
+				fail(fmt.Sprintf("identifier %q is already in use, most likely by an organization whose name also shortens to %q",
+					natsEmail, orgSlug))
+			}
+			if first, dup := seenNats[b.Code]; dup {
+				fail(fmt.Sprintf("NATS username %q is also requested on line %d of this upload", b.Code, first))
+			} else {
+				seenNats[b.Code] = row.Line
+				if existing, _ := re.App.FindFirstRecordByFilter(
+					opts.NatsUserCollection,
+					"account_id = {:acct} && nats_username = {:u}",
+					dbx.Params{"acct": natsAccountID, "u": b.Code},
+				); existing != nil {
+					fail(fmt.Sprintf("NATS username %q is already used in this organization", b.Code))
+				}
+			}
+		}
+
+		switch nebulaMode {
+		case modeLink:
+			if !recordInOrg(re.App, opts.NebulaHostCollection, b.Nebula.HostID, orgID) {
+				fail("nebula.host_id is not a Nebula host in this organization")
+			}
+		case modeAuto:
+			if b.Nebula.NetworkID == "" {
+				fail("nebula.network_id is required when nebula.mode is auto")
+				break
+			}
+			network := networks[b.Nebula.NetworkID]
+			if network == nil {
+				rec, err := re.App.FindRecordById(opts.NebulaNetworkCollection, b.Nebula.NetworkID)
+				if err != nil || rec.GetString("organization") != orgID {
+					fail("nebula.network_id is not a network in this organization")
+					break
+				}
+				used, err := overlayIPsInUse(re.App, opts.NebulaHostCollection, rec.Id)
+				if err != nil {
+					return nil, nil, err
+				}
+				network = &plannedNetwork{record: rec, used: used}
+				networks[rec.Id] = network
+			}
+			ip := strings.TrimSpace(b.Nebula.OverlayIP)
+			if ip == "" {
+				pool, err := overlayPool(network.record)
+				if err != nil {
+					fail(fmt.Sprintf("nebula.overlay_ip is required: network %q cannot allocate addresses (%v)",
+						network.record.GetString("name"), err))
+					break
+				}
+				next, err := pool.Next(network.used)
+				if err != nil {
+					fail("nebula.overlay_ip: " + err.Error())
+					break
+				}
+				ip = next.String()
+				res.OverlayIP = ip
+			} else if err := checkOverlayIP(network.record, ip); err != nil {
+				fail("nebula.overlay_ip: " + err.Error())
+			}
+
+			ipKey := b.Nebula.NetworkID + "|" + ip
+			if first, dup := seenOverlay[ipKey]; dup {
+				fail(fmt.Sprintf("overlay IP %q is also requested on line %d of this upload", ip, first))
+			} else {
+				seenOverlay[ipKey] = row.Line
+			}
+			hostKey := b.Nebula.NetworkID + "|" + b.Code
+			if first, dup := seenHost[hostKey]; dup {
+				fail(fmt.Sprintf("Nebula hostname %q is also requested on line %d of this upload", b.Code, first))
+			} else {
+				seenHost[hostKey] = row.Line
+			}
+			if existing, _ := re.App.FindFirstRecordByFilter(
+				opts.NebulaHostCollection,
+				"network_id = {:n} && (hostname = {:h} || overlay_ip = {:ip})",
+				dbx.Params{"n": b.Nebula.NetworkID, "h": b.Code, "ip": ip},
+			); existing != nil {
+				fail(fmt.Sprintf("hostname %q or overlay IP %q is already used on that network", b.Code, ip))
+			}
+			// Only a row that will be written takes its address; allocation for
+			// the rows after it must not skip one a failed row never held.
+			if res.Status == rowOK {
+				network.used = append(network.used, ip)
+			}
+		}
+	}
+
+	return results, modes, nil
+}
+
+// recordInOrg reports whether id names a record of collection in orgID. An empty
+// id is never in any organization.
+func recordInOrg(app core.App, collection, id, orgID string) bool {
+	if id == "" {
+		return false
+	}
+	rec, err := app.FindRecordById(collection, id)
+	return err == nil && rec.GetString("organization") == orgID
+}
+
+// describeError flattens a route error into one line for the report. An
+// ApiError's message alone often loses the useful part — "failed to create
+// thing" says nothing about which field — so the wrapped error is appended.
+func describeError(err error) string {
+	var apiErr *router.ApiError
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+	if raw, ok := apiErr.RawData().(error); ok && raw != nil {
+		return apiErr.Message + ": " + raw.Error()
+	}
+	return apiErr.Message
+}
+
+// parseThingImport reads the request body as CSV or NDJSON. The format comes
+// from ?format= when given, else from the Content-Type. A row that cannot be
+// parsed is returned with ParseErr set rather than failing the upload, so the
+// report can name every bad line at once; only a body that cannot be read as
+// rows at all (no CSV header, unknown column) is an error here.
+func parseThingImport(re *core.RequestEvent) ([]importRow, error) {
+	format := re.Request.URL.Query().Get("format")
+	if format == "" {
+		ct, _, _ := mime.ParseMediaType(re.Request.Header.Get("Content-Type"))
+		switch ct {
+		case "text/csv":
+			format = "csv"
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			format = "ndjson"
+		}
+	}
+
+	switch format {
+	case "csv":
+		return parseThingCSV(re.Request.Body)
+	case "ndjson":
+		return parseThingNDJSON(re.Request.Body)
+	default:
+		return nil, errors.New("send text/csv or application/x-ndjson, or pass ?format=csv|ndjson")
+	}
+}
+
+func parseThingCSV(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1 // checked per row below, so one short row doesn't sink the file
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read CSV header: %w", err)
+	}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, ok := thingImportColumns[h]; !ok && h != "metadata" {
+			return nil, fmt.Errorf("unknown CSV column %q", header[i])
+		}
+		header[i] = h
+	}
+
+	var rows []importRow
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				rows = append(rows, importRow{Line: pe.StartLine, ParseErr: pe.Err.Error()})
+				continue
+			}
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		row := importRow{Line: line}
+		if len(fields) != len(header) {
+			row.ParseErr = fmt.Sprintf("expected %d fields, got %d", len(header), len(fields))
+			rows = append(rows, row)
+			continue
+		}
+		for i, v := range fields {
+			if header[i] == "metadata" {
+				if strings.TrimSpace(v) == "" {
+					continue
+				}
+				if err := json.Unmarshal([]byte(v), &row.Body.Metadata); err != nil {
+					row.ParseErr = "metadata must be a JSON object: " + err.Error()
+					break
+				}
+				continue
+			}
+			thingImportColumns[header[i]](&row.Body, v)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseThingNDJSON(r io.Reader) ([]importRow, error) {
+	sc := bufio.NewScanner(r)
+	// A row carrying a large metadata object can exceed bufio's 64 KiB default.
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var rows []importRow
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		row := importRow{Line: line}
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.DisallowUnknownFields() // same reason as the CSV header check
+		if err := dec.Decode(&row.Body); err != nil {
+			row.ParseErr = "invalid JSON: " + err.Error()
+		}
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read NDJSON body: %w", err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,437 @@
+package hooks
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+
+	"platform/internal/enrollment"
+	"platform/internal/subjectresolver"
+)
+
+// thingContractRoleName is the per-organization role given to a Thing whose NATS
+// permissions come from its type's contract. It grants nothing itself.
+const thingContractRoleName = "thing-contract"
+
+// thingContract is what a Thing's type says it may do on the bus.
+type thingContract struct {
+	Type       *core.Record
+	Operations []*core.Record
+	Context    subjectresolver.ThingContext
+	Perms      subjectresolver.Permissions
+	Problems   []subjectresolver.Problem
+}
+
+// contractSubject is one operation of a contract with its subject resolved for
+// a particular Thing. Problem is set, and the subject not granted, when it did
+// not resolve to a valid subject.
+type contractSubject struct {
+	Operation  string `json:"operation"`
+	Capability string `json:"capability"`
+	Subject    string `json:"subject"`
+	Problem    string `json:"problem,omitempty"`
+}
+
+// Subjects lists the contract's operations with their resolved subjects.
+func (c *thingContract) Subjects() []contractSubject {
+	problems := map[string]string{}
+	for _, p := range c.Problems {
+		problems[p.Operation] = p.Reason
+	}
+	prefix := c.Type.GetString("subject_prefix")
+	out := make([]contractSubject, 0, len(c.Operations))
+	for _, op := range c.Operations {
+		out = append(out, contractSubject{
+			Operation:  op.GetString("name"),
+			Capability: op.GetString("capability"),
+			Subject:    subjectresolver.ResolveThing(subjectresolver.Join(prefix, op.GetString("subject_suffix")), c.Context),
+			Problem:    problems[op.GetString("name")],
+		})
+	}
+	return out
+}
+
+// RegisterThingPermissions keeps the NATS permissions of every auto-provisioned
+// Thing identity equal to what its Thing Type's contract says the device does.
+//
+// Before this, resolveNatsUser attached the organization's default role to every
+// credential it minted, so a temperature sensor and a valve controller held the
+// same grants — usually the broad ones the default role needs for humans. The
+// contract that says what each device actually does already existed in
+// thing_types and thing_type_operations; nothing read it server-side.
+//
+// Now a Thing whose type has operations is provisioned with:
+//
+//   - user-level publish_permissions / subscribe_permissions computed by
+//     subjectresolver.Derive from the type's subject_prefix, the Thing's code and
+//     location, and each operation's capability and subject_suffix;
+//   - the `thing-contract` role, which grants nothing, unless the caller passed a
+//     role_id or the type names a nats_role. The role matters because pb-nats
+//     UNIONS user-level permissions with the role's (NatsUserFormView says so to
+//     the operator), so a contract list under the default role would be a
+//     narrowing that narrows nothing. For the same reason the role is recomputed
+//     with the lists (contractRole): a type that gains operations, or a Thing
+//     moved to a type with them, leaves the default role for the contract one,
+//     and back again when the contract goes. A role the caller chose at creation
+//     is kept, unless it is one of those the platform picks itself.
+//
+// Requests and replies never touch the account-wide `_INBOX.>`, which would let
+// any device read or answer any other device's requests. A requester subscribes
+// to its own inbox prefix, `_INBOX.<thing>` (the contract routes and the bundle
+// tell the device which), and a responder gets the JWT's response permission
+// (`allow_responses`), which lets it answer exactly the requests it receives.
+// pb-nats has no field for that permission, so an identity with
+// allow_responses is signed here, ahead of pb-nats, as device-keyed identities
+// are in hooks/thing_enrollment.go, and its creds file rebuilt around the new
+// JWT. That needs its seed as stored: with nats.encryption_key set, pb-nats signs
+// it instead, without the permission, and a warning says the device cannot
+// answer.
+//
+// The grants are recomputed, here, when anything they were derived from changes:
+// the type's subject_prefix, code, operations or nats_role; an operation's
+// capability or subject_suffix; a location's code; a Thing's type, location or
+// code. A changed grant sets `regenerate` so pb-nats signs a JWT carrying it — the
+// device picks it up by re-reading its credential, the same as after any rotation.
+//
+// Only identities minted for their Thing are touched (things.provisioned_identities).
+// A linked identity is somebody's hand-configured credential, possibly shared, and
+// rewriting its permissions from one Thing's contract would be wrong for the rest.
+// Likewise any user-level permissions hand-edited onto a minted identity are
+// replaced on the next recompute; the contract is the place to change them.
+//
+// Like the active-flag cascade, recomputation is best-effort and logged: a
+// failure must not roll back the operator's edit to a type, and the next change
+// recomputes from scratch anyway. Every minted identity is also recomputed once
+// at startup, so a change to how grants are derived reaches the credentials that
+// were issued before it; an unchanged one is not touched.
+func RegisterThingPermissions(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		refreshThingsWhere(se.App, opts, "nats_user != ''", nil)
+		return se.Next()
+	})
+
+	app.OnRecordUpdate(opts.NatsUserCollection).Bind(&hook.Handler[*core.RecordEvent]{
+		Priority: -100,
+		Func: func(e *core.RecordEvent) error {
+			if !e.Record.GetBool("regenerate") || !e.Record.GetBool("allow_responses") ||
+				deviceKeyedNatsUser(e.App, opts, e.Record.Id) {
+				return e.Next()
+			}
+			name := e.Record.GetString("nats_username")
+			seed := e.Record.GetString("seed")
+			if !strings.HasPrefix(seed, "SU") {
+				log.Printf("⚠️ NATS identity '%s' answers requests, but its seed is not readable (at-rest encryption is on?); pb-nats signs it without the response permission", name)
+				return e.Next()
+			}
+			token, err := signNatsUserJWT(e.App, opts, e.Record)
+			if err != nil {
+				return fmt.Errorf("NATS identity %q answers requests and could not be signed: %w", name, err)
+			}
+			creds, err := enrollment.UserCreds(token, seed)
+			if err != nil {
+				return fmt.Errorf("NATS identity %q: %w", name, err)
+			}
+			e.Record.Set("jwt", token)
+			e.Record.Set("creds_file", creds)
+			e.Record.Set("regenerate", false)
+			return e.Next()
+		},
+	})
+
+	app.OnRecordAfterUpdateSuccess(opts.ThingTypeCollection).BindFunc(func(e *core.RecordEvent) error {
+		if changed(e.Record, "subject_prefix", "code", "operations", "nats_role") {
+			refreshThingsWhere(e.App, opts, "type = {:id}", dbx.Params{"id": e.Record.Id})
+		}
+		return e.Next()
+	})
+
+	app.OnRecordAfterUpdateSuccess(opts.ThingTypeOperationCollection).BindFunc(func(e *core.RecordEvent) error {
+		if !changed(e.Record, "capability", "subject_suffix") {
+			return e.Next()
+		}
+		types, err := e.App.FindRecordsByFilter(opts.ThingTypeCollection,
+			"operations ?= {:id}", "", 0, 0, dbx.Params{"id": e.Record.Id})
+		if err != nil {
+			log.Printf("⚠️ operation '%s' changed but its thing types could not be listed: %v", e.Record.Id, err)
+			return e.Next()
+		}
+		for _, t := range types {
+			refreshThingsWhere(e.App, opts, "type = {:id}", dbx.Params{"id": t.Id})
+		}
+		return e.Next()
+	})
+
+	app.OnRecordAfterUpdateSuccess(opts.LocationCollection).BindFunc(func(e *core.RecordEvent) error {
+		if changed(e.Record, "code") {
+			refreshThingsWhere(e.App, opts, "location = {:id}", dbx.Params{"id": e.Record.Id})
+		}
+		return e.Next()
+	})
+
+	app.OnRecordAfterUpdateSuccess(opts.ThingCollection).BindFunc(func(e *core.RecordEvent) error {
+		if changed(e.Record, "type", "location", "code") {
+			if _, err := refreshThingPermissions(e.App, opts, e.Record); err != nil {
+				log.Printf("⚠️ thing '%s' changed but its NATS permissions were not recomputed: %v",
+					e.Record.GetString("code"), err)
+			}
+		}
+		return e.Next()
+	})
+}
+
+// changed reports whether any of the fields differs from the record's original.
+func changed(rec *core.Record, fields ...string) bool {
+	orig := rec.Original()
+	for _, f := range fields {
+		if fmt.Sprint(orig.Get(f)) != fmt.Sprint(rec.Get(f)) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshThingsWhere recomputes the permissions of every Thing matching filter.
+func refreshThingsWhere(app core.App, opts ThingRoutesOptions, filter string, params dbx.Params) {
+	things, err := app.FindRecordsByFilter(opts.ThingCollection, filter, "", 0, 0, params)
+	if err != nil {
+		log.Printf("⚠️ could not list things to recompute NATS permissions: %v", err)
+		return
+	}
+	updated := 0
+	for _, t := range things {
+		ok, err := refreshThingPermissions(app, opts, t)
+		if err != nil {
+			log.Printf("⚠️ NATS permissions for thing '%s' not recomputed: %v", t.GetString("code"), err)
+			continue
+		}
+		if ok {
+			updated++
+		}
+	}
+	if updated > 0 {
+		log.Printf("✅ NATS permissions recomputed for %d thing(s)", updated)
+	}
+}
+
+// refreshThingPermissions rewrites the contract permissions of a Thing's minted
+// NATS identity, reporting whether anything changed. A Thing whose identity is
+// linked, or that has none, is left alone.
+func refreshThingPermissions(app core.App, opts ThingRoutesOptions, thing *core.Record) (bool, error) {
+	if !ownsNatsUser(thing) {
+		return false, nil
+	}
+	contract, err := loadThingContract(app, opts, thing.GetString("organization"),
+		thing.GetString("type"), thing.GetString("location"), thingRef(thing))
+	if err != nil {
+		return false, err
+	}
+
+	natsUser, err := app.FindRecordById(opts.NatsUserCollection, thing.GetString("nats_user"))
+	if err != nil {
+		return false, err
+	}
+
+	// No contract is an empty contract: a Thing moved off its type keeps no
+	// grants from it.
+	var perms subjectresolver.Permissions
+	if contract != nil {
+		perms = contract.Perms
+		logContractProblems(thing.GetString("code"), contract.Problems)
+	}
+	roleChanged := false
+	orgID := thing.GetString("organization")
+	if current := natsUser.GetString("role_id"); automaticRole(app, opts, orgID, current) {
+		want, err := contractRole(app, opts, orgID, contract)
+		if err != nil {
+			return false, err
+		}
+		if want != current {
+			natsUser.Set("role_id", want)
+			roleChanged = true
+		}
+	}
+	if !setContractPermissions(natsUser, perms) && !roleChanged {
+		return false, nil
+	}
+	natsUser.Set("regenerate", true)
+	if err := app.Save(natsUser); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadThingContract reads a Thing's type, its operations and the values its
+// subjects resolve against, and derives the permissions. It returns nil for a
+// Thing with no type. A type, location or operation outside orgID is an error:
+// app.Save does not check that relations stay inside the tenant, so this must,
+// or one organization's contract could grant subjects to another's device.
+func loadThingContract(app core.App, opts ThingRoutesOptions, orgID, typeID, locationID, thing string) (*thingContract, error) {
+	if typeID == "" {
+		return nil, nil
+	}
+	tt, err := app.FindRecordById(opts.ThingTypeCollection, typeID)
+	if err != nil || tt.GetString("organization") != orgID {
+		return nil, fmt.Errorf("thing type %q is not in this organization", typeID)
+	}
+
+	c := &thingContract{Type: tt}
+	if ids := tt.GetStringSlice("operations"); len(ids) > 0 {
+		ops, err := app.FindRecordsByIds(opts.ThingTypeOperationCollection, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			if op.GetString("organization") != orgID {
+				return nil, fmt.Errorf("operation %q is not in this organization", op.Id)
+			}
+		}
+		c.Operations = ops
+	}
+
+	ctx := subjectresolver.ThingContext{Thing: thing, ThingTypeCode: tt.GetString("code")}
+	if locationID != "" {
+		loc, err := app.FindRecordById(opts.LocationCollection, locationID)
+		if err != nil || loc.GetString("organization") != orgID {
+			return nil, fmt.Errorf("location %q is not in this organization", locationID)
+		}
+		ctx.Location = loc.GetString("code")
+	}
+	if org, err := app.FindRecordById(opts.OrgCollection, orgID); err == nil {
+		ctx.Org = org.GetString("name")
+	}
+
+	ops := make([]subjectresolver.Operation, 0, len(c.Operations))
+	for _, op := range c.Operations {
+		ops = append(ops, subjectresolver.Operation{
+			Name:       op.GetString("name"),
+			Capability: op.GetString("capability"),
+			Suffix:     op.GetString("subject_suffix"),
+		})
+	}
+	c.Context = ctx
+	c.Perms, c.Problems = subjectresolver.Derive(tt.GetString("subject_prefix"), ctx, ops)
+	return c, nil
+}
+
+// setContractPermissions writes perms as the identity's user-level allow lists
+// and response permission, reporting whether they differ from what was stored.
+func setContractPermissions(natsUser *core.Record, perms subjectresolver.Permissions) bool {
+	current := subjectresolver.Permissions{AllowResponses: natsUser.GetBool("allow_responses")}
+	_ = natsUser.UnmarshalJSONField("publish_permissions", &current.Publish)
+	_ = natsUser.UnmarshalJSONField("subscribe_permissions", &current.Subscribe)
+	if current.Equal(perms) {
+		return false
+	}
+	natsUser.Set("publish_permissions", perms.Publish)
+	natsUser.Set("subscribe_permissions", perms.Subscribe)
+	natsUser.Set("allow_responses", perms.AllowResponses)
+	return true
+}
+
+// contractRole is the role a minted identity is put on when nobody chose one:
+// the type's nats_role if it names one, the grant-nothing contract role if the
+// type has operations, and the organization's default role otherwise. contract
+// is nil for a Thing with no type.
+func contractRole(app core.App, opts ThingRoutesOptions, orgID string, contract *thingContract) (string, error) {
+	roleID, err := plannedContractRole(app, opts, orgID, contract)
+	if err != nil || roleID != "" {
+		return roleID, err
+	}
+	roleID, err = ensureThingContractRole(app, opts.NatsRoleCollection, orgID)
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare the thing contract role: %w", err)
+	}
+	return roleID, nil
+}
+
+// plannedContractRole is contractRole without the write, for the import's
+// planning pass: it fails where contractRole would, and returns "" where
+// contractRole would create (or reuse) the contract role.
+func plannedContractRole(app core.App, opts ThingRoutesOptions, orgID string, contract *thingContract) (string, error) {
+	if contract != nil && contract.Type.GetString("nats_role") != "" {
+		roleID := contract.Type.GetString("nats_role")
+		if role, err := app.FindRecordById(opts.NatsRoleCollection, roleID); err != nil || role.GetString("organization") != orgID {
+			return "", fmt.Errorf("the thing type's nats_role is not a role in this organization")
+		}
+		return roleID, nil
+	}
+	if contract != nil && len(contract.Operations) > 0 {
+		return "", nil
+	}
+	def, err := app.FindFirstRecordByFilter(opts.NatsRoleCollection,
+		"organization = {:org} && is_default = true", dbx.Params{"org": orgID})
+	if err != nil || def == nil {
+		return "", fmt.Errorf("no default NATS role for this organization; pass nats.role_id")
+	}
+	return def.Id, nil
+}
+
+// automaticRole reports whether roleID is one contractRole could have picked —
+// the organization's default role, its contract role, or some type's nats_role
+// — and so may be moved when the contract changes. Any other role was chosen by
+// whoever created the Thing, and stays.
+func automaticRole(app core.App, opts ThingRoutesOptions, orgID, roleID string) bool {
+	role, err := app.FindRecordById(opts.NatsRoleCollection, roleID)
+	if err != nil || role.GetString("organization") != orgID {
+		return false
+	}
+	if role.GetBool("is_default") || role.GetString("name") == thingContractRoleName {
+		return true
+	}
+	named, _ := app.FindFirstRecordByFilter(opts.ThingTypeCollection,
+		"organization = {:org} && nats_role = {:role}", dbx.Params{"org": orgID, "role": roleID})
+	return named != nil
+}
+
+// ensureThingContractRole finds (or creates) the organization's grant-nothing
+// role for contract-scoped Things, returning its id. The limits match the leaf
+// node role — unlimited — because the contract constrains subjects, not volume.
+func ensureThingContractRole(app core.App, roleCollection, orgID string) (string, error) {
+	existing, _ := app.FindFirstRecordByFilter(roleCollection,
+		"organization = {:org} && name = {:name}",
+		dbx.Params{"org": orgID, "name": thingContractRoleName})
+	if existing != nil {
+		return existing.Id, nil
+	}
+
+	col, err := app.FindCollectionByNameOrId(roleCollection)
+	if err != nil {
+		return "", err
+	}
+
+	role := core.NewRecord(col)
+	role.Set("name", thingContractRoleName)
+	role.Set("description", "Devices scoped by their Thing Type contract: grants nothing itself; each identity carries its own derived allow lists.")
+	role.Set("organization", orgID)
+	role.Set("is_default", false)
+	role.Set("max_subscriptions", -1)
+	role.Set("max_data", -1)
+	role.Set("max_payload", -1)
+	role.Set("publish_permissions", []string{})
+	role.Set("subscribe_permissions", []string{})
+	role.Set("publish_deny_permissions", []string{})
+	role.Set("subscribe_deny_permissions", []string{})
+	if err := app.Save(role); err != nil {
+		return "", err
+	}
+	return role.Id, nil
+}
+
+// thingRef is the value {thing} resolves to: the code, or the id without one.
+func thingRef(thing *core.Record) string {
+	if code := thing.GetString("code"); code != "" {
+		return code
+	}
+	return thing.Id
+}
+
+func logContractProblems(code string, problems []subjectresolver.Problem) {
+	for _, p := range problems {
+		log.Printf("⚠️ thing '%s': operation '%s' not granted (%s): %s", code, p.Operation, p.Subject, p.Reason)
+	}
+}
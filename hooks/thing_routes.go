@@ -22,6 +22,15 @@ type ThingRoutesOptions struct {
 	NatsRoleCollection      string
 	NebulaHostCollection    string
 	NebulaNetworkCollection string
+	LeafNodeCollection      string
+
+	ThingTypeCollection          string
+	ThingTypeOperationCollection string
+	LocationCollection           string
+	MessageSchemaCollection      string
+
+	NebulaCACollection   string
+	ClaimTokenCollection string
 }
 
 // provisionMode mirrors the three choices the form offers per identity.
@@ -49,7 +58,7 @@ type createThingRequest struct {
 		Mode      string `json:"mode"`
 		HostID    string `json:"host_id"`    // link
 		NetworkID string `json:"network_id"` // auto
-		OverlayIP string `json:"overlay_ip"` // auto
+		OverlayIP string `json:"overlay_ip"` // auto; allocated when empty
 	} `json:"nebula"`
 }
 
@@ -93,38 +102,14 @@ func RegisterThingRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
 				return re.BadRequestError("invalid request body", err)
 			}
 
-			body.Name = strings.TrimSpace(body.Name)
-			body.Code = strings.TrimSpace(body.Code)
-			if body.Name == "" {
-				return re.BadRequestError("name is required", nil)
-			}
-			if body.Code == "" {
-				return re.BadRequestError("code is required", nil)
-			}
-
-			// Modes default to "none" so an absent block provisions nothing. A
-			// mode we don't recognise is rejected rather than treated as none —
-			// the same reason the account-key route rejects unknown actions.
-			natsMode := defaultMode(body.Nats.Mode)
-			nebulaMode := defaultMode(body.Nebula.Mode)
-			if natsMode == "" {
-				return re.BadRequestError("nats.mode must be auto, link, or none", nil)
-			}
-			if nebulaMode == "" {
-				return re.BadRequestError("nebula.mode must be auto, link, or none", nil)
-			}
-
 			orgID, role, err := resolveInventoryRole(re, opts)
 			if err != nil {
 				return err
 			}
 
-			// The identity half is owner/admin only. This is the same boundary
-			// things.createRule draws by freezing nats_user/nebula_host for
-			// members, restated because app.Save() below skips that rule.
-			wantsIdentity := natsMode != modeNone || nebulaMode != modeNone
-			if wantsIdentity && role != "owner" && role != "admin" {
-				return re.ForbiddenError("attaching a NATS or Nebula identity requires owner or admin", nil)
+			natsMode, nebulaMode, err := prepareThingRequest(re, &body, role)
+			if err != nil {
+				return err
 			}
 
 			if err := assertThingCodeFree(re, opts, orgID, body.Code); err != nil {
@@ -144,52 +129,10 @@ func RegisterThingRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
 			var created *core.Record
 
 			txErr := re.App.RunInTransaction(func(txApp core.App) error {
-				natsUserID, err := resolveNatsUser(re, txApp, opts, natsMode, body, orgID, orgSlug)
-				if err != nil {
-					return err
-				}
-
-				nebulaHostID, err := resolveNebulaHost(re, txApp, opts, nebulaMode, body, orgID, orgSlug)
+				thing, err := createThing(re, txApp, opts, body, natsMode, nebulaMode, orgID, orgSlug, thingPassword)
 				if err != nil {
 					return err
 				}
-
-				col, err := txApp.FindCollectionByNameOrId(opts.ThingCollection)
-				if err != nil {
-					return re.InternalServerError("thing collection not found", err)
-				}
-
-				thing := core.NewRecord(col)
-				thing.Set("name", body.Name)
-				thing.Set("description", body.Description)
-				thing.Set("code", body.Code)
-				thing.Set("email", fmt.Sprintf("%s@%s.thing.local", body.Code, orgSlug))
-				thing.Set("emailVisibility", true)
-				thing.SetPassword(thingPassword)
-				thing.Set("organization", orgID)
-				// The client used to omit this, which left the Thing unable to
-				// authenticate: things.authRule is `active = true` and a bool
-				// column has no schema default, so an unset flag reads false.
-				thing.Set("active", true)
-				if body.Type != "" {
-					thing.Set("type", body.Type)
-				}
-				if body.Location != "" {
-					thing.Set("location", body.Location)
-				}
-				if body.Metadata != nil {
-					thing.Set("metadata", body.Metadata)
-				}
-				if natsUserID != "" {
-					thing.Set("nats_user", natsUserID)
-				}
-				if nebulaHostID != "" {
-					thing.Set("nebula_host", nebulaHostID)
-				}
-
-				if err := txApp.Save(thing); err != nil {
-					return re.BadRequestError("failed to create thing", err)
-				}
 				created = thing
 				return nil
 			})
@@ -211,6 +154,109 @@ func RegisterThingRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
 	})
 }
 
+// prepareThingRequest trims and checks the fields of one create request and
+// applies the owner/admin gate on its identity half, returning the normalised
+// modes. It reads nothing from the database, so the bulk import can run it over
+// every row before deciding whether to write anything.
+func prepareThingRequest(re *core.RequestEvent, body *createThingRequest, role string) (string, string, error) {
+	body.Name = strings.TrimSpace(body.Name)
+	body.Code = strings.TrimSpace(body.Code)
+	if body.Name == "" {
+		return "", "", re.BadRequestError("name is required", nil)
+	}
+	if body.Code == "" {
+		return "", "", re.BadRequestError("code is required", nil)
+	}
+
+	// Modes default to "none" so an absent block provisions nothing. A
+	// mode we don't recognise is rejected rather than treated as none —
+	// the same reason the account-key route rejects unknown actions.
+	natsMode := defaultMode(body.Nats.Mode)
+	nebulaMode := defaultMode(body.Nebula.Mode)
+	if natsMode == "" {
+		return "", "", re.BadRequestError("nats.mode must be auto, link, or none", nil)
+	}
+	if nebulaMode == "" {
+		return "", "", re.BadRequestError("nebula.mode must be auto, link, or none", nil)
+	}
+
+	// The identity half is owner/admin only. This is the same boundary
+	// things.createRule draws by freezing nats_user/nebula_host for
+	// members, restated because app.Save() skips that rule.
+	wantsIdentity := natsMode != modeNone || nebulaMode != modeNone
+	if wantsIdentity && role != "owner" && role != "admin" {
+		return "", "", re.ForbiddenError("attaching a NATS or Nebula identity requires owner or admin", nil)
+	}
+
+	return natsMode, nebulaMode, nil
+}
+
+// createThing writes one Thing, minting or linking its identities first, with
+// txApp. It must be called inside a transaction: the identity records it creates
+// are only safe to leave behind if the Thing that references them is saved too.
+func createThing(
+	re *core.RequestEvent, txApp core.App, opts ThingRoutesOptions,
+	body createThingRequest, natsMode, nebulaMode, orgID, orgSlug, password string,
+) (*core.Record, error) {
+	natsUserID, err := resolveNatsUser(re, txApp, opts, natsMode, body, orgID, orgSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	nebulaHostID, err := resolveNebulaHost(re, txApp, opts, nebulaMode, body, orgID, orgSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	col, err := txApp.FindCollectionByNameOrId(opts.ThingCollection)
+	if err != nil {
+		return nil, re.InternalServerError("thing collection not found", err)
+	}
+
+	thing := core.NewRecord(col)
+	thing.Set("name", body.Name)
+	thing.Set("description", body.Description)
+	thing.Set("code", body.Code)
+	thing.Set("email", fmt.Sprintf("%s@%s.thing.local", body.Code, orgSlug))
+	thing.Set("emailVisibility", true)
+	thing.SetPassword(password)
+	thing.Set("organization", orgID)
+	// The client used to omit this, which left the Thing unable to
+	// authenticate: things.authRule is `active = true` and a bool
+	// column has no schema default, so an unset flag reads false.
+	thing.Set("active", true)
+	if body.Type != "" {
+		thing.Set("type", body.Type)
+	}
+	if body.Location != "" {
+		thing.Set("location", body.Location)
+	}
+	if body.Metadata != nil {
+		thing.Set("metadata", body.Metadata)
+	}
+	if natsUserID != "" {
+		thing.Set("nats_user", natsUserID)
+	}
+	if nebulaHostID != "" {
+		thing.Set("nebula_host", nebulaHostID)
+	}
+	// Record which identities were minted for this Thing rather than linked to
+	// it, so decommissioning knows which ones are its to remove.
+	var prov provisionedIdentities
+	if natsMode == modeAuto {
+		prov.NatsUser = natsUserID
+	}
+	if nebulaMode == modeAuto {
+		prov.NebulaHost = nebulaHostID
+	}
+	setProvisioned(thing, prov)
+
+	if err := txApp.Save(thing); err != nil {
+		return nil, re.BadRequestError("failed to create thing", err)
+	}
+	return thing, nil
+}
+
 // defaultMode normalises an absent mode to "none" and returns "" for anything
 // unrecognised, so the caller can reject it explicitly.
 func defaultMode(m string) string {
@@ -316,17 +362,22 @@ func resolveNatsUser(
 		return "", re.BadRequestError("no active NATS account for this organization", nil)
 	}
 
+	// The type's contract decides what the device may do on the bus (see
+	// RegisterThingPermissions). A type with operations puts the credential on
+	// the grant-nothing contract role, so the derived lists are the whole grant;
+	// an explicit role_id, or the type's own nats_role, still wins.
+	contract, err := loadThingContract(txApp, opts, orgID, body.Type, body.Location, body.Code)
+	if err != nil {
+		return "", re.BadRequestError(err.Error(), nil)
+	}
+	hasContract := contract != nil && len(contract.Operations) > 0
+
 	roleID := body.Nats.RoleID
 	if roleID == "" {
-		def, err := txApp.FindFirstRecordByFilter(
-			opts.NatsRoleCollection,
-			"organization = {:org} && is_default = true",
-			dbx.Params{"org": orgID},
-		)
-		if err != nil || def == nil {
-			return "", re.BadRequestError("no default NATS role for this organization; pass nats.role_id", nil)
+		roleID, err = contractRole(txApp, opts, orgID, contract)
+		if err != nil {
+			return "", re.BadRequestError(err.Error(), nil)
 		}
-		roleID = def.Id
 	} else {
 		role, err := txApp.FindRecordById(opts.NatsRoleCollection, roleID)
 		if err != nil || role.GetString("organization") != orgID {
@@ -387,14 +438,31 @@ func resolveNatsUser(
 	u.Set("role_id", roleID)
 	u.Set("organization", orgID)
 	u.Set("active", true)
+	if hasContract {
+		setContractPermissions(u, contract.Perms)
+		logContractProblems(body.Code, contract.Problems)
+	}
 	if err := txApp.Save(u); err != nil {
 		return "", re.BadRequestError("failed to create NATS identity", err)
 	}
+	// pb-nats signed the first JWT without the response permission; sign it
+	// again now that the identity has its key (RegisterThingPermissions).
+	if u.GetBool("allow_responses") {
+		minted, err := txApp.FindRecordById(opts.NatsUserCollection, u.Id)
+		if err == nil {
+			minted.Set("regenerate", true)
+			err = txApp.Save(minted)
+		}
+		if err != nil {
+			return "", re.InternalServerError("failed to sign the NATS identity's response permission", err)
+		}
+	}
 	return u.Id, nil
 }
 
-// resolveNebulaHost mirrors resolveNatsUser for the Nebula side. The overlay IP is
-// operator-supplied, as it was in the form — this route does not allocate one.
+// resolveNebulaHost mirrors resolveNatsUser for the Nebula side. Under "auto" the
+// overlay IP is the caller's if given and the network's next free address if not
+// (hooks/nebula_ipam.go).
 func resolveNebulaHost(
 	re *core.RequestEvent, txApp core.App, opts ThingRoutesOptions,
 	mode string, body createThingRequest, orgID, orgSlug string,
@@ -418,21 +486,31 @@ func resolveNebulaHost(
 	if body.Nebula.NetworkID == "" {
 		return "", re.BadRequestError("nebula.network_id is required when nebula.mode is auto", nil)
 	}
-	if body.Nebula.OverlayIP == "" {
-		return "", re.BadRequestError("nebula.overlay_ip is required when nebula.mode is auto", nil)
-	}
 	network, err := txApp.FindRecordById(opts.NebulaNetworkCollection, body.Nebula.NetworkID)
 	if err != nil || network.GetString("organization") != orgID {
 		return "", re.BadRequestError("nebula.network_id is not a network in this organization", nil)
 	}
 
+	// An omitted overlay IP is allocated from the network's range; a supplied one
+	// is checked against it here so the error names the field the caller sent,
+	// rather than surfacing from the host hook as a failed save.
+	overlayIP := strings.TrimSpace(body.Nebula.OverlayIP)
+	if overlayIP == "" {
+		overlayIP, err = allocateOverlayIP(txApp, opts.NebulaHostCollection, network)
+		if err != nil {
+			return "", re.BadRequestError("nebula.overlay_ip: "+err.Error(), nil)
+		}
+	} else if err := checkOverlayIP(network, overlayIP); err != nil {
+		return "", re.BadRequestError("nebula.overlay_ip: "+err.Error(), nil)
+	}
+
 	if existing, _ := txApp.FindFirstRecordByFilter(
 		opts.NebulaHostCollection,
 		"network_id = {:n} && (hostname = {:h} || overlay_ip = {:ip})",
-		dbx.Params{"n": body.Nebula.NetworkID, "h": body.Code, "ip": body.Nebula.OverlayIP},
+		dbx.Params{"n": body.Nebula.NetworkID, "h": body.Code, "ip": overlayIP},
 	); existing != nil {
 		return "", re.BadRequestError(
-			fmt.Sprintf("hostname %q or overlay IP %q is already used on that network", body.Code, body.Nebula.OverlayIP), nil)
+			fmt.Sprintf("hostname %q or overlay IP %q is already used on that network", body.Code, overlayIP), nil)
 	}
 
 	col, err := txApp.FindCollectionByNameOrId(opts.NebulaHostCollection)
@@ -450,7 +528,7 @@ func resolveNebulaHost(
 	h.Set("emailVisibility", true)
 	h.SetPassword(pw)
 	h.Set("network_id", body.Nebula.NetworkID)
-	h.Set("overlay_ip", body.Nebula.OverlayIP)
+	h.Set("overlay_ip", overlayIP)
 	h.Set("organization", orgID)
 	h.Set("active", true)
 	if err := txApp.Save(h); err != nil {
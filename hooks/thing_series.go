@@ -0,0 +1,181 @@
+package hooks
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/series"
+)
+
+// thingSeriesRequest is the body of POST /api/org/things/series.
+type thingSeriesRequest struct {
+	// Template is a POST /api/org/things body without name or code; every Thing
+	// in the series gets a copy of it.
+	Template createThingRequest `json:"template"`
+
+	Code string `json:"code"` // e.g. "pump-{001..120}"
+	Name string `json:"name"` // e.g. "Pump {1..120}"; the code's pattern when empty
+
+	// OverlayIPStart gives the series consecutive overlay IPs from this one.
+	// Without it, each auto host gets the next free address in its network.
+	OverlayIPStart string `json:"overlay_ip_start"`
+}
+
+// RegisterThingSeriesRoutes adds POST /api/org/things/series: create a run of
+// identical Things from one template and a code pattern, in one transaction.
+//
+// A row of sensors is the same Thing N times over — same type, location,
+// metadata and identity modes — differing only in code and name. The bulk
+// import takes that too, but only as an N-line file in which every line repeats
+// the same eight columns; one typo on line 87 is a device on the wrong network.
+// Here the shared part is written once and the pattern says what varies:
+//
+//	{"template": {"type": "…", "location": "…",
+//	              "nats": {"mode": "auto"},
+//	              "nebula": {"mode": "auto", "network_id": "…"}},
+//	 "code": "pump-{001..120}",
+//	 "name": "Pump {1..120}"}
+//
+// The name pattern must expand to as many names as the code's; left empty, the
+// codes are the names. Auto Nebula hosts get the network's next free address
+// each, or consecutive addresses from overlay_ip_start.
+//
+// The series is expanded into rows and handed to the bulk import's planner and
+// atomic writer, so it is exactly an atomic import of the rows it stands for:
+// every code, NATS username, hostname and overlay IP is checked against the
+// database and against the rest of the series before anything is written
+// (assertThingCodeFree and the NATS/Nebula duplicate checks), ?dry_run=true
+// stops there, and the write is one transaction that creates all of them or
+// none. The report is the import's, with `line` the 1-based position in the
+// series.
+//
+// SECURITY: as RegisterThingImportRoutes — every Thing goes through createThing,
+// the organization comes from the caller, and the identity half is owner/admin.
+func RegisterThingSeriesRoutes(app *pocketbase.PocketBase, opts ThingRoutesOptions) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.POST("/api/org/things/series", func(re *core.RequestEvent) error {
+			q := re.Request.URL.Query()
+			dryRun := q.Get("dry_run") == "true" || q.Get("dry_run") == "1"
+
+			var body thingSeriesRequest
+			if err := re.BindBody(&body); err != nil {
+				return re.BadRequestError("invalid request body", err)
+			}
+
+			orgID, role, err := resolveInventoryRole(re, opts)
+			if err != nil {
+				return err
+			}
+
+			rows, err := expandThingSeries(body)
+			if err != nil {
+				return re.BadRequestError(err.Error(), nil)
+			}
+
+			orgSlug, err := orgSlugFor(re, opts, orgID)
+			if err != nil {
+				return err
+			}
+
+			results, modes, err := planThingImport(re, opts, orgID, orgSlug, role, rows)
+			if err != nil {
+				return re.InternalServerError("failed to plan the series", err)
+			}
+			failed := countStatus(results, rowFailed)
+
+			report := map[string]any{
+				"dry_run": dryRun,
+				"count":   len(rows),
+				"rows":    results,
+			}
+			if dryRun {
+				report["would_create"] = len(rows) - failed
+				report["failed"] = failed
+				return re.JSON(200, report)
+			}
+			if failed > 0 {
+				markRolledBack(results)
+				report["created"] = 0
+				report["failed"] = failed
+				return re.JSON(400, report)
+			}
+
+			importAtomically(re, opts, orgID, orgSlug, rows, modes, results)
+
+			created := countStatus(results, rowCreated)
+			report["created"] = created
+			report["failed"] = countStatus(results, rowFailed)
+			status := 200
+			if created == 0 {
+				status = 400
+			}
+			return re.JSON(status, report)
+		}).Bind(apis.RequireAuth("users"))
+
+		return se.Next()
+	})
+}
+
+// expandThingSeries turns a series request into the import rows it stands for.
+func expandThingSeries(body thingSeriesRequest) ([]importRow, error) {
+	if body.Template.Code != "" || body.Template.Name != "" {
+		return nil, fmt.Errorf("template.code and template.name are not used; give the patterns as code and name")
+	}
+	codePattern := strings.TrimSpace(body.Code)
+	if codePattern == "" {
+		return nil, fmt.Errorf("code is required, e.g. \"pump-{001..120}\"")
+	}
+	codes, err := series.Expand(codePattern, thingImportMaxRows)
+	if err != nil {
+		return nil, fmt.Errorf("code: %w", err)
+	}
+
+	names := codes
+	if namePattern := strings.TrimSpace(body.Name); namePattern != "" {
+		names, err = series.Expand(namePattern, thingImportMaxRows)
+		if err != nil {
+			return nil, fmt.Errorf("name: %w", err)
+		}
+		if len(names) != len(codes) {
+			return nil, fmt.Errorf("name expands to %d names but code to %d codes", len(names), len(codes))
+		}
+	}
+
+	var ip netip.Addr
+	sequential := false
+	if start := strings.TrimSpace(body.OverlayIPStart); start != "" {
+		if body.Template.Nebula.Mode != modeAuto {
+			return nil, fmt.Errorf("overlay_ip_start needs template.nebula.mode auto")
+		}
+		if body.Template.Nebula.OverlayIP != "" {
+			return nil, fmt.Errorf("give either template.nebula.overlay_ip or overlay_ip_start, not both")
+		}
+		ip, err = netip.ParseAddr(start)
+		if err != nil || !ip.Is4() {
+			return nil, fmt.Errorf("overlay_ip_start must be an IPv4 address")
+		}
+		sequential = true
+	} else if body.Template.Nebula.OverlayIP != "" && len(codes) > 1 {
+		return nil, fmt.Errorf("template.nebula.overlay_ip would give every Thing the same address; use overlay_ip_start")
+	}
+
+	rows := make([]importRow, len(codes))
+	for i := range codes {
+		b := body.Template
+		b.Code, b.Name = codes[i], names[i]
+		if sequential {
+			if !ip.IsValid() {
+				return nil, fmt.Errorf("overlay_ip_start leaves no address for %q", codes[i])
+			}
+			b.Nebula.OverlayIP = ip.String()
+			ip = ip.Next()
+		}
+		rows[i] = importRow{Line: i + 1, Body: b}
+	}
+	return rows, nil
+}
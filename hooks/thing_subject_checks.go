@@ -0,0 +1,226 @@
+package hooks
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	validation "github.com/pocketbase/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"platform/internal/subjectresolver"
+)
+
+// SubjectCheckOptions configures the save-time subject checks on Thing Types.
+type SubjectCheckOptions struct {
+	OrgCollection                string
+	ThingTypeCollection          string
+	ThingTypeOperationCollection string
+
+	// Overlap is contracts.subject_overlap: "reject" (the default) refuses a
+	// save whose subjects overlap another Thing Type's, "warn" only logs it.
+	Overlap string
+}
+
+// typeSubject is one operation of a Thing Type with its role-level pattern.
+type typeSubject struct {
+	Type       *core.Record
+	Operation  string
+	Capability string
+	Template   string
+	Pattern    string
+}
+
+// describe names the operation and the type it belongs to, for error messages.
+func (s typeSubject) describe() string {
+	return fmt.Sprintf("%q of Thing Type %q (%s)", s.Operation, s.Type.GetString("name"), s.Type.GetString("code"))
+}
+
+// RegisterSubjectChecks validates the subjects a Thing Type's operations
+// resolve to when a thing_types or thing_type_operations record is saved.
+//
+// Subjects were free text. A typo such as "telemetry..raw", a space, a ">" in
+// the middle or a misspelled variable saved fine and surfaced later, as an
+// operation the contract routes report as a problem and no device is granted.
+// Worse, nothing noticed two types claiming the same subjects: a valve and a
+// pump both under "{org}.devices.{thing}.status" are indistinguishable on the
+// bus, and the schema registry and the contract validator can no longer tell
+// which contract a message falls under.
+//
+// Each operation's subject — Join(subject_prefix, subject_suffix) — is checked
+// twice:
+//
+//   - as a template, by subjectresolver.CheckTemplate: only the reserved
+//     variables, a valid subject whatever they resolve to, and no literal
+//     wildcard where the Thing publishes;
+//   - as the role pattern it resolves to for the organization and the type's
+//     code ({thing} and {location} as "*"), which must be a valid subject and
+//     must not overlap, per subjectresolver.Overlaps, any operation of another
+//     Thing Type in the same organization. A pattern that keeps {org} or
+//     {thing_type_code} is not compared; the contract routes already report it
+//     as unresolved.
+//
+// An invalid subject is always refused. An overlap is refused, naming the type
+// and operation it collides with, unless Overlap is "warn":
+//
+//	{"data": {"subject_prefix": {"code": "validation_subject_overlap",
+//	  "message": "operation \"status\" (acme.*.pump.*.status) overlaps \"status\" of Thing Type \"Valve\" (valve) (acme.*.>)"}}}
+//
+// The type is checked on create and when its subject_prefix, code, operations
+// or organization change; the error is on subject_prefix, or on operations when
+// only those changed. An operation is checked on its own when created — its
+// suffix is not yet part of any type — and, when its subject_suffix or
+// capability changes, once for every type that lists it, with the error on
+// subject_suffix. Records that predate the check are only judged when next
+// saved.
+func RegisterSubjectChecks(app *pocketbase.PocketBase, opts SubjectCheckOptions) {
+	checkType := func(e *core.RecordEvent, field string) error {
+		if err := checkTypeSubjects(e.App, opts, e.Record, nil, field); err != nil {
+			return err
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(opts.ThingTypeCollection).BindFunc(func(e *core.RecordEvent) error {
+		return checkType(e, "subject_prefix")
+	})
+	app.OnRecordUpdate(opts.ThingTypeCollection).BindFunc(func(e *core.RecordEvent) error {
+		switch {
+		case changed(e.Record, "subject_prefix", "code", "organization"):
+			return checkType(e, "subject_prefix")
+		case changed(e.Record, "operations"):
+			return checkType(e, "operations")
+		}
+		return e.Next()
+	})
+
+	app.OnRecordCreate(opts.ThingTypeOperationCollection).BindFunc(func(e *core.RecordEvent) error {
+		tmpl := subjectresolver.Join("", e.Record.GetString("subject_suffix"))
+		if err := subjectresolver.CheckTemplate(tmpl, e.Record.GetString("capability")); err != nil {
+			return validation.Errors{"subject_suffix": validation.NewError("validation_invalid_subject", err.Error())}
+		}
+		return e.Next()
+	})
+	app.OnRecordUpdate(opts.ThingTypeOperationCollection).BindFunc(func(e *core.RecordEvent) error {
+		if !changed(e.Record, "subject_suffix", "capability") {
+			return e.Next()
+		}
+		types, err := e.App.FindRecordsByFilter(opts.ThingTypeCollection,
+			"operations ?= {:id}", "", 0, 0, dbx.Params{"id": e.Record.Id})
+		if err != nil {
+			return err
+		}
+		for _, tt := range types {
+			if err := checkTypeSubjects(e.App, opts, tt, e.Record, "subject_suffix"); err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	})
+}
+
+// checkTypeSubjects checks every operation of tt, with edited standing in for
+// the stored operation of the same id, and returns the field error that
+// refuses the save, if any.
+func checkTypeSubjects(app core.App, opts SubjectCheckOptions, tt, edited *core.Record, field string) error {
+	orgID := tt.GetString("organization")
+	orgName := ""
+	if org, err := app.FindRecordById(opts.OrgCollection, orgID); err == nil {
+		orgName = org.GetString("name")
+	}
+
+	own, err := typeSubjects(app, opts, orgName, tt, edited)
+	if err != nil {
+		return err
+	}
+	for _, s := range own {
+		err := subjectresolver.CheckTemplate(s.Template, s.Capability)
+		if err == nil && len(subjectresolver.Unresolved(s.Pattern)) == 0 {
+			err = subjectresolver.Valid(s.Pattern)
+		}
+		if err != nil {
+			return validation.Errors{field: validation.NewError("validation_invalid_subject",
+				fmt.Sprintf("operation %q: %v", s.Operation, err))}
+		}
+	}
+
+	others, err := app.FindRecordsByFilter(opts.ThingTypeCollection,
+		"organization = {:org} && id != {:id}", "", 0, 0, dbx.Params{"org": orgID, "id": tt.Id})
+	if err != nil {
+		return err
+	}
+	var overlaps []string
+	for _, other := range others {
+		theirs, err := typeSubjects(app, opts, orgName, other, edited)
+		if err != nil {
+			return err
+		}
+		for _, a := range own {
+			if len(subjectresolver.Unresolved(a.Pattern)) > 0 {
+				continue
+			}
+			for _, b := range theirs {
+				if len(subjectresolver.Unresolved(b.Pattern)) > 0 || subjectresolver.Valid(b.Pattern) != nil {
+					continue
+				}
+				if subjectresolver.Overlaps(a.Pattern, b.Pattern) {
+					overlaps = append(overlaps, fmt.Sprintf("operation %q (%s) overlaps %s (%s)",
+						a.Operation, a.Pattern, b.describe(), b.Pattern))
+				}
+			}
+		}
+	}
+	if len(overlaps) == 0 {
+		return nil
+	}
+
+	msg := strings.Join(overlaps, "; ")
+	if opts.Overlap == "warn" {
+		log.Printf("⚠️ thing type '%s': %s", tt.GetString("code"), msg)
+		return nil
+	}
+	return validation.Errors{field: validation.NewError("validation_subject_overlap", msg)}
+}
+
+// typeSubjects resolves the role pattern of each of tt's operations.
+func typeSubjects(app core.App, opts SubjectCheckOptions, orgName string, tt, edited *core.Record) ([]typeSubject, error) {
+	ops, err := operationRecords(app, opts, tt, edited)
+	if err != nil {
+		return nil, err
+	}
+	ctx := subjectresolver.RolePatternContext{Org: orgName, ThingTypeCode: tt.GetString("code")}
+	out := make([]typeSubject, 0, len(ops))
+	for _, op := range ops {
+		tmpl := subjectresolver.Join(tt.GetString("subject_prefix"), op.GetString("subject_suffix"))
+		out = append(out, typeSubject{
+			Type:       tt,
+			Operation:  op.GetString("name"),
+			Capability: op.GetString("capability"),
+			Template:   tmpl,
+			Pattern:    subjectresolver.ResolveRolePattern(tmpl, ctx),
+		})
+	}
+	return out, nil
+}
+
+// operationRecords loads tt's operations, substituting edited for the stored
+// record with its id.
+func operationRecords(app core.App, opts SubjectCheckOptions, tt, edited *core.Record) ([]*core.Record, error) {
+	ids := tt.GetStringSlice("operations")
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ops, err := app.FindRecordsByIds(opts.ThingTypeOperationCollection, ids)
+	if err != nil {
+		return nil, err
+	}
+	if edited != nil {
+		for i, op := range ops {
+			if op.Id == edited.Id {
+				ops[i] = edited
+			}
+		}
+	}
+	return ops, nil
+}
@@ -0,0 +1,382 @@
+// Package asyncapi renders an organization's message contracts — Thing Types,
+// their operations and the message schemas those reference — as an AsyncAPI 3.0
+// document, for integration partners who would otherwise get one written by
+// hand from the console.
+//
+// The package knows nothing about records. The caller resolves each operation's
+// subject as far as the organization goes ({org} and {thing_type_code}
+// substituted) and passes the rest in; what remains of the template variables
+// becomes AsyncAPI channel parameters, which use the same {name} syntax:
+//
+//	address: acme.{location}.sensor.{thing}.telemetry
+//	parameters: {location: ..., thing: ...}
+//
+// Each channel also carries x-nats-subject, the same address with every
+// parameter widened to "*" — the pattern a NATS subscriber actually uses, and
+// the one a role grant for the type holds.
+//
+// The document describes the Things. A publish operation is one a Thing sends,
+// subscribe one it receives; request and reply are the same two directions with
+// an answer on the requester's NATS inbox, which has no fixed address and so is
+// declared as a reply channel whose address is null, as AsyncAPI specifies for a
+// dynamic one.
+//
+// Output is deterministic: types, operations and schemas are ordered by key,
+// and info.version is a digest of the channels, operations and components, so
+// the same contracts always produce the same bytes and any change to them
+// produces a new version.
+package asyncapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Version is the AsyncAPI specification version emitted.
+const Version = "3.0.0"
+
+// Contract is the input: one organization's Thing Types and where to reach the
+// bus they are spoken on.
+type Contract struct {
+	Org         string // the organization's name
+	Title       string
+	Description string
+	Servers     []Server
+	Types       []ThingType
+}
+
+// Server is one broker address, as a URL: nats://, tls://, ws:// or wss://.
+type Server struct {
+	Name string
+	URL  string
+}
+
+// ThingType is one type and its operations in declared order.
+type ThingType struct {
+	Key         string // stable identifier: the type's code, or its id without one
+	Name        string
+	Description string
+	Operations  []Operation
+}
+
+// Operation is one thing_type_operations record. Address is the subject with
+// {org} and {thing_type_code} substituted and any other variable left in place.
+type Operation struct {
+	Name        string
+	Capability  string // publish, subscribe, request or reply
+	Description string
+	Address     string
+	Schema      *Schema
+}
+
+// Schema is a message_schemas record. Document is the decoded schema — maps,
+// slices and scalars as encoding/json produces them — so both encoders render it
+// the same way.
+type Schema struct {
+	Namespace   string
+	Name        string
+	Version     string
+	Format      string
+	MessageType string // the Protobuf message or Avro type; empty for json_schema
+	Document    any
+}
+
+// Key is the schema's handle, namespace__name__version — the key leaf-sync
+// mirrors it under.
+func (s Schema) Key() string {
+	return s.Namespace + "__" + s.Name + "__" + s.Version
+}
+
+// Document is an AsyncAPI 3.0 document. Struct fields keep the top-level keys in
+// the order the specification lists them; everything below is maps, which both
+// encoders sort.
+type Document struct {
+	AsyncAPI           string         `json:"asyncapi" yaml:"asyncapi"`
+	Info               Info           `json:"info" yaml:"info"`
+	Servers            map[string]any `json:"servers,omitempty" yaml:"servers,omitempty"`
+	DefaultContentType string         `json:"defaultContentType" yaml:"defaultContentType"`
+	Channels           map[string]any `json:"channels" yaml:"channels"`
+	Operations         map[string]any `json:"operations" yaml:"operations"`
+	Components         Components     `json:"components" yaml:"components"`
+}
+
+// Info is the document's info object.
+type Info struct {
+	Title       string `json:"title" yaml:"title"`
+	Version     string `json:"version" yaml:"version"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// Components holds the reusable messages.
+type Components struct {
+	Messages map[string]any `json:"messages" yaml:"messages"`
+}
+
+// keyPattern is what AsyncAPI allows as a map key for channels, operations and
+// components.
+var keyPattern = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// paramPattern finds the {name} parameters left in an address.
+var paramPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// Build renders c. An operation with an unknown capability is an error: it
+// would otherwise be exported with a direction nobody chose.
+func Build(c Contract) (*Document, error) {
+	doc := &Document{
+		AsyncAPI:           Version,
+		Info:               Info{Title: c.Title, Description: c.Description},
+		DefaultContentType: "application/json",
+		Channels:           map[string]any{},
+		Operations:         map[string]any{},
+		Components:         Components{Messages: map[string]any{}},
+	}
+
+	if len(c.Servers) > 0 {
+		doc.Servers = map[string]any{}
+		for _, s := range c.Servers {
+			srv, err := server(s.URL)
+			if err != nil {
+				return nil, fmt.Errorf("server %s: %w", s.Name, err)
+			}
+			doc.Servers[key(s.Name)] = srv
+		}
+	}
+
+	types := append([]ThingType(nil), c.Types...)
+	sort.SliceStable(types, func(i, j int) bool { return types[i].Key < types[j].Key })
+
+	used := map[string]bool{}
+	for _, tt := range types {
+		for _, op := range tt.Operations {
+			id := unique(used, key(tt.Key)+"."+key(op.Name))
+			if err := doc.addOperation(used, id, tt, op); err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", tt.Key, op.Name, err)
+			}
+		}
+	}
+
+	digest, err := doc.digest()
+	if err != nil {
+		return nil, err
+	}
+	doc.Info.Version = digest
+	return doc, nil
+}
+
+// addOperation adds op's channel and operation under id, and for a request or
+// reply the channel of its inbox, under an id reserved in used like id was.
+func (d *Document) addOperation(used map[string]bool, id string, tt ThingType, op Operation) error {
+	var action string
+	switch op.Capability {
+	case "publish", "request":
+		action = "send"
+	case "subscribe", "reply":
+		action = "receive"
+	default:
+		return fmt.Errorf("unknown capability %q", op.Capability)
+	}
+
+	channel := map[string]any{
+		"address":        op.Address,
+		"x-nats-subject": paramPattern.ReplaceAllString(op.Address, "*"),
+	}
+	if params := parameters(op.Address); len(params) > 0 {
+		channel["parameters"] = params
+	}
+	if op.Description != "" {
+		channel["description"] = op.Description
+	}
+
+	operation := map[string]any{
+		"action":            action,
+		"channel":           ref("#/channels/" + id),
+		"title":             tt.Name + ": " + op.Name,
+		"x-nats-capability": op.Capability,
+	}
+	if op.Description != "" {
+		operation["summary"] = op.Description
+	}
+
+	if op.Schema != nil {
+		msgID := key(op.Schema.Key())
+		d.Components.Messages[msgID] = message(*op.Schema)
+		channel["messages"] = map[string]any{msgID: ref("#/components/messages/" + msgID)}
+		operation["messages"] = []any{ref("#/channels/" + id + "/messages/" + msgID)}
+	}
+
+	if op.Capability == "request" || op.Capability == "reply" {
+		// An operation named "<op>.reply" has that id already, or will ask for it.
+		replyID := unique(used, id+".reply")
+		d.Channels[replyID] = map[string]any{
+			"address":     nil,
+			"description": "The NATS inbox the requester names as the reply subject of each request.",
+		}
+		operation["reply"] = map[string]any{"channel": ref("#/channels/" + replyID)}
+	}
+
+	d.Channels[id] = channel
+	d.Operations[id] = operation
+	return nil
+}
+
+// parameters declares each {name} left in an address.
+func parameters(address string) map[string]any {
+	out := map[string]any{}
+	for _, m := range paramPattern.FindAllStringSubmatch(address, -1) {
+		desc := "Subject token " + m[1] + "."
+		switch m[1] {
+		case "thing":
+			desc = "The Thing's code, or its id when it has none."
+		case "location":
+			desc = "The code of the Thing's location."
+		}
+		out[m[1]] = map[string]any{"description": desc}
+	}
+	return out
+}
+
+// message renders a schema as a message component.
+func message(s Schema) map[string]any {
+	m := map[string]any{
+		"name":              s.Name,
+		"title":             s.Namespace + "/" + s.Name + " " + s.Version,
+		"x-schema-version":  s.Version,
+		"x-schema-handle":   s.Key(),
+		"x-schema-language": s.Format,
+	}
+	if s.MessageType != "" {
+		m["x-message-type"] = s.MessageType
+	}
+	if ct := contentType(s); ct != "" {
+		m["contentType"] = ct
+	}
+	if format, schema := payload(s); format != "" {
+		m["payload"] = map[string]any{"schemaFormat": format, "schema": schema}
+	}
+	return m
+}
+
+// contentType is the wire encoding of a format other than the document's
+// default, JSON.
+func contentType(s Schema) string {
+	switch s.Format {
+	case "protobuf":
+		return "application/x-protobuf"
+	case "avro":
+		return "application/avro"
+	}
+	return ""
+}
+
+// payload is the AsyncAPI schemaFormat for s and the schema to put under it, or
+// "" for what this package does not know how to label. Such a message is
+// exported without a payload rather than with one a tool would misread: a
+// format it does not know, and a Protobuf document given as several files or a
+// FileDescriptorSet, which the Protobuf schemaFormat — a single .proto source —
+// cannot carry.
+func payload(s Schema) (string, any) {
+	switch s.Format {
+	case "json_schema":
+		return jsonSchemaFormat(s), s.Document
+	case "avro":
+		return "application/vnd.apache.avro+json;version=1.9.0", s.Document
+	case "protobuf":
+		if doc, ok := s.Document.(map[string]any); ok {
+			if src, ok := doc["proto"].(string); ok && src != "" {
+				return "application/vnd.google.protobuf;version=3", src
+			}
+		}
+	}
+	return "", nil
+}
+
+// jsonSchemaFormat labels a JSON Schema with the draft it declares, draft-07
+// when it declares none.
+func jsonSchemaFormat(s Schema) string {
+	version := "draft-07"
+	if doc, ok := s.Document.(map[string]any); ok {
+		declared, _ := doc["$schema"].(string)
+		switch {
+		case strings.Contains(declared, "2020-12"):
+			version = "2020-12"
+		case strings.Contains(declared, "2019-09"):
+			version = "2019-09"
+		}
+	}
+	return "application/schema+json;version=" + version
+}
+
+// server turns a broker URL into an AsyncAPI server object.
+func server(raw string) (map[string]any, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", raw)
+	}
+	protocol := u.Scheme
+	switch u.Scheme {
+	case "nats", "tls":
+		protocol = "nats"
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	out := map[string]any{"host": u.Host, "protocol": protocol}
+	if u.Scheme == "tls" || u.Scheme == "wss" {
+		out["x-tls"] = true
+	}
+	if p := strings.TrimSuffix(u.Path, "/"); p != "" {
+		out["pathname"] = p
+	}
+	return out, nil
+}
+
+// digest hashes everything but info, so the version moves only when the
+// contracts do.
+func (d *Document) digest() (string, error) {
+	b, err := json.Marshal([]any{d.Servers, d.Channels, d.Operations, d.Components})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return "sha256-" + hex.EncodeToString(sum[:6]), nil
+}
+
+// JSON renders the document as indented JSON.
+func (d *Document) JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// YAML renders the document as YAML.
+func (d *Document) YAML() ([]byte, error) {
+	return yaml.Marshal(d)
+}
+
+func ref(path string) map[string]any { return map[string]any{"$ref": path} }
+
+func key(s string) string { return keyPattern.ReplaceAllString(s, "_") }
+
+// unique returns id, or id with a numeric suffix if it is already taken — two
+// type codes can sanitize to the same key.
+func unique(used map[string]bool, id string) string {
+	out := id
+	for n := 2; used[out]; n++ {
+		out = fmt.Sprintf("%s_%d", id, n)
+	}
+	used[out] = true
+	return out
+}
@@ -0,0 +1,154 @@
+package asyncapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func sample() Contract {
+	schema := &Schema{
+		Namespace: "telemetry", Name: "temperature", Version: "1.0.0", Format: "json_schema",
+		Document: map[string]any{"type": "object", "required": []any{"celsius"}},
+	}
+	return Contract{
+		Title:   "acme contracts",
+		Servers: []Server{{Name: "nats", URL: "tls://nats.example.com:4222"}},
+		Types: []ThingType{
+			{Key: "sensor", Name: "Sensor", Operations: []Operation{
+				{Name: "telemetry", Capability: "publish", Address: "acme.{location}.sensor.{thing}.telemetry", Schema: schema},
+				{Name: "config", Capability: "reply", Address: "acme.{location}.sensor.{thing}.config"},
+			}},
+		},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	doc, err := Build(sample())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := doc.Channels["sensor.telemetry"].(map[string]any)
+	if ch["x-nats-subject"] != "acme.*.sensor.*.telemetry" {
+		t.Errorf("x-nats-subject = %v", ch["x-nats-subject"])
+	}
+	if params := ch["parameters"].(map[string]any); len(params) != 2 {
+		t.Errorf("parameters = %v", params)
+	}
+	op := doc.Operations["sensor.telemetry"].(map[string]any)
+	if op["action"] != "send" {
+		t.Errorf("publish action = %v", op["action"])
+	}
+	msg := doc.Components.Messages["telemetry__temperature__1.0.0"].(map[string]any)
+	if msg["payload"].(map[string]any)["schemaFormat"] != "application/schema+json;version=draft-07" {
+		t.Errorf("payload = %v", msg["payload"])
+	}
+
+	reply := doc.Operations["sensor.config"].(map[string]any)
+	if reply["action"] != "receive" || reply["reply"] == nil {
+		t.Errorf("reply operation = %v", reply)
+	}
+	if _, ok := doc.Channels["sensor.config.reply"]; !ok {
+		t.Error("reply channel missing")
+	}
+	if doc.Servers["nats"].(map[string]any)["host"] != "nats.example.com:4222" {
+		t.Errorf("servers = %v", doc.Servers)
+	}
+}
+
+func TestBuildIsDeterministic(t *testing.T) {
+	a, _ := Build(sample())
+	b, _ := Build(sample())
+	ay, _ := a.YAML()
+	by, _ := b.YAML()
+	if !bytes.Equal(ay, by) {
+		t.Error("two builds of the same contract differ")
+	}
+
+	changed := sample()
+	changed.Types[0].Operations[0].Address = "acme.{location}.sensor.{thing}.temp"
+	c, _ := Build(changed)
+	if c.Info.Version == a.Info.Version {
+		t.Error("version did not change with the contract")
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	doc, _ := Build(sample())
+	y, err := doc.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(y), "asyncapi: 3.0.0\ninfo:") {
+		t.Errorf("YAML does not start with the version and info:\n%s", y)
+	}
+	j, err := doc.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back map[string]any
+	if err := json.Unmarshal(j, &back); err != nil || back["asyncapi"] != Version {
+		t.Errorf("JSON = %s (%v)", j, err)
+	}
+}
+
+func TestUnknownCapability(t *testing.T) {
+	c := sample()
+	c.Types[0].Operations[0].Capability = "stream"
+	if _, err := Build(c); err == nil {
+		t.Error("unknown capability accepted")
+	}
+}
+
+func TestBinaryFormats(t *testing.T) {
+	proto := Schema{
+		Namespace: "telemetry", Name: "reading", Version: "1.0.0", Format: "protobuf",
+		MessageType: "acme.Reading",
+		Document:    map[string]any{"proto": "syntax = \"proto3\";\npackage acme;\nmessage Reading { double celsius = 1; }\n"},
+	}
+	set := proto
+	set.Version = "1.1.0"
+	set.Document = map[string]any{"file_descriptor_set": "CgA="}
+	avro := Schema{
+		Namespace: "telemetry", Name: "sample", Version: "1.0.0", Format: "avro",
+		MessageType: "acme.Sample", Document: map[string]any{"type": "record", "name": "Sample", "namespace": "acme", "fields": []any{}},
+	}
+
+	m := message(proto)
+	if p := m["payload"].(map[string]any); p["schemaFormat"] != "application/vnd.google.protobuf;version=3" || p["schema"] != proto.Document.(map[string]any)["proto"] {
+		t.Errorf("protobuf payload = %v", p)
+	}
+	if m["contentType"] != "application/x-protobuf" || m["x-message-type"] != "acme.Reading" {
+		t.Errorf("protobuf message = %v", m)
+	}
+	if _, ok := message(set)["payload"]; ok {
+		t.Error("a descriptor set was exported as a payload")
+	}
+	if p := message(avro)["payload"].(map[string]any); p["schemaFormat"] != "application/vnd.apache.avro+json;version=1.9.0" {
+		t.Errorf("avro payload = %v", p)
+	}
+}
+
+func TestReplyChannelDoesNotTakeAnotherOperationsID(t *testing.T) {
+	reply := Operation{Name: "config", Capability: "reply", Address: "acme.config"}
+	named := Operation{Name: "config.reply", Capability: "publish", Address: "acme.config.reply"}
+	for _, ops := range [][]Operation{{reply, named}, {named, reply}} {
+		doc, err := Build(Contract{Types: []ThingType{{Key: "sensor", Name: "Sensor", Operations: ops}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(doc.Channels) != 3 {
+			t.Errorf("%s first: channels %v", ops[0].Name, doc.Channels)
+		}
+		inbox := doc.Operations["sensor.config"].(map[string]any)["reply"].(map[string]any)["channel"].(map[string]any)["$ref"]
+		published := doc.Operations["sensor.config.reply"]
+		if published == nil {
+			published = doc.Operations["sensor.config.reply_2"]
+		}
+		if ch := published.(map[string]any)["channel"].(map[string]any)["$ref"]; ch == inbox {
+			t.Errorf("%s first: reply inbox and config.reply share channel %v", ops[0].Name, ch)
+		}
+	}
+}
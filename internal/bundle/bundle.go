@@ -0,0 +1,139 @@
+// Package bundle writes a set of in-memory files as a tar.gz or zip archive —
+// the provisioning bundle handed to a field technician for one device.
+//
+// It exists so the route that assembles a bundle only decides WHAT goes in it.
+// Archive details that are easy to get subtly wrong live here once: secrets are
+// written 0600 so unpacking on a shared machine does not leave a key
+// world-readable, every entry gets the same timestamp, and entry names are
+// checked so nothing can be written outside the directory it is unpacked into.
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Formats the archive can be written in.
+const (
+	TarGz = "tar.gz"
+	Zip   = "zip"
+)
+
+// File is one entry. Secret files are written 0600, everything else 0644.
+type File struct {
+	Name   string
+	Data   []byte
+	Secret bool
+}
+
+func (f File) mode() int64 {
+	if f.Secret {
+		return 0o600
+	}
+	return 0o644
+}
+
+// ContentType returns the media type for a format, "" for an unknown one.
+func ContentType(format string) string {
+	switch format {
+	case TarGz:
+		return "application/gzip"
+	case Zip:
+		return "application/zip"
+	}
+	return ""
+}
+
+// Write writes files to w in format, under a top-level directory named root so
+// the archive unpacks into one folder rather than into the current one.
+func Write(w io.Writer, format, root string, modTime time.Time, files []File) error {
+	for _, f := range files {
+		if err := checkName(f.Name); err != nil {
+			return err
+		}
+	}
+	if err := checkName(root); err != nil {
+		return err
+	}
+
+	switch format {
+	case TarGz:
+		return writeTarGz(w, root, modTime, files)
+	case Zip:
+		return writeZip(w, root, modTime, files)
+	}
+	return fmt.Errorf("unknown archive format %q (want %s or %s)", format, TarGz, Zip)
+}
+
+// Bytes is Write into memory.
+func Bytes(format, root string, modTime time.Time, files []File) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Write(&buf, format, root, modTime, files); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkName refuses entry names that are absolute, climb out with "..", or are
+// not already in clean form. The names come from record fields — a Thing code,
+// a hostname — so this is not paranoia.
+func checkName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") ||
+		path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("invalid archive entry name %q", name)
+	}
+	return nil
+}
+
+func writeTarGz(w io.Writer, root string, modTime time.Time, files []File) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir, Name: root + "/", Mode: 0o755, ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     root + "/" + f.Name,
+			Mode:     f.mode(),
+			Size:     int64(len(f.Data)),
+			ModTime:  modTime,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, root string, modTime time.Time, files []File) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		h := &zip.FileHeader{Name: root + "/" + f.Name, Method: zip.Deflate, Modified: modTime}
+		h.SetMode(fs.FileMode(f.mode()))
+		fw, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
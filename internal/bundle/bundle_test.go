@@ -0,0 +1,90 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+)
+
+var when = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+var files = []File{
+	{Name: "manifest.json", Data: []byte(`{"a":1}`)},
+	{Name: "nebula/host.key", Data: []byte("KEY"), Secret: true},
+}
+
+func TestTarGzRoundTrip(t *testing.T) {
+	b, err := Bytes(TarGz, "pump-001", when, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	got := map[string]*tar.Header{}
+	data := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[h.Name] = h
+		body, _ := io.ReadAll(tr)
+		data[h.Name] = string(body)
+	}
+
+	if h := got["pump-001/"]; h == nil || h.Typeflag != tar.TypeDir {
+		t.Errorf("no root directory entry: %v", got)
+	}
+	if h := got["pump-001/nebula/host.key"]; h == nil || h.Mode != 0o600 || data[h.Name] != "KEY" {
+		t.Errorf("key entry = %+v", h)
+	}
+	if h := got["pump-001/manifest.json"]; h == nil || h.Mode != 0o644 || !h.ModTime.Equal(when) {
+		t.Errorf("manifest entry = %+v", h)
+	}
+}
+
+func TestZipRoundTrip(t *testing.T) {
+	b, err := Bytes(Zip, "pump-001", when, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, f := range zr.File {
+		seen[f.Name] = true
+		if f.Name == "pump-001/nebula/host.key" && f.Mode().Perm() != 0o600 {
+			t.Errorf("key mode = %v", f.Mode())
+		}
+	}
+	if !seen["pump-001/manifest.json"] || !seen["pump-001/nebula/host.key"] {
+		t.Errorf("entries = %v", seen)
+	}
+}
+
+func TestUnsafeNamesAreRefused(t *testing.T) {
+	for _, name := range []string{"", "/etc/passwd", "../x", "a/../../x", "a//b", `a\b`} {
+		if _, err := Bytes(TarGz, "root", when, []File{{Name: name}}); err == nil {
+			t.Errorf("name %q accepted", name)
+		}
+	}
+	if _, err := Bytes(TarGz, "../root", when, nil); err == nil {
+		t.Error("root ../root accepted")
+	}
+	if _, err := Bytes("rar", "root", when, nil); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,566 @@
+// Package codegen writes a Go package from an organization's message contracts:
+// a payload type per message schema version, subject constants and builders per
+// Thing Type operation, and a validator per schema. Services that talk to Things
+// used to hand-write all three, and the copies drifted from the records.
+//
+// It reads the same resolved model the AsyncAPI export does (internal/asyncapi),
+// so a subject in the generated code is byte-for-byte the channel address in
+// the document, and both are what the permission code grants.
+//
+// Output is deterministic — schemas ordered by handle, types by key, operations
+// in declared order, no timestamps — and gofmt-clean, so it can be checked in
+// and a regeneration reviewed as a diff.
+//
+// The JSON Schema to Go mapping is deliberately plain:
+//
+//   - object with properties → struct; required properties are values, optional
+//     ones pointers (or nil-able slices and maps) with omitempty
+//   - object without properties → map[string]T from additionalProperties, or
+//     map[string]any
+//   - string with an all-string enum → a named string type with a constant per
+//     value
+//   - array → slice of the items type
+//   - integer → int64, number → float64, boolean → bool, string → string
+//   - a local $ref (#/$defs/… or #/definitions/…) → the named type of its target,
+//     through a pointer where the reference is to a type that contains it
+//   - anything else — several types, oneOf and the like, a boolean schema — any
+//
+// The types are for reading and writing payloads, not for enforcing them; the
+// generated Validate functions check the schema itself, and a type that came
+// out as `any` is a reminder to call one.
+package codegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"platform/internal/asyncapi"
+)
+
+// Input is what to generate from.
+type Input struct {
+	Package string // Go package name
+	Source  string // the organization, named in the package comment
+	Schemas []asyncapi.Schema
+	Types   []asyncapi.ThingType
+}
+
+var (
+	packagePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	paramPattern   = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+	wordPattern    = regexp.MustCompile(`[A-Za-z0-9]+`)
+)
+
+// Generate returns the source of one Go file.
+func Generate(in Input) ([]byte, error) {
+	if !packagePattern.MatchString(in.Package) {
+		return nil, fmt.Errorf("package name %q is not a valid Go package name", in.Package)
+	}
+
+	g := &generator{used: map[string]bool{}, refs: map[string]string{}, open: map[string]bool{}}
+
+	schemas := append([]asyncapi.Schema(nil), in.Schemas...)
+	sort.SliceStable(schemas, func(i, j int) bool { return schemas[i].Key() < schemas[j].Key() })
+	payloads := map[string]string{} // handle -> type name
+	var skipped []string
+	for _, s := range schemas {
+		if s.Format != "json_schema" {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", s.Key(), s.Format))
+			continue
+		}
+		payloads[s.Key()] = g.schema(s)
+	}
+
+	types := append([]asyncapi.ThingType(nil), in.Types...)
+	sort.SliceStable(types, func(i, j int) bool { return types[i].Key < types[j].Key })
+	var subjects bytes.Buffer
+	for _, tt := range types {
+		g.subjects(&subjects, tt, payloads)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("// Code generated by stone-age contracts generate. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "// Package %s holds the message contracts of %s: payload types and\n", in.Package, in.Source)
+	out.WriteString("// validators per message schema version, and subjects per Thing Type operation.\n")
+	for _, s := range skipped {
+		fmt.Fprintf(&out, "//\n// Not generated: %s; only json_schema documents are.\n", s)
+	}
+	fmt.Fprintf(&out, "package %s\n\n", in.Package)
+	if len(payloads) > 0 {
+		out.WriteString(runtimeImports)
+	}
+	out.Write(subjects.Bytes())
+	out.Write(g.decls.Bytes())
+	if len(payloads) > 0 {
+		out.WriteString(runtime)
+	}
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated source does not parse: %w", err)
+	}
+	return src, nil
+}
+
+type generator struct {
+	decls bytes.Buffer
+	base  string // payload type of the schema being generated
+	about string // and its doc comment
+	used  map[string]bool
+	refs  map[string]string // "$ref" target -> type name, per schema
+	open  map[string]bool   // types being declared; a field of one is a pointer
+}
+
+// methodNames are the methods generated on payload types. A property that
+// would become a field of the same name gets a trailing underscore instead,
+// since Go refuses a field and a method with one name.
+var methodNames = map[string]bool{"Validate": true}
+
+// name reserves a Go identifier, numbering it if it is taken.
+func (g *generator) name(base string) string {
+	out := base
+	for n := 2; g.used[out]; n++ {
+		out = fmt.Sprintf("%s%d", base, n)
+	}
+	g.used[out] = true
+	return out
+}
+
+// schema declares the payload type, schema constant and validators of one
+// version and returns the payload type's name.
+func (g *generator) schema(s asyncapi.Schema) string {
+	base := g.name(pascal(s.Namespace) + pascal(s.Name) + "V" + strings.ReplaceAll(s.Version, ".", "_"))
+	g.base = base
+	g.about = description(s.Document, fmt.Sprintf("%s is a %s/%s %s payload.", base, s.Namespace, s.Name, s.Version))
+	for k := range g.refs {
+		delete(g.refs, k)
+	}
+
+	fmt.Fprintf(&g.decls, "// %sHandle identifies message schema %s/%s version %s.\n", base, s.Namespace, s.Name, s.Version)
+	fmt.Fprintf(&g.decls, "const %sHandle = %q\n\n", base, s.Key())
+
+	doc, _ := json.MarshalIndent(s.Document, "", "  ")
+	fmt.Fprintf(&g.decls, "// %sSchema is the JSON Schema document of %s.\n", base, s.Key())
+	fmt.Fprintf(&g.decls, "const %sSchema = %s\n\n", base, goString(string(doc)))
+
+	var body bytes.Buffer
+	g.open[base] = true
+	t := strings.TrimPrefix(g.goType(&body, base, s.Document, s.Document, true), "*")
+	delete(g.open, base)
+	switch t {
+	case base:
+	case "any":
+		// An alias, since methods cannot be declared on an interface type.
+		fmt.Fprintf(&g.decls, "%stype %s = any\n\n", comment(g.about), base)
+	default:
+		fmt.Fprintf(&g.decls, "%stype %s %s\n\n", comment(g.about), base, t)
+	}
+	g.decls.Write(body.Bytes())
+
+	validator := lowerFirst(base) + "Validator"
+	fmt.Fprintf(&g.decls, "var %s = &schemaValidator{document: %sSchema}\n\n", validator, base)
+	fmt.Fprintf(&g.decls, "// Validate%s checks a raw payload against %sSchema.\n", base, base)
+	fmt.Fprintf(&g.decls, "func Validate%s(payload []byte) error { return %s.validate(payload) }\n\n", base, validator)
+	if t != "any" {
+		fmt.Fprintf(&g.decls, "// Validate checks v, as it would be encoded, against %sSchema.\n", base)
+		fmt.Fprintf(&g.decls, "func (v %s) Validate() error { return %s.validateValue(v) }\n\n", base, validator)
+	}
+	return base
+}
+
+// goType returns the Go type of node, writing any named type it needs to out.
+// When top is set and node is an object or enum, the type is declared as name.
+func (g *generator) goType(out *bytes.Buffer, name string, root, node any, top bool) string {
+	m, ok := node.(map[string]any)
+	if !ok {
+		return "any"
+	}
+	if ref, ok := m["$ref"].(string); ok {
+		return g.ref(out, name, root, ref)
+	}
+
+	types := typeList(m["type"])
+	nullable := false
+	for i := 0; i < len(types); i++ {
+		if types[i] == "null" {
+			nullable = true
+			types = append(types[:i], types[i+1:]...)
+			i--
+		}
+	}
+	if len(types) != 1 {
+		return "any"
+	}
+
+	var t string
+	switch types[0] {
+	case "string":
+		t = "string"
+		if values := stringEnum(m["enum"]); len(values) > 0 {
+			t = g.enum(out, g.typeName(name, top), m, values)
+		}
+	case "integer":
+		t = "int64"
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		items, ok := m["items"]
+		if !ok {
+			return "[]any"
+		}
+		return "[]" + g.goType(out, name+"Item", root, items, false)
+	case "object":
+		props, _ := m["properties"].(map[string]any)
+		if len(props) == 0 {
+			if ap, ok := m["additionalProperties"].(map[string]any); ok {
+				return "map[string]" + g.goType(out, name+"Value", root, ap, false)
+			}
+			return "map[string]any"
+		}
+		t = g.object(out, g.typeName(name, top), root, m, props)
+	default:
+		return "any"
+	}
+	if nullable {
+		return "*" + t
+	}
+	return t
+}
+
+// typeName is name itself at the top level, where the caller already reserved
+// it, and a fresh reservation below.
+func (g *generator) typeName(name string, top bool) string {
+	if top {
+		return name
+	}
+	return g.name(name)
+}
+
+func (g *generator) object(out *bytes.Buffer, name string, root any, m, props map[string]any) string {
+	required := map[string]bool{}
+	if list, ok := m["required"].([]any); ok {
+		for _, r := range list {
+			if s, ok := r.(string); ok {
+				required[s] = true
+			}
+		}
+	}
+
+	var nested bytes.Buffer
+	var fields bytes.Buffer
+	fieldNames := map[string]bool{}
+	for _, prop := range sortedKeys(props) {
+		field := pascal(prop)
+		if methodNames[field] {
+			field += "_"
+		}
+		for n := 2; fieldNames[field]; n++ {
+			field = fmt.Sprintf("%s%d", pascal(prop), n)
+		}
+		fieldNames[field] = true
+
+		t := g.goType(&nested, name+pascal(prop), root, props[prop], false)
+		tag := prop
+		if g.open[t] {
+			// A type holding itself by value has no size.
+			t = "*" + t
+		}
+		if !required[prop] {
+			tag += ",omitempty"
+			if !strings.HasPrefix(t, "*") && !strings.HasPrefix(t, "[]") && !strings.HasPrefix(t, "map[") && t != "any" {
+				t = "*" + t
+			}
+		}
+		if d := description(props[prop], ""); d != "" {
+			fields.WriteString(comment(d))
+		}
+		fmt.Fprintf(&fields, "\t%s %s `json:%q`\n", field, t, tag)
+	}
+
+	about := description(m, name+" is an object of the schema.")
+	if name == g.base {
+		about = g.about
+	}
+	fmt.Fprintf(out, "%stype %s struct {\n%s}\n\n", comment(about), name, fields.String())
+	out.Write(nested.Bytes())
+	return name
+}
+
+func (g *generator) enum(out *bytes.Buffer, name string, m map[string]any, values []string) string {
+	fmt.Fprintf(out, "%stype %s string\n\n", comment(description(m, name+" is one of the values the schema allows.")), name)
+	fmt.Fprintf(out, "// The values of %s.\nconst (\n", name)
+	for _, v := range values {
+		fmt.Fprintf(out, "\t%s %s = %q\n", g.name(name+pascal(v)), name, v)
+	}
+	out.WriteString(")\n\n")
+	return name
+}
+
+// ref resolves a local $ref to the type of its target, declaring it once per
+// schema. A reference that cannot be followed is any.
+func (g *generator) ref(out *bytes.Buffer, name string, root any, ref string) string {
+	if ref == "#" {
+		return g.base // recursive reference to the root type
+	}
+	if t, ok := g.refs[ref]; ok {
+		return t
+	}
+	var section string
+	switch {
+	case strings.HasPrefix(ref, "#/$defs/"):
+		section = "$defs"
+	case strings.HasPrefix(ref, "#/definitions/"):
+		section = "definitions"
+	default:
+		return "any"
+	}
+	defName := strings.TrimPrefix(strings.TrimPrefix(ref, "#/$defs/"), "#/definitions/")
+	rm, _ := root.(map[string]any)
+	defs, _ := rm[section].(map[string]any)
+	target, ok := defs[defName]
+	if !ok {
+		return "any"
+	}
+
+	typeName := g.name(g.base + pascal(defName))
+	g.refs[ref] = typeName // set first, so a recursive definition refers back to it
+	var body bytes.Buffer
+	g.open[typeName] = true
+	t := strings.TrimPrefix(g.goType(&body, typeName, root, target, true), "*")
+	delete(g.open, typeName)
+	if t != typeName {
+		fmt.Fprintf(out, "// %s is the %s definition of the schema.\ntype %s %s\n\n", typeName, defName, typeName, t)
+	}
+	out.Write(body.Bytes())
+	return typeName
+}
+
+// subjects writes the constants and builders of one Thing Type's operations.
+func (g *generator) subjects(out *bytes.Buffer, tt asyncapi.ThingType, payloads map[string]string) {
+	if len(tt.Operations) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "// Subjects of Thing Type %s (%s).\nconst (\n", tt.Name, tt.Key)
+	var builders bytes.Buffer
+	for _, op := range tt.Operations {
+		base := g.name(pascal(tt.Key) + pascal(op.Name))
+		params := uniqueParams(op.Address)
+
+		doc := fmt.Sprintf("%sSubject is the %s subject of operation %s.", base, op.Capability, op.Name)
+		if op.Description != "" {
+			doc += "\n" + op.Description
+		}
+		if op.Schema != nil {
+			if p, ok := payloads[op.Schema.Key()]; ok {
+				doc += fmt.Sprintf("\nPayload: %s.", p)
+			}
+		}
+		if len(params) > 0 {
+			doc += fmt.Sprintf("\nUse %sSubjectFor for one Thing.", base)
+		}
+		out.WriteString(indent(comment(doc)))
+		fmt.Fprintf(out, "\t%sSubject = %q\n", base, op.Address)
+		fmt.Fprintf(out, "\t// %sPattern matches %sSubject for every Thing.\n", base, base)
+		fmt.Fprintf(out, "\t%sPattern = %q\n", base, paramPattern.ReplaceAllString(op.Address, "*"))
+
+		if len(params) == 0 {
+			continue
+		}
+		args := make([]string, len(params))
+		for i, p := range params {
+			args[i] = lowerFirst(pascal(p))
+		}
+		fmt.Fprintf(&builders, "// %sSubjectFor returns %sSubject with its variables filled in.\n", base, base)
+		fmt.Fprintf(&builders, "func %sSubjectFor(%s string) string {\n\treturn %s\n}\n\n",
+			base, strings.Join(args, ", "), concat(op.Address))
+	}
+	out.WriteString(")\n\n")
+	out.Write(builders.Bytes())
+}
+
+// concat renders an address as a Go string expression, each {var} an argument.
+func concat(address string) string {
+	var parts []string
+	last := 0
+	for _, loc := range paramPattern.FindAllStringSubmatchIndex(address, -1) {
+		if loc[0] > last {
+			parts = append(parts, strconv.Quote(address[last:loc[0]]))
+		}
+		parts = append(parts, lowerFirst(pascal(address[loc[2]:loc[3]])))
+		last = loc[1]
+	}
+	if last < len(address) {
+		parts = append(parts, strconv.Quote(address[last:]))
+	}
+	return strings.Join(parts, " + ")
+}
+
+func uniqueParams(address string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, m := range paramPattern.FindAllStringSubmatch(address, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			out = append(out, m[1])
+		}
+	}
+	return out
+}
+
+// pascal turns a code, name or value into an exported Go identifier fragment.
+func pascal(s string) string {
+	var b strings.Builder
+	for _, w := range wordPattern.FindAllString(s, -1) {
+		b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+	}
+	out := b.String()
+	if out == "" || (out[0] >= '0' && out[0] <= '9') {
+		out = "X" + out
+	}
+	return out
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func typeList(v any) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		var out []string
+		for _, x := range t {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func stringEnum(v any) []string {
+	list, ok := v.([]any)
+	if !ok {
+		return nil
+	}
+	out := make([]string, 0, len(list))
+	for _, x := range list {
+		s, ok := x.(string)
+		if !ok {
+			return nil
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func description(node any, fallback string) string {
+	if m, ok := node.(map[string]any); ok {
+		if d, ok := m["description"].(string); ok && strings.TrimSpace(d) != "" {
+			return strings.TrimSpace(d)
+		}
+	}
+	return fallback
+}
+
+func comment(text string) string {
+	if text == "" {
+		return ""
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString("// " + strings.TrimRight(line, " \t") + "\n")
+	}
+	return b.String()
+}
+
+func indent(s string) string {
+	if s == "" {
+		return s
+	}
+	return "\t" + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n\t") + "\n"
+}
+
+// goString is a raw string literal when the text allows one, which keeps an
+// embedded schema readable, and a quoted one otherwise.
+func goString(s string) string {
+	if strings.Contains(s, "`") || strings.Contains(s, "\r") {
+		return strconv.Quote(s)
+	}
+	return "`" + s + "`"
+}
+
+func sortedKeys(m map[string]any) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+const runtimeImports = `import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+`
+
+const runtime = `// schemaValidator compiles a schema document on first use.
+type schemaValidator struct {
+	document string
+	once     sync.Once
+	schema   *jsonschema.Schema
+	err      error
+}
+
+func (v *schemaValidator) validate(payload []byte) error {
+	v.once.Do(func() {
+		doc, err := jsonschema.UnmarshalJSON(strings.NewReader(v.document))
+		if err != nil {
+			v.err = err
+			return
+		}
+		c := jsonschema.NewCompiler()
+		if err := c.AddResource("urn:contract", doc); err != nil {
+			v.err = err
+			return
+		}
+		v.schema, v.err = c.Compile("urn:contract")
+	})
+	if v.err != nil {
+		return fmt.Errorf("schema does not compile: %w", v.err)
+	}
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("payload is not valid JSON: %w", err)
+	}
+	return v.schema.Validate(inst)
+}
+
+func (v *schemaValidator) validateValue(value any) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return v.validate(payload)
+}
+`
@@ -0,0 +1,158 @@
+package codegen
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"platform/internal/asyncapi"
+)
+
+func sample() Input {
+	temperature := asyncapi.Schema{
+		Namespace: "telemetry", Name: "temperature", Version: "1.2.0", Format: "json_schema",
+		Document: map[string]any{
+			"type":     "object",
+			"required": []any{"celsius"},
+			"properties": map[string]any{
+				"celsius": map[string]any{"type": "number", "description": "Reading in degrees Celsius."},
+				"unit":    map[string]any{"type": "string", "enum": []any{"C", "F"}},
+				"tags":    map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+				"probe":   map[string]any{"$ref": "#/$defs/probe"},
+			},
+			"$defs": map[string]any{
+				"probe": map[string]any{"type": "object", "properties": map[string]any{"id": map[string]any{"type": "integer"}}},
+			},
+		},
+	}
+	return Input{
+		Package: "contracts",
+		Source:  "acme",
+		Schemas: []asyncapi.Schema{temperature, {Namespace: "raw", Name: "blob", Version: "1.0.0", Format: "avro"}},
+		Types: []asyncapi.ThingType{{Key: "sensor", Name: "Sensor", Operations: []asyncapi.Operation{
+			{Name: "telemetry", Capability: "publish", Address: "acme.{location}.sensor.{thing}.telemetry", Schema: &temperature},
+			{Name: "status", Capability: "publish", Address: "acme.sensors.status"},
+		}}},
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	src, err := Generate(sample())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(strings.Fields(string(src)), " ")
+	for _, want := range []string{
+		"// Code generated by stone-age contracts generate. DO NOT EDIT.",
+		"// TelemetryTemperatureV1_2_0 is a telemetry/temperature 1.2.0 payload.",
+		"package contracts",
+		"type TelemetryTemperatureV1_2_0 struct {",
+		"Celsius float64 `json:\"celsius\"`",
+		"Unit *TelemetryTemperatureV1_2_0Unit `json:\"unit,omitempty\"`",
+		"Tags []string `json:\"tags,omitempty\"`",
+		"Probe *TelemetryTemperatureV1_2_0Probe `json:\"probe,omitempty\"`",
+		"TelemetryTemperatureV1_2_0UnitC TelemetryTemperatureV1_2_0Unit = \"C\"",
+		"func ValidateTelemetryTemperatureV1_2_0(payload []byte) error",
+		"SensorTelemetrySubject = \"acme.{location}.sensor.{thing}.telemetry\"",
+		"SensorTelemetryPattern = \"acme.*.sensor.*.telemetry\"",
+		"func SensorTelemetrySubjectFor(location, thing string) string {",
+		"return \"acme.\" + location + \".sensor.\" + thing + \".telemetry\"",
+		"Not generated: raw__blob__1.0.0 (avro)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated source lacks %q", want)
+		}
+	}
+	if strings.Contains(got, "SensorStatusSubjectFor") {
+		t.Error("a builder was generated for a subject without variables")
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	a, _ := Generate(sample())
+	in := sample()
+	in.Schemas[0], in.Schemas[1] = in.Schemas[1], in.Schemas[0]
+	b, _ := Generate(in)
+	if !bytes.Equal(a, b) {
+		t.Error("input order changed the output")
+	}
+}
+
+func TestGenerateRejectsBadPackage(t *testing.T) {
+	in := sample()
+	in.Package = "My-Contracts"
+	if _, err := Generate(in); err == nil {
+		t.Error("invalid package name accepted")
+	}
+}
+
+// typeCheck fails t unless src compiles. Matching strings cannot tell.
+func typeCheck(t *testing.T, src []byte) {
+	t.Helper()
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "contracts.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("contracts", fset, []*ast.File{file}, nil); err != nil {
+		t.Errorf("generated source does not type-check: %v\n%s", err, src)
+	}
+}
+
+func TestGeneratedSourceCompiles(t *testing.T) {
+	src, err := Generate(sample())
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeCheck(t, src)
+}
+
+func TestGenerateAvoidsMethodNamesAndInfiniteTypes(t *testing.T) {
+	in := sample()
+	in.Schemas = []asyncapi.Schema{{
+		Namespace: "config", Name: "tree", Version: "1.0.0", Format: "json_schema",
+		Document: map[string]any{
+			"type":     "object",
+			"required": []any{"validate", "parent", "root"},
+			"properties": map[string]any{
+				"validate": map[string]any{"type": "boolean"},
+				"Validate": map[string]any{"type": "string"},
+				"parent":   map[string]any{"$ref": "#"},
+				"root":     map[string]any{"$ref": "#/$defs/node"},
+			},
+			"$defs": map[string]any{
+				"node": map[string]any{
+					"type":     "object",
+					"required": []any{"next", "validate"},
+					"properties": map[string]any{
+						"next":     map[string]any{"$ref": "#/$defs/node"},
+						"validate": map[string]any{"type": "string"},
+					},
+				},
+			},
+		},
+	}}
+	in.Types = nil
+	src, err := Generate(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeCheck(t, src)
+	got := strings.Join(strings.Fields(string(src)), " ")
+	for _, want := range []string{
+		"Validate_ *string `json:\"Validate,omitempty\"`",
+		"Validate2 bool `json:\"validate\"`",
+		"Parent *ConfigTreeV1_0_0 `json:\"parent\"`",
+		"Next *ConfigTreeV1_0_0Node `json:\"next\"`",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated source lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+// Package contractcheck watches live NATS traffic against the message contracts
+// declared in the platform — a Thing Type's operations and the message_schemas
+// they reference — and reports what does not conform.
+//
+// Save-time validation covers what the platform writes. The payloads devices
+// publish never pass through it, so a firmware build that renames a field is
+// found when a dashboard goes blank, by whoever owns the dashboard. This package
+// subscribes to each contracted subject in each organization's account,
+// validates every message on it against the operation's schema, and publishes:
+//
+//	<violations>.<type code>.<operation>   one event per non-conforming message
+//	<stats>                                per-subject pass/fail counts, periodically
+//
+// into the same account, where the organization's own tooling can consume them.
+//
+// It is observational. Nothing is blocked, rejected or acknowledged; a message
+// that fails its schema is delivered exactly as it would have been. Payload
+// contents are not copied into violation events — the validation errors, the
+// size and the subject are — because the event stream is readable by more of the
+// organization than the device's data may be.
+//
+// The package knows nothing about PocketBase or credentials. A Loader says what
+// to watch and a Connector opens a connection into an account; the platform
+// supplies both (hooks/contract_validator.go).
+package contractcheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"platform/internal/jsonvalidate"
+)
+
+// SchemaRef names the message_schemas record a rule validates against.
+type SchemaRef struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+// Validator checks one message payload against a schema. A compiled JSON
+// Schema (*jsonvalidate.Schema) is one, and so is a Protobuf or Avro codec
+// (internal/msgformat), which reports a payload it cannot decode.
+type Validator interface {
+	Validate(payload []byte) []jsonvalidate.Violation
+}
+
+// Rule is one operation of one Thing Type as something to watch: the subject
+// pattern every Thing of the type uses for it, and the schema its messages must
+// match.
+type Rule struct {
+	Subject    string    `json:"subject"` // a NATS pattern: {thing} and {location} are "*"
+	ThingType  string    `json:"thing_type"`
+	Operation  string    `json:"operation"`
+	Capability string    `json:"capability"`
+	Schema     SchemaRef `json:"schema"`
+	Validator  Validator `json:"-"`
+	// SchemaDigest identifies what Validator was compiled from — the schema
+	// document, its format and message type — since a schema record can be
+	// edited without its version changing.
+	SchemaDigest string `json:"-"`
+}
+
+// Account is one organization's account and the rules to watch in it.
+type Account struct {
+	Org       string
+	OrgName   string
+	PublicKey string
+	Rules     []Rule
+}
+
+// fingerprint identifies an account's rule set, so a reload that changes
+// nothing keeps the subscriptions it has — and one that changes a schema in
+// place replaces the validators compiled from it.
+func (a Account) fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", a.PublicKey, a.OrgName)
+	for _, r := range a.Rules {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\n",
+			r.Subject, r.ThingType, r.Operation, r.Capability, r.Schema.ID, r.Schema.Version, r.SchemaDigest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Violation is the event published for a message that failed its schema.
+type Violation struct {
+	Org        string                   `json:"org"`
+	Subject    string                   `json:"subject"`
+	Pattern    string                   `json:"pattern"`
+	ThingType  string                   `json:"thing_type"`
+	Operation  string                   `json:"operation"`
+	Capability string                   `json:"capability"`
+	Schema     SchemaRef                `json:"schema"`
+	Errors     []jsonvalidate.Violation `json:"errors"`
+	Size       int                      `json:"size"`
+	ReceivedAt string                   `json:"received_at"`
+}
+
+// Check validates one message against its rule and returns the violation event
+// for it, or nil when it conforms.
+func Check(org string, rule *Rule, subject string, payload []byte, at time.Time) *Violation {
+	errs := rule.Validator.Validate(payload)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &Violation{
+		Org:        org,
+		Subject:    subject,
+		Pattern:    rule.Subject,
+		ThingType:  rule.ThingType,
+		Operation:  rule.Operation,
+		Capability: rule.Capability,
+		Schema:     rule.Schema,
+		Errors:     errs,
+		Size:       len(payload),
+		ReceivedAt: at.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+var unsafeToken = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Token makes s usable as one subject token: anything but letters, digits, "_"
+// and "-" becomes "_", so an operation named "set point" or "v1.2" cannot add
+// or break tokens in the subject it is reported on.
+func Token(s string) string {
+	t := unsafeToken.ReplaceAllString(s, "_")
+	if t == "" {
+		return "_"
+	}
+	return t
+}
+
+// Counts is one subject's tally.
+type Counts struct {
+	Pass uint64 `json:"pass"`
+	Fail uint64 `json:"fail"`
+}
+
+// Counters tallies pass/fail per concrete subject. Subjects carry the Thing's
+// code, so their number grows with the fleet; past max distinct subjects, new
+// ones are counted under their rule's pattern instead, which keeps the total but
+// loses which device it was.
+type Counters struct {
+	mu    sync.Mutex
+	max   int
+	since time.Time
+	by    map[string]*Counts
+}
+
+// NewCounters returns empty counters that track at most max subjects.
+func NewCounters(max int, since time.Time) *Counters {
+	return &Counters{max: max, since: since, by: map[string]*Counts{}}
+}
+
+// Add counts one message on subject, matched by pattern.
+func (c *Counters) Add(subject, pattern string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.by[subject]
+	if n == nil {
+		if len(c.by) >= c.max {
+			subject = pattern
+			n = c.by[subject]
+		}
+		if n == nil {
+			n = &Counts{}
+			c.by[subject] = n
+		}
+	}
+	if ok {
+		n.Pass++
+	} else {
+		n.Fail++
+	}
+}
+
+// Snapshot copies the current tallies.
+func (c *Counters) Snapshot() map[string]Counts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]Counts, len(c.by))
+	for k, v := range c.by {
+		out[k] = *v
+	}
+	return out
+}
+
+// Stats is the periodic counters event. Counts are cumulative since Since, which
+// is when the account's current rule set started being watched.
+type Stats struct {
+	Org      string            `json:"org"`
+	Since    string            `json:"since"`
+	At       string            `json:"at"`
+	Subjects map[string]Counts `json:"subjects"`
+}
+
+// Config tunes a Service. Zero values take the defaults below.
+type Config struct {
+	ViolationPrefix string        // default "contracts.violations"
+	StatsSubject    string        // default "contracts.stats"
+	StatsInterval   time.Duration // default 1m
+	ReloadInterval  time.Duration // default 5m; Reload() also triggers one
+	MaxSubjects     int           // per account; default 10000
+}
+
+func (c Config) withDefaults() Config {
+	if c.ViolationPrefix == "" {
+		c.ViolationPrefix = "contracts.violations"
+	}
+	if c.StatsSubject == "" {
+		c.StatsSubject = "contracts.stats"
+	}
+	if c.StatsInterval <= 0 {
+		c.StatsInterval = time.Minute
+	}
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = 5 * time.Minute
+	}
+	if c.MaxSubjects <= 0 {
+		c.MaxSubjects = 10000
+	}
+	return c
+}
+
+// Loader returns every account to watch, with compiled rules.
+type Loader func(ctx context.Context) ([]Account, error)
+
+// Connector opens a connection into acct that may subscribe to its rules'
+// subjects and publish under the violation prefix and stats subject.
+type Connector func(ctx context.Context, acct Account, cfg Config) (*nats.Conn, error)
+
+// Service keeps one connection per account, subscribed to that account's rules.
+type Service struct {
+	cfg     Config
+	load    Loader
+	connect Connector
+	reload  chan struct{}
+
+	mu       sync.Mutex
+	watchers map[string]*watcher // by org
+}
+
+// New returns a Service; Run starts it.
+func New(cfg Config, load Loader, connect Connector) *Service {
+	return &Service{
+		cfg:      cfg.withDefaults(),
+		load:     load,
+		connect:  connect,
+		reload:   make(chan struct{}, 1),
+		watchers: map[string]*watcher{},
+	}
+}
+
+// Reload asks the service to re-read its rules soon. It never blocks, and
+// several calls before the reload runs collapse into one.
+func (s *Service) Reload() {
+	select {
+	case s.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches until ctx is done, then closes every connection. Load and connect
+// failures are logged and retried on the next reload; they do not stop it.
+func (s *Service) Run(ctx context.Context) error {
+	s.apply(ctx)
+
+	reload := time.NewTicker(s.cfg.ReloadInterval)
+	defer reload.Stop()
+	stats := time.NewTicker(s.cfg.StatsInterval)
+	defer stats.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.closeAll()
+			return nil
+		case <-s.reload:
+			s.apply(ctx)
+		case <-reload.C:
+			s.apply(ctx)
+		case <-stats.C:
+			s.publishStats()
+		}
+	}
+}
+
+// Watching returns the organizations currently watched and their rule counts.
+func (s *Service) Watching() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int, len(s.watchers))
+	for org, w := range s.watchers {
+		out[org] = len(w.acct.Rules)
+	}
+	return out
+}
+
+func (s *Service) apply(ctx context.Context) {
+	accounts, err := s.load(ctx)
+	if err != nil {
+		log.Printf("⚠️ contract validator: loading contracts failed (keeping current subscriptions): %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, acct := range accounts {
+		if len(acct.Rules) == 0 {
+			continue
+		}
+		seen[acct.Org] = true
+		fp := acct.fingerprint()
+		if w := s.watchers[acct.Org]; w != nil {
+			if w.fingerprint == fp {
+				continue
+			}
+			w.close(s.cfg.StatsSubject)
+			delete(s.watchers, acct.Org)
+		}
+		w, err := s.start(ctx, acct, fp)
+		if err != nil {
+			log.Printf("⚠️ contract validator: org %s: %v", acct.OrgName, err)
+			continue
+		}
+		s.watchers[acct.Org] = w
+		log.Printf("✅ contract validator: watching %d subject(s) in org %s", len(acct.Rules), acct.OrgName)
+	}
+	for org, w := range s.watchers {
+		if !seen[org] {
+			w.close(s.cfg.StatsSubject)
+			delete(s.watchers, org)
+		}
+	}
+}
+
+func (s *Service) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for org, w := range s.watchers {
+		w.close(s.cfg.StatsSubject)
+		delete(s.watchers, org)
+	}
+}
+
+func (s *Service) publishStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.watchers {
+		w.publishStats(s.cfg.StatsSubject)
+	}
+}
+
+// watcher is one account's connection and subscriptions.
+type watcher struct {
+	acct        Account
+	fingerprint string
+	nc          *nats.Conn
+	counters    *Counters
+}
+
+func (s *Service) start(ctx context.Context, acct Account, fp string) (*watcher, error) {
+	nc, err := s.connect(ctx, acct, s.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	w := &watcher{acct: acct, fingerprint: fp, nc: nc, counters: NewCounters(s.cfg.MaxSubjects, time.Now())}
+
+	// Our own events are never validated, even when a rule's pattern is wide
+	// enough to match them; one violation would otherwise beget another.
+	own := func(subject string) bool {
+		return subject == s.cfg.StatsSubject || strings.HasPrefix(subject, s.cfg.ViolationPrefix+".")
+	}
+
+	for i := range acct.Rules {
+		rule := &acct.Rules[i]
+		violationSubject := s.cfg.ViolationPrefix + "." + Token(rule.ThingType) + "." + Token(rule.Operation)
+		_, err := nc.Subscribe(rule.Subject, func(msg *nats.Msg) {
+			if own(msg.Subject) {
+				return
+			}
+			v := Check(acct.OrgName, rule, msg.Subject, msg.Data, time.Now())
+			w.counters.Add(msg.Subject, rule.Subject, v == nil)
+			if v == nil {
+				return
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return
+			}
+			if err := nc.Publish(violationSubject, data); err != nil {
+				log.Printf("⚠️ contract validator: publish violation for %s: %v", msg.Subject, err)
+			}
+		})
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("subscribe %q: %w", rule.Subject, err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("subscribe: %w", err)
+	}
+	if err := nc.LastError(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *watcher) publishStats(subject string) {
+	data, err := json.Marshal(Stats{
+		Org:      w.acct.OrgName,
+		Since:    w.counters.since.UTC().Format(time.RFC3339),
+		At:       time.Now().UTC().Format(time.RFC3339),
+		Subjects: w.counters.Snapshot(),
+	})
+	if err != nil {
+		return
+	}
+	if err := w.nc.Publish(subject, data); err != nil {
+		log.Printf("⚠️ contract validator: publish stats for org %s: %v", w.acct.OrgName, err)
+	}
+}
+
+// close publishes a last tally, so counts since the previous one are not lost
+// when a rule change or shutdown replaces the watcher.
+func (w *watcher) close(statsSubject string) {
+	w.publishStats(statsSubject)
+	_ = w.nc.Flush()
+	w.nc.Close()
+}
+
+// SortRules orders rules by subject, then type and operation, so a Loader's
+// output — and with it the fingerprint — does not depend on query order.
+func SortRules(rules []Rule) {
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		if a.ThingType != b.ThingType {
+			return a.ThingType < b.ThingType
+		}
+		return a.Operation < b.Operation
+	})
+}
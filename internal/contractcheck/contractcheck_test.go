@@ -0,0 +1,205 @@
+package contractcheck
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"platform/internal/jsonvalidate"
+)
+
+func mustSchema(t *testing.T, raw string) *jsonvalidate.Schema {
+	t.Helper()
+	s, err := jsonvalidate.Compile([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+const tempSchema = `{"type":"object","required":["celsius"],"properties":{"celsius":{"type":"number"}}}`
+
+func TestCheck(t *testing.T) {
+	rule := &Rule{Subject: "site.*.sensor.telemetry", ThingType: "sensor", Operation: "telemetry",
+		Capability: "publish", Schema: SchemaRef{ID: "s1", Name: "temp", Version: "1.0.0"},
+		Validator: mustSchema(t, tempSchema)}
+
+	if v := Check("acme", rule, "site.a.sensor.telemetry", []byte(`{"celsius":21.5}`), time.Now()); v != nil {
+		t.Fatalf("conforming message reported: %+v", v)
+	}
+	v := Check("acme", rule, "site.a.sensor.telemetry", []byte(`{"fahrenheit":70}`), time.Now())
+	if v == nil {
+		t.Fatal("non-conforming message passed")
+	}
+	if v.Pattern != rule.Subject || v.Schema.ID != "s1" || v.Size != len(`{"fahrenheit":70}`) || len(v.Errors) == 0 {
+		t.Errorf("violation = %+v", v)
+	}
+}
+
+func TestToken(t *testing.T) {
+	for in, want := range map[string]string{
+		"telemetry": "telemetry",
+		"set point": "set_point",
+		"v1.2":      "v1_2",
+		"a.*.>":     "a_",
+		"":          "_",
+	} {
+		if got := Token(in); got != want {
+			t.Errorf("Token(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCountersFoldPastTheLimitIntoThePattern(t *testing.T) {
+	c := NewCounters(2, time.Now())
+	c.Add("a.1", "a.*", true)
+	c.Add("a.2", "a.*", false)
+	c.Add("a.3", "a.*", true) // over the limit: counted under the pattern
+	c.Add("a.1", "a.*", true) // already tracked: still counted on its own
+
+	got := c.Snapshot()
+	if got["a.1"] != (Counts{Pass: 2}) || got["a.2"] != (Counts{Fail: 1}) || got["a.*"] != (Counts{Pass: 1}) {
+		t.Errorf("snapshot = %+v", got)
+	}
+}
+
+// inProcessServer runs a NATS server with no listener, so the test binds no port.
+func inProcessServer(t *testing.T) *natsserver.Server {
+	t.Helper()
+	srv, err := natsserver.NewServer(&natsserver.Options{DontListen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestServicePublishesViolationsAndStats(t *testing.T) {
+	srv := inProcessServer(t)
+	connect := func(ctx context.Context, acct Account, cfg Config) (*nats.Conn, error) {
+		return nats.Connect("", nats.InProcessServer(srv))
+	}
+	load := func(ctx context.Context) ([]Account, error) {
+		return []Account{{Org: "o1", OrgName: "acme", Rules: []Rule{{
+			Subject: "acme.*.sensor.*.telemetry", ThingType: "sensor", Operation: "telemetry",
+			Capability: "publish", Validator: mustSchema(t, tempSchema),
+		}}}}, nil
+	}
+
+	client, err := nats.Connect("", nats.InProcessServer(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	violations, _ := client.SubscribeSync("contracts.violations.>")
+	stats, _ := client.SubscribeSync("contracts.stats")
+	_ = client.Flush()
+
+	svc := New(Config{StatsInterval: 50 * time.Millisecond}, load, connect)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { _ = svc.Run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.Watching()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if svc.Watching()["o1"] != 1 {
+		t.Fatalf("watching = %v", svc.Watching())
+	}
+
+	_ = client.Publish("acme.hq.sensor.t1.telemetry", []byte(`{"celsius":20}`))
+	_ = client.Publish("acme.hq.sensor.t2.telemetry", []byte(`{"celsius":"warm"}`))
+	_ = client.Flush()
+
+	msg, err := violations.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("no violation event: %v", err)
+	}
+	if msg.Subject != "contracts.violations.sensor.telemetry" {
+		t.Errorf("violation subject = %s", msg.Subject)
+	}
+	var v Violation
+	if err := json.Unmarshal(msg.Data, &v); err != nil || v.Subject != "acme.hq.sensor.t2.telemetry" || v.Org != "acme" {
+		t.Errorf("violation = %+v (%v)", v, err)
+	}
+	if _, err := violations.NextMsg(200 * time.Millisecond); err == nil {
+		t.Error("a conforming message was reported")
+	}
+
+	for time.Now().Before(deadline) {
+		msg, err := stats.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("no stats event: %v", err)
+		}
+		var s Stats
+		if err := json.Unmarshal(msg.Data, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Subjects["acme.hq.sensor.t1.telemetry"].Pass == 1 && s.Subjects["acme.hq.sensor.t2.telemetry"].Fail == 1 {
+			return
+		}
+	}
+	t.Fatal("stats never showed both messages")
+}
+
+func TestServiceIgnoresItsOwnEvents(t *testing.T) {
+	srv := inProcessServer(t)
+	connect := func(ctx context.Context, acct Account, cfg Config) (*nats.Conn, error) {
+		return nats.Connect("", nats.InProcessServer(srv))
+	}
+	// A rule wide enough to match the violation subjects themselves.
+	load := func(ctx context.Context) ([]Account, error) {
+		return []Account{{Org: "o1", OrgName: "acme", Rules: []Rule{{
+			Subject: ">", ThingType: "any", Operation: "all", Validator: mustSchema(t, tempSchema),
+		}}}}, nil
+	}
+
+	client, _ := nats.Connect("", nats.InProcessServer(srv))
+	defer client.Close()
+	violations, _ := client.SubscribeSync("contracts.violations.>")
+	_ = client.Flush()
+
+	svc := New(Config{StatsInterval: time.Hour}, load, connect)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { _ = svc.Run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.Watching()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = client.Publish("x.y", []byte(`{}`))
+	_ = client.Flush()
+	if _, err := violations.NextMsg(5 * time.Second); err != nil {
+		t.Fatalf("no violation event: %v", err)
+	}
+	if _, err := violations.NextMsg(300 * time.Millisecond); err == nil {
+		t.Error("the service validated its own violation event")
+	}
+}
+
+func TestFingerprintChangesWithTheSchemaDocument(t *testing.T) {
+	rule := Rule{Subject: "acme.*.telemetry", ThingType: "sensor", Operation: "telemetry", Capability: "publish",
+		Schema: SchemaRef{ID: "s1", Version: "1.0.0"}, SchemaDigest: "a"}
+	a := Account{Org: "o1", OrgName: "acme", Rules: []Rule{rule}}
+	b := Account{Org: "o1", OrgName: "acme", Rules: []Rule{rule}}
+	if a.fingerprint() != b.fingerprint() {
+		t.Fatal("equal accounts fingerprint differently")
+	}
+	b.Rules[0].SchemaDigest = "b"
+	if a.fingerprint() == b.fingerprint() {
+		t.Error("a schema edited under the same version kept the fingerprint")
+	}
+}
@@ -0,0 +1,226 @@
+// Package enrollment holds the cryptography behind zero-touch device enrollment:
+// one-time claim tokens, and signing credentials for public keys a device
+// generated itself.
+//
+// The usual provisioning path has the server generate the key pair and hand the
+// device a secret — the NATS seed inside a creds file, the Nebula host key — so
+// the secret exists on the server, in the database, and in whatever carried it
+// to the device. Enrollment inverts that: the device keeps its private keys and
+// sends only public ones, and the server's part is to vouch for them by signing.
+// Nothing in this package ever sees a device private key.
+//
+// The package knows nothing about records or collections. It signs what it is
+// given with the keys it is given; deciding what a device is entitled to is the
+// caller's job.
+package enrollment
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/slackhq/nebula/cert"
+)
+
+// TokenPrefix marks a claim token, so one pasted into the wrong place is
+// recognisable for what it is.
+const TokenPrefix = "claim_"
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewClaimToken returns a fresh claim token and the hash to store for it. The
+// token carries 256 bits of randomness, so it cannot be guessed, and only its
+// hash is kept, so a database read does not yield a usable token.
+func NewClaimToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = TokenPrefix + strings.ToLower(tokenEncoding.EncodeToString(b))
+	return token, HashClaimToken(token), nil
+}
+
+// HashClaimToken returns the stored form of a token. A plain digest is enough:
+// the input is 256 random bits, so there is nothing for a slow hash to protect.
+func HashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateUserKey checks that key is an nkey user public key ("U…"). A seed, an
+// account key or anything else is refused, so a device that sends its seed by
+// mistake is told so rather than enrolled with it.
+func ValidateUserKey(key string) error {
+	if strings.HasPrefix(key, "S") {
+		return errors.New("that is a seed, not a public key; send the public key and keep the seed on the device")
+	}
+	if !nkeys.IsValidPublicUserKey(key) {
+		return errors.New("not an nkey user public key (expected a key starting with U)")
+	}
+	return nil
+}
+
+// UserSpec is what a device's user JWT grants.
+type UserSpec struct {
+	PublicKey string
+	Name      string
+
+	PubAllow, PubDeny []string
+	SubAllow, SubDeny []string
+
+	// Limits; -1 is unlimited, as in the role records they come from.
+	Subs, Data, Payload int64
+
+	BearerToken bool
+	Expires     time.Time // zero: does not expire
+
+	// AllowResponses lets the user publish one reply to each request it
+	// receives, whatever the reply subject — what a service answering on the
+	// requester's inbox needs without a publish grant on every inbox.
+	AllowResponses bool
+}
+
+// SignUserJWT signs a user JWT for spec.PublicKey with an account key.
+// accountSeed may be the account's identity seed or one of its signing keys;
+// for a signing key, accountPublicKey names the account it signs for.
+func SignUserJWT(accountSeed, accountPublicKey string, spec UserSpec) (string, error) {
+	if err := ValidateUserKey(spec.PublicKey); err != nil {
+		return "", err
+	}
+	kp, err := nkeys.FromSeed([]byte(accountSeed))
+	if err != nil {
+		return "", fmt.Errorf("account seed: %w", err)
+	}
+	issuer, err := kp.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	if !nkeys.IsValidPublicAccountKey(issuer) {
+		return "", errors.New("account seed is not an account key")
+	}
+
+	claims := jwt.NewUserClaims(spec.PublicKey)
+	claims.Name = spec.Name
+	if accountPublicKey != "" && accountPublicKey != issuer {
+		claims.IssuerAccount = accountPublicKey
+	}
+	claims.Pub.Allow.Add(spec.PubAllow...)
+	claims.Pub.Deny.Add(spec.PubDeny...)
+	claims.Sub.Allow.Add(spec.SubAllow...)
+	claims.Sub.Deny.Add(spec.SubDeny...)
+	claims.Limits.Subs = spec.Subs
+	claims.Limits.Data = spec.Data
+	claims.Limits.Payload = spec.Payload
+	claims.BearerToken = spec.BearerToken
+	if spec.AllowResponses {
+		claims.Resp = &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}
+	}
+	if !spec.Expires.IsZero() {
+		claims.Expires = spec.Expires.Unix()
+	}
+	return claims.Encode(kp)
+}
+
+// UserCreds formats a user JWT and the seed of the key it was signed for as a
+// NATS creds file. The seed must be a user seed and match the JWT's subject, so
+// a creds file never pairs a JWT with a key that cannot use it.
+func UserCreds(userJWT, userSeed string) (string, error) {
+	kp, err := nkeys.FromSeed([]byte(userSeed))
+	if err != nil {
+		return "", fmt.Errorf("user seed: %w", err)
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	claims, err := jwt.DecodeUserClaims(userJWT)
+	if err != nil {
+		return "", fmt.Errorf("user JWT: %w", err)
+	}
+	if claims.Subject != pub {
+		return "", errors.New("the seed is not the key the JWT was signed for")
+	}
+	creds, err := jwt.FormatUserConfig(userJWT, []byte(userSeed))
+	if err != nil {
+		return "", err
+	}
+	return string(creds), nil
+}
+
+// HostSpec is what a device's Nebula host certificate asserts.
+type HostSpec struct {
+	Name string
+	// Network is the host's overlay address with its network's prefix length,
+	// e.g. 10.42.0.7/24, which is how nebula-cert writes it.
+	Network   netip.Prefix
+	Groups    []string
+	PublicKey []byte // PEM, as written by `nebula-cert keygen`
+	NotAfter  time.Time
+}
+
+// SignHostCert signs a Nebula host certificate for spec.PublicKey with a CA,
+// returning it as PEM with the expiry it was given. The certificate takes the
+// CA's version and curve. A NotAfter that is zero or beyond the CA's own expiry
+// is clamped to just before it, since Nebula refuses a certificate that outlives
+// its issuer.
+func SignHostCert(caCertPEM, caKeyPEM []byte, spec HostSpec) ([]byte, time.Time, error) {
+	ca, _, err := cert.UnmarshalCertificateFromPEM(caCertPEM)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("CA certificate: %w", err)
+	}
+	if !ca.IsCA() {
+		return nil, time.Time{}, errors.New("CA certificate is not a CA")
+	}
+	caKey, _, curve, err := cert.UnmarshalSigningPrivateKeyFromPEM(caKeyPEM)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("CA key: %w", err)
+	}
+	if err := ca.VerifyPrivateKey(curve, caKey); err != nil {
+		return nil, time.Time{}, fmt.Errorf("CA key does not match the CA certificate: %w", err)
+	}
+
+	pub, _, pubCurve, err := cert.UnmarshalPublicKeyFromPEM(spec.PublicKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("nebula public key: %w", err)
+	}
+	if pubCurve != ca.Curve() {
+		return nil, time.Time{}, fmt.Errorf("nebula public key is %s but the CA signs %s keys", pubCurve, ca.Curve())
+	}
+	if !spec.Network.IsValid() {
+		return nil, time.Time{}, errors.New("no overlay address to certify")
+	}
+
+	notBefore := time.Now().Truncate(time.Second)
+	if notBefore.Before(ca.NotBefore()) {
+		notBefore = ca.NotBefore()
+	}
+	notAfter := spec.NotAfter
+	if limit := ca.NotAfter().Add(-time.Second); notAfter.IsZero() || notAfter.After(limit) {
+		notAfter = limit
+	}
+
+	tbs := &cert.TBSCertificate{
+		Version:   ca.Version(),
+		Name:      spec.Name,
+		Networks:  []netip.Prefix{spec.Network},
+		Groups:    spec.Groups,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+		PublicKey: pub,
+		Curve:     ca.Curve(),
+	}
+	c, err := tbs.Sign(ca, curve, caKey)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	out, err := c.MarshalPEM()
+	return out, notAfter, err
+}
@@ -0,0 +1,276 @@
+package enrollment
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestClaimTokensAreUniqueAndHashStably(t *testing.T) {
+	a, hashA, err := NewClaimToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, _ := NewClaimToken()
+	if a == b {
+		t.Fatal("two tokens are equal")
+	}
+	if !strings.HasPrefix(a, TokenPrefix) {
+		t.Errorf("token %q lacks the prefix", a)
+	}
+	if HashClaimToken(a) != hashA || HashClaimToken(" "+a+"\n") != hashA {
+		t.Error("hash is not stable")
+	}
+	if strings.Contains(hashA, strings.TrimPrefix(a, TokenPrefix)) {
+		t.Error("hash contains the token")
+	}
+}
+
+func TestValidateUserKey(t *testing.T) {
+	user, _ := nkeys.CreateUser()
+	pub, _ := user.PublicKey()
+	seed, _ := user.Seed()
+	account, _ := nkeys.CreateAccount()
+	accountPub, _ := account.PublicKey()
+
+	if err := ValidateUserKey(pub); err != nil {
+		t.Errorf("user key refused: %v", err)
+	}
+	if err := ValidateUserKey(string(seed)); err == nil || !strings.Contains(err.Error(), "seed") {
+		t.Errorf("seed: err = %v", err)
+	}
+	if err := ValidateUserKey(accountPub); err == nil {
+		t.Error("account key accepted")
+	}
+}
+
+func TestSignUserJWT(t *testing.T) {
+	account, _ := nkeys.CreateAccount()
+	accountSeed, _ := account.Seed()
+	accountPub, _ := account.PublicKey()
+	user, _ := nkeys.CreateUser()
+	userPub, _ := user.PublicKey()
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	token, err := SignUserJWT(string(accountSeed), accountPub, UserSpec{
+		PublicKey: userPub,
+		Name:      "pump-001",
+		PubAllow:  []string{"acme.site1.pump-001.telemetry"},
+		SubAllow:  []string{"acme.site1.pump-001.cmd", "_INBOX.>"},
+		Subs:      -1, Data: -1, Payload: 1024,
+		Expires: expires,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != userPub || claims.Issuer != accountPub || claims.IssuerAccount != "" {
+		t.Errorf("subject/issuer = %s/%s/%s", claims.Subject, claims.Issuer, claims.IssuerAccount)
+	}
+	if !claims.Pub.Allow.Contains("acme.site1.pump-001.telemetry") || !claims.Sub.Allow.Contains("_INBOX.>") {
+		t.Errorf("permissions = %+v", claims.Permissions)
+	}
+	if claims.Limits.Payload != 1024 || claims.Expires != expires.Unix() {
+		t.Errorf("limits/expiry = %+v / %d", claims.Limits, claims.Expires)
+	}
+}
+
+func TestUserCredsPairsOnlyTheSignedKey(t *testing.T) {
+	account, _ := nkeys.CreateAccount()
+	accountSeed, _ := account.Seed()
+	accountPub, _ := account.PublicKey()
+	user, _ := nkeys.CreateUser()
+	userSeed, _ := user.Seed()
+	userPub, _ := user.PublicKey()
+
+	token, err := SignUserJWT(string(accountSeed), accountPub, UserSpec{PublicKey: userPub, AllowResponses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := UserCreds(token, string(userSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(creds, token) || !strings.Contains(creds, string(userSeed)) {
+		t.Errorf("creds = %q", creds)
+	}
+	claims, _ := jwt.DecodeUserClaims(token)
+	if claims.Resp == nil || claims.Resp.MaxMsgs != 1 {
+		t.Errorf("response permission = %+v", claims.Resp)
+	}
+
+	other, _ := nkeys.CreateUser()
+	otherSeed, _ := other.Seed()
+	if _, err := UserCreds(token, string(otherSeed)); err == nil {
+		t.Error("paired a JWT with another key's seed")
+	}
+}
+
+func TestSignUserJWTWithSigningKeyNamesTheAccount(t *testing.T) {
+	account, _ := nkeys.CreateAccount()
+	accountPub, _ := account.PublicKey()
+	signing, _ := nkeys.CreateAccount()
+	signingSeed, _ := signing.Seed()
+	signingPub, _ := signing.PublicKey()
+	user, _ := nkeys.CreateUser()
+	userPub, _ := user.PublicKey()
+
+	token, err := SignUserJWT(string(signingSeed), accountPub, UserSpec{PublicKey: userPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := jwt.DecodeUserClaims(token)
+	if claims.Issuer != signingPub || claims.IssuerAccount != accountPub {
+		t.Errorf("issuer = %s, issuer_account = %s", claims.Issuer, claims.IssuerAccount)
+	}
+}
+
+func TestSignUserJWTRefusesANonAccountSeed(t *testing.T) {
+	op, _ := nkeys.CreateOperator()
+	opSeed, _ := op.Seed()
+	user, _ := nkeys.CreateUser()
+	userPub, _ := user.PublicKey()
+	if _, err := SignUserJWT(string(opSeed), "", UserSpec{PublicKey: userPub}); err == nil {
+		t.Error("signed with an operator seed")
+	}
+}
+
+// testCA returns a v1 Curve25519 CA valid for a day, as PEM.
+func testCA(t *testing.T, networks ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nets []netip.Prefix
+	for _, n := range networks {
+		nets = append(nets, netip.MustParsePrefix(n))
+	}
+	now := time.Now().Truncate(time.Second)
+	tbs := &cert.TBSCertificate{
+		Version:   cert.Version1,
+		Name:      "test-ca",
+		Networks:  nets,
+		IsCA:      true,
+		NotBefore: now.Add(-time.Minute),
+		NotAfter:  now.Add(24 * time.Hour),
+		PublicKey: pub,
+		Curve:     cert.Curve_CURVE25519,
+	}
+	c, err := tbs.Sign(nil, cert.Curve_CURVE25519, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err = c.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, cert.MarshalSigningPrivateKeyToPEM(cert.Curve_CURVE25519, priv)
+}
+
+func hostPublicKeyPEM(t *testing.T) []byte {
+	t.Helper()
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.MarshalPublicKeyToPEM(cert.Curve_CURVE25519, pub)
+}
+
+func TestSignHostCert(t *testing.T) {
+	caPEM, caKey := testCA(t)
+	hostPub := hostPublicKeyPEM(t)
+
+	out, notAfter, err := SignHostCert(caPEM, caKey, HostSpec{
+		Name:      "pump-001",
+		Network:   netip.MustParsePrefix("10.42.0.7/24"),
+		Groups:    []string{"pumps"},
+		PublicKey: hostPub,
+		NotAfter:  time.Now().Add(365 * 24 * time.Hour), // beyond the CA: clamped
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, _, err := cert.UnmarshalCertificateFromPEM(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, _ := cert.UnmarshalCertificateFromPEM(caPEM)
+	if !host.CheckSignature(ca.PublicKey()) {
+		t.Error("certificate is not signed by the CA")
+	}
+	if host.Name() != "pump-001" || host.Networks()[0].String() != "10.42.0.7/24" || host.Groups()[0] != "pumps" {
+		t.Errorf("certificate = %s", host)
+	}
+	if host.IsCA() || host.NotAfter().After(ca.NotAfter()) || !host.NotAfter().Equal(notAfter) {
+		t.Errorf("certificate outlives or is a CA: %s", host)
+	}
+	wantPub, _, _, _ := cert.UnmarshalPublicKeyFromPEM(hostPub)
+	if string(host.PublicKey()) != string(wantPub) {
+		t.Error("certificate is not for the device's key")
+	}
+}
+
+func TestSignHostCertHonoursCAConstraints(t *testing.T) {
+	caPEM, caKey := testCA(t, "10.42.0.0/16")
+	_, _, err := SignHostCert(caPEM, caKey, HostSpec{
+		Name:      "outside",
+		Network:   netip.MustParsePrefix("10.99.0.7/24"),
+		PublicKey: hostPublicKeyPEM(t),
+	})
+	if err == nil {
+		t.Error("signed an address outside the CA's networks")
+	}
+}
+
+func TestSignHostCertRefusesAPrivateKey(t *testing.T) {
+	caPEM, caKey := testCA(t)
+	priv := cert.MarshalPrivateKeyToPEM(cert.Curve_CURVE25519, make([]byte, 32))
+	if _, _, err := SignHostCert(caPEM, caKey, HostSpec{
+		Name: "x", Network: netip.MustParsePrefix("10.0.0.1/24"), PublicKey: priv,
+	}); err == nil {
+		t.Error("accepted a private key as the public key")
+	}
+}
+
+func TestLimiterCapsAttemptsPerKeyInTheWindow(t *testing.T) {
+	l := NewLimiter(2, time.Minute)
+	t0 := time.Unix(1_700_000_000, 0)
+	if !l.Allow("a", t0) || !l.Allow("a", t0.Add(time.Second)) {
+		t.Fatal("attempts within the limit refused")
+	}
+	if l.Allow("a", t0.Add(2*time.Second)) {
+		t.Error("third attempt in the window allowed")
+	}
+	if !l.Allow("b", t0.Add(2*time.Second)) {
+		t.Error("another key refused")
+	}
+	// The first attempt ages out; the refused one was never counted.
+	if !l.Allow("a", t0.Add(time.Minute+time.Millisecond)) {
+		t.Error("attempt after the oldest aged out refused")
+	}
+	if l.Allow("a", t0.Add(time.Minute+2*time.Millisecond)) {
+		t.Error("attempt over the limit allowed")
+	}
+	l.Allow("c", t0.Add(3*time.Minute))
+	if _, ok := l.attempts["b"]; ok {
+		t.Error("quiet key not pruned")
+	}
+}
@@ -0,0 +1,60 @@
+package enrollment
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter caps how often one caller may attempt something: at most n attempts
+// in any window. The enroll route is unauthenticated, so without it anyone who
+// can reach the server may hammer it; a guess at a 256-bit token is hopeless,
+// but each attempt still costs a transaction and a log line.
+//
+// Attempts are counted whether or not they succeed, and a refused attempt is
+// not counted, so a caller that keeps trying is let back in once its oldest
+// attempts age out of the window. State is in memory and per process.
+type Limiter struct {
+	n      int
+	window time.Duration
+
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+	pruned   time.Time
+}
+
+// NewLimiter returns a Limiter allowing n attempts per key in any window.
+func NewLimiter(n int, window time.Duration) *Limiter {
+	return &Limiter{n: n, window: window, attempts: map[string][]time.Time{}}
+}
+
+// Allow records an attempt by key at now and reports whether it is within the
+// limit. A refused attempt is not recorded.
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	since := now.Add(-l.window)
+	if now.Sub(l.pruned) >= l.window {
+		// Forget callers that have gone quiet, so the map does not grow with
+		// every address that ever tried once.
+		for k, ts := range l.attempts {
+			if !ts[len(ts)-1].After(since) {
+				delete(l.attempts, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	ts := l.attempts[key]
+	i := 0
+	for i < len(ts) && !ts[i].After(since) {
+		i++
+	}
+	ts = ts[i:]
+	if len(ts) >= l.n {
+		l.attempts[key] = ts
+		return false
+	}
+	l.attempts[key] = append(ts, now)
+	return true
+}
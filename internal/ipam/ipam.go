@@ -0,0 +1,322 @@
+// Package ipam does the address arithmetic for Nebula overlay networks: whether
+// an address may be given to a host, which one to give next, and what a network's
+// address space currently looks like.
+//
+// It knows nothing about PocketBase. The caller reads a network's cidr_range and
+// reserved_ranges and the overlay_ip of every host already on it, and hands them
+// over as strings; everything here is a pure function of those. That keeps the
+// rules testable without a database and means the route, the record hooks and the
+// bulk import all apply exactly the same ones.
+//
+// IPv4 only. Nebula's v1 certificates carry IPv4 networks, and every network this
+// platform creates is one; a v6 cidr_range is reported as unsupported rather than
+// half-managed.
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Errors a caller may want to tell apart. Each is wrapped with the address and
+// network it concerns, so the message reads on its own.
+var (
+	ErrUnsupported = errors.New("only IPv4 networks are managed")
+	ErrOutside     = errors.New("address is outside the network")
+	ErrNetwork     = errors.New("address is the network address")
+	ErrBroadcast   = errors.New("address is the broadcast address")
+	ErrReserved    = errors.New("address is in a reserved range")
+	ErrExhausted   = errors.New("no free address left in the network")
+)
+
+// Span is an inclusive run of addresses. A single address is a Span whose First
+// and Last are equal.
+type Span struct {
+	First netip.Addr `json:"first"`
+	Last  netip.Addr `json:"last"`
+}
+
+// Size is the number of addresses in the span.
+func (s Span) Size() uint64 {
+	return uint64(toU32(s.Last)) - uint64(toU32(s.First)) + 1
+}
+
+func (s Span) String() string {
+	if s.First == s.Last {
+		return s.First.String()
+	}
+	return s.First.String() + "-" + s.Last.String()
+}
+
+func (s Span) contains(a netip.Addr) bool {
+	return toU32(a) >= toU32(s.First) && toU32(a) <= toU32(s.Last)
+}
+
+// Pool is one network's assignable address space: its prefix less the network and
+// broadcast addresses, less its reserved ranges.
+type Pool struct {
+	prefix   netip.Prefix
+	usable   Span
+	reserved []Span
+}
+
+// NewPool parses a network's cidr_range and reserved_ranges. Reserved entries
+// take three shapes — "10.0.0.1", "10.0.0.0/28" and "10.0.0.10-10.0.0.20" — and
+// each must lie inside the network; one that doesn't is a typo, and silently
+// ignoring it would leave the address it was meant to protect up for grabs.
+func NewPool(cidr string, reserved []string) (*Pool, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr_range %q: %w", cidr, err)
+	}
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("cidr_range %q: %w", cidr, ErrUnsupported)
+	}
+	prefix = prefix.Masked()
+
+	p := &Pool{prefix: prefix, usable: usableSpan(prefix)}
+	whole := Span{First: prefix.Addr(), Last: lastAddr(prefix)}
+	for _, r := range reserved {
+		s, err := ParseSpan(r)
+		if err != nil {
+			return nil, err
+		}
+		if !whole.contains(s.First) || !whole.contains(s.Last) {
+			return nil, fmt.Errorf("reserved range %q is not inside %s", r, prefix)
+		}
+		p.reserved = append(p.reserved, s)
+	}
+	p.reserved = merge(p.reserved)
+	return p, nil
+}
+
+// ParseSpan reads one reserved_ranges entry.
+func ParseSpan(s string) (Span, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.Contains(s, "/"):
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil || !prefix.Addr().Is4() {
+			return Span{}, fmt.Errorf("invalid reserved range %q: want an IPv4 address, CIDR or first-last range", s)
+		}
+		prefix = prefix.Masked()
+		return Span{First: prefix.Addr(), Last: lastAddr(prefix)}, nil
+
+	case strings.Contains(s, "-"):
+		lo, hi, _ := strings.Cut(s, "-")
+		first, err1 := netip.ParseAddr(strings.TrimSpace(lo))
+		last, err2 := netip.ParseAddr(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || !first.Is4() || !last.Is4() {
+			return Span{}, fmt.Errorf("invalid reserved range %q: want an IPv4 address, CIDR or first-last range", s)
+		}
+		if toU32(last) < toU32(first) {
+			return Span{}, fmt.Errorf("invalid reserved range %q: the range ends before it starts", s)
+		}
+		return Span{First: first, Last: last}, nil
+	}
+
+	a, err := netip.ParseAddr(s)
+	if err != nil || !a.Is4() {
+		return Span{}, fmt.Errorf("invalid reserved range %q: want an IPv4 address, CIDR or first-last range", s)
+	}
+	return Span{First: a, Last: a}, nil
+}
+
+// Prefix is the network the pool was built from, masked to its network address.
+func (p *Pool) Prefix() netip.Prefix { return p.prefix }
+
+// Check reports whether addr may be assigned to a host on this network, ignoring
+// whether another host already has it — uniqueness is the unique index on
+// nebula_hosts, and the caller that knows the other hosts checks it.
+//
+// An address may be written with the network's prefix length ("10.0.0.5/24"),
+// which is how Nebula's own config spells it; any other length is refused rather
+// than guessed at.
+func (p *Pool) Check(addr string) (netip.Addr, error) {
+	a, err := p.parseHostAddr(addr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !p.prefix.Contains(a) {
+		return a, fmt.Errorf("%s: %w %s", a, ErrOutside, p.prefix)
+	}
+	if p.prefix.Bits() < 31 {
+		if a == p.prefix.Addr() {
+			return a, fmt.Errorf("%s: %w of %s", a, ErrNetwork, p.prefix)
+		}
+		if a == lastAddr(p.prefix) {
+			return a, fmt.Errorf("%s: %w of %s", a, ErrBroadcast, p.prefix)
+		}
+	}
+	for _, r := range p.reserved {
+		if r.contains(a) {
+			return a, fmt.Errorf("%s: %w (%s)", a, ErrReserved, r)
+		}
+	}
+	return a, nil
+}
+
+// Next returns the lowest assignable address that is not in used. Entries in used
+// that don't parse or lie outside the network are ignored; they cannot collide
+// with anything Next would return.
+func (p *Pool) Next(used []string) (netip.Addr, error) {
+	cur, last := toU32(p.usable.First), toU32(p.usable.Last)
+	for _, t := range p.takenSpans(used) {
+		if toU32(t.Last) < cur {
+			continue
+		}
+		if toU32(t.First) > cur {
+			break
+		}
+		if toU32(t.Last) >= last {
+			return netip.Addr{}, fmt.Errorf("%s: %w", p.prefix, ErrExhausted)
+		}
+		cur = toU32(t.Last) + 1
+	}
+	return fromU32(cur), nil
+}
+
+// Usage is a network's address space at a glance. Free is given as spans, not
+// addresses, so a /16 answers in a few lines rather than sixty-five thousand.
+type Usage struct {
+	Network    string   `json:"network"`
+	Usable     uint64   `json:"usable"` // assignable addresses, before reservations
+	Reserved   []Span   `json:"reserved"`
+	Used       []string `json:"used"`
+	UsedCount  uint64   `json:"used_count"`
+	Free       []Span   `json:"free"`
+	FreeCount  uint64   `json:"free_count"`
+	OutOfRange []string `json:"out_of_range"` // held by hosts but not assignable here
+}
+
+// Usage summarises the network given the overlay_ip of every host on it. An
+// address a host holds that Check would now refuse — outside the range, the
+// broadcast address, or inside a range reserved after it was assigned — is listed
+// under OutOfRange so it can be fixed, and not counted as used.
+func (p *Pool) Usage(used []string) Usage {
+	u := Usage{
+		Network:    p.prefix.String(),
+		Reserved:   append([]Span{}, p.reserved...),
+		Used:       []string{},
+		Free:       []Span{},
+		OutOfRange: []string{},
+	}
+	u.Usable = p.usable.Size()
+
+	var inRange []netip.Addr
+	for _, s := range used {
+		a, err := p.Check(s)
+		if err != nil {
+			u.OutOfRange = append(u.OutOfRange, strings.TrimSpace(s))
+			continue
+		}
+		inRange = append(inRange, a)
+	}
+	sort.Slice(inRange, func(i, j int) bool { return inRange[i].Less(inRange[j]) })
+	for i, a := range inRange {
+		if i > 0 && inRange[i-1] == a {
+			continue
+		}
+		u.Used = append(u.Used, a.String())
+	}
+	u.UsedCount = uint64(len(u.Used))
+
+	cur := uint64(toU32(p.usable.First))
+	last := uint64(toU32(p.usable.Last))
+	for _, t := range p.takenSpans(u.Used) {
+		if uint64(toU32(t.First)) > cur {
+			u.Free = append(u.Free, Span{First: fromU32(uint32(cur)), Last: fromU32(toU32(t.First) - 1)})
+		}
+		if next := uint64(toU32(t.Last)) + 1; next > cur {
+			cur = next
+		}
+	}
+	if cur <= last {
+		u.Free = append(u.Free, Span{First: fromU32(uint32(cur)), Last: p.usable.Last})
+	}
+	for _, f := range u.Free {
+		u.FreeCount += f.Size()
+	}
+	return u
+}
+
+// takenSpans is every reservation plus every in-network used address, merged and
+// sorted. The callers walk it against the usable span.
+func (p *Pool) takenSpans(used []string) []Span {
+	taken := append([]Span{}, p.reserved...)
+	for _, s := range used {
+		a, err := p.parseHostAddr(s)
+		if err != nil || !p.prefix.Contains(a) {
+			continue
+		}
+		taken = append(taken, Span{First: a, Last: a})
+	}
+	return merge(taken)
+}
+
+func (p *Pool) parseHostAddr(addr string) (netip.Addr, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.Contains(addr, "/") {
+		pfx, err := netip.ParsePrefix(addr)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid overlay IP %q", addr)
+		}
+		if pfx.Bits() != p.prefix.Bits() {
+			return netip.Addr{}, fmt.Errorf("overlay IP %q has a different prefix length from the network %s", addr, p.prefix)
+		}
+		addr = pfx.Addr().String()
+	}
+	a, err := netip.ParseAddr(addr)
+	if err != nil || !a.Is4() {
+		return netip.Addr{}, fmt.Errorf("invalid overlay IP %q: want an IPv4 address", addr)
+	}
+	return a, nil
+}
+
+// merge sorts spans and joins any that overlap or touch.
+func merge(spans []Span) []Span {
+	if len(spans) == 0 {
+		return nil
+	}
+	sort.Slice(spans, func(i, j int) bool { return toU32(spans[i].First) < toU32(spans[j].First) })
+	out := []Span{spans[0]}
+	for _, s := range spans[1:] {
+		tail := &out[len(out)-1]
+		if uint64(toU32(s.First)) <= uint64(toU32(tail.Last))+1 {
+			if toU32(s.Last) > toU32(tail.Last) {
+				tail.Last = s.Last
+			}
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// usableSpan is the prefix less its network and broadcast addresses. A /31 is a
+// point-to-point link with two usable addresses and a /32 a single host
+// (RFC 3021), so neither loses anything.
+func usableSpan(prefix netip.Prefix) Span {
+	first, last := toU32(prefix.Addr()), toU32(lastAddr(prefix))
+	if prefix.Bits() < 31 {
+		first, last = first+1, last-1
+	}
+	return Span{First: fromU32(first), Last: fromU32(last)}
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	host := uint32(1)<<(32-prefix.Bits()) - 1 // a shift of 32 is 0, so /0 gives all ones
+	return fromU32(toU32(prefix.Addr()) | host)
+}
+
+func toU32(a netip.Addr) uint32 {
+	b := a.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func fromU32(v uint32) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
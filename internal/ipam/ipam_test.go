@@ -0,0 +1,115 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustPool(t *testing.T, cidr string, reserved ...string) *Pool {
+	t.Helper()
+	p, err := NewPool(cidr, reserved)
+	if err != nil {
+		t.Fatalf("NewPool(%q, %v): %v", cidr, reserved, err)
+	}
+	return p
+}
+
+func TestCheckRefusesWhatCannotBeAssigned(t *testing.T) {
+	p := mustPool(t, "10.100.0.0/24", "10.100.0.1", "10.100.0.240/28")
+
+	cases := []struct {
+		addr string
+		want error
+	}{
+		{"10.100.0.5", nil},
+		{"10.100.0.5/24", nil},
+		{"10.100.1.5", ErrOutside},
+		{"10.100.0.0", ErrNetwork},
+		{"10.100.0.255", ErrBroadcast},
+		{"10.100.0.1", ErrReserved},
+		{"10.100.0.241", ErrReserved},
+	}
+	for _, c := range cases {
+		_, err := p.Check(c.addr)
+		if !errors.Is(err, c.want) {
+			t.Errorf("Check(%q) = %v, want %v", c.addr, err, c.want)
+		}
+	}
+
+	// Not sentinel errors, but errors all the same: garbage, IPv6, and a prefix
+	// length that disagrees with the network's.
+	for _, bad := range []string{"", "10.100.0", "fd00::1", "10.100.0.5/16"} {
+		if _, err := p.Check(bad); err == nil {
+			t.Errorf("Check(%q) accepted it", bad)
+		}
+	}
+}
+
+// A /31 is a point-to-point link (RFC 3021): both addresses are hosts, and
+// refusing either as "network" or "broadcast" would make the prefix unusable.
+func TestPointToPointPrefixesKeepEveryAddress(t *testing.T) {
+	p := mustPool(t, "10.0.0.0/31")
+	for _, a := range []string{"10.0.0.0", "10.0.0.1"} {
+		if _, err := p.Check(a); err != nil {
+			t.Errorf("Check(%q) on a /31: %v", a, err)
+		}
+	}
+}
+
+func TestNextSkipsUsedAndReservedAddresses(t *testing.T) {
+	p := mustPool(t, "10.100.0.0/24", "10.100.0.1-10.100.0.9")
+
+	got, err := p.Next([]string{"10.100.0.10", "10.100.0.11", "10.100.0.13", "192.168.1.1", "junk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "10.100.0.12" {
+		t.Errorf("Next = %s, want 10.100.0.12", got)
+	}
+}
+
+func TestNextReportsExhaustion(t *testing.T) {
+	p := mustPool(t, "10.0.0.0/30", "10.0.0.2")
+	if _, err := p.Next([]string{"10.0.0.1"}); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Next on a full /30 = %v, want ErrExhausted", err)
+	}
+}
+
+func TestNewPoolRejectsBadReservations(t *testing.T) {
+	for _, r := range []string{"10.1.0.1", "10.0.0.9-10.0.0.2", "nope", "10.0.0.0/23"} {
+		if _, err := NewPool("10.0.0.0/24", []string{r}); err == nil {
+			t.Errorf("reserved %q accepted for 10.0.0.0/24", r)
+		}
+	}
+	if _, err := NewPool("fd00::/64", nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("IPv6 network: %v, want ErrUnsupported", err)
+	}
+}
+
+func TestUsageSummarisesTheNetwork(t *testing.T) {
+	p := mustPool(t, "10.0.0.0/28", "10.0.0.1-10.0.0.2")
+
+	u := p.Usage([]string{"10.0.0.5", "10.0.0.3", "10.0.0.5", "10.0.0.15", "10.9.9.9"})
+
+	if u.Usable != 14 {
+		t.Errorf("Usable = %d, want 14", u.Usable)
+	}
+	if len(u.Used) != 2 || u.Used[0] != "10.0.0.3" || u.Used[1] != "10.0.0.5" {
+		t.Errorf("Used = %v, want [10.0.0.3 10.0.0.5]", u.Used)
+	}
+	if len(u.OutOfRange) != 2 {
+		t.Errorf("OutOfRange = %v, want the broadcast and the foreign address", u.OutOfRange)
+	}
+
+	var free []string
+	for _, s := range u.Free {
+		free = append(free, s.String())
+	}
+	want := []string{"10.0.0.4", "10.0.0.6-10.0.0.14"}
+	if len(free) != len(want) || free[0] != want[0] || free[1] != want[1] {
+		t.Errorf("Free = %v, want %v", free, want)
+	}
+	if u.FreeCount != 10 {
+		t.Errorf("FreeCount = %d, want 10", u.FreeCount)
+	}
+}
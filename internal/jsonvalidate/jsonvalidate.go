@@ -0,0 +1,208 @@
+// Package jsonvalidate checks JSON documents against JSON Schemas stored in the
+// platform's records — a type's metadata_schema, a message_schemas entry — and
+// reports each violation against the place in the document it concerns.
+//
+// It wraps github.com/santhosh-tekuri/jsonschema with two decisions made once
+// rather than at every call site:
+//
+//   - No loader. A schema is tenant-authored, and a `$ref` that the compiler is
+//     allowed to follow is a request the server makes on the tenant's behalf —
+//     to a file on the server's disk with the default loader, or to any URL with
+//     an HTTP one. Every `$ref` must resolve inside the schema itself.
+//   - Violations are flattened to (pointer, message) pairs, so a caller can hand
+//     them to PocketBase as field errors, print them, or publish them without
+//     knowing the library's error tree.
+package jsonvalidate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+var printer = message.NewPrinter(language.English)
+
+// Violation is one way a document fails its schema. Pointer is the RFC 6901
+// location of the offending value ("" for the document itself); for a missing
+// required property it is where the property should have been.
+type Violation struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// Schema is a compiled schema, safe for concurrent use.
+type Schema struct {
+	s *jsonschema.Schema
+}
+
+// refuseLoader is the compiler's only loader. See the package comment.
+type refuseLoader struct{}
+
+func (refuseLoader) Load(url string) (any, error) {
+	return nil, fmt.Errorf("external $ref %q is not allowed; define it under $defs instead", url)
+}
+
+// resourceURL is the name the schema is compiled under. Never fetched.
+const resourceURL = "urn:platform:schema"
+
+// Compile parses and compiles a schema given as JSON.
+func Compile(raw []byte) (*Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	c := jsonschema.NewCompiler()
+	c.UseLoader(refuseLoader{})
+	if err := c.AddResource(resourceURL, doc); err != nil {
+		return nil, err
+	}
+	s, err := c.Compile(resourceURL)
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(err.Error()))
+	}
+	return &Schema{s: s}, nil
+}
+
+// IsEmpty reports whether raw is a schema that constrains nothing worth
+// checking: absent, null, or an empty object. The console treats these the same
+// as no schema, and so does every caller here.
+func IsEmpty(raw []byte) bool {
+	t := bytes.TrimSpace(raw)
+	if len(t) == 0 || bytes.Equal(t, []byte("null")) {
+		return true
+	}
+	var m map[string]any
+	return json.Unmarshal(t, &m) == nil && len(m) == 0
+}
+
+// Validate checks a document given as JSON. A document that is not JSON at all
+// is reported as a single violation at the root.
+func (s *Schema) Validate(raw []byte) []Violation {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		raw = []byte("null")
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return []Violation{{Pointer: "", Message: "not valid JSON: " + err.Error()}}
+	}
+	return s.ValidateValue(doc)
+}
+
+// ValidateValue checks a document already decoded with encoding/json or
+// jsonschema.UnmarshalJSON. Numbers decoded as float64 are accepted.
+func (s *Schema) ValidateValue(doc any) []Violation {
+	err := s.s.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []Violation{{Pointer: "", Message: err.Error()}}
+	}
+
+	var out []Violation
+	collect(ve, &out)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Pointer < out[j].Pointer })
+	return dedupe(out)
+}
+
+// collect walks the error tree down to its leaves — the causes that name an
+// actual keyword failure rather than "one of these failed" — and records each.
+func collect(ve *jsonschema.ValidationError, out *[]Violation) {
+	if len(ve.Causes) > 0 {
+		for _, c := range ve.Causes {
+			collect(c, out)
+		}
+		return
+	}
+	loc := ve.InstanceLocation
+	if req, ok := ve.ErrorKind.(*kind.Required); ok {
+		for _, prop := range req.Missing {
+			*out = append(*out, Violation{
+				Pointer: Pointer(append(append([]string{}, loc...), prop)),
+				Message: "required",
+			})
+		}
+		return
+	}
+	*out = append(*out, Violation{Pointer: Pointer(loc), Message: ve.ErrorKind.LocalizedString(printer)})
+}
+
+func dedupe(vs []Violation) []Violation {
+	out := vs[:0]
+	for i, v := range vs {
+		if i > 0 && v == vs[i-1] {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// Pointer renders path tokens as an RFC 6901 JSON pointer.
+func Pointer(tokens []string) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, t := range tokens {
+		sb.WriteByte('/')
+		t = strings.ReplaceAll(t, "~", "~0")
+		sb.WriteString(strings.ReplaceAll(t, "/", "~1"))
+	}
+	return sb.String()
+}
+
+// Cache holds compiled schemas keyed by their content, so validating every save
+// of a Thing does not recompile its type's schema each time. Keying by content
+// rather than record id means an edited schema is simply a miss; nothing has to
+// be invalidated.
+type Cache struct {
+	mu  sync.Mutex
+	max int
+	m   map[[32]byte]cacheEntry
+}
+
+type cacheEntry struct {
+	s   *Schema
+	err error
+}
+
+// NewCache returns a cache holding at most max schemas. It is cleared, not
+// evicted piecemeal, when full — schemas are few and compiling is cheap enough
+// that anything cleverer is not worth its code.
+func NewCache(max int) *Cache {
+	return &Cache{max: max, m: map[[32]byte]cacheEntry{}}
+}
+
+// Compile returns the compiled schema for raw, compiling it on a miss. A schema
+// that fails to compile is cached as failing too.
+func (c *Cache) Compile(raw []byte) (*Schema, error) {
+	key := sha256.Sum256(raw)
+	c.mu.Lock()
+	e, ok := c.m[key]
+	c.mu.Unlock()
+	if ok {
+		return e.s, e.err
+	}
+
+	s, err := Compile(raw)
+
+	c.mu.Lock()
+	if len(c.m) >= c.max {
+		c.m = map[[32]byte]cacheEntry{}
+	}
+	c.m[key] = cacheEntry{s, err}
+	c.mu.Unlock()
+	return s, err
+}
@@ -0,0 +1,106 @@
+package jsonvalidate
+
+import (
+	"strings"
+	"testing"
+)
+
+const assetSchema = `{
+	"type": "object",
+	"properties": {
+		"serial":  {"type": "string", "minLength": 3},
+		"ports":   {"type": "array", "items": {"type": "object", "required": ["name"]}},
+		"a/b":     {"type": "integer"}
+	},
+	"required": ["serial", "installed"]
+}`
+
+func TestViolationsPointAtTheOffendingValue(t *testing.T) {
+	s, err := Compile([]byte(assetSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.Validate([]byte(`{"serial": "x", "ports": [{"name": "a"}, {}], "a/b": 1.5}`))
+
+	want := map[string]bool{
+		"/a~1b":         false,
+		"/installed":    false,
+		"/ports/1/name": false,
+		"/serial":       false,
+	}
+	for _, v := range got {
+		if _, ok := want[v.Pointer]; !ok {
+			t.Errorf("unexpected violation %+v", v)
+			continue
+		}
+		want[v.Pointer] = true
+	}
+	for p, seen := range want {
+		if !seen {
+			t.Errorf("no violation reported at %s; got %+v", p, got)
+		}
+	}
+}
+
+func TestConformingDocumentHasNoViolations(t *testing.T) {
+	s, err := Compile([]byte(assetSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Validate([]byte(`{"serial": "abc", "installed": "2024-01-01", "extra": true}`)); len(got) != 0 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestNonObjectRootIsReportedAtTheRoot(t *testing.T) {
+	s, err := Compile([]byte(assetSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Validate([]byte(`[1, 2]`))
+	if len(got) != 1 || got[0].Pointer != "" {
+		t.Errorf("got %+v, want one violation at the root", got)
+	}
+}
+
+// A tenant-authored schema must not make the server read files or fetch URLs.
+func TestExternalRefsAreRefused(t *testing.T) {
+	for _, ref := range []string{"file:///etc/passwd", "https://example.com/s.json"} {
+		_, err := Compile([]byte(`{"$ref": "` + ref + `"}`))
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("$ref %s: err = %v", ref, err)
+		}
+	}
+	if _, err := Compile([]byte(`{"$defs": {"x": {"type": "string"}}, "$ref": "#/$defs/x"}`)); err != nil {
+		t.Errorf("internal $ref refused: %v", err)
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	for _, raw := range []string{"", " ", "null", "{}", " { } "} {
+		if !IsEmpty([]byte(raw)) {
+			t.Errorf("IsEmpty(%q) = false", raw)
+		}
+	}
+	for _, raw := range []string{`{"type":"object"}`, "true"} {
+		if IsEmpty([]byte(raw)) {
+			t.Errorf("IsEmpty(%q) = true", raw)
+		}
+	}
+}
+
+func TestCacheReturnsTheSameCompiledSchema(t *testing.T) {
+	c := NewCache(2)
+	a, err := c.Compile([]byte(assetSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := c.Compile([]byte(assetSchema))
+	if a != b {
+		t.Error("second lookup recompiled")
+	}
+	if _, err := c.Compile([]byte(`{"type": 5}`)); err == nil {
+		t.Error("invalid schema compiled")
+	}
+}
@@ -0,0 +1,275 @@
+package leafsync
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Mirror bucket settings.
+//
+// Every mirrored collection gets a KV bucket of its own, and one shape does not
+// fit every edge: a site on an SD card wants `things` in memory or capped, one
+// that audits config changes wants more history than the default five
+// revisions, a clustered leaf wants replicas. Settings come from two places,
+// each a map of `default` or a collection name to the fields below:
+//
+//	history      revisions kept per key, 1-64
+//	storage      file | memory
+//	replicas     1-5; more than one needs a clustered leaf
+//	max_bytes    size cap in bytes, 0 for none
+//	compression  compress stored values (S2)
+//
+// leaf_nodes.kv_buckets, set per leaf node in the console, and the `buckets:`
+// section of leaf-sync.yaml. A field is taken from the most specific place
+// that sets it: the yaml's entry for the collection, then its `default`, then
+// the record's entry for the collection, then its `default`, then the built-in
+// shape (5 revisions, file storage, one replica, no cap, no compression). The
+// yaml wins because it is what the person at the site wrote.
+//
+// A new bucket a single-server leaf will not create with replicas is created
+// with one (relaxBucketConfig). An existing bucket is brought to the resolved
+// settings in place where JetStream allows it. Where it does not, the bucket is
+// left as it is and a warning says why (planBucketUpdate): leaf-sync never
+// deletes a bucket on its own, since consumers on the edge may be reading it.
+//
+// The derived index buckets (indexes.go) are not configurable: they hold one
+// recomputed revision per key, and nothing on the edge depends on their shape.
+
+// bucketDefaultKey is the settings entry that applies to every collection.
+const bucketDefaultKey = "default"
+
+// bucketSettings is one entry of a settings map. A nil field is not set there.
+type bucketSettings struct {
+	History     *uint8
+	Storage     *jetstream.StorageType
+	Replicas    *int
+	MaxBytes    *int64
+	Compression *bool
+}
+
+// bucketLayers are settings maps, least specific first.
+type bucketLayers []map[string]bucketSettings
+
+// mirrorBucketConfig is the shape of a mirror bucket nothing configures.
+func mirrorBucketConfig(name string) jetstream.KeyValueConfig {
+	return jetstream.KeyValueConfig{
+		Bucket:      name,
+		Description: "leaf-sync mirror of PocketBase collection: " + name,
+		History:     5,
+		Storage:     jetstream.FileStorage,
+		Replicas:    1,
+	}
+}
+
+// config resolves the bucket config of collection col.
+func (layers bucketLayers) config(col string) jetstream.KeyValueConfig {
+	cfg := mirrorBucketConfig(col)
+	for _, layer := range layers {
+		layer[bucketDefaultKey].apply(&cfg)
+		layer[col].apply(&cfg)
+	}
+	return cfg
+}
+
+func (s bucketSettings) apply(cfg *jetstream.KeyValueConfig) {
+	if s.History != nil {
+		cfg.History = *s.History
+	}
+	if s.Storage != nil {
+		cfg.Storage = *s.Storage
+	}
+	if s.Replicas != nil {
+		cfg.Replicas = *s.Replicas
+	}
+	if s.MaxBytes != nil {
+		cfg.MaxBytes = *s.MaxBytes
+	}
+	if s.Compression != nil {
+		cfg.Compression = *s.Compression
+	}
+}
+
+// parseBucketSettings reads a settings map, from leaf-sync.yaml or from
+// leaf_nodes.kv_buckets:
+//
+//	buckets:
+//	  default:
+//	    history: 10
+//	  things:
+//	    storage: memory
+//	    max_bytes: 10485760
+//
+// Every key must be `default` or a syncable collection, and every field one of
+// the five above with a value JetStream would accept, so a typo fails where it
+// was made rather than at the first bucket update.
+func parseBucketSettings(raw any) (map[string]bucketSettings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	entries, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("want a map of collection (or %q) to bucket settings", bucketDefaultKey)
+	}
+	out := make(map[string]bucketSettings, len(entries))
+	for col, rawEntry := range entries {
+		if col != bucketDefaultKey && !allowedCollections[col] {
+			return nil, fmt.Errorf("%s is not a syncable collection", col)
+		}
+		fields, ok := rawEntry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: want a map of setting to value", col)
+		}
+		var s bucketSettings
+		for field, v := range fields {
+			if err := s.set(field, v); err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", col, field, err)
+			}
+		}
+		out[col] = s
+	}
+	return out, nil
+}
+
+func (s *bucketSettings) set(field string, v any) error {
+	switch field {
+	case "history":
+		n, err := intSetting(v, 1, jetstream.KeyValueMaxHistory)
+		if err != nil {
+			return err
+		}
+		h := uint8(n)
+		s.History = &h
+	case "storage":
+		name, _ := v.(string)
+		var st jetstream.StorageType
+		switch strings.ToLower(name) {
+		case "file":
+			st = jetstream.FileStorage
+		case "memory":
+			st = jetstream.MemoryStorage
+		default:
+			return fmt.Errorf("%v is not file or memory", v)
+		}
+		s.Storage = &st
+	case "replicas":
+		n, err := intSetting(v, 1, 5)
+		if err != nil {
+			return err
+		}
+		r := int(n)
+		s.Replicas = &r
+	case "max_bytes":
+		n, err := intSetting(v, 0, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		s.MaxBytes = &n
+	case "compression":
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("%v is not true or false", v)
+		}
+		s.Compression = &b
+	default:
+		return fmt.Errorf("unknown setting (want history, storage, replicas, max_bytes or compression)")
+	}
+	return nil
+}
+
+// intSetting reads a whole number in [lo, hi]. YAML gives ints, JSON float64s.
+func intSetting(v any, lo, hi int64) (int64, error) {
+	var n int64
+	switch x := v.(type) {
+	case int:
+		n = int64(x)
+	case int64:
+		n = x
+	case float64:
+		if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not a whole number", v)
+		}
+		n = int64(x)
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("%d is out of range (%d-%d)", n, lo, hi)
+	}
+	return n, nil
+}
+
+// planBucketUpdate decides what an existing bucket, currently configured as
+// current and holding size bytes, is updated to so that it matches want as
+// closely as JetStream allows. changes describes what the update changes, and
+// is empty when the bucket already matches; notes are the settings that cannot
+// be applied, and why.
+//
+//   - Storage cannot change in place. The bucket keeps its storage until an
+//     operator deletes it; leaf-sync then recreates it with the new one and the
+//     next reconcile refills it.
+//   - A max_bytes below what the bucket already holds is not applied either:
+//     JetStream would refuse it, or discard the oldest keys to fit, and a
+//     mirror missing keys is worse than a mirror over its cap.
+//
+// Lowering history is applied; it drops the oldest revisions of each key.
+func planBucketUpdate(current jetstream.KeyValueConfig, size uint64, want jetstream.KeyValueConfig) (next jetstream.KeyValueConfig, changes, notes []string) {
+	next = want
+	if want.Storage != current.Storage {
+		next.Storage = current.Storage
+		notes = append(notes, fmt.Sprintf("storage is %s, configured %s: storage cannot change in place; delete the bucket and leaf-sync recreates and refills it",
+			strings.ToLower(current.Storage.String()), strings.ToLower(want.Storage.String())))
+	}
+	if want.MaxBytes > 0 && uint64(want.MaxBytes) < size {
+		next.MaxBytes = current.MaxBytes
+		notes = append(notes, fmt.Sprintf("holds %d bytes, more than max_bytes %d; keeping the current cap", size, want.MaxBytes))
+	}
+
+	if current.History != next.History {
+		changes = append(changes, fmt.Sprintf("history %d -> %d", current.History, next.History))
+	}
+	if max(current.Replicas, 1) != max(next.Replicas, 1) {
+		changes = append(changes, fmt.Sprintf("replicas %d -> %d", max(current.Replicas, 1), max(next.Replicas, 1)))
+	}
+	// JetStream reports "no cap" as -1; leaf-sync writes it as 0.
+	if max(current.MaxBytes, 0) != max(next.MaxBytes, 0) {
+		changes = append(changes, fmt.Sprintf("max_bytes %d -> %d", max(current.MaxBytes, 0), max(next.MaxBytes, 0)))
+	}
+	if current.Compression != next.Compression {
+		changes = append(changes, fmt.Sprintf("compression %t -> %t", current.Compression, next.Compression))
+	}
+	if current.Description != next.Description {
+		changes = append(changes, "description")
+	}
+	return next, changes, notes
+}
+
+// jsReplicasNotSupported is the JetStream error a server outside a cluster
+// answers a request for more than one replica with.
+const jsReplicasNotSupported jetstream.ErrorCode = 10074
+
+// relaxBucketConfig returns cfg with one replica when err is the server's
+// refusal of its replicas, and dropped naming what was asked for. ok is false
+// for any other error, or none.
+func relaxBucketConfig(cfg jetstream.KeyValueConfig, err error) (next jetstream.KeyValueConfig, dropped string, ok bool) {
+	var jsErr jetstream.JetStreamError
+	if cfg.Replicas <= 1 || !errors.As(err, &jsErr) || jsErr.APIError() == nil ||
+		jsErr.APIError().ErrorCode != jsReplicasNotSupported {
+		return cfg, "", false
+	}
+	next = cfg
+	next.Replicas = 1
+	return next, fmt.Sprintf("replicas %d", cfg.Replicas), true
+}
+
+// ValidateBucketSettings reports whether raw, decoded JSON, is a settings map
+// leaf-sync would accept. The control plane checks leaf_nodes.kv_buckets with
+// it on save, so a typo is a form error rather than a warning in a log on the
+// edge.
+func ValidateBucketSettings(raw any) error {
+	_, err := parseBucketSettings(raw)
+	return err
+}
@@ -0,0 +1,151 @@
+package leafsync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestBucketLayersMostSpecificWins(t *testing.T) {
+	record, err := parseBucketSettings(map[string]any{
+		"default": map[string]any{"history": float64(20), "replicas": float64(3)},
+		"things":  map[string]any{"storage": "memory", "max_bytes": float64(4096)},
+	})
+	if err != nil {
+		t.Fatalf("record settings: %v", err)
+	}
+	yaml, err := parseBucketSettings(map[string]any{
+		"default": map[string]any{"replicas": 1},
+		"things":  map[string]any{"history": 2},
+	})
+	if err != nil {
+		t.Fatalf("yaml settings: %v", err)
+	}
+	layers := bucketLayers{record, yaml}
+
+	things := layers.config("things")
+	if things.History != 2 || things.Replicas != 1 || things.Storage != jetstream.MemoryStorage || things.MaxBytes != 4096 {
+		t.Errorf("things = %+v", things)
+	}
+	locs := layers.config("locations")
+	if locs.History != 20 || locs.Replicas != 1 || locs.Storage != jetstream.FileStorage || locs.MaxBytes != 0 {
+		t.Errorf("locations = %+v", locs)
+	}
+	if locs.Bucket != "locations" || locs.Description != mirrorBucketConfig("locations").Description {
+		t.Errorf("locations lost its name or description: %+v", locs)
+	}
+}
+
+func TestBucketLayersUnsetKeepsBuiltIn(t *testing.T) {
+	if got, want := (bucketLayers{nil, nil}).config("things"), mirrorBucketConfig("things"); !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseBucketSettingsRejects(t *testing.T) {
+	for name, raw := range map[string]any{
+		"not a map":          []any{"things"},
+		"entry not a map":    map[string]any{"things": 5},
+		"unknown collection": map[string]any{"leaf_nodes": map[string]any{"history": 2}},
+		"unknown setting":    map[string]any{"things": map[string]any{"ttl": "1h"}},
+		"history zero":       map[string]any{"things": map[string]any{"history": float64(0)}},
+		"fractional":         map[string]any{"things": map[string]any{"history": 2.5}},
+		"replicas too many":  map[string]any{"things": map[string]any{"replicas": float64(7)}},
+		"negative max_bytes": map[string]any{"things": map[string]any{"max_bytes": float64(-1)}},
+		"storage not string": map[string]any{"things": map[string]any{"storage": true}},
+		"compression string": map[string]any{"things": map[string]any{"compression": "yes"}},
+	} {
+		if _, err := parseBucketSettings(raw); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := ValidateBucketSettings(nil); err != nil {
+		t.Errorf("nil settings: %v", err)
+	}
+}
+
+func TestPlanBucketUpdateMatching(t *testing.T) {
+	current := mirrorBucketConfig("things")
+	current.MaxBytes = -1 // how JetStream reports no cap
+	_, changes, notes := planBucketUpdate(current, 100, mirrorBucketConfig("things"))
+	if len(changes) != 0 || len(notes) != 0 {
+		t.Errorf("changes %v, notes %v; want none", changes, notes)
+	}
+}
+
+func TestPlanBucketUpdateAppliesWhatItCan(t *testing.T) {
+	current := mirrorBucketConfig("things")
+	want := current
+	want.History = 10
+	want.Compression = true
+	want.MaxBytes = 1 << 20
+	next, changes, notes := planBucketUpdate(current, 4096, want)
+	if !reflect.DeepEqual(next, want) {
+		t.Errorf("next = %+v, want %+v", next, want)
+	}
+	if len(changes) != 3 || len(notes) != 0 {
+		t.Errorf("changes %v, notes %v", changes, notes)
+	}
+}
+
+func TestPlanBucketUpdateKeepsStorage(t *testing.T) {
+	current := mirrorBucketConfig("things")
+	want := current
+	want.Storage = jetstream.MemoryStorage
+	next, changes, notes := planBucketUpdate(current, 0, want)
+	if next.Storage != jetstream.FileStorage {
+		t.Errorf("storage changed in place: %+v", next)
+	}
+	if len(changes) != 0 {
+		t.Errorf("changes = %v; want none", changes)
+	}
+	if len(notes) != 1 || !strings.Contains(notes[0], "delete the bucket") {
+		t.Errorf("notes = %v", notes)
+	}
+}
+
+func TestPlanBucketUpdateKeepsCapBelowUsage(t *testing.T) {
+	current := mirrorBucketConfig("things")
+	current.MaxBytes = -1
+	want := mirrorBucketConfig("things")
+	want.MaxBytes = 1000
+	want.History = 1
+	next, changes, notes := planBucketUpdate(current, 5000, want)
+	if next.MaxBytes != -1 || next.History != 1 {
+		t.Errorf("next = %+v", next)
+	}
+	if len(changes) != 1 || len(notes) != 1 {
+		t.Errorf("changes %v, notes %v", changes, notes)
+	}
+}
+
+func TestRelaxBucketConfigOnlyOnTheReplicasRefusal(t *testing.T) {
+	cfg := mirrorBucketConfig("things")
+	cfg.Replicas = 3
+	cfg.Compression = true
+	refusal := &jetstream.APIError{Code: 500, ErrorCode: jsReplicasNotSupported,
+		Description: "replicas > 1 not supported in non-clustered mode"}
+
+	next, dropped, ok := relaxBucketConfig(cfg, fmt.Errorf("create: %w", refusal))
+	if !ok || dropped != "replicas 3" || next.Replicas != 1 || !next.Compression {
+		t.Fatalf("refusal: %q %v %+v", dropped, ok, next)
+	}
+	for _, err := range []error{
+		nil,
+		context.DeadlineExceeded,
+		jetstream.ErrStreamNameAlreadyInUse,
+		&jetstream.APIError{Code: 400, ErrorCode: 10047, Description: "insufficient storage resources available"},
+	} {
+		if _, _, ok := relaxBucketConfig(cfg, err); ok {
+			t.Errorf("relaxed on %v", err)
+		}
+	}
+	cfg.Replicas = 1
+	if _, _, ok := relaxBucketConfig(cfg, refusal); ok {
+		t.Error("relaxed a single-replica config")
+	}
+}
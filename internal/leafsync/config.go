@@ -34,14 +34,49 @@ type Config struct {
 	// <OutputDir>/nats-leaf.conf, which is where `config` put it.
 	EmbeddedConfig string
 
+	// SyncInterval is how often `run` reconciles every collection while it has
+	// no realtime stream, and how often it publishes a heartbeat.
 	SyncInterval time.Duration
 
+	// Realtime subscribes `run` to PocketBase's record events and applies them
+	// as they arrive (see realtime.go). On by default; the agent falls back to
+	// polling every SyncInterval whenever the stream is down.
+	Realtime bool
+
+	// FullSyncInterval is how often the reconcile runs as a safety net while
+	// the realtime stream is up. Never less than SyncInterval.
+	FullSyncInterval time.Duration
+
+	// StateFile is where `run` persists the content hashes of what it wrote
+	// (see state.go). Empty means <OutputDir>/leaf-sync-state.json.
+	StateFile string
+
+	// FullSyncEvery makes every Nth reconcile of a collection a full one, and
+	// the rest incremental (see incremental.go). 1 makes every reconcile full.
+	FullSyncEvery int
+
 	// TwinEnabled turns on digital-twin sync between the local leaf domain and
 	// the hub (see twin.go): a server-maintained mirror of `twin_desired` down,
 	// and a relay of `twin` up. Off by default — it moves data plane traffic, so
 	// an upgrade must not silently start doing it. Requires HubDomain.
 	TwinEnabled bool
 
+	// Relations annotates each mirrored record with where the records its
+	// relation fields point to are mirrored, and RelationEmbed copies selected
+	// fields of those records in too (see relations.go). Off by default: it
+	// changes every mirrored value, so an upgrade must not do it unasked.
+	Relations     bool
+	RelationEmbed map[string]map[string][]string // collection -> relation field -> fields
+
+	// Indexes keeps the derived index buckets (indexes.go) alongside the
+	// mirrored ones. Off by default: they are extra buckets on every edge.
+	Indexes bool
+
+	// Buckets overrides the shape of the mirror buckets per collection, over
+	// the leaf node's own leaf_nodes.kv_buckets (see buckets.go). Empty keeps
+	// what the record says, or the built-in shape.
+	Buckets map[string]bucketSettings
+
 	// Reserved (off by default): optional account-JWT refresh + portable reload.
 	ReloadHook string
 	JWTRefresh bool
@@ -76,7 +111,13 @@ func LoadConfig(path string) (*Config, error) {
 	v.SetDefault("nats.embedded_config", "")
 	v.SetDefault("output.dir", ".")
 	v.SetDefault("sync.interval", "30s")
+	v.SetDefault("sync.realtime", true)
+	v.SetDefault("sync.full_interval", "10m")
+	v.SetDefault("sync.full_every", 10)
+	v.SetDefault("sync.state_file", "") // <output.dir>/leaf-sync-state.json, filled in below
 	v.SetDefault("twin.enabled", false)
+	v.SetDefault("relations.enabled", false)
+	v.SetDefault("indexes.enabled", false)
 	v.SetDefault("jwt_refresh.enabled", false)
 
 	if err := v.ReadInConfig(); err != nil {
@@ -89,6 +130,31 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid sync.interval: %w", err)
 	}
+	fullInterval, err := time.ParseDuration(v.GetString("sync.full_interval"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync.full_interval: %w", err)
+	}
+	// The full reconcile runs on a tick, so a shorter period would just mean
+	// every tick.
+	fullInterval = max(fullInterval, interval)
+	fullEvery := v.GetInt("sync.full_every")
+	if fullEvery < 1 {
+		return nil, fmt.Errorf("invalid sync.full_every: %d (must be at least 1)", fullEvery)
+	}
+
+	embed, err := parseRelationEmbed(v.Get("relations.embed"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid relations.embed: %w", err)
+	}
+	relations := v.GetBool("relations.enabled")
+	if len(embed) > 0 && !relations {
+		return nil, fmt.Errorf("relations.embed is set but relations.enabled is false")
+	}
+
+	buckets, err := parseBucketSettings(v.Get("buckets"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid buckets: %w", err)
+	}
 
 	cfg := &Config{
 		PocketBaseURL:      v.GetString("pocketbase.url"),
@@ -102,7 +168,15 @@ func LoadConfig(path string) (*Config, error) {
 		EmbedNATS:          v.GetBool("nats.embedded"),
 		EmbeddedConfig:     v.GetString("nats.embedded_config"),
 		SyncInterval:       interval,
+		Realtime:           v.GetBool("sync.realtime"),
+		FullSyncInterval:   fullInterval,
+		FullSyncEvery:      fullEvery,
+		StateFile:          v.GetString("sync.state_file"),
 		TwinEnabled:        v.GetBool("twin.enabled"),
+		Relations:          relations,
+		RelationEmbed:      embed,
+		Indexes:            v.GetBool("indexes.enabled"),
+		Buckets:            buckets,
 		ReloadHook:         v.GetString("reload_hook"),
 		JWTRefresh:         v.GetBool("jwt_refresh.enabled"),
 	}
@@ -113,6 +187,9 @@ func LoadConfig(path string) (*Config, error) {
 	if cfg.EmbeddedConfig == "" {
 		cfg.EmbeddedConfig = filepath.Join(cfg.OutputDir, LeafConfName)
 	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = filepath.Join(cfg.OutputDir, StateFileName)
+	}
 
 	if cfg.PocketBaseURL == "" || cfg.PocketBaseEmail == "" || cfg.PocketBasePassword == "" {
 		return nil, fmt.Errorf("pocketbase.url, pocketbase.email and pocketbase.password are required")
@@ -120,3 +197,62 @@ func LoadConfig(path string) (*Config, error) {
 
 	return cfg, nil
 }
+
+// parseRelationEmbed reads relations.embed — collection, then relation field,
+// then the list of fields to copy:
+//
+//	relations:
+//	  embed:
+//	    things:
+//	      type: [subject_prefix]
+//
+// Every collection and relation field must be one knownRelations has, so a
+// typo fails at startup rather than embedding nothing.
+func parseRelationEmbed(raw any) (map[string]map[string][]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	cols, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("want a map of collection to relation field to a list of fields")
+	}
+	out := make(map[string]map[string][]string, len(cols))
+	for col, rawFields := range cols {
+		rels, ok := rawFields.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: want a map of relation field to a list of fields", col)
+		}
+		for field, rawList := range rels {
+			if !hasRelation(col, field) {
+				return nil, fmt.Errorf("%s.%s is not a relation between syncable collections", col, field)
+			}
+			list, ok := rawList.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s.%s: want a list of fields", col, field)
+			}
+			var names []string
+			for _, item := range list {
+				name, _ := item.(string)
+				if name == "" || name == relField {
+					return nil, fmt.Errorf("%s.%s: %v is not a field name", col, field, item)
+				}
+				names = append(names, name)
+			}
+			if out[col] == nil {
+				out[col] = make(map[string][]string)
+			}
+			out[col][field] = names
+		}
+	}
+	return out, nil
+}
+
+// hasRelation reports whether col.field is one of knownRelations.
+func hasRelation(col, field string) bool {
+	for _, r := range knownRelations[col] {
+		if r.field == field {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 func writeConfig(t *testing.T, body string) string {
@@ -42,6 +44,18 @@ nats:
 	if cfg.SyncInterval != 30*time.Second {
 		t.Errorf("default sync.interval not applied: %v", cfg.SyncInterval)
 	}
+	if !cfg.Realtime || cfg.FullSyncInterval != 10*time.Minute {
+		t.Errorf("realtime defaults not applied: realtime=%t full_interval=%v", cfg.Realtime, cfg.FullSyncInterval)
+	}
+	if cfg.FullSyncEvery != 10 {
+		t.Errorf("default sync.full_every not applied: %d", cfg.FullSyncEvery)
+	}
+	if want := filepath.Join(".", StateFileName); cfg.StateFile != want {
+		t.Errorf("state_file should default to %q, got %q", want, cfg.StateFile)
+	}
+	if cfg.Relations || cfg.Indexes {
+		t.Errorf("relations and indexes should be opt-in: relations=%t indexes=%t", cfg.Relations, cfg.Indexes)
+	}
 	if cfg.EmbedNATS {
 		t.Error("nats.embedded should default to false — running the bus in-process is opt-in")
 	}
@@ -119,6 +133,20 @@ sync:
 	}
 }
 
+func TestLoadConfigRejectsFullEveryBelowOne(t *testing.T) {
+	path := writeConfig(t, `
+pocketbase:
+  url: https://pb.example.com
+  email: e
+  password: p
+sync:
+  full_every: 0
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected error for sync.full_every 0, got nil")
+	}
+}
+
 func TestLoadConfigEnvOverride(t *testing.T) {
 	path := writeConfig(t, `
 pocketbase:
@@ -138,3 +166,79 @@ nats:
 		t.Errorf("env var did not override file value, got %q", cfg.PocketBasePassword)
 	}
 }
+
+func TestLoadConfigRelations(t *testing.T) {
+	const base = `
+pocketbase:
+  url: https://pb.example.com
+  email: edge01@x.leaf.local
+  password: secret
+nats:
+  hub_leaf_url: nats-leaf://hub:7422
+`
+	cfg, err := LoadConfig(writeConfig(t, base+`
+relations:
+  enabled: true
+  embed:
+    things:
+      type: [subject_prefix, name]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !cfg.Relations {
+		t.Error("relations.enabled not read")
+	}
+	if got := cfg.RelationEmbed["things"]["type"]; len(got) != 2 || got[0] != "subject_prefix" || got[1] != "name" {
+		t.Errorf("relations.embed = %v", cfg.RelationEmbed)
+	}
+
+	for name, body := range map[string]string{
+		"unknown relation": "relations:\n  enabled: true\n  embed:\n    things:\n      owner: [name]\n",
+		"reserved field":   "relations:\n  enabled: true\n  embed:\n    things:\n      type: [_rel]\n",
+		"not a list":       "relations:\n  enabled: true\n  embed:\n    things:\n      type: name\n",
+		"not enabled":      "relations:\n  embed:\n    things:\n      type: [name]\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, base+body)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadConfigBuckets(t *testing.T) {
+	const base = `
+pocketbase:
+  url: https://pb.example.com
+  email: edge01@x.leaf.local
+  password: secret
+nats:
+  hub_leaf_url: nats-leaf://hub:7422
+`
+	cfg, err := LoadConfig(writeConfig(t, base+`
+buckets:
+  default:
+    history: 10
+  things:
+    storage: memory
+    max_bytes: 1048576
+    compression: true
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	got := bucketLayers{cfg.Buckets}.config("things")
+	if got.History != 10 || got.Storage != jetstream.MemoryStorage || got.MaxBytes != 1048576 || !got.Compression {
+		t.Errorf("things bucket = %+v", got)
+	}
+
+	for name, body := range map[string]string{
+		"unknown collection": "buckets:\n  users:\n    history: 2\n",
+		"unknown setting":    "buckets:\n  default:\n    ttl: 1h\n",
+		"history too large":  "buckets:\n  default:\n    history: 65\n",
+		"bad storage":        "buckets:\n  things:\n    storage: disk\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, base+body)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
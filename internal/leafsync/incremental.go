@@ -0,0 +1,141 @@
+package leafsync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+// Incremental reconcile.
+//
+// A full reconcile reads every record of every collection, so the load a fleet
+// of leaf nodes puts on the control plane grows with the size of their
+// organizations, every interval, whether or not anything changed. Most
+// reconciles are therefore incremental, and cost in proportion to what changed:
+//
+//   - the ids of the collection (fields=id), to find records that were deleted
+//     — a deleted record leaves nothing behind to match a filter;
+//   - the records whose `updated` is at or after the watermark, the latest
+//     `updated` seen so far, which are written exactly as a realtime event
+//     would be (applyEvent).
+//
+// Anything an incremental reconcile cannot settle on its own — a change that
+// moves another record's key, a record that appeared without being updated
+// (one a changed API rule made visible, say), a failed write — turns it into a
+// full reconcile on the spot. So does every fullEvery-th reconcile, which is
+// also what repairs a key deleted from KV out-of-band: an incremental one never
+// lists the bucket.
+
+// watermarkOverlap is how far before the watermark an incremental reconcile
+// starts reading. A record's `updated` is stamped before its transaction
+// commits, so a slow write can become visible with a stamp older than one a
+// faster write already published; re-reading a few seconds costs nothing, as
+// unchanged records are not rewritten.
+const watermarkOverlap = 5 * time.Second
+
+// pbTimeLayout is how PocketBase writes datetimes, in UTC. Parsing accepts the
+// fractional seconds whether or not they are there.
+const pbTimeLayout = "2006-01-02 15:04:05.000Z"
+
+// reconcileCollection brings one collection's bucket up to date: incrementally
+// when the last reconcile left a watermark and fewer than fullEvery-1
+// incremental reconciles have run since the last full one, in full otherwise.
+// It returns the number of records the collection has in KV.
+func reconcileCollection(ctx context.Context, pb recordLister, kv kvBucket, cache *syncCache, col string, fullEvery int) (int, error) {
+	if idx := cache.index[col]; idx != nil && idx.watermark != "" && !idx.needsFull && idx.incremental < fullEvery-1 {
+		n, ok, err := syncIncremental(ctx, pb, kv, cache, col)
+		if ok {
+			idx.incremental++
+			return n, err
+		}
+	}
+	return syncCollection(ctx, pb, kv, cache, col)
+}
+
+// syncIncremental applies what changed in a collection since its watermark.
+// ok is false when it could not, and the caller must reconcile in full; an
+// error with ok true is a fetch that failed, leaving KV as it was.
+func syncIncremental(ctx context.Context, pb recordLister, kv kvBucket, cache *syncCache, col string) (n int, ok bool, err error) {
+	idx := cache.index[col]
+	since, err := time.Parse(pbTimeLayout, idx.watermark)
+	if err != nil {
+		return 0, false, nil
+	}
+
+	ids, err := fetchIDs(ctx, pb, col)
+	if err != nil {
+		return len(idx.keys), true, err
+	}
+	// The same guard as syncCollection's: an empty answer for a collection we
+	// hold records of is far likelier a glitch than everything being deleted.
+	if len(ids) == 0 && len(idx.keys) > 0 {
+		log.Printf("⚠️ leaf-sync: %q listed 0 records but %d are mirrored; skipping purge this cycle", col, len(idx.keys))
+		return len(idx.keys), true, nil
+	}
+	filter := fmt.Sprintf("updated >= %q", since.Add(-watermarkOverlap).UTC().Format(pbTimeLayout))
+	changed, err := fetchRecords(ctx, pb, col, filter)
+	if err != nil {
+		return len(idx.keys), true, err
+	}
+
+	// Deletions first, so a handle a deleted record freed is seen as free.
+	for id := range idx.keys {
+		if ids[id] {
+			continue
+		}
+		reconcile, err := applyEvent(ctx, kv, cache, pbclient.Event{Collection: col, Action: "delete", Record: pbclient.Record{"id": id}})
+		if reconcile || err != nil {
+			return 0, false, nil
+		}
+	}
+	for _, rec := range changed {
+		reconcile, err := applyEvent(ctx, kv, cache, pbclient.Event{Collection: col, Action: "update", Record: rec})
+		if reconcile || err != nil {
+			return 0, false, nil
+		}
+	}
+	for id := range ids {
+		if _, known := idx.keys[id]; !known {
+			return 0, false, nil
+		}
+	}
+
+	if latest := latestUpdate(changed); latest > idx.watermark {
+		idx.watermark = latest
+	}
+	return len(idx.keys), true, nil
+}
+
+// fetchIDs reads the ids of every record of a collection.
+func fetchIDs(ctx context.Context, pb recordLister, col string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	for page := 1; ; page++ {
+		res, err := pb.ListIDs(ctx, col, page, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range res.Items {
+			if id, _ := item["id"].(string); id != "" {
+				ids[id] = true
+			}
+		}
+		if res.TotalPages == 0 || res.Page >= res.TotalPages {
+			return ids, nil
+		}
+	}
+}
+
+// latestUpdate returns the greatest `updated` among records, or "" if none has
+// one. PocketBase's datetime format sorts as text.
+func latestUpdate(records []pbclient.Record) string {
+	latest := ""
+	for _, rec := range records {
+		if u, _ := rec["updated"].(string); u > latest {
+			latest = u
+		}
+	}
+	return latest
+}
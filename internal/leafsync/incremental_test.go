@@ -0,0 +1,156 @@
+package leafsync
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+func stamped(id, code, updated string) pbclient.Record {
+	r := rec(id, code)
+	r["updated"] = updated
+	return r
+}
+
+func TestIncrementalReconcileReadsOnlyChanges(t *testing.T) {
+	ctx := context.Background()
+	kv := newFakeKV(nil)
+	cache := newSyncCache()
+	pb := &fakeLister{records: []pbclient.Record{
+		stamped("id1", "alpha", "2026-10-01 10:00:00.000Z"),
+		stamped("id2", "beta", "2026-10-01 11:00:00.000Z"),
+		stamped("id3", "gamma", "2026-10-01 12:00:00.000Z"),
+	}}
+	if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+		t.Fatalf("full: %v", err)
+	}
+
+	// beta changes, gamma is deleted.
+	changed := stamped("id2", "beta", "2026-10-02 09:00:00.000Z")
+	changed["name"] = "renamed"
+	pb.records = []pbclient.Record{pb.records[0], changed}
+	pb.changed = []pbclient.Record{changed}
+	pb.calls = 0
+	kv.puts, kv.deletes = nil, nil
+
+	n, err := reconcileCollection(ctx, pb, kv, cache, "things", 10)
+	if err != nil || n != 2 {
+		t.Fatalf("incremental = %d, %v", n, err)
+	}
+	if pb.calls != 1 || !reflect.DeepEqual(pb.filters, []string{`updated >= "2026-10-01 11:59:55.000Z"`}) {
+		t.Errorf("fetched %d times with filters %v; want one read from the watermark less the overlap", pb.calls, pb.filters)
+	}
+	if !reflect.DeepEqual(kv.puts, []string{"beta"}) || !reflect.DeepEqual(kv.deletes, []string{"gamma"}) {
+		t.Errorf("puts %v deletes %v", kv.puts, kv.deletes)
+	}
+	if wm := cache.index["things"].watermark; wm != "2026-10-02 09:00:00.000Z" {
+		t.Errorf("watermark not advanced: %q", wm)
+	}
+}
+
+func TestIncrementalReconcileRunsFullEveryNth(t *testing.T) {
+	ctx := context.Background()
+	kv := newFakeKV(nil)
+	cache := newSyncCache()
+	pb := &fakeLister{records: []pbclient.Record{stamped("id1", "alpha", "2026-10-01 10:00:00.000Z")}}
+
+	var full []bool
+	for i := 0; i < 5; i++ {
+		before := len(pb.filters)
+		if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 3); err != nil {
+			t.Fatal(err)
+		}
+		full = append(full, len(pb.filters) == before)
+	}
+	if want := []bool{true, false, false, true, false}; !reflect.DeepEqual(full, want) {
+		t.Errorf("full reconciles %v, want %v", full, want)
+	}
+
+	// 1 means always full: the behaviour before incremental reconciles.
+	pb.filters = nil
+	for i := 0; i < 3; i++ {
+		if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(pb.filters) != 0 {
+		t.Errorf("full_every 1 still reconciled incrementally: %v", pb.filters)
+	}
+}
+
+// What an incremental reconcile cannot settle from the changed records alone
+// falls back to a full one in the same call.
+func TestIncrementalReconcileFallsBackToFull(t *testing.T) {
+	ctx := context.Background()
+	base := []pbclient.Record{stamped("id1", "alpha", "2026-10-01 10:00:00.000Z")}
+
+	t.Run("record appeared without an update", func(t *testing.T) {
+		kv, cache := newFakeKV(nil), newSyncCache()
+		pb := &fakeLister{records: base}
+		if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+			t.Fatal(err)
+		}
+		pb.records = append(base, stamped("id2", "beta", "2026-09-01 00:00:00.000Z"))
+		pb.calls = 0
+		if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+			t.Fatal(err)
+		}
+		if got := kv.storedKeys(); !reflect.DeepEqual(got, []string{"alpha", "beta"}) {
+			t.Errorf("keys %v, want [alpha beta]", got)
+		}
+		if pb.calls != 2 {
+			t.Errorf("List called %d times, want the incremental read then the full one", pb.calls)
+		}
+	})
+
+	t.Run("handle became shared", func(t *testing.T) {
+		kv, cache := newFakeKV(nil), newSyncCache()
+		pb := &fakeLister{records: append(base, stamped("id2", "beta", "2026-10-01 10:00:00.000Z"))}
+		if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+			t.Fatal(err)
+		}
+		clash := stamped("id2", "alpha", "2026-10-02 00:00:00.000Z")
+		pb.records = []pbclient.Record{base[0], clash}
+		pb.changed = []pbclient.Record{clash}
+		if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+			t.Fatal(err)
+		}
+		if got := kv.storedKeys(); !reflect.DeepEqual(got, []string{"id1", "id2"}) {
+			t.Errorf("keys %v, want both records under their ids", got)
+		}
+	})
+
+	t.Run("no updated field", func(t *testing.T) {
+		kv, cache := newFakeKV(nil), newSyncCache()
+		pb := &fakeLister{records: []pbclient.Record{rec("id1", "alpha")}}
+		for i := 0; i < 2; i++ {
+			if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(pb.filters) != 0 {
+			t.Errorf("reconciled incrementally without a watermark: %v", pb.filters)
+		}
+	})
+}
+
+// A full reconcile whose writes partly failed leaves no watermark, so the
+// record that failed is fetched again by the next (full) reconcile.
+func TestFailedFullReconcileLeavesNoWatermark(t *testing.T) {
+	ctx := context.Background()
+	kv, cache := newFakeKV(nil), newSyncCache()
+	kv.failPut["alpha"] = true
+	pb := &fakeLister{records: []pbclient.Record{stamped("id1", "alpha", "2026-10-01 10:00:00.000Z")}}
+	if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err == nil {
+		t.Fatal("expected the failed write to be reported")
+	}
+	delete(kv.failPut, "alpha")
+	if _, err := reconcileCollection(ctx, pb, kv, cache, "things", 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(pb.filters) != 0 || kv.store["alpha"] == nil {
+		t.Errorf("retry was incremental (%v) or did not write: %v", pb.filters, kv.storedKeys())
+	}
+}
@@ -0,0 +1,349 @@
+package leafsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"platform/internal/subjectresolver"
+)
+
+// Derived index buckets.
+//
+// Edge automations keep asking the same few questions of the mirror — every
+// thing at a location and below it, every thing of a type, which thing a
+// subject belongs to — and the mirrored buckets can only answer them by
+// listing and decoding every key of `things`. With indexes.enabled, leaf-sync
+// also keeps the answers, each in a bucket of its own:
+//
+//	idx_location_ancestry  location key -> {"path": [root, ..., location]}
+//	idx_location_things    location key -> {"things": [...], "subtree": [...]}
+//	idx_thing_type_things  thing type key -> {"things": [...]}
+//	idx_subject_things     subject -> {"things": [{"key", "operation", "capability"}]}
+//
+// Every value names records by their key in the mirrored bucket, so a consumer
+// goes straight from an index to `things/<key>`. `things` is what is directly
+// at the location; `subtree` adds everything at the locations below it.
+//
+// The indexes are computed from the mirror indexes the reconciles and realtime
+// events already keep (mirrorIndex.records), so they cost no extra fetch, and
+// are written like the mirror itself: only the keys whose value changed, with
+// the hashes in the syncCache. After a cycle the buckets are listed, as a full
+// reconcile lists its bucket, to repair keys removed out-of-band; after an
+// event they are not, and only the indexes derived from the event's collection
+// are recomputed (indexesFedBy).
+//
+// An index is only built while every collection it is derived from is
+// mirrored and has been reconciled at least once, so a collection that failed
+// to load never empties an index that was right a moment ago.
+
+const (
+	indexLocationAncestry = "idx_location_ancestry"
+	indexLocationThings   = "idx_location_things"
+	indexThingTypeThings  = "idx_thing_type_things"
+	indexSubjectThings    = "idx_subject_things"
+)
+
+// indexSources are the collections each index is derived from. Every one must
+// be mirrored for the index to be kept.
+var indexSources = map[string][]string{
+	indexLocationAncestry: {"locations"},
+	indexLocationThings:   {"locations", "things"},
+	indexThingTypeThings:  {"thing_types", "things"},
+	indexSubjectThings:    {"things", "thing_types", "thing_type_operations"},
+}
+
+// indexOptionalSources are collections an index reads when they are mirrored
+// but is kept without: idx_subject_things resolves {location} from locations.
+var indexOptionalSources = map[string][]string{
+	indexSubjectThings: {"locations"},
+}
+
+// indexOrder is the order indexes are written in; also what
+// derivedIndexes returns them in.
+var indexOrder = []string{indexLocationAncestry, indexLocationThings, indexThingTypeThings, indexSubjectThings}
+
+// derivedIndexes returns the indexes collections can feed.
+func derivedIndexes(collections []string) []string {
+	mirrored := make(map[string]bool, len(collections))
+	for _, col := range collections {
+		mirrored[col] = true
+	}
+	var out []string
+next:
+	for _, name := range indexOrder {
+		for _, src := range indexSources[name] {
+			if !mirrored[src] {
+				continue next
+			}
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+// indexesFedBy returns those of indexes derived from collection col, in the
+// same order. A realtime event can only move those; rebuilding the rest would
+// cost a pass over the mirror per event and find nothing to write.
+func indexesFedBy(indexes []string, col string) []string {
+	var out []string
+	for _, name := range indexes {
+		if slices.Contains(indexSources[name], col) || slices.Contains(indexOptionalSources[name], col) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// kvKeyPattern is what NATS accepts as a KV key. A resolved subject is a
+// valid key unless it still holds a wildcard or a variable.
+var kvKeyPattern = regexp.MustCompile(`^[-/_=a-zA-Z0-9]+(\.[-/_=a-zA-Z0-9]+)*$`)
+
+// thingRef is one thing in an idx_subject_things value.
+type thingRef struct {
+	Key        string `json:"key"`
+	Operation  string `json:"operation"`
+	Capability string `json:"capability"`
+}
+
+// buildIndex computes the content of one index from the mirror. ok is false
+// when a collection it is derived from has not been reconciled yet.
+func (c *syncCache) buildIndex(name string) (want map[string]any, ok bool) {
+	for _, src := range indexSources[name] {
+		if c.index[src] == nil {
+			return nil, false
+		}
+	}
+	switch name {
+	case indexLocationAncestry:
+		want = make(map[string]any)
+		for id, key := range c.index["locations"].keys {
+			want[key] = map[string]any{"path": c.ancestry(id)}
+		}
+	case indexLocationThings:
+		want = c.locationThings()
+	case indexThingTypeThings:
+		want = c.typeThings()
+	case indexSubjectThings:
+		want = c.subjectThings()
+	default:
+		return nil, false
+	}
+	return want, true
+}
+
+// ancestry returns the keys of a location's ancestors, root first, ending with
+// its own. It stops at a parent the mirror does not hold, and at a cycle.
+func (c *syncCache) ancestry(id string) []string {
+	locs := c.index["locations"]
+	var path []string
+	seen := make(map[string]bool)
+	for id != "" && !seen[id] {
+		key, ok := locs.keys[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		path = append(path, key)
+		id, _ = locs.records[id]["parent"].(string)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+func (c *syncCache) locationThings() map[string]any {
+	locs, things := c.index["locations"], c.index["things"]
+	direct := make(map[string][]string, len(locs.keys))
+	subtree := make(map[string][]string, len(locs.keys))
+	for id, key := range things.keys {
+		loc, _ := things.records[id]["location"].(string)
+		locKey, ok := locs.keys[loc]
+		if !ok {
+			continue
+		}
+		direct[locKey] = append(direct[locKey], key)
+		for _, anc := range c.ancestry(loc) {
+			subtree[anc] = append(subtree[anc], key)
+		}
+	}
+	want := make(map[string]any, len(locs.keys))
+	for _, key := range locs.keys {
+		want[key] = map[string]any{"things": sorted(direct[key]), "subtree": sorted(subtree[key])}
+	}
+	return want
+}
+
+func (c *syncCache) typeThings() map[string]any {
+	types, things := c.index["thing_types"], c.index["things"]
+	byType := make(map[string][]string, len(types.keys))
+	for id, key := range things.keys {
+		typeID, _ := things.records[id]["type"].(string)
+		if typeKey, ok := types.keys[typeID]; ok {
+			byType[typeKey] = append(byType[typeKey], key)
+		}
+	}
+	want := make(map[string]any, len(types.keys))
+	for _, key := range types.keys {
+		want[key] = map[string]any{"things": sorted(byType[key])}
+	}
+	return want
+}
+
+// subjectThings resolves every operation of every thing's type against the
+// thing, as the server does when it grants the thing its permissions. A
+// subject that does not resolve to a concrete one — a wildcard, or a variable
+// the mirror has no value for, such as {org} (a leaf node cannot read its
+// organization) or {location} for a thing without one — is not indexed.
+func (c *syncCache) subjectThings() map[string]any {
+	things, types, ops := c.index["things"], c.index["thing_types"], c.index["thing_type_operations"]
+	locs := c.index["locations"] // optional: only {location} needs it
+
+	refs := make(map[string][]thingRef)
+	for id, key := range things.keys {
+		thing := things.records[id]
+		typeID, _ := thing["type"].(string)
+		tt, ok := types.records[typeID]
+		if !ok {
+			continue
+		}
+		ctx := subjectresolver.ThingContext{Thing: stringField(thing, "code"), ThingTypeCode: stringField(tt, "code")}
+		if ctx.Thing == "" {
+			ctx.Thing = id
+		}
+		if locs != nil {
+			loc, _ := thing["location"].(string)
+			ctx.Location = stringField(locs.records[loc], "code")
+		}
+		opIDs, _ := tt["operations"].([]any)
+		for _, raw := range opIDs {
+			opID, _ := raw.(string)
+			op, ok := ops.records[opID]
+			if !ok {
+				continue
+			}
+			subject := subjectresolver.ResolveThing(subjectresolver.Join(stringField(tt, "subject_prefix"), stringField(op, "subject_suffix")), ctx)
+			if !kvKeyPattern.MatchString(subject) {
+				continue
+			}
+			refs[subject] = append(refs[subject], thingRef{Key: key, Operation: stringField(op, "name"), Capability: stringField(op, "capability")})
+		}
+	}
+	want := make(map[string]any, len(refs))
+	for subject, list := range refs {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Key != list[j].Key {
+				return list[i].Key < list[j].Key
+			}
+			return list[i].Operation < list[j].Operation
+		})
+		want[subject] = map[string]any{"things": list}
+	}
+	return want
+}
+
+// refreshIndexes brings every index bucket in names up to date with the
+// mirror, returning an error per index that failed, for the heartbeat. full
+// lists each bucket rather than trusting the cache for what it holds.
+func refreshIndexes(ctx context.Context, open func(context.Context, string) (kvBucket, error), cache *syncCache, names []string, full bool) []string {
+	var errs []string
+	for _, name := range names {
+		want, ok := cache.buildIndex(name)
+		if !ok {
+			continue
+		}
+		kv, err := open(ctx, name)
+		if err == nil {
+			err = writeIndex(ctx, kv, cache, name, want, full)
+		}
+		if err != nil {
+			log.Printf("leaf-sync: index %q: %v", name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return errs
+}
+
+// writeIndex puts the keys of want whose value changed and deletes the keys
+// want no longer has. Without full, what the bucket holds is taken from the
+// cache, which is what an event-sized refresh can afford.
+func writeIndex(ctx context.Context, kv kvBucket, cache *syncCache, name string, want map[string]any, full bool) error {
+	var existing []string
+	present := make(map[string]bool)
+	if full {
+		keys, err := kv.Keys(ctx)
+		if err != nil && !errors.Is(err, jetstream.ErrNoKeysFound) {
+			return fmt.Errorf("kv keys: %w", err)
+		}
+		existing = keys
+	} else {
+		for key := range cache.seen[name] {
+			existing = append(existing, key)
+		}
+	}
+	for _, key := range existing {
+		present[key] = true
+	}
+
+	desired := make(map[string]bool, len(want))
+	changed, failed := 0, 0
+	for key, v := range want {
+		desired[key] = true
+		payload, err := json.Marshal(v)
+		if err != nil {
+			failed++
+			continue
+		}
+		sum := sha256.Sum256(payload)
+		if cache.unchanged(name, key, sum) && present[key] {
+			continue
+		}
+		if _, err := kv.Put(ctx, key, payload); err != nil {
+			log.Printf("leaf-sync: kv put %s/%s: %v", name, key, err)
+			failed++
+			continue
+		}
+		cache.remember(name, key, sum)
+		changed++
+	}
+	for _, key := range keysToDelete(existing, desired) {
+		if err := kv.Delete(ctx, key); err != nil {
+			log.Printf("leaf-sync: kv delete %s/%s: %v", name, key, err)
+			failed++
+			continue
+		}
+		cache.forget(name, key)
+	}
+	if changed > 0 {
+		log.Printf("leaf-sync: %s: wrote %d changed of %d keys", name, changed, len(want))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d keys failed to write", failed, len(want))
+	}
+	return nil
+}
+
+// stringField returns rec[field] if it is a string, else "".
+func stringField(rec map[string]any, field string) string {
+	s, _ := rec[field].(string)
+	return s
+}
+
+// sorted sorts keys in place and returns them, never nil, so an empty list is
+// written as [] rather than null.
+func sorted(keys []string) []string {
+	if keys == nil {
+		return []string{}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,187 @@
+package leafsync
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+// indexFixture mirrors a small site — site > bldg-a > floor-1, a sensor type
+// with one concrete and one wildcard operation, two sensors — and returns the
+// cache and the fake index buckets.
+func indexFixture(t *testing.T) (*syncCache, map[string]*fakeKV, func(context.Context, string) (kvBucket, error)) {
+	t.Helper()
+	ctx := context.Background()
+	cache := newSyncCache()
+	loc := func(id, code, parent string) pbclient.Record {
+		r := rec(id, code)
+		r["parent"] = parent
+		return r
+	}
+	thing := func(id, code, location string) pbclient.Record {
+		r := thingOf(id, code, "t1")
+		r["location"] = location
+		return r
+	}
+	op := func(id, name, capability, suffix string) pbclient.Record {
+		r := rec(id, "")
+		r["name"], r["capability"], r["subject_suffix"] = name, capability, suffix
+		return r
+	}
+	sensor := typeRecord("t1", "sensor", "")
+	sensor["operations"] = []any{"o1", "o2"}
+	for col, records := range map[string][]pbclient.Record{
+		"locations":             {loc("l1", "site", ""), loc("l2", "bldg-a", "l1"), loc("l3", "floor-1", "l2")},
+		"thing_types":           {sensor},
+		"thing_type_operations": {op("o1", "telemetry", "publish", "telemetry"), op("o2", "commands", "subscribe", "cmd.>")},
+		"things":                {thing("s1", "S01", "l3"), thing("s2", "S02", "l2")},
+	} {
+		if _, err := syncCollection(ctx, &fakeLister{records: records}, newFakeKV(nil), cache, col); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kvs := make(map[string]*fakeKV)
+	open := func(_ context.Context, name string) (kvBucket, error) {
+		if kvs[name] == nil {
+			kvs[name] = newFakeKV(nil)
+		}
+		return kvs[name], nil
+	}
+	return cache, kvs, open
+}
+
+func indexValue(t *testing.T, kv *fakeKV, key string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(kv.store[key], &v); err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	return v
+}
+
+func TestRefreshIndexesBuildsEveryIndex(t *testing.T) {
+	cache, kvs, open := indexFixture(t)
+	names := derivedIndexes([]string{"things", "locations", "thing_types", "thing_type_operations"})
+	if errs := refreshIndexes(context.Background(), open, cache, names, true); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for _, c := range []struct {
+		index, key string
+		want       string
+	}{
+		{indexLocationAncestry, "floor-1", `{"path":["site","bldg-a","floor-1"]}`},
+		{indexLocationAncestry, "site", `{"path":["site"]}`},
+		{indexLocationThings, "site", `{"things":[],"subtree":["S01","S02"]}`},
+		{indexLocationThings, "bldg-a", `{"things":["S02"],"subtree":["S01","S02"]}`},
+		{indexLocationThings, "floor-1", `{"things":["S01"],"subtree":["S01"]}`},
+		{indexThingTypeThings, "sensor", `{"things":["S01","S02"]}`},
+		{indexSubjectThings, "floor-1.sensor.S01.telemetry", `{"things":[{"key":"S01","operation":"telemetry","capability":"publish"}]}`},
+	} {
+		var want any
+		if err := json.Unmarshal([]byte(c.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if got := indexValue(t, kvs[c.index], c.key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s/%s = %v, want %s", c.index, c.key, got, c.want)
+		}
+	}
+	// The wildcard subscribe subject is not a key; the two publish ones are.
+	if got := kvs[indexSubjectThings].storedKeys(); !reflect.DeepEqual(got, []string{"bldg-a.sensor.S02.telemetry", "floor-1.sensor.S01.telemetry"}) {
+		t.Errorf("subjects %v", got)
+	}
+}
+
+// A realtime event moves what it changed in the indexes and nothing else.
+func TestRefreshIndexesAfterEventWritesOnlyWhatMoved(t *testing.T) {
+	ctx := context.Background()
+	cache, kvs, open := indexFixture(t)
+	names := derivedIndexes([]string{"things", "locations", "thing_types", "thing_type_operations"})
+	if errs := refreshIndexes(ctx, open, cache, names, true); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	for _, kv := range kvs {
+		kv.puts, kv.deletes = nil, nil
+	}
+
+	moved := thingOf("s1", "S01", "t1")
+	moved["location"] = "l2"
+	if _, err := applyEvent(ctx, newFakeKV(nil), cache, pbclient.Event{Collection: "things", Action: "update", Record: moved}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := refreshIndexes(ctx, open, cache, names, false); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	puts := func(name string) []string {
+		p := append([]string(nil), kvs[name].puts...)
+		sort.Strings(p)
+		return p
+	}
+	if got := puts(indexLocationThings); !reflect.DeepEqual(got, []string{"bldg-a", "floor-1"}) {
+		t.Errorf("location_things puts %v, want [bldg-a floor-1]", got)
+	}
+	if got := puts(indexLocationAncestry); len(got) != 0 {
+		t.Errorf("ancestry rewritten: %v", got)
+	}
+	if got := puts(indexThingTypeThings); len(got) != 0 {
+		t.Errorf("type index rewritten: %v", got)
+	}
+	subjects := kvs[indexSubjectThings]
+	if !reflect.DeepEqual(subjects.puts, []string{"bldg-a.sensor.S01.telemetry"}) || !reflect.DeepEqual(subjects.deletes, []string{"floor-1.sensor.S01.telemetry"}) {
+		t.Errorf("subject puts %v deletes %v", subjects.puts, subjects.deletes)
+	}
+}
+
+// An index waits for every collection it is derived from, rather than being
+// written — and purged — from a partial mirror.
+func TestIndexWaitsForItsSources(t *testing.T) {
+	cache, kvs, open := indexFixture(t)
+	delete(cache.index, "things")
+	if errs := refreshIndexes(context.Background(), open, cache, derivedIndexes([]string{"things", "locations", "thing_types"}), true); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if _, ok := kvs[indexLocationThings]; ok {
+		t.Error("location_things written without things")
+	}
+	if _, ok := kvs[indexLocationAncestry]; !ok {
+		t.Error("ancestry, which needs only locations, was not written")
+	}
+}
+
+func TestDerivedIndexes(t *testing.T) {
+	if got := derivedIndexes([]string{"things", "locations"}); !reflect.DeepEqual(got, []string{indexLocationAncestry, indexLocationThings}) {
+		t.Errorf("got %v", got)
+	}
+	if got := derivedIndexes([]string{"message_schemas"}); got != nil {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestIndexesFedBy(t *testing.T) {
+	all := derivedIndexes([]string{"things", "locations", "thing_types", "thing_type_operations"})
+	// idx_subject_things does not need locations, but resolves {location} from it.
+	if got := indexesFedBy(all, "locations"); !reflect.DeepEqual(got, []string{indexLocationAncestry, indexLocationThings, indexSubjectThings}) {
+		t.Errorf("locations: got %v", got)
+	}
+	if got := indexesFedBy(all, "thing_type_operations"); !reflect.DeepEqual(got, []string{indexSubjectThings}) {
+		t.Errorf("thing_type_operations: got %v", got)
+	}
+	if got := indexesFedBy(all, "things"); len(got) != 3 {
+		t.Errorf("things: got %v", got)
+	}
+	if got := indexesFedBy(all, "message_schemas"); got != nil {
+		t.Errorf("message_schemas: got %v", got)
+	}
+}
+
+func TestSubjectIndexDoesNotNeedLocations(t *testing.T) {
+	got := derivedIndexes([]string{"things", "thing_types", "thing_type_operations"})
+	if !reflect.DeepEqual(got, []string{indexThingTypeThings, indexSubjectThings}) {
+		t.Errorf("got %v", got)
+	}
+}
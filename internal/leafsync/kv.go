@@ -3,6 +3,9 @@ package leafsync
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -34,25 +37,102 @@ func openOrCreateKV(ctx context.Context, js jetstream.JetStream, cfg jetstream.K
 // KV buckets. leaf-sync connects to the LOCAL leaf, so the default JetStream
 // context targets the leaf's local domain.
 type kvWriter struct {
-	js jetstream.JetStream
+	js       jetstream.JetStream
+	settings bucketLayers      // per-collection bucket settings (buckets.go)
+	notes    map[string]string // bucket -> what was last logged about settings it cannot take
 }
 
-func newKVWriter(nc *nats.Conn) (*kvWriter, error) {
+func newKVWriter(nc *nats.Conn, settings bucketLayers) (*kvWriter, error) {
 	js, err := jetstream.New(nc)
 	if err != nil {
 		return nil, err
 	}
-	return &kvWriter{js: js}, nil
+	return &kvWriter{js: js, settings: settings, notes: make(map[string]string)}, nil
 }
 
 // bucket returns (creating if needed) the KV bucket mirroring a collection.
 // These buckets are leaf-sync's alone — nothing else writes them — so unlike
-// the shared `twin`/`leaf_status` buckets it is safe to keep asserting config.
+// the shared `twin`/`leaf_status` buckets it is safe to keep asserting config:
+// the collection's bucket settings, as far as the existing bucket can take
+// them (planBucketUpdate). A bucket that refuses an update — replicas on a
+// single-server leaf, say — is used as it is, with a warning, rather than
+// failing the collection: it still mirrors.
+//
+// It runs before every reconcile, so a warning is logged when it first
+// appears or changes, not on every cycle.
 func (w *kvWriter) bucket(ctx context.Context, name string) (jetstream.KeyValue, error) {
+	want := w.settings.config(name)
+	kv, err := w.js.KeyValue(ctx, name)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		return w.create(ctx, want)
+	}
+	if err != nil {
+		return nil, err
+	}
+	status, err := kv.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := status.(*jetstream.KeyValueBucketStatus)
+	if !ok {
+		return kv, nil
+	}
+	next, changes, notes := planBucketUpdate(st.Config(), st.Bytes(), want)
+	if len(changes) > 0 {
+		updated, err := w.js.UpdateKeyValue(ctx, next)
+		if err == nil {
+			log.Printf("leaf-sync: bucket %q updated: %s", name, strings.Join(changes, ", "))
+			kv = updated
+		} else {
+			notes = append(notes, fmt.Sprintf("cannot apply %s: %v; using the bucket as it is", strings.Join(changes, ", "), err))
+		}
+	}
+	w.note(name, notes)
+	return kv, nil
+}
+
+// create creates a bucket with the resolved settings or, when a single-server
+// leaf refuses replicas above one, with one replica. A mirror with fewer
+// replicas than asked for beats no mirror, and failing the create on every
+// cycle would leave the collection unmirrored until someone read the log. The
+// shortfall is warned about here, and on later cycles by the update path, which
+// finds the bucket short of it. Any other error — a timeout, an account limit,
+// a bucket created meanwhile — is returned as it is, for the next cycle to
+// retry with the settings as configured.
+func (w *kvWriter) create(ctx context.Context, cfg jetstream.KeyValueConfig) (jetstream.KeyValue, error) {
+	kv, err := w.js.CreateKeyValue(ctx, cfg)
+	next, dropped, ok := relaxBucketConfig(cfg, err)
+	if !ok {
+		return kv, err
+	}
+	kv, err = w.js.CreateKeyValue(ctx, next)
+	if err != nil {
+		return nil, err
+	}
+	w.note(cfg.Bucket, []string{fmt.Sprintf("the server refused %s; created with 1 replica", dropped)})
+	return kv, nil
+}
+
+// note logs what a bucket cannot take, if it differs from what was logged last.
+func (w *kvWriter) note(name string, notes []string) {
+	msg := strings.Join(notes, "; ")
+	if w.notes[name] == msg {
+		return
+	}
+	w.notes[name] = msg
+	if msg != "" {
+		log.Printf("⚠️ leaf-sync: bucket %q: %s", name, msg)
+	}
+}
+
+// indexBucket returns (creating if needed) one of the derived index buckets
+// (indexes.go). leaf-sync's alone too, and just as disposable: everything in
+// it is recomputed from the mirror.
+func (w *kvWriter) indexBucket(ctx context.Context, name string) (jetstream.KeyValue, error) {
 	return w.js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
 		Bucket:      name,
-		Description: "leaf-sync mirror of PocketBase collection: " + name,
-		History:     5,
+		Description: "leaf-sync derived index: " + name,
+		History:     1,
 		Storage:     jetstream.FileStorage,
 	})
 }
@@ -1,7 +1,7 @@
 // Package pbclient is a tiny PocketBase REST client used by leaf-sync. PocketBase
 // has no official Go client SDK (official SDKs are JS/Dart), and leaf-sync only
-// needs a handful of read endpoints plus auth-with-password, so this stays
-// deliberately small.
+// needs a handful of read endpoints, auth-with-password and the realtime
+// subscription (realtime.go), so this stays deliberately small.
 package pbclient
 
 import (
@@ -28,12 +28,14 @@ type Client struct {
 	password   string
 	token      string
 	http       *http.Client
+	stream     *http.Client // no timeout: a realtime stream stays open
 }
 
 func New(baseURL string) *Client {
 	return &Client{
 		baseURL: strings.TrimRight(baseURL, "/"),
 		http:    &http.Client{Timeout: 30 * time.Second},
+		stream:  &http.Client{},
 	}
 }
 
@@ -82,16 +84,37 @@ func (c *Client) authenticate(ctx context.Context) (Record, error) {
 // get performs an authenticated GET, transparently re-authenticating once on 401
 // (handles token expiry for the long-running `run` daemon).
 func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	return c.send(ctx, http.MethodGet, path, query, nil, http.StatusOK)
+}
+
+// send performs an authenticated request with an optional JSON body, retrying
+// once after re-authenticating on 401, and fails unless the response status is
+// want.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any, want int) ([]byte, error) {
 	full := c.baseURL + path
 	if len(query) > 0 {
 		full += "?" + query.Encode()
 	}
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
 
 	do := func() (*http.Response, error) {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, full, nil)
+		var rd io.Reader
+		if payload != nil {
+			rd = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, full, rd)
 		if err != nil {
 			return nil, err
 		}
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
 		if c.token != "" {
 			req.Header.Set("Authorization", c.token)
 		}
@@ -115,8 +138,8 @@ func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte
 	defer resp.Body.Close()
 
 	b, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET %s (%d): %s", path, resp.StatusCode, strings.TrimSpace(string(b)))
+	if resp.StatusCode != want {
+		return nil, fmt.Errorf("%s %s (%d): %s", method, path, resp.StatusCode, strings.TrimSpace(string(b)))
 	}
 	return b, nil
 }
@@ -133,11 +156,24 @@ type ListResult struct {
 // List fetches one page of records from a collection.
 func (c *Client) List(ctx context.Context, collection string, page, perPage int, filter string) (*ListResult, error) {
 	q := url.Values{}
-	q.Set("page", strconv.Itoa(page))
-	q.Set("perPage", strconv.Itoa(perPage))
 	if filter != "" {
 		q.Set("filter", filter)
 	}
+	return c.list(ctx, collection, page, perPage, q)
+}
+
+// ListIDs fetches one page of a collection's record ids: items carry nothing
+// but "id", so checking which records still exist costs a fraction of
+// fetching them.
+func (c *Client) ListIDs(ctx context.Context, collection string, page, perPage int) (*ListResult, error) {
+	q := url.Values{}
+	q.Set("fields", "id")
+	return c.list(ctx, collection, page, perPage, q)
+}
+
+func (c *Client) list(ctx context.Context, collection string, page, perPage int, q url.Values) (*ListResult, error) {
+	q.Set("page", strconv.Itoa(page))
+	q.Set("perPage", strconv.Itoa(perPage))
 	b, err := c.get(ctx, "/api/collections/"+url.PathEscape(collection)+"/records", q)
 	if err != nil {
 		return nil, err
@@ -136,3 +136,27 @@ func TestGetRawReturnsBody(t *testing.T) {
 		t.Errorf("unexpected raw body: %s", b)
 	}
 }
+
+func TestListIDsRequestsOnlyIDs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("fields"); got != "id" {
+			t.Errorf("fields not restricted to id, got %q", got)
+		}
+		if got := r.URL.Query().Get("filter"); got != "" {
+			t.Errorf("unexpected filter %q", got)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"page": 1, "perPage": 500, "totalItems": 1, "totalPages": 1,
+			"items": []map[string]any{{"id": "x"}},
+		})
+	}))
+	defer ts.Close()
+
+	res, err := New(ts.URL).ListIDs(context.Background(), "things", 1, 500)
+	if err != nil {
+		t.Fatalf("ListIDs: %v", err)
+	}
+	if len(res.Items) != 1 || res.Items[0]["id"] != "x" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
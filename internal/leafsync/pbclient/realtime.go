@@ -0,0 +1,187 @@
+package pbclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// connectTimeout bounds how long Subscribe waits for the realtime connection to
+// be established and subscribed. The stream itself has no deadline.
+const connectTimeout = 30 * time.Second
+
+// Event is one record change delivered by a realtime subscription.
+type Event struct {
+	Collection string // collection the record belongs to
+	Action     string // "create", "update" or "delete"
+	Record     Record // the record after the change (before it, for a delete)
+}
+
+// Stream is an open realtime subscription. Events is closed when the stream
+// ends — the server went away, recycled the connection, or Close was called —
+// after which Err says why.
+type Stream struct {
+	Events <-chan Event
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Err returns why the stream ended: nil if it was closed, otherwise the read
+// error. It is only meaningful once Events is closed.
+func (s *Stream) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Close ends the stream and waits for its reader to finish.
+func (s *Stream) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// sseMessage is one server-sent event.
+type sseMessage struct {
+	name string
+	data string
+}
+
+// Subscribe opens PocketBase's realtime stream (GET /api/realtime) and
+// subscribes it to every record of collections. PocketBase authorizes the
+// subscription with the token sent along with it and delivers only the
+// changes the auth record may see by the collections' list rules — the same
+// records List returns.
+//
+// Events are not buffered across connections: whatever changes while no stream
+// is open is not delivered later, so a caller that keeps a copy must
+// re-read it after every (re)subscription. PocketBase also drops a stream that
+// has been idle for a few minutes; a caller is expected to reconnect.
+func (c *Client) Subscribe(ctx context.Context, collections []string) (*Stream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	connecting := time.AfterFunc(connectTimeout, cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/realtime", nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.stream.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	fail := func(err error) (*Stream, error) {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fail(fmt.Errorf("GET /api/realtime (%d): %s", resp.StatusCode, strings.TrimSpace(string(b))))
+	}
+
+	rd := bufio.NewReader(resp.Body)
+	first, err := readSSE(rd)
+	if err != nil {
+		return fail(fmt.Errorf("realtime connect: %w", err))
+	}
+	var hello struct {
+		ClientID string `json:"clientId"`
+	}
+	if first.name != "PB_CONNECT" || json.Unmarshal([]byte(first.data), &hello) != nil || hello.ClientID == "" {
+		return fail(fmt.Errorf("realtime connect: unexpected first event %q", first.name))
+	}
+
+	topics := make(map[string]string, len(collections))
+	subs := make([]string, 0, len(collections))
+	for _, col := range collections {
+		topic := col + "/*"
+		topics[topic] = col
+		subs = append(subs, topic)
+	}
+	if _, err := c.send(ctx, http.MethodPost, "/api/realtime", nil,
+		map[string]any{"clientId": hello.ClientID, "subscriptions": subs}, http.StatusNoContent); err != nil {
+		return fail(fmt.Errorf("realtime subscribe: %w", err))
+	}
+	if !connecting.Stop() {
+		return fail(errors.New("realtime subscribe: timed out"))
+	}
+
+	events := make(chan Event)
+	s := &Stream{Events: events, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer close(events)
+		defer resp.Body.Close()
+		for {
+			msg, err := readSSE(rd)
+			if err != nil {
+				if ctx.Err() == nil {
+					if errors.Is(err, io.EOF) {
+						err = errors.New("realtime stream closed by the server")
+					}
+					s.err = err
+				}
+				return
+			}
+			col, ok := topics[msg.name]
+			if !ok {
+				continue
+			}
+			var payload struct {
+				Action string `json:"action"`
+				Record Record `json:"record"`
+			}
+			if err := json.Unmarshal([]byte(msg.data), &payload); err != nil || payload.Record == nil {
+				continue
+			}
+			select {
+			case events <- Event{Collection: col, Action: payload.Action, Record: payload.Record}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// readSSE reads the next event of a text/event-stream: "field:value" lines up
+// to a blank line. Comment lines and events without data are skipped.
+func readSSE(rd *bufio.Reader) (sseMessage, error) {
+	var msg sseMessage
+	var data []string
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return sseMessage{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(data) == 0 {
+				msg = sseMessage{}
+				continue
+			}
+			msg.data = strings.Join(data, "\n")
+			return msg, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			msg.name = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pbclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// realtimeServer is a minimal PocketBase realtime endpoint: GET opens the
+// stream and sends PB_CONNECT, POST records the subscription, and whatever is
+// sent on push is written to the stream.
+func realtimeServer(t *testing.T, push <-chan string, subscribed chan<- []string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "id:c1\nevent:PB_CONNECT\ndata:{\"clientId\":\"c1\"}\n\n")
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case msg, ok := <-push:
+					if !ok {
+						return
+					}
+					fmt.Fprint(w, msg)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		case http.MethodPost:
+			if r.Header.Get("Authorization") != "tok" {
+				t.Errorf("subscription sent without the token: %q", r.Header.Get("Authorization"))
+			}
+			var body struct {
+				ClientID      string   `json:"clientId"`
+				Subscriptions []string `json:"subscriptions"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body.ClientID != "c1" {
+				t.Errorf("unexpected clientId %q", body.ClientID)
+			}
+			subscribed <- body.Subscriptions
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestSubscribeDeliversRecordEvents(t *testing.T) {
+	push := make(chan string, 4)
+	subscribed := make(chan []string, 1)
+	ts := realtimeServer(t, push, subscribed)
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.token = "tok"
+	s, err := c.Subscribe(context.Background(), []string{"things", "locations"})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if got := <-subscribed; len(got) != 2 || got[0] != "things/*" || got[1] != "locations/*" {
+		t.Errorf("unexpected subscriptions: %v", got)
+	}
+
+	push <- ": keep-alive comment\n\n"
+	push <- "id:c1\nevent:users/*\ndata:{\"action\":\"create\",\"record\":{\"id\":\"u\"}}\n\n"
+	push <- "id:c1\nevent:things/*\ndata:{\"action\":\"update\",\"record\":{\"id\":\"t1\",\"code\":\"S01\"}}\n\n"
+	close(push)
+
+	select {
+	case ev := <-s.Events:
+		if ev.Collection != "things" || ev.Action != "update" || ev.Record["code"] != "S01" {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	if _, ok := <-s.Events; ok {
+		t.Error("Events not closed when the server ended the stream")
+	}
+	if s.Err() == nil {
+		t.Error("a stream ended by the server reported no error")
+	}
+}
+
+func TestSubscribeCloseEndsStreamWithoutError(t *testing.T) {
+	push := make(chan string)
+	subscribed := make(chan []string, 1)
+	ts := realtimeServer(t, push, subscribed)
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.token = "tok"
+	s, err := c.Subscribe(context.Background(), []string{"things"})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	s.Close()
+	if _, ok := <-s.Events; ok {
+		t.Error("Events still open after Close")
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("Close reported %v", err)
+	}
+}
+
+func TestSubscribeRejectsNonRealtimeEndpoint(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello\n\n"))
+	}))
+	defer ts.Close()
+
+	if _, err := New(ts.URL).Subscribe(context.Background(), []string{"things"}); err == nil {
+		t.Error("expected an error when the first event is not PB_CONNECT")
+	}
+}
@@ -0,0 +1,265 @@
+package leafsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+// Realtime sync.
+//
+// Polling alone makes every edit wait up to a full sync interval to reach the
+// edge, and shortening the interval multiplies full fetches of every collection
+// for changes that are usually a handful of records. So `run` also holds a
+// PocketBase realtime subscription to the synced collections and applies each
+// record event to KV as it arrives. The reconcile (reconcileCollection) stays
+// the source of truth, demoted to a safety net:
+//
+//   - It runs whenever the stream (re)connects, because events that happen
+//     while no stream is open are never delivered. PocketBase recycles idle
+//     streams after a few minutes, so on a quiet system that is the reconcile's
+//     real cadence.
+//   - It runs every sync.full_interval while the stream is up, to repair
+//     anything an event could not (an out-of-band KV deletion, say).
+//   - It runs every sync.interval while the stream is down — the polling the
+//     agent always did — so a hub without realtime, or a proxy that breaks
+//     event streams, costs latency and nothing else.
+//
+// An event is applied only when its effect is confined to its own record. KV
+// keys are handles that depend on the other records of the collection (a code
+// shared by two records keys both by id), so an event that changes whether a
+// handle is shared is written as far as it goes and then leaves the collection
+// to a full reconcile on the next tick, which re-derives every key.
+
+// Backoff bounds for re-subscribing after the stream fails. Variables for the
+// same reason as authRetryMin/Max.
+var (
+	realtimeRetryMin = 2 * time.Second
+	realtimeRetryMax = 60 * time.Second
+)
+
+// mirrorIndex is what the last full reconcile of a collection decided, kept so
+// a realtime event can be applied without re-reading the collection: where
+// each record is keyed, and how many records share each handle.
+//
+// The incremental reconcile (incremental.go) works from it too, and keeps its
+// own progress here, so a full reconcile that rebuilds the index starts the
+// count towards the next one afresh.
+type mirrorIndex struct {
+	keys    map[string]string          // record id -> KV key
+	handles map[string]string          // record id -> candidate handle ("" for none)
+	counts  map[string]int             // candidate handle -> records that have it
+	records map[string]pbclient.Record // record id -> record as mirrored, for relations.go
+
+	watermark   string // latest `updated` reconciled; "" = next reconcile is full
+	incremental int    // incremental reconciles since the full one
+	needsFull   bool   // something asked for a full reconcile (syncCache.requireFull)
+}
+
+// newMirrorIndex indexes the records syncCollection keyed.
+func newMirrorIndex(keyed []keyedRecord, counts map[string]int) *mirrorIndex {
+	idx := &mirrorIndex{
+		keys:    make(map[string]string, len(keyed)),
+		handles: make(map[string]string, len(keyed)),
+		counts:  make(map[string]int, len(counts)),
+		records: make(map[string]pbclient.Record, len(keyed)),
+	}
+	for h, n := range counts {
+		idx.counts[h] = n
+	}
+	for _, kr := range keyed {
+		id, _ := kr.rec["id"].(string)
+		idx.keys[id] = kr.key
+		idx.handles[id] = candidateKey(kr.rec)
+		idx.records[id] = kr.rec
+	}
+	return idx
+}
+
+// drop removes a record from the index.
+func (idx *mirrorIndex) drop(id string) {
+	if h := idx.handles[id]; h != "" {
+		idx.counts[h]--
+		if idx.counts[h] == 0 {
+			delete(idx.counts, h)
+		}
+	}
+	delete(idx.keys, id)
+	delete(idx.handles, id)
+	delete(idx.records, id)
+}
+
+// add indexes a record under handle; its key is set by the caller once chosen.
+func (idx *mirrorIndex) add(id, handle string) {
+	idx.handles[id] = handle
+	if handle != "" {
+		idx.counts[handle]++
+	}
+}
+
+// applyEvent writes one realtime event to the collection's bucket. It reports
+// whether the collection needs a full reconcile, and has asked for one
+// (syncCache.requireFull): the event affected other records' keys, could not be
+// applied, or arrived before any reconcile indexed the collection. An error is
+// a KV write that failed, and also asks for one.
+//
+// An event that changes what records of other collections annotate this one
+// with asks for their full reconcile too (relations.go), but that is not
+// reported: it does not stop this collection's own reconcile being
+// incremental.
+func applyEvent(ctx context.Context, kv kvBucket, cache *syncCache, ev pbclient.Event) (reconcile bool, err error) {
+	col := ev.Collection
+	idx := cache.index[col]
+	id, _ := ev.Record["id"].(string)
+	if idx == nil || id == "" {
+		return true, nil
+	}
+	oldKey, known := idx.keys[id]
+	oldHandle := idx.handles[id]
+
+	embedded := cache.embedded(col)
+	before := idx.linkSignature(id, embedded)
+	defer func() {
+		if cache.referenced(col) && idx.linkSignature(id, embedded) != before {
+			cache.touchReferrers(col, true)
+		}
+		if reconcile {
+			cache.requireFull(col)
+		}
+	}()
+
+	switch ev.Action {
+	case "delete":
+		if !known {
+			return false, nil
+		}
+		if err := kv.Delete(ctx, oldKey); err != nil {
+			return true, fmt.Errorf("kv delete %s/%s: %w", col, oldKey, err)
+		}
+		cache.forget(col, oldKey)
+		idx.drop(id)
+		log.Printf("leaf-sync: %s/%s deleted", col, oldKey)
+		// The record that is left holding a formerly shared handle is owed it back.
+		return oldHandle != "" && idx.counts[oldHandle] == 1, nil
+	case "create", "update":
+	default:
+		return false, nil
+	}
+
+	rec := strip(ev.Record)
+	handle := candidateKey(rec)
+	idx.drop(id)
+	idx.add(id, handle)
+	key := recordKey(rec, idx.counts)
+	idx.records[id] = cache.annotate(col, rec)
+
+	// A handle that became shared moves the record already holding it to its id;
+	// one that stopped being shared moves the one left back to its handle.
+	if handle != oldHandle {
+		if known && oldHandle != "" && idx.counts[oldHandle] == 1 {
+			reconcile = true
+		}
+		if handle != "" && idx.counts[handle] == 2 {
+			reconcile = true
+		}
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return true, fmt.Errorf("marshal %s/%s: %w", col, key, err)
+	}
+	sum := sha256.Sum256(payload)
+	if !cache.unchanged(col, key, sum) {
+		if _, err := kv.Put(ctx, key, payload); err != nil {
+			return true, fmt.Errorf("kv put %s/%s: %w", col, key, err)
+		}
+		cache.remember(col, key, sum)
+		log.Printf("leaf-sync: %s/%s %sd", col, key, ev.Action)
+	}
+	idx.keys[id] = key
+
+	if known && oldKey != key {
+		if err := kv.Delete(ctx, oldKey); err != nil {
+			return true, fmt.Errorf("kv delete %s/%s: %w", col, oldKey, err)
+		}
+		cache.forget(col, oldKey)
+	}
+	return reconcile, nil
+}
+
+// subscriber is the slice of pbclient.Client the realtime feed needs.
+type subscriber interface {
+	Subscribe(ctx context.Context, collections []string) (*pbclient.Stream, error)
+}
+
+// feedStatus reports the realtime stream coming up or going down. since is
+// when the subscription was established, for an up report.
+type feedStatus struct {
+	up    bool
+	since time.Time
+}
+
+// runFeed keeps a realtime subscription to collections open until ctx is
+// cancelled, forwarding its events and reporting each time it comes up or goes
+// down. Failures are retried with backoff, reset by every stream that connects.
+func runFeed(ctx context.Context, sub subscriber, collections []string, events chan<- pbclient.Event, status chan<- feedStatus) {
+	report := func(s feedStatus) bool {
+		select {
+		case status <- s:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	backoff := realtimeRetryMin
+	for {
+		stream, err := sub.Subscribe(ctx, collections)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("⚠️ leaf-sync: realtime subscribe failed (%v); polling, retrying in %s", err, backoff)
+		} else {
+			backoff = realtimeRetryMin
+			if !report(feedStatus{up: true, since: time.Now()}) {
+				stream.Close()
+				return
+			}
+		forward:
+			for {
+				select {
+				case ev, ok := <-stream.Events:
+					if !ok {
+						break forward
+					}
+					select {
+					case events <- ev:
+					case <-ctx.Done():
+						stream.Close()
+						return
+					}
+				case <-ctx.Done():
+					stream.Close()
+					return
+				}
+			}
+			if !report(feedStatus{up: false}) {
+				return
+			}
+			log.Printf("⚠️ leaf-sync: realtime stream ended (%v); polling, reconnecting in %s", stream.Err(), backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, realtimeRetryMax)
+	}
+}
@@ -0,0 +1,125 @@
+package leafsync
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+// mirrored runs one full reconcile of records into a fresh bucket, as `run`
+// does before it applies any event.
+func mirrored(t *testing.T, records ...pbclient.Record) (*fakeKV, *syncCache) {
+	t.Helper()
+	kv := newFakeKV(nil)
+	cache := newSyncCache()
+	if _, err := syncCollection(context.Background(), &fakeLister{records: records}, kv, cache, "things"); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	kv.puts, kv.deletes = nil, nil
+	return kv, cache
+}
+
+func event(action string, r pbclient.Record) pbclient.Event {
+	return pbclient.Event{Collection: "things", Action: action, Record: r}
+}
+
+func TestApplyEventUpdateInPlace(t *testing.T) {
+	kv, cache := mirrored(t, rec("id1", "alpha"), rec("id2", "beta"))
+
+	changed := rec("id1", "alpha")
+	changed["name"] = "renamed"
+	changed["collectionName"] = "things"
+	reconcile, err := applyEvent(context.Background(), kv, cache, event("update", changed))
+	if err != nil || reconcile {
+		t.Fatalf("applyEvent = %t, %v", reconcile, err)
+	}
+	if !reflect.DeepEqual(kv.puts, []string{"alpha"}) || len(kv.deletes) != 0 {
+		t.Fatalf("puts %v deletes %v", kv.puts, kv.deletes)
+	}
+	var got map[string]any
+	_ = json.Unmarshal(kv.store["alpha"], &got)
+	if got["name"] != "renamed" || got["collectionName"] != nil {
+		t.Errorf("stored %v", got)
+	}
+
+	// The same content again is not rewritten.
+	if _, err := applyEvent(context.Background(), kv, cache, event("update", changed)); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.puts) != 1 {
+		t.Errorf("unchanged record re-Put: %v", kv.puts)
+	}
+}
+
+func TestApplyEventRenameMovesKey(t *testing.T) {
+	kv, cache := mirrored(t, rec("id1", "alpha"))
+
+	reconcile, err := applyEvent(context.Background(), kv, cache, event("update", rec("id1", "gamma")))
+	if err != nil || reconcile {
+		t.Fatalf("applyEvent = %t, %v", reconcile, err)
+	}
+	if got := kv.storedKeys(); !reflect.DeepEqual(got, []string{"gamma"}) {
+		t.Errorf("keys %v, want [gamma]", got)
+	}
+}
+
+func TestApplyEventCreateAndDelete(t *testing.T) {
+	kv, cache := mirrored(t, rec("id1", "alpha"))
+	ctx := context.Background()
+
+	if reconcile, err := applyEvent(ctx, kv, cache, event("create", rec("id2", "beta"))); err != nil || reconcile {
+		t.Fatalf("create = %t, %v", reconcile, err)
+	}
+	if reconcile, err := applyEvent(ctx, kv, cache, event("delete", rec("id1", "alpha"))); err != nil || reconcile {
+		t.Fatalf("delete = %t, %v", reconcile, err)
+	}
+	if got := kv.storedKeys(); !reflect.DeepEqual(got, []string{"beta"}) {
+		t.Errorf("keys %v, want [beta]", got)
+	}
+	// A delete for a record the mirror never had is a no-op.
+	if reconcile, err := applyEvent(ctx, kv, cache, event("delete", rec("id9", "zeta"))); err != nil || reconcile {
+		t.Errorf("unknown delete = %t, %v", reconcile, err)
+	}
+}
+
+// A code that becomes shared rekeys the record that already had it, which only
+// a full reconcile can do; the event is written under the id meanwhile.
+func TestApplyEventSharedHandleAsksForReconcile(t *testing.T) {
+	ctx := context.Background()
+	kv, cache := mirrored(t, rec("id1", "alpha"))
+
+	reconcile, err := applyEvent(ctx, kv, cache, event("create", rec("id2", "alpha")))
+	if err != nil || !reconcile {
+		t.Fatalf("collision = %t, %v", reconcile, err)
+	}
+	if _, ok := kv.store["id2"]; !ok {
+		t.Errorf("colliding record not written under its id: %v", kv.storedKeys())
+	}
+
+	// After the reconcile both are keyed by id; deleting one hands the handle
+	// back to the other, which again needs a reconcile.
+	if _, err := syncCollection(ctx, &fakeLister{records: []pbclient.Record{rec("id1", "alpha"), rec("id2", "alpha")}}, kv, cache, "things"); err != nil {
+		t.Fatal(err)
+	}
+	reconcile, err = applyEvent(ctx, kv, cache, event("delete", rec("id2", "alpha")))
+	if err != nil || !reconcile {
+		t.Errorf("un-sharing delete = %t, %v", reconcile, err)
+	}
+}
+
+func TestApplyEventBeforeReconcileOrOnFailure(t *testing.T) {
+	ctx := context.Background()
+	if reconcile, _ := applyEvent(ctx, newFakeKV(nil), newSyncCache(), event("update", rec("id1", "alpha"))); !reconcile {
+		t.Error("an event for an unindexed collection was applied")
+	}
+
+	kv, cache := mirrored(t, rec("id1", "alpha"))
+	kv.failPut["beta"] = true
+	reconcile, err := applyEvent(ctx, kv, cache, event("create", rec("id2", "beta")))
+	if err == nil || !reconcile {
+		t.Errorf("failed put = %t, %v", reconcile, err)
+	}
+}
@@ -16,27 +16,47 @@ import (
 // --- fakes -------------------------------------------------------------------
 
 // fakeLister serves canned pages for one collection and can be made to fail.
+// A filtered List — the incremental reconcile's — serves changed instead of
+// records, and records every filter it was given.
 type fakeLister struct {
 	records []pbclient.Record
+	changed []pbclient.Record
 	err     error
 	calls   int
+	filters []string
 }
 
-func (f *fakeLister) List(_ context.Context, _ string, page, perPage int, _ string) (*pbclient.ListResult, error) {
+func (f *fakeLister) List(_ context.Context, _ string, page, perPage int, filter string) (*pbclient.ListResult, error) {
 	f.calls++
 	if f.err != nil {
 		return nil, f.err
 	}
+	items := f.records
+	if filter != "" {
+		f.filters = append(f.filters, filter)
+		items = f.changed
+	}
 	// Single page is enough for these tests; pagination is covered in pbclient.
 	return &pbclient.ListResult{
 		Page:       page,
 		PerPage:    perPage,
-		TotalItems: len(f.records),
+		TotalItems: len(items),
 		TotalPages: 1,
-		Items:      f.records,
+		Items:      items,
 	}, nil
 }
 
+func (f *fakeLister) ListIDs(_ context.Context, _ string, page, perPage int) (*pbclient.ListResult, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	items := make([]pbclient.Record, len(f.records))
+	for i, r := range f.records {
+		items[i] = pbclient.Record{"id": r["id"]}
+	}
+	return &pbclient.ListResult{Page: page, PerPage: perPage, TotalItems: len(items), TotalPages: 1, Items: items}, nil
+}
+
 // fakeKV is an in-memory stand-in for a JetStream KV bucket. failPut names keys
 // whose Put should fail; keysErr is returned by Keys.
 type fakeKV struct {
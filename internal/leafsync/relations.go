@@ -0,0 +1,233 @@
+package leafsync
+
+import (
+	"encoding/json"
+	"sort"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+// Relation annotations.
+//
+// A mirrored record's relation fields hold PocketBase ids (`things.type`,
+// `locations.parent`), but the buckets are keyed by handles, so an edge consumer
+// holding `things/S01` could only find its type by scanning `thing_types` for
+// the id. With relations.enabled, every mirrored record carries a `_rel` object
+// that names, for each relation field, where the related record is mirrored —
+// and, optionally, copies some of its fields in:
+//
+//	"_rel": {
+//	  "type":     {"bucket": "thing_types", "key": "sensor-v1", "fields": {"subject_prefix": "acme.sensors"}},
+//	  "location": {"bucket": "locations", "key": "bldg-a"}
+//	}
+//
+// A multi-valued relation (thing_types.operations) gets a list. An id whose
+// record is not in the mirror — its collection is not synced, or it is not
+// visible to this leaf node — is left out, so `_rel` only ever points at a key
+// that exists.
+//
+// The annotation is part of the value, so the changed-only write picks up a
+// change to it like any other. What keeps it right is re-annotating referrers
+// when a related record's key or embedded fields change — a renamed code, say:
+// the collections pointing at the changed one are given a full reconcile (next
+// in the same cycle, as targets sync first; on the next tick after a realtime
+// event), which rewrites exactly the records whose annotation moved.
+
+// relField is the field annotations are written under. No syncable collection
+// has a field by that name; one that did would be overwritten.
+const relField = "_rel"
+
+// relation is a relation field between two syncable collections.
+type relation struct {
+	field  string   // relation field on the source record
+	target string   // collection its ids point into
+	embed  []string // fields of the target copied into the annotation
+}
+
+// knownRelations are the relation fields between allowedCollections, as
+// schema.json defines them. Keep in step with it: a relation missing here is
+// simply not annotated.
+var knownRelations = map[string][]relation{
+	"things":                {{field: "type", target: "thing_types"}, {field: "location", target: "locations"}},
+	"locations":             {{field: "type", target: "location_types"}, {field: "parent", target: "locations"}},
+	"thing_types":           {{field: "operations", target: "thing_type_operations"}},
+	"thing_type_operations": {{field: "schema", target: "message_schemas"}},
+}
+
+// syncOrder is the order collections are reconciled in when relations are
+// annotated: every target before the collections that point at it, so a cycle
+// annotates from targets it has already brought up to date.
+var syncOrder = []string{
+	"message_schemas",
+	"thing_type_operations",
+	"thing_types",
+	"location_types",
+	"locations",
+	"things",
+}
+
+// relationsFor returns the relations to annotate among collections, with the
+// fields embed asks for. Relations into a collection that is not mirrored are
+// dropped: there is no key to point at.
+func relationsFor(collections []string, embed map[string]map[string][]string) map[string][]relation {
+	mirrored := make(map[string]bool, len(collections))
+	for _, col := range collections {
+		mirrored[col] = true
+	}
+	out := make(map[string][]relation)
+	for _, col := range collections {
+		for _, r := range knownRelations[col] {
+			if !mirrored[r.target] {
+				continue
+			}
+			r.embed = embed[col][r.field]
+			out[col] = append(out[col], r)
+		}
+	}
+	return out
+}
+
+// orderForRelations sorts collections into syncOrder.
+func orderForRelations(collections []string) []string {
+	rank := make(map[string]int, len(syncOrder))
+	for i, col := range syncOrder {
+		rank[col] = i
+	}
+	out := append([]string(nil), collections...)
+	sort.SliceStable(out, func(i, j int) bool { return rank[out[i]] < rank[out[j]] })
+	return out
+}
+
+// annotate sets rec's `_rel` from the current indexes of the collections its
+// relations point into, and returns rec.
+func (c *syncCache) annotate(col string, rec pbclient.Record) pbclient.Record {
+	rels := c.relations[col]
+	if len(rels) == 0 {
+		return rec
+	}
+	links := make(map[string]any, len(rels))
+	for _, r := range rels {
+		idx := c.index[r.target]
+		if idx == nil {
+			continue
+		}
+		switch v := rec[r.field].(type) {
+		case string:
+			if l := idx.link(r.target, v, r.embed); l != nil {
+				links[r.field] = l
+			}
+		case []any:
+			list := make([]any, 0, len(v))
+			for _, item := range v {
+				id, _ := item.(string)
+				if l := idx.link(r.target, id, r.embed); l != nil {
+					list = append(list, l)
+				}
+			}
+			links[r.field] = list
+		}
+	}
+	delete(rec, relField)
+	if len(links) > 0 {
+		rec[relField] = links
+	}
+	return rec
+}
+
+// link is the annotation for the record id of collection col, or nil when the
+// mirror does not hold it.
+func (idx *mirrorIndex) link(col, id string, embed []string) map[string]any {
+	key, ok := idx.keys[id]
+	if !ok {
+		return nil
+	}
+	l := map[string]any{"bucket": col, "key": key}
+	if len(embed) > 0 {
+		fields := make(map[string]any, len(embed))
+		for _, f := range embed {
+			if v, ok := idx.records[id][f]; ok {
+				fields[f] = v
+			}
+		}
+		l["fields"] = fields
+	}
+	return l
+}
+
+// embedded returns the fields any relation copies out of col's records.
+func (c *syncCache) embedded(col string) []string {
+	var fields []string
+	for _, rels := range c.relations {
+		for _, r := range rels {
+			if r.target == col {
+				fields = append(fields, r.embed...)
+			}
+		}
+	}
+	return fields
+}
+
+// referenced reports whether any annotated relation points into col.
+func (c *syncCache) referenced(col string) bool {
+	for _, rels := range c.relations {
+		for _, r := range rels {
+			if r.target == col {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// linkSignature is what a referrer's annotation of record id depends on: its
+// key and the fields embedded from it. "" when the mirror does not hold it.
+func (idx *mirrorIndex) linkSignature(id string, fields []string) string {
+	if idx == nil {
+		return ""
+	}
+	key, ok := idx.keys[id]
+	if !ok {
+		return ""
+	}
+	vals := make([]any, len(fields))
+	for i, f := range fields {
+		vals[i] = idx.records[id][f]
+	}
+	b, _ := json.Marshal(vals)
+	return key + "\x00" + string(b)
+}
+
+// linksChanged reports whether any record's linkSignature differs between two
+// indexes of col, records that appeared or disappeared included.
+func (c *syncCache) linksChanged(col string, before, after *mirrorIndex) bool {
+	if !c.referenced(col) {
+		return false
+	}
+	fields := c.embedded(col)
+	if before == nil || len(before.keys) != len(after.keys) {
+		return true
+	}
+	for id := range after.keys {
+		if before.linkSignature(id, fields) != after.linkSignature(id, fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchReferrers gives every collection with a relation into col a full
+// reconcile, to rewrite the annotations that point at it. self says whether col
+// itself is included, for a self-relation such as locations.parent.
+func (c *syncCache) touchReferrers(col string, self bool) {
+	for src, rels := range c.relations {
+		if src == col && !self {
+			continue
+		}
+		for _, r := range rels {
+			if r.target == col {
+				c.requireFull(src)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package leafsync
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+// relOf decodes the `_rel` annotation of key in kv.
+func relOf(t *testing.T, kv *fakeKV, key string) map[string]any {
+	t.Helper()
+	var v map[string]any
+	if err := json.Unmarshal(kv.store[key], &v); err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	rel, _ := v[relField].(map[string]any)
+	return rel
+}
+
+func typeRecord(id, code, prefix string) pbclient.Record {
+	r := rec(id, code)
+	r["subject_prefix"] = prefix
+	return r
+}
+
+func thingOf(id, code, typeID string) pbclient.Record {
+	r := rec(id, code)
+	r["type"] = typeID
+	return r
+}
+
+func TestAnnotateWritesHandlesAndEmbeds(t *testing.T) {
+	ctx := context.Background()
+	cache := newSyncCache()
+	cache.relations = relationsFor([]string{"thing_types", "things"}, map[string]map[string][]string{
+		"things": {"type": {"subject_prefix"}},
+	})
+	types, things := newFakeKV(nil), newFakeKV(nil)
+	if _, err := syncCollection(ctx, &fakeLister{records: []pbclient.Record{typeRecord("t1", "sensor-v1", "acme.sensors")}}, types, cache, "thing_types"); err != nil {
+		t.Fatal(err)
+	}
+	pb := &fakeLister{records: []pbclient.Record{thingOf("id1", "S01", "t1"), thingOf("id2", "S02", "missing")}}
+	if _, err := syncCollection(ctx, pb, things, cache, "things"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{"type": map[string]any{
+		"bucket": "thing_types",
+		"key":    "sensor-v1",
+		"fields": map[string]any{"subject_prefix": "acme.sensors"},
+	}}
+	if got := relOf(t, things, "S01"); !reflect.DeepEqual(got, want) {
+		t.Errorf("S01 _rel = %v, want %v", got, want)
+	}
+	// location is not mirrored and the type is unknown: nothing to point at.
+	if got := relOf(t, things, "S02"); got != nil {
+		t.Errorf("S02 _rel = %v, want none", got)
+	}
+	if got := relOf(t, types, "sensor-v1"); got != nil {
+		t.Errorf("thing_types annotated without a mirrored target: %v", got)
+	}
+}
+
+func TestAnnotateMultiValuedRelation(t *testing.T) {
+	cache := newSyncCache()
+	cache.relations = relationsFor([]string{"thing_type_operations", "thing_types"}, nil)
+	cache.index["thing_type_operations"] = newMirrorIndex([]keyedRecord{
+		{key: "read", rec: rec("o1", "read")},
+		{key: "write", rec: rec("o2", "write")},
+	}, nil)
+
+	got := cache.annotate("thing_types", pbclient.Record{"id": "t1", "operations": []any{"o1", "gone", "o2"}})
+	want := []any{
+		map[string]any{"bucket": "thing_type_operations", "key": "read"},
+		map[string]any{"bucket": "thing_type_operations", "key": "write"},
+	}
+	if rel, _ := got[relField].(map[string]any); !reflect.DeepEqual(rel["operations"], want) {
+		t.Errorf("operations = %v, want %v", rel["operations"], want)
+	}
+}
+
+// Renaming a related record rewrites the annotations that point at it on the
+// referrers' next reconcile, which is forced to be a full one.
+func TestRenamedTargetRewritesReferrers(t *testing.T) {
+	ctx := context.Background()
+	cache := newSyncCache()
+	cache.relations = relationsFor([]string{"thing_types", "things"}, nil)
+	types, things := newFakeKV(nil), newFakeKV(nil)
+	typesPB := &fakeLister{records: []pbclient.Record{stamped("t1", "sensor-v1", "2026-10-01 10:00:00.000Z")}}
+	thingsPB := &fakeLister{records: []pbclient.Record{thingOf("id1", "S01", "t1")}}
+	thingsPB.records[0]["updated"] = "2026-10-01 10:00:00.000Z"
+	for _, step := range []struct {
+		pb  *fakeLister
+		kv  *fakeKV
+		col string
+	}{{typesPB, types, "thing_types"}, {thingsPB, things, "things"}} {
+		if _, err := reconcileCollection(ctx, step.pb, step.kv, cache, step.col, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renamed := stamped("t1", "sensor-v2", "2026-10-02 10:00:00.000Z")
+	typesPB.records = []pbclient.Record{renamed}
+	typesPB.changed = []pbclient.Record{renamed}
+	if _, err := reconcileCollection(ctx, typesPB, types, cache, "thing_types", 10); err != nil {
+		t.Fatal(err)
+	}
+	if !cache.index["things"].needsFull {
+		t.Fatal("a renamed target did not mark its referrers for a full reconcile")
+	}
+
+	things.puts = nil
+	if _, err := reconcileCollection(ctx, thingsPB, things, cache, "things", 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(thingsPB.filters) != 0 {
+		t.Errorf("referrers reconciled incrementally: %v", thingsPB.filters)
+	}
+	if !reflect.DeepEqual(things.puts, []string{"S01"}) {
+		t.Errorf("puts %v, want [S01]", things.puts)
+	}
+	if key := relOf(t, things, "S01")["type"].(map[string]any)["key"]; key != "sensor-v2" {
+		t.Errorf("S01 still points at %v", key)
+	}
+}
+
+func TestOrderForRelations(t *testing.T) {
+	got := orderForRelations([]string{"things", "locations", "thing_types", "location_types"})
+	want := []string{"thing_types", "location_types", "locations", "things"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+package leafsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// StateFileName is the file under output.dir where `run` keeps the content
+// hashes of what it last wrote, unless sync.state_file says otherwise.
+const StateFileName = "leaf-sync-state.json"
+
+// stateVersion is the format of the state file. A file of another version is
+// ignored — the cost is one round of rewrites, never a wrong skip.
+const stateVersion = 1
+
+// stateFile is the persisted form of a syncCache's content hashes.
+type stateFile struct {
+	Version int                          `json:"version"`
+	Hashes  map[string]map[string]string `json:"hashes"` // collection -> KV key -> hex sha256(payload)
+}
+
+// kvReader is the slice of jetstream.KeyValue the startup check needs.
+type kvReader interface {
+	Get(ctx context.Context, key string) (jetstream.KeyValueEntry, error)
+}
+
+// restoreSyncCache loads the hashes a previous `run` left in path and keeps
+// only the ones the buckets still back: the key must hold exactly the value
+// whose hash was remembered. Everything else — a bucket that was purged or
+// recreated, a key edited or deleted by hand, a write that landed after the
+// file was last saved — is dropped, and so rewritten by the first reconcile.
+//
+// The file only ever saves writes: a hash that survives the check is true of
+// the bucket no matter how stale the file is, and the `present` check in
+// syncCollection still stands behind it. So every problem with the file is
+// logged and answered with an empty cache — the pre-persistence behaviour —
+// never a failed start.
+func restoreSyncCache(ctx context.Context, path string, collections []string, open func(context.Context, string) (kvReader, error)) *syncCache {
+	cache := newSyncCache()
+	state, err := readState(path)
+	if err != nil {
+		log.Printf("⚠️ leaf-sync: ignoring sync state %s: %v", path, err)
+		return cache
+	}
+	if state == nil {
+		return cache
+	}
+
+	kept, dropped := 0, 0
+	for _, col := range collections {
+		hashes := state.Hashes[col]
+		if len(hashes) == 0 {
+			continue
+		}
+		kv, err := open(ctx, col)
+		if err != nil {
+			log.Printf("⚠️ leaf-sync: cannot check sync state of %q (%v); it will be rewritten", col, err)
+			dropped += len(hashes)
+			continue
+		}
+		for key, hexSum := range hashes {
+			sum, ok := decodeSum(hexSum)
+			if !ok || !holds(ctx, kv, key, sum) {
+				dropped++
+				continue
+			}
+			cache.remember(col, key, sum)
+			kept++
+		}
+	}
+	cache.dirty = dropped > 0
+	log.Printf("leaf-sync: restored sync state from %s (%d keys verified, %d dropped)", path, kept, dropped)
+	return cache
+}
+
+// readState reads path, returning nil and no error when there is no file.
+func readState(path string) (*stateFile, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state stateFile
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("version %d, want %d", state.Version, stateVersion)
+	}
+	return &state, nil
+}
+
+// holds reports whether key's current value in kv hashes to sum.
+func holds(ctx context.Context, kv kvReader, key string, sum [32]byte) bool {
+	entry, err := kv.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+	return sha256.Sum256(entry.Value()) == sum
+}
+
+func decodeSum(s string) ([32]byte, bool) {
+	var sum [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(sum) {
+		return sum, false
+	}
+	copy(sum[:], b)
+	return sum, true
+}
+
+// save writes the cache's hashes to path if they changed since the last save.
+// The file is replaced atomically, so a crash mid-write leaves the previous
+// state rather than a truncated one.
+func (c *syncCache) save(path string) error {
+	if !c.dirty {
+		return nil
+	}
+	state := stateFile{Version: stateVersion, Hashes: make(map[string]map[string]string, len(c.seen))}
+	for col, keys := range c.seen {
+		m := make(map[string]string, len(keys))
+		for key, sum := range keys {
+			m[key] = hex.EncodeToString(sum[:])
+		}
+		state.Hashes[col] = m
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
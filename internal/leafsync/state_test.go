@@ -0,0 +1,156 @@
+package leafsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"platform/internal/leafsync/pbclient"
+)
+
+func (f *fakeKV) Get(_ context.Context, key string) (jetstream.KeyValueEntry, error) {
+	v, ok := f.store[key]
+	if !ok {
+		return nil, jetstream.ErrKeyNotFound
+	}
+	return &fakeEntry{key: key, value: v, op: jetstream.KeyValuePut}, nil
+}
+
+func openFake(kvs map[string]*fakeKV) func(context.Context, string) (kvReader, error) {
+	return func(_ context.Context, col string) (kvReader, error) {
+		kv, ok := kvs[col]
+		if !ok {
+			return nil, errors.New("no such bucket")
+		}
+		return kv, nil
+	}
+}
+
+// A restart with unchanged upstream data writes nothing: the hashes saved by
+// the previous process are restored and the first reconcile skips every Put.
+func TestRestoredCacheMakesRestartWriteNothing(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), StateFileName)
+	kv := newFakeKV(nil)
+	pb := &fakeLister{records: []pbclient.Record{rec("id1", "alpha"), rec("id2", "beta")}}
+
+	first := newSyncCache()
+	if _, err := syncCollection(ctx, pb, kv, first, "things"); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	kv.puts = nil
+	restored := restoreSyncCache(ctx, path, []string{"things"}, openFake(map[string]*fakeKV{"things": kv}))
+	if _, err := syncCollection(ctx, pb, kv, restored, "things"); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.puts) != 0 {
+		t.Errorf("restart rewrote %v", kv.puts)
+	}
+}
+
+// A hash is only restored if the bucket still holds exactly that value.
+func TestRestoreDropsWhatTheBucketDoesNotBackUp(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), StateFileName)
+
+	c := newSyncCache()
+	for _, k := range []string{"kept", "edited", "gone"} {
+		c.remember("things", k, sha256.Sum256([]byte(k)))
+	}
+	c.remember("locations", "hq", sha256.Sum256([]byte("hq")))
+	c.remember("unsynced", "x", sha256.Sum256([]byte("x")))
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	things := newFakeKV(map[string][]byte{"kept": []byte("kept"), "edited": []byte("by hand")})
+	restored := restoreSyncCache(ctx, path, []string{"things", "locations"}, openFake(map[string]*fakeKV{"things": things}))
+
+	if !restored.unchanged("things", "kept", sha256.Sum256([]byte("kept"))) {
+		t.Error("a key the bucket still holds was dropped")
+	}
+	for col, key := range map[string]string{"things": "edited", "unsynced": "x", "locations": "hq"} {
+		if _, ok := restored.seen[col][key]; ok {
+			t.Errorf("%s/%s restored", col, key)
+		}
+	}
+	if _, ok := restored.seen["things"]["gone"]; ok {
+		t.Error("a key missing from the bucket was restored")
+	}
+	if !restored.dirty {
+		t.Error("dropped hashes did not mark the state for saving")
+	}
+}
+
+func TestRestoreIgnoresMissingOrBadState(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := openFake(map[string]*fakeKV{"things": newFakeKV(nil)})
+
+	if c := restoreSyncCache(ctx, filepath.Join(dir, "absent.json"), []string{"things"}, open); len(c.seen) != 0 {
+		t.Error("state restored from a missing file")
+	}
+	for name, body := range map[string]string{
+		"corrupt.json": "{not json",
+		"future.json":  `{"version": 99, "hashes": {"things": {"k": "00"}}}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if c := restoreSyncCache(ctx, path, []string{"things"}, open); len(c.seen) != 0 {
+			t.Errorf("%s: state restored", name)
+		}
+	}
+}
+
+func TestSaveOnlyWhenChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StateFileName)
+	c := newSyncCache()
+	sum := sha256.Sum256([]byte("v"))
+
+	c.remember("things", "k", sum)
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("state file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Remembering the same hash again is not a change.
+	c.remember("things", "k", sum)
+	if c.dirty {
+		t.Error("an unchanged hash marked the state dirty")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Error("an unchanged cache was saved")
+	}
+
+	c.forget("things", "k")
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+	state, err := readState(path)
+	if err != nil || state == nil || len(state.Hashes["things"]) != 0 {
+		t.Errorf("forgotten key still saved: %+v, %v", state, err)
+	}
+}
@@ -37,8 +37,9 @@ var allowedCollections = map[string]bool{
 const listPageSize = 500 // PocketBase per-page maximum
 
 // Run authenticates to PocketBase as the leaf node, connects to the local leaf,
-// and reconciles the configured collections into local KV on an interval until
-// ctx is cancelled (e.g. on SIGINT/SIGTERM).
+// and mirrors the configured collections into local KV until ctx is cancelled
+// (e.g. on SIGINT/SIGTERM): record events as they arrive over a realtime
+// subscription, and a full reconcile on an interval (realtime.go).
 func Run(ctx context.Context, cfg *Config) error {
 	// Start the bus first, before PocketBase is involved at all. A site whose
 	// uplink is down must still come up with a working local NATS — that
@@ -63,10 +64,17 @@ func Run(ctx context.Context, cfg *Config) error {
 	}
 
 	collections := resolveCollections(leaf)
+	scoped := locationScoped(leaf)
+	if scoped {
+		log.Printf("leaf-sync: scoped to location %v and below; the server shows this leaf node nothing else", leaf["location"])
+	}
+	if cfg.Relations {
+		collections = orderForRelations(collections)
+	}
 	if len(collections) == 0 {
 		log.Printf("⚠️ leaf-sync: no syncable collections configured for this leaf node; nothing to do")
 	} else {
-		log.Printf("leaf-sync: mirroring %v every %s", collections, cfg.SyncInterval)
+		log.Printf("leaf-sync: mirroring %v every %s (realtime: %t)", collections, cfg.SyncInterval, cfg.Realtime)
 	}
 
 	nc, err := nats.Connect(cfg.LocalNatsURL,
@@ -78,7 +86,7 @@ func Run(ctx context.Context, cfg *Config) error {
 	}
 	defer nc.Close()
 
-	kw, err := newKVWriter(nc)
+	kw, err := newKVWriter(nc, bucketLayers{leafBucketSettings(leaf), cfg.Buckets})
 	if err != nil {
 		return fmt.Errorf("init JetStream: %w", err)
 	}
@@ -95,17 +103,84 @@ func Run(ctx context.Context, cfg *Config) error {
 	// data-plane problem.
 	startTwin(ctx, nc, cfg)
 
+	// Derived index buckets (indexes.go), kept alongside the mirrors.
+	var indexes []string
+	if cfg.Indexes {
+		indexes = derivedIndexes(collections)
+		if len(indexes) > 0 {
+			log.Printf("leaf-sync: keeping indexes %v", indexes)
+		}
+	}
+	isIndex := make(map[string]bool, len(indexes))
+	for _, name := range indexes {
+		isIndex[name] = true
+	}
+	indexBuckets := make(map[string]kvBucket) // reopened each cycle, reused by events
+	openIndex := func(ctx context.Context, name string) (kvBucket, error) {
+		if kv, ok := indexBuckets[name]; ok {
+			return kv, nil
+		}
+		kv, err := kw.indexBucket(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		indexBuckets[name] = kv
+		return kv, nil
+	}
+
 	// Remembers what was last written to each key so a reconcile only re-Puts
-	// records that actually changed. Persists for the lifetime of this daemon.
-	cache := newSyncCache()
+	// records that actually changed. Restored from the state file, as far as the
+	// buckets still bear it out, so a restart writes only what changed too.
+	cache := restoreSyncCache(ctx, cfg.StateFile, append(append([]string(nil), collections...), indexes...), func(ctx context.Context, name string) (kvReader, error) {
+		if isIndex[name] {
+			return kw.indexBucket(ctx, name)
+		}
+		return kw.bucket(ctx, name)
+	})
+	if cfg.Relations {
+		cache.relations = relationsFor(collections, cfg.RelationEmbed)
+	}
+	saveState := func() {
+		if err := cache.save(cfg.StateFile); err != nil {
+			log.Printf("⚠️ leaf-sync: save sync state %s: %v", cfg.StateFile, err)
+		}
+	}
+	defer saveState()
+
+	var (
+		synced    map[string]int // per-collection record counts, for the heartbeat
+		errs      []string       // errors since the last cycle, for the heartbeat
+		lastCycle time.Time      // when the last cycle started
+		live      bool           // the realtime stream is up
+		stale     bool           // an event left KV for the next cycle to fix
+	)
 
 	// One cycle: reconcile every collection, then publish a heartbeat.
 	cycle := func() {
-		synced, errs := syncAll(ctx, pb, kw, cache, collections)
+		lastCycle = time.Now()
+		stale = false
+		synced, errs = syncAll(ctx, pb, kw, cache, collections, cfg.FullSyncEvery)
+		clear(indexBuckets)
+		errs = append(errs, refreshIndexes(ctx, openIndex, cache, indexes, true)...)
+		saveState()
 		hb.publish(ctx, synced, errs, cfg.SyncInterval)
 	}
 
-	// Run once immediately, then on the ticker until cancelled.
+	// Realtime events (realtime.go). Nil channels when disabled, which never
+	// fire, leaving the loop below the plain poller it used to be.
+	var (
+		events chan pbclient.Event
+		feed   chan feedStatus
+	)
+	if cfg.Realtime && len(collections) > 0 {
+		events = make(chan pbclient.Event)
+		feed = make(chan feedStatus)
+		go runFeed(ctx, pb, collections, events, feed)
+	}
+	buckets := make(map[string]kvBucket) // opened once for events, not per event
+
+	// Run once immediately, then on the ticker until cancelled. The ticker keeps
+	// the heartbeat's cadence whether or not a tick reconciles.
 	cycle()
 
 	ticker := time.NewTicker(cfg.SyncInterval)
@@ -115,8 +190,55 @@ func Run(ctx context.Context, cfg *Config) error {
 		case <-ctx.Done():
 			log.Printf("leaf-sync: shutdown signal received, stopping")
 			return nil
+		case st := <-feed:
+			if !st.up {
+				live = false
+				continue
+			}
+			live = true
+			log.Printf("leaf-sync: realtime stream up; reconciling every %s", cfg.FullSyncInterval)
+			// Whatever changed before the stream was up was never delivered, so
+			// reconcile — unless a cycle has already started since.
+			if lastCycle.Before(st.since) {
+				cycle()
+			}
+		case ev := <-events:
+			kv, ok := buckets[ev.Collection]
+			if !ok {
+				b, err := kw.bucket(ctx, ev.Collection)
+				if err != nil {
+					log.Printf("leaf-sync: kv bucket %q failed: %v", ev.Collection, err)
+					stale = true
+					continue
+				}
+				kv, buckets[ev.Collection] = b, b
+			}
+			reconcile, err := applyEvent(ctx, kv, cache, ev)
+			if err != nil {
+				log.Printf("leaf-sync: realtime %s: %v", ev.Collection, err)
+				errs = append(errs, fmt.Sprintf("%s: %v", ev.Collection, err))
+			}
+			stale = stale || reconcile
+			// Under a location scope, what a things or locations change makes
+			// visible or invisible elsewhere — a newly used type, the things of a
+			// location moved into the subtree — arrives with no event of its own.
+			// The reconcile on the next tick finds it; an incremental one is cheap.
+			if scoped && (ev.Collection == "things" || ev.Collection == "locations") {
+				stale = true
+			}
+			errs = append(errs, refreshIndexes(ctx, openIndex, cache, indexesFedBy(indexes, ev.Collection), false)...)
 		case <-ticker.C:
-			cycle()
+			if !live || stale || cache.fullPending() || time.Since(lastCycle) >= cfg.FullSyncInterval {
+				cycle()
+				continue
+			}
+			for col, idx := range cache.index {
+				if _, ok := synced[col]; ok {
+					synced[col] = len(idx.keys)
+				}
+			}
+			saveState() // what events wrote since the last tick
+			hb.publish(ctx, synced, errs, cfg.SyncInterval)
 		}
 	}
 }
@@ -189,11 +311,40 @@ func resolveCollections(leaf pbclient.Record) []string {
 	return out
 }
 
+// locationScoped reports whether the leaf node's reads are limited to its
+// location's subtree (leaf_nodes.sync_scope). The server enforces the scope;
+// leaf-sync only needs to know that visibility can change without an event.
+func locationScoped(leaf pbclient.Record) bool {
+	scope, _ := leaf["sync_scope"].(string)
+	return scope == "location"
+}
+
+// leafBucketSettings reads the leaf node's kv_buckets. The console validates it
+// on save, but a record that does not parse anyway — written through the API by
+// an older server, say — is ignored with a warning rather than keeping the
+// leaf node from syncing at all: the buckets just keep their yaml or built-in
+// shape.
+func leafBucketSettings(leaf pbclient.Record) map[string]bucketSettings {
+	raw := leaf["kv_buckets"]
+	if s, ok := raw.(string); ok && s == "" {
+		return nil
+	}
+	settings, err := parseBucketSettings(raw)
+	if err != nil {
+		log.Printf("⚠️ leaf-sync: ignoring the leaf node's kv_buckets: %v", err)
+		return nil
+	}
+	return settings
+}
+
 // syncAll reconciles every configured collection and returns the per-collection
 // synced record count plus any errors, for the heartbeat payload. Fail-soft: a
 // collection that errors is logged and recorded, local KV left as-is, and the
 // remaining collections still run.
-func syncAll(ctx context.Context, pb recordLister, kw *kvWriter, cache *syncCache, collections []string) (map[string]int, []string) {
+//
+// A collection is reconciled incrementally where it can be, and in full on
+// every fullEvery-th reconcile (incremental.go).
+func syncAll(ctx context.Context, pb recordLister, kw *kvWriter, cache *syncCache, collections []string, fullEvery int) (map[string]int, []string) {
 	synced := make(map[string]int, len(collections))
 	var errs []string
 	for _, col := range collections {
@@ -206,7 +357,7 @@ func syncAll(ctx context.Context, pb recordLister, kw *kvWriter, cache *syncCach
 			errs = append(errs, fmt.Sprintf("%s: kv bucket: %v", col, err))
 			continue
 		}
-		n, err := syncCollection(ctx, pb, kv, cache, col)
+		n, err := reconcileCollection(ctx, pb, kv, cache, col, fullEvery)
 		if err != nil {
 			// Fail-soft: keep local KV as-is and retry next interval.
 			log.Printf("leaf-sync: sync %q failed (will retry): %v", col, err)
@@ -218,10 +369,11 @@ func syncAll(ctx context.Context, pb recordLister, kw *kvWriter, cache *syncCach
 	return synced, errs
 }
 
-// recordLister is the slice of pbclient.Client that syncCollection needs. Kept
+// recordLister is the slice of pbclient.Client that the reconciles need. Kept
 // narrow so the reconcile logic can be driven by a fake in tests.
 type recordLister interface {
 	List(ctx context.Context, collection string, page, perPage int, filter string) (*pbclient.ListResult, error)
+	ListIDs(ctx context.Context, collection string, page, perPage int) (*pbclient.ListResult, error)
 }
 
 // kvBucket is the slice of jetstream.KeyValue that syncCollection needs. Same
@@ -257,16 +409,9 @@ func syncCollection(ctx context.Context, pb recordLister, kv kvBucket, cache *sy
 	// Fetch the whole collection before writing: KV keys prefer the record's
 	// `code`, which is optional and non-unique in the schema, so we must see
 	// every record to detect duplicate codes before choosing keys.
-	var records []pbclient.Record
-	for page := 1; ; page++ {
-		res, err := pb.List(ctx, col, page, listPageSize, "")
-		if err != nil {
-			return 0, err
-		}
-		records = append(records, res.Items...)
-		if res.TotalPages == 0 || res.Page >= res.TotalPages {
-			break
-		}
+	records, err := fetchRecords(ctx, pb, col, "")
+	if err != nil {
+		return 0, err
 	}
 
 	// Empty-fetch guard: a successful-but-empty response (e.g. a transient auth
@@ -303,11 +448,20 @@ func syncCollection(ctx context.Context, pb recordLister, kv kvBucket, cache *sy
 		desired[key] = true
 		keyed = append(keyed, keyedRecord{key: key, rec: rec})
 	}
+	// Realtime events are applied against these keys until the next reconcile
+	// (realtime.go). Records of other collections annotated with the old ones
+	// are rewritten by their own full reconcile (relations.go); this pass
+	// annotates from the new index, self-relations included.
+	before := cache.index[col]
+	cache.index[col] = newMirrorIndex(keyed, counts)
+	if cache.linksChanged(col, before, cache.index[col]) {
+		cache.touchReferrers(col, false)
+	}
 
 	// Pass 2: write the records whose content actually changed.
 	changed, failed := 0, 0
 	for _, kr := range keyed {
-		payload, err := json.Marshal(strip(kr.rec))
+		payload, err := json.Marshal(cache.annotate(col, strip(kr.rec)))
 		if err != nil {
 			log.Printf("leaf-sync: marshal %s/%s: %v", col, kr.key, err)
 			failed++
@@ -360,9 +514,28 @@ func syncCollection(ctx context.Context, pb recordLister, kv kvBucket, cache *sy
 	if failed > 0 {
 		return len(desired), fmt.Errorf("%d of %d records failed to write", failed, len(desired))
 	}
+	// Only a clean pass may start the incremental reconciles (incremental.go):
+	// they never look at a record again until it changes, so one whose write
+	// failed here would stay stale until the next full reconcile.
+	cache.index[col].watermark = latestUpdate(records)
 	return len(desired), nil
 }
 
+// fetchRecords reads every page of a collection's records matching filter.
+func fetchRecords(ctx context.Context, pb recordLister, col, filter string) ([]pbclient.Record, error) {
+	var records []pbclient.Record
+	for page := 1; ; page++ {
+		res, err := pb.List(ctx, col, page, listPageSize, filter)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, res.Items...)
+		if res.TotalPages == 0 || res.Page >= res.TotalPages {
+			return records, nil
+		}
+	}
+}
+
 // keyedRecord pairs a fetched record with the KV key chosen for it, so the key is
 // decided for every record before any write happens.
 type keyedRecord struct {
@@ -469,21 +642,33 @@ func keysToDelete(existing []string, fetched map[string]bool) []string {
 }
 
 // syncCache remembers, per collection, the content hash of the value last written
-// to each KV key, so a reconcile only re-Puts records that actually changed. It
-// lives for one `run` process; on restart the first cycle re-Puts everything once
-// (cold cache) and then goes quiet. This is what keeps a bucket's 5-revision
-// history from rolling over every interval when the underlying data is static.
+// to each KV key, so a reconcile only re-Puts records that actually changed.
+// This is what keeps a bucket's 5-revision history from rolling over every
+// interval when the underlying data is static. The hashes outlive the process in
+// a state file (state.go), checked against the buckets on startup, so a restart
+// does not re-Put everything either.
 //
 // It records what this process wrote, which is not the same thing as what the
 // bucket holds. syncCollection therefore treats a cache hit as authoritative only
 // when the bucket's key listing still shows the key — otherwise an out-of-band
 // deletion would never be repaired.
+//
+// It also holds each collection's mirrorIndex — which record went to which key
+// in the last reconcile — that realtime events are applied against, and the
+// relations records are annotated with (relations.go), which are read from
+// those indexes.
 type syncCache struct {
-	seen map[string]map[string][32]byte // collection -> KV key -> sha256(payload)
+	seen      map[string]map[string][32]byte // collection -> KV key -> sha256(payload)
+	index     map[string]*mirrorIndex        // collection -> last reconcile's keys
+	dirty     bool                           // seen changed since the last save
+	relations map[string][]relation          // collection -> relations to annotate; nil = none
 }
 
 func newSyncCache() *syncCache {
-	return &syncCache{seen: make(map[string]map[string][32]byte)}
+	return &syncCache{
+		seen:  make(map[string]map[string][32]byte),
+		index: make(map[string]*mirrorIndex),
+	}
 }
 
 // unchanged reports whether sum matches the hash last remembered for (col, key).
@@ -502,11 +687,36 @@ func (c *syncCache) remember(col, key string, sum [32]byte) {
 		m = make(map[string][32]byte)
 		c.seen[col] = m
 	}
-	m[key] = sum
+	if prev, ok := m[key]; !ok || prev != sum {
+		m[key] = sum
+		c.dirty = true
+	}
+}
+
+// requireFull makes the next reconcile of col a full one (incremental.go).
+// Without an index it is going to be anyway.
+func (c *syncCache) requireFull(col string) {
+	if idx := c.index[col]; idx != nil {
+		idx.needsFull = true
+	}
+}
+
+// fullPending reports whether a collection is waiting for the full reconcile
+// requireFull asked for.
+func (c *syncCache) fullPending() bool {
+	for _, idx := range c.index {
+		if idx.needsFull {
+			return true
+		}
+	}
+	return false
 }
 
 // forget drops a key after it has been deleted from KV, so the entry doesn't leak
 // and a future record that reuses the key is written afresh.
 func (c *syncCache) forget(col, key string) {
-	delete(c.seen[col], key) // deleting from a nil map is a no-op
+	if _, ok := c.seen[col][key]; ok {
+		delete(c.seen[col], key)
+		c.dirty = true
+	}
 }
@@ -66,6 +66,14 @@ func TestResolveCollections(t *testing.T) {
 	}
 }
 
+func TestLocationScoped(t *testing.T) {
+	for scope, want := range map[any]bool{"location": true, "organization": false, "": false, nil: false} {
+		if got := locationScoped(pbclient.Record{"sync_scope": scope}); got != want {
+			t.Errorf("sync_scope %v: scoped = %t, want %t", scope, got, want)
+		}
+	}
+}
+
 // countCandidates mirrors the tally syncCollection builds before keying.
 func countCandidates(recs []pbclient.Record) map[string]int {
 	counts := make(map[string]int)
@@ -260,3 +268,18 @@ func TestKeysToDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestLeafBucketSettingsIgnoresInvalid(t *testing.T) {
+	if got := leafBucketSettings(pbclient.Record{"kv_buckets": map[string]any{"things": map[string]any{"history": float64(99)}}}); got != nil {
+		t.Errorf("invalid kv_buckets = %v, want ignored", got)
+	}
+	for _, raw := range []any{nil, ""} {
+		if got := leafBucketSettings(pbclient.Record{"kv_buckets": raw}); got != nil {
+			t.Errorf("kv_buckets %q = %v, want nil", raw, got)
+		}
+	}
+	got := leafBucketSettings(pbclient.Record{"kv_buckets": map[string]any{"things": map[string]any{"history": float64(9)}}})
+	if h := got["things"].History; h == nil || *h != 9 {
+		t.Errorf("kv_buckets = %v", got)
+	}
+}
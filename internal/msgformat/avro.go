@@ -0,0 +1,76 @@
+package msgformat
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/linkedin/goavro/v2"
+
+	"platform/internal/jsonvalidate"
+)
+
+// avroCodec reads and writes Avro binary — the bare datum, without an object
+// container file or a single-object header. JSON is standard JSON: a union
+// value is the value itself, not Avro's {"<type>": value} wrapper.
+type avroCodec struct {
+	codec    *goavro.Codec
+	typeName string
+}
+
+func compileAvro(document []byte, messageType string) (Codec, error) {
+	codec, err := goavro.NewCodecForStandardJSONFull(string(document))
+	if err != nil {
+		return nil, err
+	}
+	name := codec.TypeName()
+	typeName := name.String()
+	if bytes.HasPrefix(bytes.TrimSpace(document), []byte("[")) {
+		typeName = ""
+		if messageType != "" {
+			return nil, fmt.Errorf("%w: a union schema does not have a single type to name", ErrMessageType)
+		}
+	}
+	if messageType != "" && messageType != typeName {
+		return nil, fmt.Errorf("%w: the schema describes %q, not %q", ErrMessageType, typeName, messageType)
+	}
+	return avroCodec{codec: codec, typeName: typeName}, nil
+}
+
+func (avroCodec) Format() string { return Avro }
+
+func (c avroCodec) MessageType() string { return c.typeName }
+
+func (c avroCodec) decode(payload []byte) (any, error) {
+	native, rest, err := c.codec.NativeFromBinary(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d bytes left over after the datum", len(rest))
+	}
+	return native, nil
+}
+
+func (c avroCodec) Validate(payload []byte) []jsonvalidate.Violation {
+	_, err := c.decode(payload)
+	return violation(err)
+}
+
+func (c avroCodec) Encode(sample []byte) ([]byte, error) {
+	native, rest, err := c.codec.NativeFromTextual(sample)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("unexpected content after the JSON value")
+	}
+	return c.codec.BinaryFromNative(nil, native)
+}
+
+func (c avroCodec) Decode(payload []byte) ([]byte, error) {
+	native, err := c.decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.TextualFromNative(nil, native)
+}
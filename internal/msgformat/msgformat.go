@@ -0,0 +1,163 @@
+// Package msgformat understands the schema languages a message_schemas record
+// may be written in — JSON Schema, Protobuf and Avro — behind one interface:
+// compile a stored document, name the message type it describes, check a
+// payload in the format's wire encoding, and convert between that encoding and
+// JSON.
+//
+// The platform's own data is JSON, and so were its schemas until device lines
+// that publish Protobuf or Avro needed contracts too. Everything that resolves a
+// contract — save-time checks, the contract routes, the contract validator, the
+// AsyncAPI export — goes through Compile, so a format is supported everywhere or
+// nowhere.
+//
+// A document is what message_schemas.schema holds, as JSON:
+//
+//	json_schema   the JSON Schema itself
+//	avro          the Avro schema itself (an object, a primitive name, or a union)
+//	protobuf      an object with exactly one of:
+//	                "proto": "<.proto source>"
+//	                "files": {"<name>.proto": "<source>", ...}
+//	                "file_descriptor_set": "<base64 FileDescriptorSet>"
+//
+// As with JSON Schema's $ref (internal/jsonvalidate), nothing is loaded from
+// outside the document: a .proto import resolves to another entry of "files" or
+// to one of the google/protobuf well-known files, and a FileDescriptorSet must
+// carry its dependencies (protoc --include_imports).
+package msgformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"platform/internal/jsonvalidate"
+)
+
+// The format values of message_schemas.format.
+const (
+	JSONSchema = "json_schema"
+	Protobuf   = "protobuf"
+	Avro       = "avro"
+)
+
+// Formats lists every supported format.
+var Formats = []string{JSONSchema, Protobuf, Avro}
+
+// Known reports whether format is one of Formats.
+func Known(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrMessageType marks a document that compiled but in which the requested
+// message type could not be resolved, so a caller can report it against the
+// message type rather than the document.
+var ErrMessageType = errors.New("message type")
+
+// Codec is a compiled schema document. It is safe for concurrent use.
+type Codec interface {
+	// Format is the document's format.
+	Format() string
+
+	// MessageType is the fully qualified name of the message the codec reads
+	// and writes: a Protobuf message, or the Avro schema's name. Empty for
+	// JSON Schema, which has no type names.
+	MessageType() string
+
+	// Validate checks a payload in the format's wire encoding — JSON, Protobuf
+	// binary, or Avro binary without a container or header — and returns every
+	// violation, or none.
+	Validate(payload []byte) []jsonvalidate.Violation
+
+	// Encode converts a JSON sample into the wire encoding. The sample must
+	// conform; what does not is an error.
+	Encode(sample []byte) ([]byte, error)
+
+	// Decode converts a payload in the wire encoding into JSON.
+	Decode(payload []byte) ([]byte, error)
+}
+
+// Compile parses document as format. messageType picks the message of a
+// Protobuf document that declares several and may be a full or, when
+// unambiguous, a short name; for Avro it must name the schema's own type if
+// set, and for JSON Schema it must be empty. When empty, a document that
+// describes exactly one message type resolves to it.
+func Compile(format string, document []byte, messageType string) (Codec, error) {
+	switch format {
+	case JSONSchema:
+		if messageType != "" {
+			return nil, fmt.Errorf("%w: json_schema documents do not name a message type", ErrMessageType)
+		}
+		return compileJSONSchema(document)
+	case Protobuf:
+		return compileProtobuf(document, messageType)
+	case Avro:
+		return compileAvro(document, messageType)
+	}
+	return nil, fmt.Errorf("unknown schema format %q", format)
+}
+
+// jsonSchemaCodec is JSON Schema: the wire encoding is JSON, so encoding and
+// decoding validate and compact.
+type jsonSchemaCodec struct {
+	schema *jsonvalidate.Schema
+}
+
+func compileJSONSchema(document []byte) (Codec, error) {
+	s, err := jsonvalidate.Compile(document)
+	if err != nil {
+		return nil, err
+	}
+	return jsonSchemaCodec{schema: s}, nil
+}
+
+func (jsonSchemaCodec) Format() string      { return JSONSchema }
+func (jsonSchemaCodec) MessageType() string { return "" }
+
+func (c jsonSchemaCodec) Validate(payload []byte) []jsonvalidate.Violation {
+	return c.schema.Validate(payload)
+}
+
+func (c jsonSchemaCodec) Encode(sample []byte) ([]byte, error) {
+	if errs := c.schema.Validate(sample); len(errs) > 0 {
+		return nil, violationsError(errs)
+	}
+	var out bytes.Buffer
+	if err := json.Compact(&out, sample); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (c jsonSchemaCodec) Decode(payload []byte) ([]byte, error) {
+	return c.Encode(payload)
+}
+
+// violation reports err as a violation of the whole payload: Protobuf and Avro
+// decoders stop at the first problem and do not say where it is.
+func violation(err error) []jsonvalidate.Violation {
+	if err == nil {
+		return nil
+	}
+	return []jsonvalidate.Violation{{Pointer: "", Message: err.Error()}}
+}
+
+// violationsError joins violations into one error.
+func violationsError(errs []jsonvalidate.Violation) error {
+	var b bytes.Buffer
+	for i, v := range errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		if v.Pointer != "" {
+			b.WriteString(v.Pointer + ": ")
+		}
+		b.WriteString(v.Message)
+	}
+	return errors.New(b.String())
+}
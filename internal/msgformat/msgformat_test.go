@@ -0,0 +1,189 @@
+package msgformat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const telemetryProto = `syntax = "proto3";
+package acme.telemetry;
+
+import "google/protobuf/timestamp.proto";
+
+message Reading {
+  double celsius = 1;
+  string unit = 2;
+  google.protobuf.Timestamp at = 3;
+  map<string, string> tags = 4;
+}
+
+message Status {
+  bool online = 1;
+}
+`
+
+func protoDoc(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	doc := protoDoc(t, map[string]any{"proto": telemetryProto})
+
+	if _, err := Compile(Protobuf, doc, ""); !errors.Is(err, ErrMessageType) {
+		t.Fatalf("two messages and no type: %v", err)
+	}
+	if _, err := Compile(Protobuf, doc, "Missing"); !errors.Is(err, ErrMessageType) {
+		t.Fatalf("unknown type: %v", err)
+	}
+
+	c, err := Compile(Protobuf, doc, "Reading")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MessageType() != "acme.telemetry.Reading" {
+		t.Errorf("MessageType = %q", c.MessageType())
+	}
+
+	wire, err := c.Encode([]byte(`{"celsius": 21.5, "unit": "C", "at": "2026-01-02T03:04:05Z", "tags": {"site": "hq"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.Validate(wire); len(errs) != 0 {
+		t.Errorf("own encoding fails: %v", errs)
+	}
+	back, err := c.Decode(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(back, &got); err != nil || got["celsius"] != 21.5 || got["at"] != "2026-01-02T03:04:05Z" {
+		t.Errorf("decoded %s (%v)", back, err)
+	}
+
+	if _, err := c.Encode([]byte(`{"kelvin": 1}`)); err == nil {
+		t.Error("unknown field encoded")
+	}
+	if errs := c.Validate([]byte{0xff, 0xff}); len(errs) == 0 {
+		t.Error("garbage payload accepted")
+	}
+}
+
+func TestProtobufFilesAndDescriptorSet(t *testing.T) {
+	files := map[string]any{"files": map[string]string{
+		"common.proto": "syntax = \"proto3\";\npackage acme;\nmessage Unit { string name = 1; }\n",
+		"main.proto":   "syntax = \"proto3\";\npackage acme;\nimport \"common.proto\";\nmessage Reading { Unit unit = 1; }\n",
+	}}
+	if _, err := Compile(Protobuf, protoDoc(t, files), "acme.Reading"); err != nil {
+		t.Fatalf("files: %v", err)
+	}
+
+	escape := map[string]any{"proto": "syntax = \"proto3\";\nimport \"/etc/passwd\";\nmessage M {}\n"}
+	if _, err := Compile(Protobuf, protoDoc(t, escape), ""); err == nil {
+		t.Error("an import outside the document was resolved")
+	}
+
+	srcs, _, err := compileProtoSources(map[string]string{protoSourceName: telemetryProto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds := &descriptorpb.FileDescriptorSet{}
+	for _, f := range srcs {
+		for i := 0; i < f.Imports().Len(); i++ {
+			fds.File = append(fds.File, protodesc.ToFileDescriptorProto(f.Imports().Get(i).FileDescriptor))
+		}
+		fds.File = append(fds.File, protodesc.ToFileDescriptorProto(f))
+	}
+	raw, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string]any{"file_descriptor_set": base64.StdEncoding.EncodeToString(raw)}
+	c, err := Compile(Protobuf, protoDoc(t, set), "acme.telemetry.Status")
+	if err != nil {
+		t.Fatalf("descriptor set: %v", err)
+	}
+	if _, err := c.Encode([]byte(`{"online": true}`)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Compile(Protobuf, protoDoc(t, map[string]any{"proto": telemetryProto, "extra": 1}), "Reading"); err == nil {
+		t.Error("unknown document key accepted")
+	}
+}
+
+const readingAvro = `{
+  "type": "record", "name": "Reading", "namespace": "acme.telemetry",
+  "fields": [
+    {"name": "celsius", "type": "double"},
+    {"name": "unit", "type": ["null", "string"], "default": null}
+  ]
+}`
+
+func TestAvroRoundTrip(t *testing.T) {
+	c, err := Compile(Avro, []byte(readingAvro), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MessageType() != "acme.telemetry.Reading" {
+		t.Errorf("MessageType = %q", c.MessageType())
+	}
+	if _, err := Compile(Avro, []byte(readingAvro), "acme.Other"); !errors.Is(err, ErrMessageType) {
+		t.Errorf("wrong type name: %v", err)
+	}
+
+	wire, err := c.Encode([]byte(`{"celsius": 21.5, "unit": "C"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.Validate(wire); len(errs) != 0 {
+		t.Errorf("own encoding fails: %v", errs)
+	}
+	if errs := c.Validate(append(wire, 0x01)); len(errs) == 0 {
+		t.Error("trailing bytes accepted")
+	}
+	back, err := c.Decode(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(back, &got); err != nil || got["unit"] != "C" {
+		t.Errorf("decoded %s (%v)", back, err)
+	}
+
+	if _, err := c.Encode([]byte(`{"unit": "C"}`)); err == nil {
+		t.Error("sample without a required field encoded")
+	}
+	if _, err := Compile(Avro, []byte(`{"type": "record"}`), ""); err == nil {
+		t.Error("record without a name compiled")
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	c, err := Compile(JSONSchema, []byte(`{"type":"object","required":["celsius"]}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := c.Encode([]byte(`{ "celsius": 1 }`)); err != nil || string(out) != `{"celsius":1}` {
+		t.Errorf("Encode = %s, %v", out, err)
+	}
+	if _, err := c.Encode([]byte(`{}`)); err == nil {
+		t.Error("non-conforming sample encoded")
+	}
+	if _, err := Compile(JSONSchema, []byte(`{}`), "Reading"); !errors.Is(err, ErrMessageType) {
+		t.Errorf("message type on json_schema: %v", err)
+	}
+	if _, err := Compile("xml", nil, ""); err == nil {
+		t.Error("unknown format compiled")
+	}
+}
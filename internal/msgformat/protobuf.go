@@ -0,0 +1,248 @@
+package msgformat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"platform/internal/jsonvalidate"
+)
+
+// protobufDocument is the JSON form of a Protobuf schema document. Exactly one
+// field is set.
+type protobufDocument struct {
+	Proto             string            `json:"proto"`
+	Files             map[string]string `json:"files"`
+	FileDescriptorSet string            `json:"file_descriptor_set"`
+}
+
+// protoSourceName is the file name a lone "proto" source is compiled under; it
+// shows up in compiler errors.
+const protoSourceName = "schema.proto"
+
+// typeResolver finds the message types an Any or an extension refers to.
+type typeResolver interface {
+	protoregistry.MessageTypeResolver
+	protoregistry.ExtensionTypeResolver
+}
+
+// protobufCodec reads and writes one message type.
+type protobufCodec struct {
+	message protoreflect.MessageDescriptor
+	types   typeResolver
+}
+
+func compileProtobuf(document []byte, messageType string) (Codec, error) {
+	var doc protobufDocument
+	dec := json.NewDecoder(bytes.NewReader(document))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf(`a protobuf document is an object with "proto", "files" or "file_descriptor_set": %w`, err)
+	}
+
+	set := 0
+	for _, present := range []bool{doc.Proto != "", len(doc.Files) > 0, doc.FileDescriptorSet != ""} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New(`a protobuf document needs exactly one of "proto", "files" and "file_descriptor_set"`)
+	}
+
+	var (
+		files []protoreflect.FileDescriptor
+		types typeResolver
+		err   error
+	)
+	switch {
+	case doc.Proto != "":
+		files, types, err = compileProtoSources(map[string]string{protoSourceName: doc.Proto})
+	case len(doc.Files) > 0:
+		files, types, err = compileProtoSources(doc.Files)
+	default:
+		files, types, err = loadDescriptorSet(doc.FileDescriptorSet)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := resolveMessage(files, messageType)
+	if err != nil {
+		return nil, err
+	}
+	return protobufCodec{message: md, types: types}, nil
+}
+
+// compileProtoSources compiles every file in srcs. Imports resolve to other
+// entries of srcs or to protoc's standard files, never to the file system.
+func compileProtoSources(srcs map[string]string) ([]protoreflect.FileDescriptor, typeResolver, error) {
+	names := make([]string, 0, len(srcs))
+	for name := range srcs {
+		if !strings.HasSuffix(name, ".proto") {
+			return nil, nil, fmt.Errorf("file %q: names must end in .proto", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(srcs),
+		}),
+	}
+	compiled, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]protoreflect.FileDescriptor, 0, len(compiled))
+	for _, f := range compiled {
+		files = append(files, f)
+	}
+	return files, compiled.AsResolver(), nil
+}
+
+// loadDescriptorSet decodes a base64 FileDescriptorSet. Its files are the ones
+// the set carries other than google/protobuf's own.
+func loadDescriptorSet(encoded string) ([]protoreflect.FileDescriptor, typeResolver, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file_descriptor_set is not base64: %w", err)
+	}
+	var fds descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(raw, &fds); err != nil {
+		return nil, nil, fmt.Errorf("file_descriptor_set is not a FileDescriptorSet: %w", err)
+	}
+	reg, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file_descriptor_set: %w (build it with protoc --include_imports)", err)
+	}
+
+	var files []protoreflect.FileDescriptor
+	reg.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+		if !strings.HasPrefix(f.Path(), "google/protobuf/") {
+			files = append(files, f)
+		}
+		return true
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path() < files[j].Path() })
+	return files, dynamicpb.NewTypes(reg), nil
+}
+
+// resolveMessage finds the message named want — a full name, or a short name
+// that only one message has — among the messages files declare. An empty want
+// resolves to the only top-level message, if there is exactly one.
+func resolveMessage(files []protoreflect.FileDescriptor, want string) (protoreflect.MessageDescriptor, error) {
+	var all, top []protoreflect.MessageDescriptor
+	var walk func(ms protoreflect.MessageDescriptors, nested bool)
+	walk = func(ms protoreflect.MessageDescriptors, nested bool) {
+		for i := 0; i < ms.Len(); i++ {
+			m := ms.Get(i)
+			if m.IsMapEntry() {
+				continue
+			}
+			all = append(all, m)
+			if !nested {
+				top = append(top, m)
+			}
+			walk(m.Messages(), true)
+		}
+	}
+	for _, f := range files {
+		walk(f.Messages(), false)
+	}
+	if len(all) == 0 {
+		return nil, errors.New("the document declares no message")
+	}
+
+	if want == "" {
+		if len(top) == 1 {
+			return top[0], nil
+		}
+		return nil, fmt.Errorf("%w: the document declares %d messages (%s); say which one",
+			ErrMessageType, len(top), messageNames(top))
+	}
+
+	want = strings.TrimPrefix(want, ".")
+	var short []protoreflect.MessageDescriptor
+	for _, m := range all {
+		if string(m.FullName()) == want {
+			return m, nil
+		}
+		if string(m.Name()) == want {
+			short = append(short, m)
+		}
+	}
+	switch len(short) {
+	case 1:
+		return short[0], nil
+	case 0:
+		return nil, fmt.Errorf("%w: no message %q; the document declares %s", ErrMessageType, want, messageNames(all))
+	}
+	return nil, fmt.Errorf("%w: %q is ambiguous (%s); use the full name", ErrMessageType, want, messageNames(short))
+}
+
+func messageNames(ms []protoreflect.MessageDescriptor) string {
+	names := make([]string, len(ms))
+	for i, m := range ms {
+		names[i] = string(m.FullName())
+	}
+	return strings.Join(names, ", ")
+}
+
+func (protobufCodec) Format() string { return Protobuf }
+
+func (c protobufCodec) MessageType() string { return string(c.message.FullName()) }
+
+func (c protobufCodec) unmarshal(payload []byte) (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(c.message)
+	if err := (proto.UnmarshalOptions{Resolver: c.types}).Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c protobufCodec) Validate(payload []byte) []jsonvalidate.Violation {
+	_, err := c.unmarshal(payload)
+	return violation(err)
+}
+
+func (c protobufCodec) Encode(sample []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.message)
+	if err := (protojson.UnmarshalOptions{Resolver: c.types}).Unmarshal(sample, msg); err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
+
+func (c protobufCodec) Decode(payload []byte) ([]byte, error) {
+	msg, err := c.unmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := protojson.MarshalOptions{Resolver: c.types}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	// protojson varies its whitespace on purpose; compacting makes the output
+	// stable.
+	var out bytes.Buffer
+	if err := json.Compact(&out, raw); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
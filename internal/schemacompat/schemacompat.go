@@ -0,0 +1,424 @@
+// Package schemacompat compares two versions of a JSON Schema and reports the
+// changes that would break a producer or a consumer, in the sense schema
+// registries use:
+//
+//   - backward: the NEW schema accepts everything the old one did, so a consumer
+//     upgraded to the new version still reads data written under the old one.
+//     Adding a required property, narrowing a type, tightening a bound or
+//     removing an enum value breaks it.
+//   - forward: the OLD schema accepts everything the new one does, so a consumer
+//     still on the old version reads data written under the new one. Dropping a
+//     required property, widening a type, loosening a bound or adding an enum
+//     value breaks it.
+//   - full: both.
+//
+// The comparison is structural and conservative. It walks the keywords message
+// contracts actually use — type, properties, required, additionalProperties,
+// items, enum, const, the numeric and length bounds, pattern and format — and
+// reports each difference with the direction it breaks. A change it cannot
+// reason about, such as an edited oneOf or a re-pointed $ref, is reported as
+// breaking both ways rather than passed. One simplification is deliberate:
+// a property added while additionalProperties stays open is not reported as a
+// backward break, although old data could in principle carry a same-named
+// property of another shape. Registries that flag that make adding an optional
+// field impossible, which is the change schemas most need to make.
+package schemacompat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Compatibility modes.
+const (
+	Backward = "backward"
+	Forward  = "forward"
+	Full     = "full"
+	None     = "none"
+)
+
+// ValidMode reports whether m is one of the modes above.
+func ValidMode(m string) bool {
+	switch m {
+	case Backward, Forward, Full, None:
+		return true
+	}
+	return false
+}
+
+// Change is one difference between the versions. Pointer is the RFC 6901
+// location in the schema document the change is at.
+type Change struct {
+	Pointer        string `json:"pointer"`
+	Message        string `json:"message"`
+	BreaksBackward bool   `json:"breaks_backward"`
+	BreaksForward  bool   `json:"breaks_forward"`
+}
+
+// Breaks reports whether the change breaks compatibility under mode.
+func (c Change) Breaks(mode string) bool {
+	switch mode {
+	case Backward:
+		return c.BreaksBackward
+	case Forward:
+		return c.BreaksForward
+	case Full:
+		return c.BreaksBackward || c.BreaksForward
+	}
+	return false
+}
+
+// Compare parses both schemas and returns every change, ordered by pointer.
+func Compare(oldRaw, newRaw []byte) ([]Change, error) {
+	var o, n any
+	if err := json.Unmarshal(oldRaw, &o); err != nil {
+		return nil, fmt.Errorf("previous schema: %w", err)
+	}
+	if err := json.Unmarshal(newRaw, &n); err != nil {
+		return nil, fmt.Errorf("new schema: %w", err)
+	}
+	var c comparer
+	c.walk("", o, n)
+	sort.SliceStable(c.changes, func(i, j int) bool { return c.changes[i].Pointer < c.changes[j].Pointer })
+	return c.changes, nil
+}
+
+// Breaking returns the changes that break compatibility under mode.
+func Breaking(changes []Change, mode string) []Change {
+	var out []Change
+	for _, c := range changes {
+		if c.Breaks(mode) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Describe renders changes one per line, for an error message.
+func Describe(changes []Change) string {
+	lines := make([]string, 0, len(changes))
+	for _, c := range changes {
+		p := c.Pointer
+		if p == "" {
+			p = "(root)"
+		}
+		lines = append(lines, p+": "+c.Message)
+	}
+	return strings.Join(lines, "; ")
+}
+
+type comparer struct {
+	changes []Change
+}
+
+func (c *comparer) add(ptr, msg string, backward, forward bool) {
+	c.changes = append(c.changes, Change{Pointer: ptr, Message: msg, BreaksBackward: backward, BreaksForward: forward})
+}
+
+// walk compares two schema nodes at ptr.
+func (c *comparer) walk(ptr string, o, n any) {
+	// Boolean schemas: true accepts anything, false nothing.
+	ob, oIsBool := o.(bool)
+	nb, nIsBool := n.(bool)
+	if oIsBool || nIsBool {
+		switch {
+		case oIsBool && nIsBool && ob == nb:
+		case oIsBool && !ob:
+			c.add(ptr, "accepted nothing, now accepts values", false, true)
+		case nIsBool && !nb:
+			c.add(ptr, "now accepts nothing", true, false)
+		case oIsBool && ob:
+			if m, ok := n.(map[string]any); ok && len(m) > 0 {
+				c.add(ptr, "accepted anything, now constrained", true, false)
+			}
+		case nIsBool && nb:
+			if m, ok := o.(map[string]any); ok && len(m) > 0 {
+				c.add(ptr, "was constrained, now accepts anything", false, true)
+			}
+		}
+		return
+	}
+
+	om, _ := o.(map[string]any)
+	nm, _ := n.(map[string]any)
+	if om == nil || nm == nil {
+		if !equalJSON(o, n) {
+			c.add(ptr, "changed in a way that cannot be compared", true, true)
+		}
+		return
+	}
+
+	if !equalJSON(om["$ref"], nm["$ref"]) {
+		c.add(ptr+"/$ref", fmt.Sprintf("reference changed from %s to %s", show(om["$ref"]), show(nm["$ref"])), true, true)
+	}
+	for _, kw := range []string{"oneOf", "anyOf", "allOf", "not", "if", "then", "else"} {
+		if !equalJSON(om[kw], nm[kw]) {
+			c.add(ptr+"/"+kw, kw+" changed; not compared in depth", true, true)
+		}
+	}
+
+	c.types(ptr, om, nm)
+	c.values(ptr, om, nm, "enum")
+	c.values(ptr, om, nm, "const")
+	c.properties(ptr, om, nm)
+	c.required(ptr, om, nm)
+	c.additional(ptr, om, nm)
+	if oi, ni := om["items"], nm["items"]; oi != nil || ni != nil {
+		c.walk(ptr+"/items", orTrue(oi), orTrue(ni))
+	}
+	for _, kw := range []string{"minimum", "exclusiveMinimum", "minLength", "minItems", "minProperties"} {
+		c.bound(ptr, om, nm, kw, true)
+	}
+	for _, kw := range []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems", "maxProperties"} {
+		c.bound(ptr, om, nm, kw, false)
+	}
+	for _, kw := range []string{"pattern", "format", "multipleOf"} {
+		c.constraint(ptr, om, nm, kw)
+	}
+	for _, kw := range []string{"$defs", "definitions"} {
+		od, _ := om[kw].(map[string]any)
+		nd, _ := nm[kw].(map[string]any)
+		for _, name := range sortedKeys(od) {
+			if nv, ok := nd[name]; ok {
+				c.walk(ptr+"/"+kw+"/"+escape(name), od[name], nv)
+			}
+		}
+	}
+}
+
+func (c *comparer) types(ptr string, om, nm map[string]any) {
+	ot, nt := typeSet(om["type"]), typeSet(nm["type"])
+	if ot == nil && nt == nil {
+		return
+	}
+	var removed, added []string
+	for _, t := range sortedKeys(ot) {
+		if !accepts(nt, t) {
+			removed = append(removed, t)
+		}
+	}
+	for _, t := range sortedKeys(nt) {
+		if !accepts(ot, t) {
+			added = append(added, t)
+		}
+	}
+	switch {
+	case nt != nil && ot == nil:
+		c.add(ptr+"/type", "now restricted to "+strings.Join(sortedKeys(nt), ", "), true, false)
+	case ot != nil && nt == nil:
+		c.add(ptr+"/type", "no longer restricted to "+strings.Join(sortedKeys(ot), ", "), false, true)
+	default:
+		if len(removed) > 0 {
+			c.add(ptr+"/type", "no longer accepts "+strings.Join(removed, ", "), true, false)
+		}
+		if len(added) > 0 {
+			c.add(ptr+"/type", "now also accepts "+strings.Join(added, ", "), false, true)
+		}
+	}
+}
+
+// values compares enum (a list) or const (one value).
+func (c *comparer) values(ptr string, om, nm map[string]any, kw string) {
+	ov, oHas := om[kw]
+	nv, nHas := nm[kw]
+	if !oHas && !nHas {
+		return
+	}
+	set := func(v any) map[string]bool {
+		out := map[string]bool{}
+		if list, ok := v.([]any); ok && kw == "enum" {
+			for _, x := range list {
+				out[canonical(x)] = true
+			}
+			return out
+		}
+		out[canonical(v)] = true
+		return out
+	}
+	switch {
+	case !oHas:
+		c.add(ptr+"/"+kw, kw+" added", true, false)
+	case !nHas:
+		c.add(ptr+"/"+kw, kw+" removed", false, true)
+	default:
+		os, ns := set(ov), set(nv)
+		var removed, added []string
+		for _, v := range sortedKeys(os) {
+			if !ns[v] {
+				removed = append(removed, v)
+			}
+		}
+		for _, v := range sortedKeys(ns) {
+			if !os[v] {
+				added = append(added, v)
+			}
+		}
+		if len(removed) > 0 {
+			c.add(ptr+"/"+kw, "no longer allows "+strings.Join(removed, ", "), true, false)
+		}
+		if len(added) > 0 {
+			c.add(ptr+"/"+kw, "now also allows "+strings.Join(added, ", "), false, true)
+		}
+	}
+}
+
+func (c *comparer) properties(ptr string, om, nm map[string]any) {
+	op, _ := om["properties"].(map[string]any)
+	np, _ := nm["properties"].(map[string]any)
+	oClosed, nClosed := om["additionalProperties"] == false, nm["additionalProperties"] == false
+
+	for _, name := range sortedKeys(op) {
+		p := ptr + "/properties/" + escape(name)
+		nv, ok := np[name]
+		if ok {
+			c.walk(p, op[name], nv)
+			continue
+		}
+		if nClosed {
+			c.add(p, fmt.Sprintf("property %q removed while additional properties are not allowed", name), true, false)
+		}
+	}
+	for _, name := range sortedKeys(np) {
+		if _, ok := op[name]; ok {
+			continue
+		}
+		if oClosed {
+			c.add(ptr+"/properties/"+escape(name),
+				fmt.Sprintf("property %q added, which the previous version rejects as an additional property", name), false, true)
+		}
+	}
+}
+
+func (c *comparer) required(ptr string, om, nm map[string]any) {
+	or, nr := stringSet(om["required"]), stringSet(nm["required"])
+	for _, name := range sortedKeys(nr) {
+		if !or[name] {
+			c.add(ptr+"/required", fmt.Sprintf("property %q is now required", name), true, false)
+		}
+	}
+	for _, name := range sortedKeys(or) {
+		if !nr[name] {
+			c.add(ptr+"/required", fmt.Sprintf("property %q is no longer required", name), false, true)
+		}
+	}
+}
+
+func (c *comparer) additional(ptr string, om, nm map[string]any) {
+	oa, oHas := om["additionalProperties"]
+	na, nHas := nm["additionalProperties"]
+	if !oHas && !nHas {
+		return
+	}
+	c.walk(ptr+"/additionalProperties", orTrue(oa), orTrue(na))
+}
+
+// bound compares a numeric keyword. For a lower bound (minimum, minLength…) a
+// larger value is tighter; for an upper bound a smaller one is.
+func (c *comparer) bound(ptr string, om, nm map[string]any, kw string, lower bool) {
+	ov, oHas := number(om[kw])
+	nv, nHas := number(nm[kw])
+	switch {
+	case !oHas && !nHas:
+	case !oHas:
+		c.add(ptr+"/"+kw, fmt.Sprintf("%s %v added", kw, nv), true, false)
+	case !nHas:
+		c.add(ptr+"/"+kw, fmt.Sprintf("%s %v removed", kw, ov), false, true)
+	case ov != nv:
+		tighter := nv > ov
+		if !lower {
+			tighter = nv < ov
+		}
+		c.add(ptr+"/"+kw, fmt.Sprintf("%s changed from %v to %v", kw, ov, nv), tighter, !tighter)
+	}
+}
+
+// constraint compares a keyword whose values cannot be ordered.
+func (c *comparer) constraint(ptr string, om, nm map[string]any, kw string) {
+	ov, oHas := om[kw]
+	nv, nHas := nm[kw]
+	switch {
+	case !oHas && !nHas:
+	case !oHas:
+		c.add(ptr+"/"+kw, fmt.Sprintf("%s %s added", kw, show(nv)), true, false)
+	case !nHas:
+		c.add(ptr+"/"+kw, fmt.Sprintf("%s %s removed", kw, show(ov)), false, true)
+	case !equalJSON(ov, nv):
+		c.add(ptr+"/"+kw, fmt.Sprintf("%s changed from %s to %s", kw, show(ov), show(nv)), true, true)
+	}
+}
+
+// typeSet reads "type" as a set; nil means unrestricted.
+func typeSet(v any) map[string]bool {
+	switch t := v.(type) {
+	case string:
+		return map[string]bool{t: true}
+	case []any:
+		out := map[string]bool{}
+		for _, x := range t {
+			if s, ok := x.(string); ok {
+				out[s] = true
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// accepts reports whether a type set admits every value of type t. "number"
+// covers "integer".
+func accepts(set map[string]bool, t string) bool {
+	return set == nil || set[t] || (t == "integer" && set["number"])
+}
+
+func stringSet(v any) map[string]bool {
+	out := map[string]bool{}
+	if list, ok := v.([]any); ok {
+		for _, x := range list {
+			if s, ok := x.(string); ok {
+				out[s] = true
+			}
+		}
+	}
+	return out
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func orTrue(v any) any {
+	if v == nil {
+		return true
+	}
+	return v
+}
+
+func canonical(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func equalJSON(a, b any) bool { return canonical(a) == canonical(b) }
+
+func show(v any) string {
+	if v == nil {
+		return "(none)"
+	}
+	return canonical(v)
+}
+
+func escape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,99 @@
+package schemacompat
+
+import (
+	"strings"
+	"testing"
+)
+
+const base = `{
+	"type": "object",
+	"required": ["celsius"],
+	"properties": {
+		"celsius": {"type": "number", "minimum": -50},
+		"unit": {"type": "string", "enum": ["C", "F"]}
+	}
+}`
+
+func compare(t *testing.T, old, new string) []Change {
+	t.Helper()
+	changes, err := Compare([]byte(old), []byte(new))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestIdenticalSchemasHaveNoChanges(t *testing.T) {
+	if changes := compare(t, base, base); len(changes) != 0 {
+		t.Errorf("changes = %+v", changes)
+	}
+}
+
+func TestDirections(t *testing.T) {
+	cases := []struct {
+		name              string
+		new               string
+		backward, forward bool
+		pointerContains   string
+	}{
+		{"new required property", `{"type":"object","required":["celsius","site"],"properties":{"celsius":{"type":"number","minimum":-50},"unit":{"type":"string","enum":["C","F"]}}}`,
+			true, false, "/required"},
+		{"required dropped", `{"type":"object","properties":{"celsius":{"type":"number","minimum":-50},"unit":{"type":"string","enum":["C","F"]}}}`,
+			false, true, "/required"},
+		{"type narrowed", `{"type":"object","required":["celsius"],"properties":{"celsius":{"type":"integer","minimum":-50},"unit":{"type":"string","enum":["C","F"]}}}`,
+			true, false, "/properties/celsius/type"},
+		{"type changed", `{"type":"object","required":["celsius"],"properties":{"celsius":{"type":"string","minimum":-50},"unit":{"type":"string","enum":["C","F"]}}}`,
+			true, true, "/properties/celsius/type"},
+		{"enum value added", `{"type":"object","required":["celsius"],"properties":{"celsius":{"type":"number","minimum":-50},"unit":{"type":"string","enum":["C","F","K"]}}}`,
+			false, true, "/properties/unit/enum"},
+		{"minimum tightened", `{"type":"object","required":["celsius"],"properties":{"celsius":{"type":"number","minimum":0},"unit":{"type":"string","enum":["C","F"]}}}`,
+			true, false, "/properties/celsius/minimum"},
+		{"additional properties closed", `{"type":"object","required":["celsius"],"additionalProperties":false,"properties":{"celsius":{"type":"number","minimum":-50},"unit":{"type":"string","enum":["C","F"]}}}`,
+			true, false, "/additionalProperties"},
+	}
+	for _, c := range cases {
+		changes := compare(t, base, c.new)
+		var backward, forward bool
+		for _, ch := range changes {
+			if !strings.Contains(ch.Pointer, c.pointerContains) {
+				t.Errorf("%s: unexpected change %+v", c.name, ch)
+			}
+			backward = backward || ch.BreaksBackward
+			forward = forward || ch.BreaksForward
+		}
+		if len(changes) == 0 || backward != c.backward || forward != c.forward {
+			t.Errorf("%s: backward=%v forward=%v, want %v/%v (%+v)", c.name, backward, forward, c.backward, c.forward, changes)
+		}
+	}
+}
+
+func TestAddingAnOptionalPropertyIsCompatible(t *testing.T) {
+	changes := compare(t, base, `{"type":"object","required":["celsius"],"properties":{
+		"celsius":{"type":"number","minimum":-50},"unit":{"type":"string","enum":["C","F"]},"site":{"type":"string"}}}`)
+	if len(Breaking(changes, Full)) != 0 {
+		t.Errorf("changes = %+v", changes)
+	}
+}
+
+func TestAddingAPropertyToAClosedObjectBreaksForward(t *testing.T) {
+	old := `{"type":"object","additionalProperties":false,"properties":{"a":{"type":"string"}}}`
+	new := `{"type":"object","additionalProperties":false,"properties":{"a":{"type":"string"},"b":{"type":"string"}}}`
+	changes := compare(t, old, new)
+	if len(Breaking(changes, Backward)) != 0 || len(Breaking(changes, Forward)) != 1 {
+		t.Errorf("changes = %+v", changes)
+	}
+}
+
+func TestUncomparableChangesBreakBothWays(t *testing.T) {
+	changes := compare(t, `{"oneOf":[{"type":"string"},{"type":"number"}]}`, `{"oneOf":[{"type":"string"}]}`)
+	if len(changes) != 1 || !changes[0].BreaksBackward || !changes[0].BreaksForward {
+		t.Errorf("changes = %+v", changes)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	got := Describe([]Change{{Pointer: "/required", Message: `property "x" is now required`}, {Message: "now accepts nothing"}})
+	if got != `/required: property "x" is now required; (root): now accepts nothing` {
+		t.Errorf("Describe = %q", got)
+	}
+}
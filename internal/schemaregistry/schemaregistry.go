@@ -0,0 +1,521 @@
+// Package schemaregistry answers schema lookups over NATS, for the participants
+// that cannot call the PocketBase HTTP API — devices on the bus, rule-router
+// instances, anything on a leaf node — but need the schema behind a subject at
+// runtime.
+//
+// It runs a NATS micro service in each organization's account, so it is
+// discoverable with `nats micro ls` and answers the standard $SRV PING, INFO and
+// STATS requests, with three endpoints under a prefix ("schemas" by default):
+//
+//	schemas.get      <handle>                       one schema version, with its document
+//	                 {"namespace","name","version"}  version omitted: the highest one
+//	schemas.list     [{"namespace","name"}]          summaries, without documents
+//	schemas.resolve  <subject>                       the operations whose subject pattern
+//	                 {"subject"}                     matches it, each with its schema
+//
+// A handle is namespace__name__version, the key leaf-sync mirrors a schema
+// under. Errors use the micro error headers (Nats-Service-Error-Code 400 or
+// 404) and a {"error": "..."} body.
+//
+// Each account's data is an immutable snapshot, replaced whole when the
+// records it was built from change; encoded responses are cached per snapshot,
+// so replacing it is the invalidation. The connection is kept across a data
+// change and only replaced when the account's identity does.
+package schemaregistry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Schema is one message_schemas version.
+type Schema struct {
+	ID          string          `json:"id"`
+	Namespace   string          `json:"namespace"`
+	Name        string          `json:"name"`
+	Version     string          `json:"version"`
+	Format      string          `json:"format"`
+	MessageType string          `json:"message_type,omitempty"` // Protobuf message or Avro type; empty for json_schema
+	Document    json.RawMessage `json:"schema,omitempty"`
+}
+
+// Handle is namespace__name__version.
+func (s Schema) Handle() string { return s.Namespace + "__" + s.Name + "__" + s.Version }
+
+// Binding is a Thing Type operation and the schema it references. Subject is
+// the pattern every Thing of the type uses: {thing} and {location} widened to
+// "*", as a role grant resolves it.
+type Binding struct {
+	Subject    string `json:"subject"`
+	ThingType  string `json:"thing_type"`
+	Operation  string `json:"operation"`
+	Capability string `json:"capability"`
+	Schema     string `json:"schema"` // handle
+}
+
+// Registry is the data served in one organization's account.
+type Registry struct {
+	Org       string
+	OrgName   string
+	PublicKey string
+	Schemas   []Schema
+	Bindings  []Binding
+}
+
+func (r Registry) fingerprint() string {
+	h := sha256.New()
+	_ = json.NewEncoder(h).Encode([]any{r.OrgName, r.Schemas, r.Bindings})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Config tunes a Service. Zero values take the defaults below.
+type Config struct {
+	Prefix         string        // endpoint subject prefix; default "schemas"
+	ReloadInterval time.Duration // default 5m; Reload() also triggers one
+	CacheSize      int           // cached responses per account; default 1024
+}
+
+func (c Config) withDefaults() Config {
+	if c.Prefix == "" {
+		c.Prefix = "schemas"
+	}
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = 5 * time.Minute
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = 1024
+	}
+	return c
+}
+
+// Loader returns every account to serve.
+type Loader func(ctx context.Context) ([]Registry, error)
+
+// Connector opens a connection into reg's account that may subscribe under the
+// prefix and $SRV, and reply to what it receives.
+type Connector func(ctx context.Context, reg Registry, cfg Config) (*nats.Conn, error)
+
+// Service keeps one connection and micro service per account.
+type Service struct {
+	cfg     Config
+	load    Loader
+	connect Connector
+	reload  chan struct{}
+
+	mu      sync.Mutex
+	servers map[string]*server // by org
+}
+
+// New returns a Service; Run starts it.
+func New(cfg Config, load Loader, connect Connector) *Service {
+	return &Service{
+		cfg:     cfg.withDefaults(),
+		load:    load,
+		connect: connect,
+		reload:  make(chan struct{}, 1),
+		servers: map[string]*server{},
+	}
+}
+
+// Reload asks the service to re-read its data soon. It never blocks, and
+// several calls before the reload runs collapse into one.
+func (s *Service) Reload() {
+	select {
+	case s.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run serves until ctx is done, then stops every service and connection. Load
+// and connect failures are logged and retried on the next reload.
+func (s *Service) Run(ctx context.Context) error {
+	s.apply(ctx)
+
+	reload := time.NewTicker(s.cfg.ReloadInterval)
+	defer reload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.closeAll()
+			return nil
+		case <-s.reload:
+			s.apply(ctx)
+		case <-reload.C:
+			s.apply(ctx)
+		}
+	}
+}
+
+// Serving returns the organizations currently served and their schema counts.
+func (s *Service) Serving() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int, len(s.servers))
+	for org, srv := range s.servers {
+		out[org] = len(srv.index.Load().reg.Schemas)
+	}
+	return out
+}
+
+func (s *Service) apply(ctx context.Context) {
+	regs, err := s.load(ctx)
+	if err != nil {
+		log.Printf("⚠️ schema registry: loading schemas failed (keeping current data): %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, reg := range regs {
+		seen[reg.Org] = true
+		fp := reg.fingerprint()
+		if srv := s.servers[reg.Org]; srv != nil {
+			if srv.publicKey == reg.PublicKey {
+				if srv.fingerprint != fp {
+					srv.index.Store(newIndex(reg, s.cfg.CacheSize))
+					srv.fingerprint = fp
+				}
+				continue
+			}
+			srv.close()
+			delete(s.servers, reg.Org)
+		}
+		srv, err := s.start(ctx, reg, fp)
+		if err != nil {
+			log.Printf("⚠️ schema registry: org %s: %v", reg.OrgName, err)
+			continue
+		}
+		s.servers[reg.Org] = srv
+		log.Printf("✅ schema registry: serving %d schema(s) in org %s on %s.>", len(reg.Schemas), reg.OrgName, s.cfg.Prefix)
+	}
+	for org, srv := range s.servers {
+		if !seen[org] {
+			srv.close()
+			delete(s.servers, org)
+		}
+	}
+}
+
+func (s *Service) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for org, srv := range s.servers {
+		srv.close()
+		delete(s.servers, org)
+	}
+}
+
+// server is one account's connection, micro service and current data.
+type server struct {
+	publicKey   string
+	fingerprint string
+	nc          *nats.Conn
+	svc         micro.Service
+	index       atomic.Pointer[index]
+}
+
+func (s *Service) start(ctx context.Context, reg Registry, fp string) (*server, error) {
+	nc, err := s.connect(ctx, reg, s.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	srv := &server{publicKey: reg.PublicKey, fingerprint: fp, nc: nc}
+	srv.index.Store(newIndex(reg, s.cfg.CacheSize))
+
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        "schema-registry",
+		Version:     "1.0.0",
+		Description: "Message schemas and the subjects that use them",
+	})
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("micro service: %w", err)
+	}
+	srv.svc = svc
+
+	g := svc.AddGroup(s.cfg.Prefix)
+	for name, h := range map[string]func(*index, []byte) ([]byte, *requestError){
+		"get":     (*index).get,
+		"list":    (*index).list,
+		"resolve": (*index).resolve,
+	} {
+		endpoint, handle := name, h
+		err := g.AddEndpoint(endpoint, micro.HandlerFunc(func(req micro.Request) {
+			idx := srv.index.Load()
+			body, rerr := idx.cached(endpoint, req.Data(), handle)
+			if rerr != nil {
+				data, _ := json.Marshal(map[string]string{"error": rerr.msg})
+				_ = req.Error(rerr.code, rerr.msg, data)
+				return
+			}
+			_ = req.Respond(body)
+		}))
+		if err != nil {
+			_ = svc.Stop()
+			nc.Close()
+			return nil, fmt.Errorf("endpoint %s: %w", endpoint, err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		_ = svc.Stop()
+		nc.Close()
+		return nil, err
+	}
+	if err := nc.LastError(); err != nil {
+		_ = svc.Stop()
+		nc.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+func (srv *server) close() {
+	_ = srv.svc.Stop()
+	_ = srv.nc.Drain()
+}
+
+type requestError struct {
+	code string
+	msg  string
+}
+
+// index is an immutable view of one Registry, with a cache of the responses
+// computed from it.
+type index struct {
+	reg      Registry
+	byHandle map[string]*Schema
+	byName   map[string][]*Schema // "namespace/name" -> versions, highest first
+
+	mu    sync.Mutex
+	cache map[string][]byte
+	limit int
+}
+
+func newIndex(reg Registry, limit int) *index {
+	idx := &index{
+		reg:      reg,
+		byHandle: map[string]*Schema{},
+		byName:   map[string][]*Schema{},
+		cache:    map[string][]byte{},
+		limit:    limit,
+	}
+	for i := range reg.Schemas {
+		s := &reg.Schemas[i]
+		idx.byHandle[s.Handle()] = s
+		key := s.Namespace + "/" + s.Name
+		idx.byName[key] = append(idx.byName[key], s)
+	}
+	for _, versions := range idx.byName {
+		sort.Slice(versions, func(i, j int) bool { return versionLess(versions[j].Version, versions[i].Version) })
+	}
+	return idx
+}
+
+// cached answers from the cache or computes and stores the answer. Errors are
+// not cached; they are cheap, and a miss should not crowd out a hit.
+func (idx *index) cached(endpoint string, req []byte, compute func(*index, []byte) ([]byte, *requestError)) ([]byte, *requestError) {
+	key := endpoint + "\x00" + string(req)
+	idx.mu.Lock()
+	body, ok := idx.cache[key]
+	idx.mu.Unlock()
+	if ok {
+		return body, nil
+	}
+
+	body, rerr := compute(idx, req)
+	if rerr != nil {
+		return nil, rerr
+	}
+	idx.mu.Lock()
+	if len(idx.cache) >= idx.limit {
+		idx.cache = map[string][]byte{}
+	}
+	idx.cache[key] = body
+	idx.mu.Unlock()
+	return body, nil
+}
+
+type getRequest struct {
+	Handle    string `json:"handle"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+func (idx *index) get(data []byte) ([]byte, *requestError) {
+	var req getRequest
+	if text := strings.TrimSpace(string(data)); strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, &requestError{"400", "request is not valid JSON: " + err.Error()}
+		}
+	} else {
+		req.Handle = text
+	}
+
+	var s *Schema
+	switch {
+	case req.Handle != "":
+		s = idx.byHandle[req.Handle]
+	case req.Namespace != "" && req.Name != "" && req.Version != "":
+		s = idx.byHandle[req.Namespace+"__"+req.Name+"__"+req.Version]
+	case req.Namespace != "" && req.Name != "":
+		if versions := idx.byName[req.Namespace+"/"+req.Name]; len(versions) > 0 {
+			s = versions[0]
+		}
+	default:
+		return nil, &requestError{"400", "a handle, or a namespace and name, is required"}
+	}
+	if s == nil {
+		return nil, &requestError{"404", "schema not found"}
+	}
+	return marshal(s)
+}
+
+// summary is a list entry: a schema without its document.
+type summary struct {
+	ID          string `json:"id"`
+	Handle      string `json:"handle"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Format      string `json:"format"`
+	MessageType string `json:"message_type,omitempty"` // Protobuf message or Avro type; empty for json_schema
+}
+
+func (idx *index) list(data []byte) ([]byte, *requestError) {
+	var req getRequest
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, &requestError{"400", "request is not valid JSON: " + err.Error()}
+		}
+	}
+	out := []summary{}
+	for _, s := range idx.reg.Schemas {
+		if (req.Namespace != "" && s.Namespace != req.Namespace) || (req.Name != "" && s.Name != req.Name) {
+			continue
+		}
+		out = append(out, summary{
+			ID: s.ID, Handle: s.Handle(), Namespace: s.Namespace, Name: s.Name,
+			Version: s.Version, Format: s.Format, MessageType: s.MessageType,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace+"/"+out[i].Name != out[j].Namespace+"/"+out[j].Name {
+			return out[i].Namespace+"/"+out[i].Name < out[j].Namespace+"/"+out[j].Name
+		}
+		return versionLess(out[i].Version, out[j].Version)
+	})
+	return marshal(out)
+}
+
+// match is a resolve result.
+type match struct {
+	Binding
+	Document *Schema `json:"schema_document"`
+}
+
+func (idx *index) resolve(data []byte) ([]byte, *requestError) {
+	subject := strings.TrimSpace(string(data))
+	if strings.HasPrefix(subject, "{") {
+		var req struct {
+			Subject string `json:"subject"`
+		}
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, &requestError{"400", "request is not valid JSON: " + err.Error()}
+		}
+		subject = req.Subject
+	}
+	if subject == "" {
+		return nil, &requestError{"400", "a subject is required"}
+	}
+	if strings.ContainsAny(subject, "*> \t") {
+		return nil, &requestError{"400", "resolve takes a concrete subject, not a pattern"}
+	}
+
+	var matches []match
+	for _, b := range idx.reg.Bindings {
+		if Matches(b.Subject, subject) {
+			matches = append(matches, match{Binding: b, Document: idx.byHandle[b.Schema]})
+		}
+	}
+	if len(matches) == 0 {
+		return nil, &requestError{"404", "no operation with a schema uses this subject"}
+	}
+	return marshal(map[string]any{"subject": subject, "matches": matches})
+}
+
+// Matches reports whether a NATS subject pattern matches a concrete subject.
+func Matches(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, tok := range p {
+		if tok == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (tok != "*" && tok != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func marshal(v any) ([]byte, *requestError) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, &requestError{"500", err.Error()}
+	}
+	return b, nil
+}
+
+// versionLess orders MAJOR.MINOR.PATCH versions numerically, falling back to
+// string order for anything else.
+func versionLess(a, b string) bool {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	if len(pa) == 3 && len(pb) == 3 {
+		for i := range pa {
+			x, errX := strconv.Atoi(pa[i])
+			y, errY := strconv.Atoi(pb[i])
+			if errX != nil || errY != nil {
+				break
+			}
+			if x != y {
+				return x < y
+			}
+			if i == 2 {
+				return false
+			}
+		}
+	}
+	return a < b
+}
+
+// SortBindings orders bindings by subject, type and operation, so a Loader's
+// output — and with it the fingerprint — does not depend on query order.
+func SortBindings(bindings []Binding) {
+	sort.Slice(bindings, func(i, j int) bool {
+		a, b := bindings[i], bindings[j]
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		if a.ThingType != b.ThingType {
+			return a.ThingType < b.ThingType
+		}
+		return a.Operation < b.Operation
+	})
+}
@@ -0,0 +1,142 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"acme.*.sensor.*.telemetry", "acme.hq.sensor.t1.telemetry", true},
+		{"acme.*.sensor.*.telemetry", "acme.hq.sensor.t1.status", false},
+		{"acme.*.sensor.*.telemetry", "acme.hq.sensor.telemetry", false},
+		{"acme.>", "acme.hq.sensor", true},
+		{"acme.>", "acme", false},
+	}
+	for _, c := range cases {
+		if got := Matches(c.pattern, c.subject); got != c.want {
+			t.Errorf("Matches(%q, %q) = %v", c.pattern, c.subject, got)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	if !versionLess("1.2.0", "1.10.0") || versionLess("2.0.0", "1.10.0") || versionLess("1.0.0", "1.0.0") {
+		t.Error("versions are not ordered numerically")
+	}
+}
+
+// inProcessServer runs a NATS server with no listener, so the test binds no port.
+func inProcessServer(t *testing.T) *natsserver.Server {
+	t.Helper()
+	srv, err := natsserver.NewServer(&natsserver.Options{DontListen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func registry(version string) Registry {
+	return Registry{
+		Org: "o1", OrgName: "acme", PublicKey: "A1",
+		Schemas: []Schema{
+			{ID: "s1", Namespace: "telemetry", Name: "temperature", Version: "1.0.0", Format: "json_schema", Document: json.RawMessage(`{"type":"object"}`)},
+			{ID: "s2", Namespace: "telemetry", Name: "temperature", Version: version, Format: "json_schema", Document: json.RawMessage(`{"type":"object","required":["celsius"]}`)},
+		},
+		Bindings: []Binding{{
+			Subject: "acme.*.sensor.*.telemetry", ThingType: "sensor", Operation: "telemetry",
+			Capability: "publish", Schema: "telemetry__temperature__" + version,
+		}},
+	}
+}
+
+func TestServiceAnswersAndReloads(t *testing.T) {
+	srv := inProcessServer(t)
+	var mu sync.Mutex
+	current := registry("1.1.0")
+	load := func(ctx context.Context) ([]Registry, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return []Registry{current}, nil
+	}
+	connect := func(ctx context.Context, reg Registry, cfg Config) (*nats.Conn, error) {
+		return nats.Connect("", nats.InProcessServer(srv))
+	}
+
+	svc := New(Config{}, load, connect)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { _ = svc.Run(ctx); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svc.Serving()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client, err := nats.Connect("", nats.InProcessServer(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	request := func(subject, body string) *nats.Msg {
+		t.Helper()
+		msg, err := client.Request(subject, []byte(body), 2*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", subject, err)
+		}
+		return msg
+	}
+
+	var s Schema
+	if err := json.Unmarshal(request("schemas.get", `{"namespace":"telemetry","name":"temperature"}`).Data, &s); err != nil || s.Version != "1.1.0" {
+		t.Errorf("latest = %+v (%v)", s, err)
+	}
+	if err := json.Unmarshal(request("schemas.get", "telemetry__temperature__1.0.0").Data, &s); err != nil || s.ID != "s1" {
+		t.Errorf("by handle = %+v (%v)", s, err)
+	}
+	if msg := request("schemas.get", "nope__nope__1.0.0"); msg.Header.Get(micro.ErrorCodeHeader) != "404" {
+		t.Errorf("missing schema headers = %v", msg.Header)
+	}
+
+	var list []summary
+	if err := json.Unmarshal(request("schemas.list", "").Data, &list); err != nil || len(list) != 2 || list[0].Version != "1.0.0" {
+		t.Errorf("list = %+v (%v)", list, err)
+	}
+
+	var resolved struct {
+		Matches []match `json:"matches"`
+	}
+	if err := json.Unmarshal(request("schemas.resolve", "acme.hq.sensor.t1.telemetry").Data, &resolved); err != nil ||
+		len(resolved.Matches) != 1 || resolved.Matches[0].Document == nil || resolved.Matches[0].Document.ID != "s2" {
+		t.Errorf("resolve = %+v (%v)", resolved, err)
+	}
+
+	// A record change replaces the data, and with it every cached answer.
+	mu.Lock()
+	current = registry("2.0.0")
+	mu.Unlock()
+	svc.Reload()
+	for time.Now().Before(deadline) {
+		if err := json.Unmarshal(request("schemas.get", `{"namespace":"telemetry","name":"temperature"}`).Data, &s); err == nil && s.Version == "2.0.0" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("reload not visible: latest is still %s", s.Version)
+}
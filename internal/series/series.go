@@ -0,0 +1,100 @@
+// Package series expands name patterns with a numeric range — "pump-{001..120}"
+// — into the names they stand for, for creating a run of identical devices in
+// one request.
+//
+// The syntax is the shell's brace range, restricted to what a device code
+// needs: exactly one {first..last} per pattern, ascending, non-negative. A first
+// bound written with leading zeros sets the minimum width, so {001..120} gives
+// 001, 002, … 120 and {1..120} gives 1, 2, … 120. Anything that is not exactly
+// one such range is an error rather than a literal, because a pattern with a
+// typo in the braces would otherwise create one Thing literally named
+// "pump-{001..12O}".
+package series
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pattern is a parsed pattern: Prefix, then each number in [First, Last]
+// zero-padded to Width, then Suffix.
+type Pattern struct {
+	Prefix, Suffix string
+	First, Last    int
+	Width          int
+}
+
+var rangePattern = regexp.MustCompile(`\{(\d+)\.\.(\d+)\}`)
+
+// Parse reads a pattern containing exactly one {first..last} range.
+func Parse(s string) (Pattern, error) {
+	locs := rangePattern.FindAllStringSubmatchIndex(s, -1)
+	if len(locs) == 0 {
+		return Pattern{}, fmt.Errorf("pattern %q has no {first..last} range", s)
+	}
+	if len(locs) > 1 {
+		return Pattern{}, fmt.Errorf("pattern %q has more than one range", s)
+	}
+	loc := locs[0]
+	p := Pattern{Prefix: s[:loc[0]], Suffix: s[loc[1]:]}
+	if strings.ContainsAny(p.Prefix+p.Suffix, "{}") {
+		return Pattern{}, fmt.Errorf("pattern %q has a brace outside its range", s)
+	}
+
+	firstText := s[loc[2]:loc[3]]
+	first, err := strconv.Atoi(firstText)
+	if err != nil {
+		return Pattern{}, fmt.Errorf("pattern %q: %w", s, err)
+	}
+	last, err := strconv.Atoi(s[loc[4]:loc[5]])
+	if err != nil {
+		return Pattern{}, fmt.Errorf("pattern %q: %w", s, err)
+	}
+	if last < first {
+		return Pattern{}, fmt.Errorf("pattern %q counts down; write the range first..last ascending", s)
+	}
+	// Both bounds are non-negative, so last-first cannot overflow, but one more
+	// can: {0..9223372036854775807} has more names than an int counts.
+	if last-first >= math.MaxInt {
+		return Pattern{}, fmt.Errorf("pattern %q has more names than can be counted", s)
+	}
+	p.First, p.Last = first, last
+	if len(firstText) > 1 && firstText[0] == '0' {
+		p.Width = len(firstText)
+	}
+	return p, nil
+}
+
+// Len is the number of names the pattern expands to. Parse guarantees it fits
+// in an int.
+func (p Pattern) Len() int { return p.Last - p.First + 1 }
+
+// At returns the i-th name, counting from 0.
+func (p Pattern) At(i int) string {
+	return fmt.Sprintf("%s%0*d%s", p.Prefix, p.Width, p.First+i, p.Suffix)
+}
+
+// ErrTooMany is returned by Expand for a range longer than its limit.
+var ErrTooMany = errors.New("range is too long")
+
+// Expand parses s and returns every name it stands for, refusing a range of more
+// than max names before generating any of them.
+func Expand(s string, max int) ([]string, error) {
+	p, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// Compared as last-first, which cannot overflow, before anything uses Len.
+	if p.Last-p.First >= max {
+		return nil, fmt.Errorf("%w: %q gives %d names, the limit is %d", ErrTooMany, s, p.Len(), max)
+	}
+	out := make([]string, p.Len())
+	for i := range out {
+		out[i] = p.At(i)
+	}
+	return out, nil
+}
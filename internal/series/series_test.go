@@ -0,0 +1,72 @@
+package series
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"pump-{001..003}", []string{"pump-001", "pump-002", "pump-003"}},
+		{"pump-{8..11}", []string{"pump-8", "pump-9", "pump-10", "pump-11"}},
+		{"{09..11}-east", []string{"09-east", "10-east", "11-east"}},
+		{"Pump {098..100}", []string{"Pump 098", "Pump 099", "Pump 100"}},
+		{"s{0..0}", []string{"s0"}},
+	}
+	for _, c := range cases {
+		got, err := Expand(c.pattern, 100)
+		if err != nil {
+			t.Errorf("Expand(%q): %v", c.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Expand(%q) = %v, want %v", c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestParseRefusesWhatIsNotOneRange(t *testing.T) {
+	for _, s := range []string{
+		"pump-001",
+		"pump-{001..12O}",
+		"pump-{1..3}-{1..3}",
+		"pump-{3..1}",
+		"pump-{1...3}",
+		"pump}-{1..3}",
+		"pump-{-1..3}",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) accepted", s)
+		}
+	}
+}
+
+func TestExpandRefusesALongRangeBeforeGenerating(t *testing.T) {
+	_, err := Expand("x{1..1000000000}", 5000)
+	if !errors.Is(err, ErrTooMany) {
+		t.Fatalf("err = %v, want ErrTooMany", err)
+	}
+}
+
+func TestExpandRefusesARangeTooLongToCount(t *testing.T) {
+	if _, err := Expand("x{0..9223372036854775807}", 5000); err == nil {
+		t.Fatal("Expand accepted a range of 2^63 names")
+	}
+	if _, err := Expand("x{1..9223372036854775807}", 5000); !errors.Is(err, ErrTooMany) {
+		t.Fatalf("err = %v, want ErrTooMany", err)
+	}
+}
+
+func TestLenAndAt(t *testing.T) {
+	p, err := Parse("pump-{001..120}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 120 || p.At(0) != "pump-001" || p.At(119) != "pump-120" {
+		t.Errorf("Len = %d, At(0) = %q, At(119) = %q", p.Len(), p.At(0), p.At(119))
+	}
+}
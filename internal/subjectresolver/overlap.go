@@ -0,0 +1,70 @@
+package subjectresolver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Everything below is server-side only — the console has no counterpart — so
+// it is not part of what must stay in step with subjectResolver.ts.
+
+// placeholder stands in for a variable when a template is checked on its own:
+// a plain token, so that a variable resolves to something valid and only what
+// the author wrote literally is judged.
+const placeholder = "x"
+
+var templateVar = regexp.MustCompile(`\{[^{}]*\}`)
+
+// CheckTemplate reports whether tmpl, a joined prefix and suffix, yields a valid
+// subject for an operation with the given capability whatever its variables
+// resolve to. It rejects:
+//
+//   - a variable that is not one of the four reserved ones — "{location_code}"
+//     would otherwise stay in the subject as literal text and be granted as is
+//   - anything Valid rejects once each variable is a plain token
+//   - a literal wildcard in a publish or request subject, since a Thing cannot
+//     publish to a pattern; subscribe and reply subjects may use one
+func CheckTemplate(tmpl, capability string) error {
+	for _, v := range templateVar.FindAllString(tmpl, -1) {
+		switch v {
+		case VarOrg, VarLocation, VarThing, VarThingTypeCode:
+		default:
+			return fmt.Errorf("subject %q uses unknown variable %s", tmpl, v)
+		}
+	}
+
+	sample := ResolveThing(tmpl, ThingContext{
+		Org: placeholder, Location: placeholder, Thing: placeholder, ThingTypeCode: placeholder,
+	})
+	if err := Valid(sample); err != nil {
+		return fmt.Errorf("subject %q is not a valid NATS subject: %w", tmpl, err)
+	}
+	if capability == CapPublish || capability == CapRequest {
+		for _, t := range strings.Split(sample, ".") {
+			if t == "*" || t == ">" {
+				return fmt.Errorf("subject %q uses a wildcard; a %s subject must be concrete", tmpl, capability)
+			}
+		}
+	}
+	return nil
+}
+
+// Overlaps reports whether some concrete subject matches both patterns a and b.
+// "*" matches any one token and ">" one or more, so "a.*.c" and "a.b.>"
+// overlap on "a.b.c" while "a.*" and "a.*.c" never do. Both must be Valid.
+func Overlaps(a, b string) bool {
+	at, bt := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(at) && i == len(bt):
+			return true
+		case i == len(at) || i == len(bt):
+			return false
+		case at[i] == ">" || bt[i] == ">":
+			return true
+		case at[i] != "*" && bt[i] != "*" && at[i] != bt[i]:
+			return false
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package subjectresolver
+
+import "testing"
+
+func TestOverlaps(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"acme.*.pump.*.telemetry", "acme.*.pump.*.telemetry", true},
+		{"acme.*.pump.*.telemetry", "acme.*.valve.*.telemetry", false},
+		{"acme.*.c", "acme.b.>", true},
+		{"acme.*", "acme.*.c", false},
+		{"acme.>", "acme", false},
+		{"acme.>", "acme.a.b.c", true},
+		{"*.pump.*.cmd", "plant-a.*.*.cmd", true},
+		{"*.pump.*.cmd", "plant-a.*.*.status", false},
+	}
+	for _, c := range cases {
+		if got := Overlaps(c.a, c.b); got != c.want {
+			t.Errorf("Overlaps(%q, %q) = %v", c.a, c.b, got)
+		}
+		if got := Overlaps(c.b, c.a); got != c.want {
+			t.Errorf("Overlaps(%q, %q) = %v, not symmetric", c.b, c.a, got)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	ok := []struct{ tmpl, capability string }{
+		{Join("", "telemetry"), CapPublish},
+		{Join("{org}.sensors.{thing}", "cmd.*"), CapSubscribe},
+		{Join("{org}.{thing_type_code}", "events.>"), CapReply},
+		{Join("", "cmd-{thing}"), CapRequest},
+	}
+	for _, c := range ok {
+		if err := CheckTemplate(c.tmpl, c.capability); err != nil {
+			t.Errorf("CheckTemplate(%q, %s) = %v", c.tmpl, c.capability, err)
+		}
+	}
+
+	bad := []struct{ tmpl, capability string }{
+		{Join("", "telemetry.*"), CapPublish},
+		{Join("", ">"), CapRequest},
+		{Join("", "a..b"), CapSubscribe},
+		{Join("", "a b"), CapSubscribe},
+		{Join("", "a.>.b"), CapSubscribe},
+		{Join("{site}.{thing}", "telemetry"), CapPublish},
+		{Join("", "{thing}*"), CapSubscribe},
+	}
+	for _, c := range bad {
+		if err := CheckTemplate(c.tmpl, c.capability); err == nil {
+			t.Errorf("CheckTemplate(%q, %s) accepted it", c.tmpl, c.capability)
+		}
+	}
+}
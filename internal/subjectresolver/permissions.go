@@ -0,0 +1,199 @@
+package subjectresolver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The capabilities a thing_type_operations record may declare, matching the
+// select values on thing_type_operations.capability and thing_types.capabilities.
+const (
+	CapPublish   = "publish"
+	CapSubscribe = "subscribe"
+	CapRequest   = "request"
+	CapReply     = "reply"
+)
+
+// InboxTemplate is the inbox prefix a Thing with a request operation must use:
+// `_INBOX.<thing>`, set as the client's custom inbox prefix (nats.go's
+// CustomInboxPrefix). The requester is granted a subscription to its own prefix
+// only. Granting `_INBOX.>`, as any client with the default prefix needs, would
+// let every device in the account read every other device's replies.
+//
+// The reply side needs no inbox grant at all: a responder is given
+// AllowResponses, which lets it publish one message to the reply subject of a
+// request it received, whatever that subject is, and nothing else there.
+const InboxTemplate = "_INBOX." + VarThing
+
+// Operation is the part of a thing_type_operations record that decides a
+// permission.
+type Operation struct {
+	Name       string
+	Capability string
+	Suffix     string
+}
+
+// Permissions are NATS allow lists, sorted and free of duplicates so that an
+// unchanged contract always produces an identical value — the caller compares
+// against what is stored to decide whether a credential needs re-issuing.
+type Permissions struct {
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+
+	// AllowResponses is set by a reply operation: the identity may answer the
+	// requests it receives (the JWT's response permission, one message each).
+	AllowResponses bool `json:"allow_responses"`
+
+	// InboxPrefix is set by a request operation: the custom inbox prefix the
+	// device must use, and the only inbox it may subscribe to. Derived from
+	// InboxTemplate; for DeriveRolePattern it is `_INBOX.*`.
+	InboxPrefix string `json:"inbox_prefix,omitempty"`
+}
+
+// Equal reports whether p and o grant exactly the same subjects and response
+// permission. InboxPrefix is not compared: its grant is in Subscribe.
+func (p Permissions) Equal(o Permissions) bool {
+	return equalStrings(p.Publish, o.Publish) && equalStrings(p.Subscribe, o.Subscribe) &&
+		p.AllowResponses == o.AllowResponses
+}
+
+// Problem is an operation Derive could not grant, and why.
+type Problem struct {
+	Operation string `json:"operation"`
+	Subject   string `json:"subject"`
+	Reason    string `json:"reason"`
+}
+
+// Derive computes the allow lists a Thing needs to perform its type's operations:
+//
+//	publish   -> pub  subject
+//	subscribe -> sub  subject
+//	request   -> pub  subject,  sub _INBOX.<thing>.>   (InboxPrefix _INBOX.<thing>)
+//	reply     -> sub  subject,  AllowResponses
+//
+// where subject is ResolveThing(Join(prefix, op.Suffix), ctx). A request
+// operation needs {thing} to be a single subject token; a Thing whose code has
+// a dot or a wildcard in it cannot be given an inbox of its own, and its request
+// operations are reported rather than granted a shared one.
+//
+// It fails closed. An operation whose subject keeps an unresolved variable — a
+// Thing with no location under a prefix that uses {location}, say — or is not a
+// valid NATS subject is left out and reported as a Problem, rather than granted
+// with the variable widened to a wildcard. A missing grant shows up as one
+// operation failing; a widened one shows up as nothing at all.
+func Derive(prefix string, ctx ThingContext, ops []Operation) (Permissions, []Problem) {
+	return derive(prefix, ops, func(tmpl string) string { return ResolveThing(tmpl, ctx) })
+}
+
+// DeriveRolePattern is Derive for every Thing of a type at once: subjects are
+// resolved with ResolveRolePattern, so {thing} — and {location}, unless ctx
+// names one — become "*". It is what a Thing of the type would need, written
+// as the patterns a role would grant; {org} and {thing_type_code} must still
+// resolve, and an operation whose subject keeps either is reported, not granted.
+func DeriveRolePattern(prefix string, ctx RolePatternContext, ops []Operation) (Permissions, []Problem) {
+	return derive(prefix, ops, func(tmpl string) string { return ResolveRolePattern(tmpl, ctx) })
+}
+
+func derive(prefix string, ops []Operation, resolve func(string) string) (Permissions, []Problem) {
+	pub := map[string]bool{}
+	sub := map[string]bool{}
+	var perms Permissions
+	var problems []Problem
+
+	for _, op := range ops {
+		subject := resolve(Join(prefix, op.Suffix))
+		if vars := Unresolved(subject); len(vars) > 0 {
+			problems = append(problems, Problem{op.Name, subject,
+				"unresolved " + strings.Join(vars, ", ")})
+			continue
+		}
+		if err := Valid(subject); err != nil {
+			problems = append(problems, Problem{op.Name, subject, err.Error()})
+			continue
+		}
+
+		switch op.Capability {
+		case CapPublish:
+			pub[subject] = true
+		case CapSubscribe:
+			sub[subject] = true
+		case CapRequest:
+			inbox := resolve(InboxTemplate)
+			if err := validInbox(inbox); err != nil {
+				problems = append(problems, Problem{op.Name, subject, err.Error()})
+				continue
+			}
+			pub[subject] = true
+			sub[inbox+".>"] = true
+			perms.InboxPrefix = inbox
+		case CapReply:
+			sub[subject] = true
+			perms.AllowResponses = true
+		default:
+			problems = append(problems, Problem{op.Name, subject,
+				fmt.Sprintf("unknown capability %q", op.Capability)})
+		}
+	}
+
+	perms.Publish, perms.Subscribe = sortedKeys(pub), sortedKeys(sub)
+	return perms, problems
+}
+
+// validInbox checks a resolved InboxTemplate: `_INBOX.` and exactly one more
+// token, so that no Thing's inbox contains another's.
+func validInbox(inbox string) error {
+	token := strings.TrimPrefix(inbox, "_INBOX.")
+	if vars := Unresolved(token); len(vars) > 0 {
+		return fmt.Errorf("inbox %q: unresolved %s", inbox, strings.Join(vars, ", "))
+	}
+	if token == "" || strings.ContainsAny(token, ". \t\r\n>") || (strings.Contains(token, "*") && token != "*") {
+		return fmt.Errorf("inbox %q: {thing} must be a single subject token to name an inbox", inbox)
+	}
+	return nil
+}
+
+// Valid reports whether s is a well-formed NATS subject or subject pattern: dot-
+// separated, non-empty tokens with no whitespace, "*" only as a whole token, and
+// ">" only as the whole last token.
+func Valid(s string) error {
+	if s == "" {
+		return errors.New("subject is empty")
+	}
+	tokens := strings.Split(s, ".")
+	for i, t := range tokens {
+		switch {
+		case t == "":
+			return fmt.Errorf("subject %q has an empty token", s)
+		case strings.ContainsAny(t, " \t\r\n"):
+			return fmt.Errorf("subject %q contains whitespace", s)
+		case t == ">" && i != len(tokens)-1:
+			return fmt.Errorf("subject %q uses \">\" before the last token", s)
+		case t != "*" && t != ">" && strings.ContainsAny(t, "*>"):
+			return fmt.Errorf("subject %q uses a wildcard inside a token", s)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package subjectresolver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeriveMapsEachCapability(t *testing.T) {
+	ctx := ThingContext{Location: "plant-a", Thing: "pump-001", ThingTypeCode: "pump"}
+	ops := []Operation{
+		{Name: "telemetry", Capability: CapPublish, Suffix: "telemetry"},
+		{Name: "config", Capability: CapSubscribe, Suffix: "config"},
+		{Name: "lookup", Capability: CapRequest, Suffix: "lookup"},
+		{Name: "reboot", Capability: CapReply, Suffix: "cmd.reboot"},
+		{Name: "dup", Capability: CapPublish, Suffix: "telemetry"},
+	}
+
+	perms, problems := Derive("", ctx, ops)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %+v", problems)
+	}
+
+	want := Permissions{
+		Publish: []string{
+			"plant-a.pump.pump-001.lookup",
+			"plant-a.pump.pump-001.telemetry",
+		},
+		Subscribe: []string{
+			"_INBOX.pump-001.>",
+			"plant-a.pump.pump-001.cmd.reboot",
+			"plant-a.pump.pump-001.config",
+		},
+		AllowResponses: true,
+		InboxPrefix:    "_INBOX.pump-001",
+	}
+	if !reflect.DeepEqual(perms, want) {
+		t.Errorf("got %+v\nwant %+v", perms, want)
+	}
+	if !perms.Equal(want) {
+		t.Error("Equal disagrees with DeepEqual")
+	}
+}
+
+// Fail closed: a subject that cannot be resolved is not granted, and in
+// particular {location} is never widened to "*" the way a role pattern would.
+func TestDeriveSkipsWhatItCannotResolve(t *testing.T) {
+	ops := []Operation{
+		{Name: "telemetry", Capability: CapPublish, Suffix: "telemetry"},
+		{Name: "bad", Capability: CapPublish, Suffix: "a..b"},
+		{Name: "odd", Capability: "broadcast", Suffix: "x"},
+	}
+
+	perms, problems := Derive("", ThingContext{Thing: "pump-001", ThingTypeCode: "pump"}, ops)
+	if len(perms.Publish) != 0 || len(perms.Subscribe) != 0 {
+		t.Errorf("granted %+v with an unresolved {location}", perms)
+	}
+	if len(problems) != 3 {
+		t.Errorf("want 3 problems, got %+v", problems)
+	}
+
+	perms, problems = Derive("site.{thing}", ThingContext{Thing: "pump-001"}, ops)
+	if !reflect.DeepEqual(perms.Publish, []string{"site.pump-001.telemetry"}) {
+		t.Errorf("Publish = %v", perms.Publish)
+	}
+	if len(problems) != 2 {
+		t.Errorf("want the invalid subject and the unknown capability, got %+v", problems)
+	}
+}
+
+// A Thing's inbox is its own: no grant on the account-wide _INBOX.>, and no
+// inbox for a code that would contain another Thing's.
+func TestDeriveGivesEachThingItsOwnInbox(t *testing.T) {
+	ops := []Operation{{Name: "lookup", Capability: CapRequest, Suffix: "lookup"}}
+
+	perms, _ := Derive("site.{thing}", ThingContext{Thing: "pump-001"}, ops)
+	for _, s := range append(perms.Publish, perms.Subscribe...) {
+		if s == "_INBOX.>" {
+			t.Fatalf("granted the shared inbox: %+v", perms)
+		}
+	}
+	if perms.AllowResponses {
+		t.Error("a requester was given response permission")
+	}
+
+	for _, code := range []string{"pump.001", "pump*"} {
+		perms, problems := Derive("site", ThingContext{Thing: code}, ops)
+		if len(perms.Publish) != 0 || len(perms.Subscribe) != 0 || perms.InboxPrefix != "" {
+			t.Errorf("code %q: granted %+v", code, perms)
+		}
+		if len(problems) != 1 {
+			t.Errorf("code %q: want 1 problem, got %+v", code, problems)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, ok := range []string{"a", "a.b.c", "a.*.c", "a.>", "_INBOX.>"} {
+		if err := Valid(ok); err != nil {
+			t.Errorf("Valid(%q) = %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", ".a", "a.", "a..b", "a b", "a.>.c", "a.b*", "a.>x"} {
+		if err := Valid(bad); err == nil {
+			t.Errorf("Valid(%q) accepted it", bad)
+		}
+	}
+}
+
+func TestDeriveRolePatternWildcardsTheThing(t *testing.T) {
+	ops := []Operation{
+		{Name: "telemetry", Capability: CapPublish, Suffix: "telemetry"},
+		{Name: "reboot", Capability: CapReply, Suffix: "cmd.reboot"},
+	}
+
+	perms, problems := DeriveRolePattern("", RolePatternContext{ThingTypeCode: "pump"}, ops)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %+v", problems)
+	}
+	want := Permissions{
+		Publish:        []string{"*.pump.*.telemetry"},
+		Subscribe:      []string{"*.pump.*.cmd.reboot"},
+		AllowResponses: true,
+	}
+	if !perms.Equal(want) {
+		t.Errorf("got %+v\nwant %+v", perms, want)
+	}
+
+	perms, _ = DeriveRolePattern("", RolePatternContext{Location: "plant-a", ThingTypeCode: "pump"}, ops[:1])
+	if !reflect.DeepEqual(perms.Publish, []string{"plant-a.pump.*.telemetry"}) {
+		t.Errorf("Publish = %v", perms.Publish)
+	}
+
+	_, problems = DeriveRolePattern("{org}.{thing}", RolePatternContext{}, ops[:1])
+	if len(problems) != 1 {
+		t.Errorf("an unresolved {org} was granted: %+v", problems)
+	}
+}
@@ -0,0 +1,125 @@
+// Package subjectresolver turns a Thing Type's subject templates into concrete
+// NATS subjects. It is the Go half of ui/src/utils/subjectResolver.ts: the
+// console resolves subjects to show and publish to them, the server resolves
+// them to grant permissions on them, and the two must agree on every byte or a
+// device is granted one subject and told to use another. Keep the reserved
+// variable set and the behaviour of Join, ResolveThing and ResolveRolePattern in
+// step with the TS file.
+//
+// A subject is `prefix.suffix`, where the prefix comes from
+// thing_types.subject_prefix (DefaultPrefix when empty) and the suffix from a
+// thing_type_operations record. Four variables may appear in either:
+//
+//	{org}             the organization's name
+//	{location}        the Thing's location code
+//	{thing}           the Thing's code, or its id when it has none
+//	{thing_type_code} the Thing Type's code
+package subjectresolver
+
+import (
+	"strings"
+)
+
+// The reserved template variables.
+const (
+	VarOrg           = "{org}"
+	VarLocation      = "{location}"
+	VarThing         = "{thing}"
+	VarThingTypeCode = "{thing_type_code}"
+)
+
+// DefaultPrefix is the subject prefix of a Thing Type that does not set one.
+const DefaultPrefix = VarLocation + "." + VarThingTypeCode + "." + VarThing
+
+// ThingContext is the concrete value of each variable for one Thing. An empty
+// field leaves its variable unresolved.
+type ThingContext struct {
+	Org           string
+	Location      string
+	Thing         string
+	ThingTypeCode string
+}
+
+// RolePatternContext is ThingContext without the Thing: the values a role-level
+// pattern, which covers every Thing of a type, can be resolved against.
+type RolePatternContext struct {
+	Org           string
+	Location      string
+	ThingTypeCode string
+}
+
+// Join appends suffix to prefix, substituting DefaultPrefix for an empty prefix.
+// An empty suffix yields the prefix alone.
+func Join(prefix, suffix string) string {
+	p := prefix
+	if p == "" {
+		p = DefaultPrefix
+	}
+	if suffix == "" {
+		return p
+	}
+	return p + "." + suffix
+}
+
+// ResolveThing substitutes every reserved variable against a concrete Thing.
+// Variables whose value is empty are left as literal template tokens, so a caller
+// can tell an incomplete context from a resolved subject (see Unresolved).
+func ResolveThing(tmpl string, ctx ThingContext) string {
+	var pairs []string
+	if ctx.Org != "" {
+		pairs = append(pairs, VarOrg, ctx.Org)
+	}
+	if ctx.Location != "" {
+		pairs = append(pairs, VarLocation, ctx.Location)
+	}
+	if ctx.Thing != "" {
+		pairs = append(pairs, VarThing, ctx.Thing)
+	}
+	if ctx.ThingTypeCode != "" {
+		pairs = append(pairs, VarThingTypeCode, ctx.ThingTypeCode)
+	}
+	return replaceAll(tmpl, pairs)
+}
+
+// ResolveRolePattern produces a NATS role-level subject pattern:
+//
+//   - {thing} always becomes "*"
+//   - {location} becomes the supplied value, or "*" when empty
+//   - {org} and {thing_type_code} substitute when supplied, else remain literal
+func ResolveRolePattern(tmpl string, ctx RolePatternContext) string {
+	location := ctx.Location
+	if location == "" {
+		location = "*"
+	}
+	pairs := []string{VarThing, "*", VarLocation, location}
+	if ctx.Org != "" {
+		pairs = append(pairs, VarOrg, ctx.Org)
+	}
+	if ctx.ThingTypeCode != "" {
+		pairs = append(pairs, VarThingTypeCode, ctx.ThingTypeCode)
+	}
+	return replaceAll(tmpl, pairs)
+}
+
+// Unresolved returns the reserved variables still present in s, in the order
+// they are declared above.
+func Unresolved(s string) []string {
+	var out []string
+	for _, v := range []string{VarOrg, VarLocation, VarThing, VarThingTypeCode} {
+		if strings.Contains(s, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// replaceAll applies the pairs in order, each one to the output of the last —
+// the same sequential split/join the TS applyReplacements does, so a value that
+// happens to contain a later variable's token is substituted identically on both
+// sides.
+func replaceAll(tmpl string, pairs []string) string {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		tmpl = strings.ReplaceAll(tmpl, pairs[i], pairs[i+1])
+	}
+	return tmpl
+}
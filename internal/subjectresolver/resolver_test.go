@@ -0,0 +1,42 @@
+package subjectresolver
+
+import (
+	"reflect"
+	"testing"
+)
+
+// These cases are the TS resolver's behaviour, restated. A difference between
+// the two is a device granted one subject and told to publish on another.
+func TestJoinFallsBackToTheDefaultPrefix(t *testing.T) {
+	cases := []struct{ prefix, suffix, want string }{
+		{"", "telemetry", DefaultPrefix + ".telemetry"},
+		{"acme.pumps", "telemetry", "acme.pumps.telemetry"},
+		{"acme.pumps", "", "acme.pumps"},
+		{"", "", DefaultPrefix},
+	}
+	for _, c := range cases {
+		if got := Join(c.prefix, c.suffix); got != c.want {
+			t.Errorf("Join(%q, %q) = %q, want %q", c.prefix, c.suffix, got, c.want)
+		}
+	}
+}
+
+func TestResolveThingLeavesMissingVariablesLiteral(t *testing.T) {
+	got := ResolveThing(Join("", "telemetry"), ThingContext{Thing: "pump-001", ThingTypeCode: "pump"})
+	if want := "{location}.pump.pump-001.telemetry"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if vars := Unresolved(got); !reflect.DeepEqual(vars, []string{VarLocation}) {
+		t.Errorf("Unresolved = %v, want [{location}]", vars)
+	}
+}
+
+func TestResolveRolePatternWildcardsTheThing(t *testing.T) {
+	tmpl := Join("", "telemetry")
+	if got, want := ResolveRolePattern(tmpl, RolePatternContext{ThingTypeCode: "pump"}), "*.pump.*.telemetry"; got != want {
+		t.Errorf("no location: got %q, want %q", got, want)
+	}
+	if got, want := ResolveRolePattern(tmpl, RolePatternContext{Location: "plant-a", ThingTypeCode: "pump"}), "plant-a.pump.*.telemetry"; got != want {
+		t.Errorf("with location: got %q, want %q", got, want)
+	}
+}
@@ -19,7 +19,10 @@ import (
 	pbtenancy "github.com/skeeeon/pb-tenancy"
 
 	"platform/hooks"
+	"platform/internal/contractcheck"
 	"platform/internal/natsd"
+	"platform/internal/schemacompat"
+	"platform/internal/schemaregistry"
 	"platform/internal/version"
 	"platform/migrations"
 )
@@ -138,6 +141,30 @@ func setDefaults() {
 	viper.SetDefault("audit.retention.max_records", 0)
 	viper.SetDefault("audit.retention.interval", "0 2 * * *")
 
+	// Bus-side contract validator. Off by default: it subscribes to every
+	// contracted subject of every organization. See hooks/contract_validator.go.
+	viper.SetDefault("contracts.validator.enabled", false)
+	viper.SetDefault("contracts.validator.violation_prefix", "contracts.violations")
+	viper.SetDefault("contracts.validator.stats_subject", "contracts.stats")
+	viper.SetDefault("contracts.validator.stats_interval", "1m")
+	viper.SetDefault("contracts.validator.reload_interval", "5m")
+	viper.SetDefault("contracts.validator.max_subjects", 10000)
+
+	// Schema registry over NATS request-reply. Off by default, like the
+	// validator. See hooks/schema_registry.go.
+	viper.SetDefault("contracts.registry.enabled", false)
+	viper.SetDefault("contracts.registry.prefix", "schemas")
+	viper.SetDefault("contracts.registry.reload_interval", "5m")
+	viper.SetDefault("contracts.registry.cache_size", 1024)
+
+	// Compatibility mode for message schema namespaces without their own
+	// message_schema_namespaces record. See hooks/message_schema_compat.go.
+	viper.SetDefault("contracts.compatibility.default", "backward")
+
+	// What to do when a Thing Type's subjects overlap another type's in the same
+	// organization: reject or warn. See hooks/thing_subject_checks.go.
+	viper.SetDefault("contracts.subject_overlap", "reject")
+
 	// Branding (operator-level overrides for logo / theme / app name).
 	// Empty disables overrides; the embedded default branding is used.
 	viper.SetDefault("branding.dir", "")
@@ -363,6 +390,18 @@ func main() {
 		UserCollection:       "users",
 	})
 
+	// Keeps locations.ancestors, which the location-scoped leaf-node read rules
+	// compare against, and refuses a location-scoped leaf node with no location.
+	hooks.RegisterLeafSyncScope(app, hooks.LeafSyncScopeOptions{
+		LeafNodeCollection: "leaf_nodes",
+		LocationCollection: "locations",
+	})
+
+	// Refuses leaf_nodes.kv_buckets settings leaf-sync could not apply.
+	hooks.RegisterLeafKVBuckets(app, hooks.LeafKVBucketsOptions{
+		LeafNodeCollection: "leaf_nodes",
+	})
+
 	// Leaf-node-authenticated bootstrap routes. These serve the operator JWT, the
 	// org account JWT, and the leaf's own creds, so a leaf-node identity needs no
 	// read grant on nats_users or nats_accounts at all.
@@ -390,11 +429,20 @@ func main() {
 		MembershipCollection:  tenancyOptions.MembershipsCollection,
 	})
 
+	// Overlay IP management: cidr_range becomes an address pool. Hosts are checked
+	// against it on every write path and given the next free address when created
+	// without one, and owners/admins can list a network's used and free space.
+	hooks.RegisterNebulaIPAM(app, hooks.NebulaIPAMOptions{
+		NetworkCollection:    nebulaOptions.NetworkCollectionName,
+		HostCollection:       nebulaOptions.HostCollectionName,
+		MembershipCollection: tenancyOptions.MembershipsCollection,
+	})
+
 	// Thing creation with optional identity provisioning, in one transaction. The
 	// console used to do this in three unguarded calls, so a late failure orphaned
 	// a signed NATS credential; it also never set `active`, so every Thing it made
 	// was locked out of the API by things.authRule.
-	hooks.RegisterThingRoutes(app, hooks.ThingRoutesOptions{
+	thingRoutesOptions := hooks.ThingRoutesOptions{
 		ThingCollection:         "things",
 		OrgCollection:           tenancyOptions.OrganizationsCollection,
 		MembershipCollection:    tenancyOptions.MembershipsCollection,
@@ -403,6 +451,137 @@ func main() {
 		NatsRoleCollection:      natsOptions.RoleCollectionName,
 		NebulaHostCollection:    nebulaOptions.HostCollectionName,
 		NebulaNetworkCollection: nebulaOptions.NetworkCollectionName,
+		LeafNodeCollection:      "leaf_nodes",
+
+		ThingTypeCollection:          "thing_types",
+		ThingTypeOperationCollection: "thing_type_operations",
+		LocationCollection:           "locations",
+		MessageSchemaCollection:      "message_schemas",
+
+		NebulaCACollection:   nebulaOptions.CACollectionName,
+		ClaimTokenCollection: "thing_claim_tokens",
+	}
+	hooks.RegisterThingRoutes(app, thingRoutesOptions)
+
+	// Bulk Thing creation from CSV/NDJSON: every row goes through the same
+	// createThing path as the single-create route, with a dry run and a choice of
+	// all-or-nothing or per-row transactions.
+	hooks.RegisterThingImportRoutes(app, thingRoutesOptions)
+
+	// A run of identical Things from one template and a code pattern such as
+	// pump-{001..120}: the bulk import's checks and atomic write, without a file
+	// that repeats the same columns on every line.
+	hooks.RegisterThingSeriesRoutes(app, thingRoutesOptions)
+
+	// Thing removal that takes its provisioned NATS and Nebula identities with
+	// it. The record API's delete removes the Thing alone and orphans both.
+	hooks.RegisterThingDecommissionRoutes(app, thingRoutesOptions)
+
+	// Attach, replace or detach a Thing's identities after creation, with the
+	// create route's own auto/link/none resolution.
+	hooks.RegisterThingIdentityRoutes(app, thingRoutesOptions)
+
+	// Per-device NATS permissions derived from the Thing Type contract, kept in
+	// step when the type, its operations, a location or the Thing changes. Only
+	// identities minted for their Thing are managed this way.
+	hooks.RegisterThingPermissions(app, thingRoutesOptions)
+
+	// Thing Type subjects checked when a type or an operation is saved: invalid
+	// subjects are refused, and so are subjects overlapping another type's in the
+	// same organization unless contracts.subject_overlap is "warn".
+	subjectOverlap := viper.GetString("contracts.subject_overlap")
+	if subjectOverlap != "reject" && subjectOverlap != "warn" {
+		log.Fatalf("❌ contracts.subject_overlap must be reject or warn (got %q)", subjectOverlap)
+	}
+	hooks.RegisterSubjectChecks(app, hooks.SubjectCheckOptions{
+		OrgCollection:                tenancyOptions.OrganizationsCollection,
+		ThingTypeCollection:          "thing_types",
+		ThingTypeOperationCollection: "thing_type_operations",
+		Overlap:                      subjectOverlap,
+	})
+
+	// The resolved contract of a Thing or a Thing Type — operations, concrete
+	// subjects, schema documents and the NATS permissions they need — computed by
+	// the same code that grants those permissions.
+	hooks.RegisterThingContractRoutes(app, thingRoutesOptions)
+
+	// Zero-touch enrollment: one-time claim tokens bound to a Thing, redeemed by
+	// the device with public keys it generated, for credentials signed for them.
+	// The device's private keys never reach the server.
+	hooks.RegisterThingEnrollment(app, thingRoutesOptions)
+
+	// A new API password for an existing Thing, with live sessions killed and,
+	// optionally, a new NATS key pair in the same transaction — for a device that
+	// is re-flashed or replaced, without recreating the Thing.
+	hooks.RegisterThingCredentialRoutes(app, thingRoutesOptions)
+
+	// Thing and Location metadata validated against the type's metadata_schema
+	// whenever it is written, plus a conformance report for records that predate
+	// or were left behind by a schema change.
+	metadataOptions := hooks.MetadataValidationOptions{
+		ThingCollection:        "things",
+		ThingTypeCollection:    "thing_types",
+		LocationCollection:     "locations",
+		LocationTypeCollection: "location_types",
+		MembershipCollection:   tenancyOptions.MembershipsCollection,
+	}
+	hooks.RegisterMetadataValidation(app, metadataOptions)
+
+	// Protobuf and Avro message schemas compiled on save with their message type
+	// resolved and stored, plus a route converting JSON samples to and from a
+	// schema's wire encoding.
+	hooks.RegisterMessageSchemaFormats(app, thingRoutesOptions)
+
+	// New message schema versions checked against the previous version of the
+	// same schema under the namespace's compatibility mode, with breaking changes
+	// refused unless explicitly overridden and the result stored on the record.
+	schemaCompatDefault := viper.GetString("contracts.compatibility.default")
+	if !schemacompat.ValidMode(schemaCompatDefault) {
+		log.Fatalf("❌ contracts.compatibility.default must be backward, forward, full or none (got %q)", schemaCompatDefault)
+	}
+	hooks.RegisterMessageSchemaCompat(app, hooks.MessageSchemaCompatOptions{
+		MessageSchemaCollection: "message_schemas",
+		NamespaceCollection:     "message_schema_namespaces",
+		DefaultMode:             schemaCompatDefault,
+	})
+
+	// Live NATS traffic checked against each operation's message schema, with
+	// violation events and per-subject counters published into the organization's
+	// own account. Opt-in; `stone-age contracts validate` runs it on its own.
+	contractValidatorOptions := hooks.ContractValidatorOptions{
+		OrgCollection:                tenancyOptions.OrganizationsCollection,
+		NatsAccountCollection:        natsOptions.AccountCollectionName,
+		ThingTypeCollection:          "thing_types",
+		ThingTypeOperationCollection: "thing_type_operations",
+		MessageSchemaCollection:      "message_schemas",
+		Enabled:                      viper.GetBool("contracts.validator.enabled"),
+		ServerURL:                    viper.GetString("nats.server_url"),
+		Config: contractcheck.Config{
+			ViolationPrefix: viper.GetString("contracts.validator.violation_prefix"),
+			StatsSubject:    viper.GetString("contracts.validator.stats_subject"),
+			StatsInterval:   viper.GetDuration("contracts.validator.stats_interval"),
+			ReloadInterval:  viper.GetDuration("contracts.validator.reload_interval"),
+			MaxSubjects:     viper.GetInt("contracts.validator.max_subjects"),
+		},
+	}
+	hooks.RegisterContractValidator(app, contractValidatorOptions)
+
+	// message_schemas served over NATS in each organization's account, for the
+	// devices and rule routers that need a subject's schema but cannot reach the
+	// HTTP API. Opt-in.
+	hooks.RegisterSchemaRegistry(app, hooks.SchemaRegistryOptions{
+		OrgCollection:                tenancyOptions.OrganizationsCollection,
+		NatsAccountCollection:        natsOptions.AccountCollectionName,
+		ThingTypeCollection:          "thing_types",
+		ThingTypeOperationCollection: "thing_type_operations",
+		MessageSchemaCollection:      "message_schemas",
+		Enabled:                      viper.GetBool("contracts.registry.enabled"),
+		ServerURL:                    viper.GetString("nats.server_url"),
+		Config: schemaregistry.Config{
+			Prefix:         viper.GetString("contracts.registry.prefix"),
+			ReloadInterval: viper.GetDuration("contracts.registry.reload_interval"),
+			CacheSize:      viper.GetInt("contracts.registry.cache_size"),
+		},
 	})
 
 	// Deployment facts the SPA needs at runtime but cannot be compiled with —
@@ -433,6 +612,28 @@ func main() {
 		NatsWebsocketURLs: natsWebsocketURLs,
 	})
 
+	// One archive per Thing for the field install: creds, Nebula certificate,
+	// key, CA and config, and a manifest naming the bus URLs and the Thing's
+	// subjects. Registered here rather than with the other Thing routes because
+	// it needs the validated WebSocket URLs. Every download is written to
+	// audit_logs before it is served.
+	hooks.RegisterThingBundleRoutes(app, hooks.ThingBundleOptions{
+		ThingRoutesOptions: thingRoutesOptions,
+		AuditCollection:    auditOptions.CollectionName,
+		NatsServerURL:      viper.GetString("nats.server_url"),
+		NatsWebsocketURLs:  natsWebsocketURLs,
+	})
+
+	// The organization's contracts as an AsyncAPI 3.0 document, built from the
+	// records rather than written by hand for each partner. Also here for the
+	// WebSocket URLs, which become servers alongside nats.server_url.
+	contractExportOptions := hooks.ContractExportOptions{
+		ThingRoutesOptions: thingRoutesOptions,
+		NatsServerURL:      viper.GetString("nats.server_url"),
+		NatsWebsocketURLs:  natsWebsocketURLs,
+	}
+	hooks.RegisterContractExportRoutes(app, contractExportOptions)
+
 	// Embedded NATS server. Bound to OnServe rather than OnBootstrap on purpose:
 	// the support library calls e.Next() *before* it seeds the NATS operator, so
 	// a bootstrap handler registered after its Setup actually runs earlier, when
@@ -534,6 +735,13 @@ func main() {
 	// Register Bootstrap Command
 	addBootstrapCommand(app, tenancyOptions.OrganizationsCollection, tenancyOptions.MembershipsCollection, natsOptions)
 
+	// Register Metadata Conformance Command
+	addMetadataCheckCommand(app, tenancyOptions.OrganizationsCollection, metadataOptions)
+	contractsCmd := addContractsCommand(app)
+	addContractsValidateCommand(app, contractsCmd, contractValidatorOptions)
+	addContractsAsyncAPICommand(app, contractsCmd, contractExportOptions)
+	addContractsGenerateCommand(app, contractsCmd, contractExportOptions)
+
 	if err := app.Start(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+
+	"platform/hooks"
+)
+
+// addMetadataCheckCommand registers the `metadata-check` CLI command, which
+// reports every Thing and Location whose metadata does not conform to its type's
+// metadata_schema. It is the operator's view of GET /api/org/metadata/conformance:
+// the same check, across every organization unless --org narrows it.
+//
+// Save-time validation only runs when a record's metadata or type is written, so
+// records that predate a schema, or that a later schema edit left behind, stay
+// as they are until someone looks. This is where to look — and, because it exits
+// non-zero when anything fails, it can gate a schema change in a deploy script.
+func addMetadataCheckCommand(app *pocketbase.PocketBase, orgColName string, opts hooks.MetadataValidationOptions) {
+	cmd := &cobra.Command{
+		Use:   "metadata-check",
+		Short: "Report Things and Locations whose metadata does not match their type's schema",
+		Run: func(cmd *cobra.Command, args []string) {
+			orgRef, _ := cmd.Flags().GetString("org")
+			asJSON, _ := cmd.Flags().GetBool("json")
+
+			orgID := ""
+			if orgRef != "" {
+				org, err := app.FindFirstRecordByFilter(orgColName,
+					"id = {:ref} || name = {:ref}", dbx.Params{"ref": orgRef})
+				if err != nil {
+					log.Fatalf("❌ Organization %q not found", orgRef)
+				}
+				orgID = org.Id
+			}
+
+			report, err := hooks.MetadataConformance(app, opts, orgID)
+			if err != nil {
+				log.Fatalf("❌ Conformance check failed: %v", err)
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(report); err != nil {
+					log.Fatalf("❌ %v", err)
+				}
+			} else {
+				printMetadataReport(report)
+			}
+
+			if report.NonConforming > 0 || schemaErrors(report) > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().String("org", "", "Check one organization (id or name) instead of all of them")
+	cmd.Flags().Bool("json", false, "Print the report as JSON")
+
+	app.RootCmd.AddCommand(cmd)
+}
+
+func printMetadataReport(report *hooks.MetadataReport) {
+	for _, t := range report.Types {
+		switch {
+		case t.SchemaError != "":
+			fmt.Printf("❌ %s type '%s' (%s): schema does not compile: %s\n", t.Collection, t.TypeName, t.Organization, t.SchemaError)
+		case len(t.NonConforming) == 0:
+			fmt.Printf("✅ %s type '%s' (%s): %d checked, all conform\n", t.Collection, t.TypeName, t.Organization, t.Checked)
+		default:
+			fmt.Printf("⚠️  %s type '%s' (%s): %d of %d do not conform\n", t.Collection, t.TypeName, t.Organization, len(t.NonConforming), t.Checked)
+			for _, r := range t.NonConforming {
+				label := r.Code
+				if label == "" {
+					label = r.ID
+				}
+				for _, v := range r.Violations {
+					pointer := v.Pointer
+					if pointer == "" {
+						pointer = "(root)"
+					}
+					fmt.Printf("   %s %s: %s\n", label, pointer, v.Message)
+				}
+			}
+		}
+	}
+	fmt.Printf("\n%d record(s) checked, %d non-conforming\n", report.Checked, report.NonConforming)
+}
+
+func schemaErrors(report *hooks.MetadataReport) int {
+	n := 0
+	for _, t := range report.Types {
+		if t.SchemaError != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_audit_download_event adds "download" to audit_logs.event_type.
+//
+// pb-audit records writes. The provisioning bundle route
+// (hooks/thing_bundle.go) serves a Thing's creds file and Nebula host key in
+// one archive, which is a read, so pb-audit never sees it; the route writes its
+// own audit_logs entry with this event type before serving. The entry carries the
+// file list and the archive's digest, never the secrets themselves.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping audit download event")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ audit_logs.event_type accepts download")
+		return nil
+	}, nil)
+}
@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_leaf_kv_buckets adds leaf_nodes.kv_buckets: per-collection
+// settings (history, storage, replicas, max_bytes, compression) for the KV
+// buckets leaf-sync mirrors into on that leaf node. hooks/leaf_kv_buckets.go
+// validates it on save.
+//
+// The field is empty on every existing leaf node, which keeps the buckets
+// exactly as they were. It inherits the leaf_nodes rules: the organization's
+// owners and admins edit it, and the leaf node reads its own.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping leaf kv buckets")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ Added leaf_nodes.kv_buckets for per-leaf-node KV bucket settings")
+		return nil
+	}, nil)
+}
@@ -0,0 +1,90 @@
+package migrations
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_leaf_sync_scope lets a leaf node mirror only the site it serves
+// (hooks/leaf_sync_scope.go):
+//
+//   - leaf_nodes.sync_scope: "organization" (or empty, as every existing leaf
+//     node is) keeps today's org-wide read; "location" limits it to the leaf
+//     node's location and everything below it.
+//   - locations.ancestors: a hidden relation listing every location above a
+//     location, maintained on save. API rules cannot walk `parent`, and the
+//     scoped rules need "is this at or below that" in one comparison.
+//   - the leaf_nodes branch of the list and view rules of things, locations,
+//     location_types, thing_types, thing_type_operations and message_schemas
+//     gains the scoped condition. Types, operations and schemas are visible to a
+//     scoped leaf node only when something in its subtree uses them.
+//
+// Existing locations are backfilled here. The write goes straight to the table:
+// it is derived data, and a Save would bump `updated` on every location of every
+// organization, and refuse one whose parent chain already loops. Such a chain is
+// cut where it repeats, and logged.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping leaf sync scope")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		if err := backfillLocationAncestors(app); err != nil {
+			return err
+		}
+		log.Println("✅ Added leaf_nodes.sync_scope and locations.ancestors; leaf-node reads can be scoped to a location subtree")
+		return nil
+	}, nil)
+}
+
+// backfillLocationAncestors computes every location's ancestors from the
+// parent relation.
+func backfillLocationAncestors(app core.App) error {
+	records, err := app.FindAllRecords("locations")
+	if err != nil {
+		return err
+	}
+	parent := make(map[string]string, len(records))
+	for _, rec := range records {
+		parent[rec.Id] = rec.GetString("parent")
+	}
+
+	for _, rec := range records {
+		var chain []string
+		seen := map[string]bool{rec.Id: true}
+		for p := parent[rec.Id]; p != ""; p = parent[p] {
+			if seen[p] {
+				log.Printf("⚠️ location %s has a parent chain that loops at %s; its ancestors stop there", rec.Id, p)
+				break
+			}
+			if _, ok := parent[p]; !ok {
+				break // dangling parent
+			}
+			seen[p] = true
+			chain = append([]string{p}, chain...)
+		}
+		if chain == nil {
+			chain = []string{}
+		}
+		raw, err := json.Marshal(chain)
+		if err != nil {
+			return err
+		}
+		if _, err := app.DB().Update("locations",
+			dbx.Params{"ancestors": string(raw)},
+			dbx.HashExp{"id": rec.Id},
+		).Execute(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_message_schema_compatibility adds what the compatibility check
+// on message_schemas (hooks/message_schema_compat.go) needs:
+//
+//   - message_schemas.allow_breaking, the one-shot override an owner/admin sets
+//     to publish a version that breaks its namespace's mode. The hook clears it
+//     before the record is saved.
+//   - message_schemas.compatibility, the stored result of the check: the mode,
+//     the version compared with, every change found and whether the write was
+//     overridden.
+//   - message_schema_namespaces, one record per organization and namespace
+//     choosing backward, forward, full or none. A namespace without one uses
+//     contracts.compatibility.default. Readable by the same audience as
+//     message_schemas, so a leaf node can mirror it; written by owners/admins.
+//
+// Existing versions are not re-checked; their compatibility stays empty until
+// their schema or version is next written.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping message schema compatibility")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ Added message schema compatibility fields and message_schema_namespaces")
+		return nil
+	}, nil)
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_message_schema_formats lets message_schemas hold Protobuf and
+// Avro documents as well as JSON Schema (hooks/message_schema_formats.go,
+// internal/msgformat):
+//
+//   - message_schemas.format gains "protobuf" and "avro". The document stays in
+//     the `schema` JSON field: the Avro schema as is, and for Protobuf an object
+//     holding the .proto source, several named sources, or a base64
+//     FileDescriptorSet.
+//   - message_schemas.message_type names the message a document describes — the
+//     fully qualified Protobuf message, or the Avro schema's name. Written by the
+//     save hook once the document compiles, from what the client asked for or,
+//     when the document has a single message, from the document. Always empty
+//     for JSON Schema.
+//
+// Existing records are all json_schema, and keep an empty message_type.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping message schema formats")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ Added protobuf and avro to message_schemas.format, and message_schemas.message_type")
+		return nil
+	}, nil)
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_nats_allow_responses adds nats_users.allow_responses: the JWT's
+// response permission, which lets an identity answer the requests it receives
+// without a publish grant on `_INBOX.>`. hooks/thing_permissions.go sets it from
+// a Thing's contract (a `reply` operation) and signs the identity itself, since
+// pb-nats has no field for it.
+//
+// False on every existing identity. Minted Thing identities are brought to the
+// new grants — their own inbox instead of `_INBOX.>` — by the startup recompute
+// in RegisterThingPermissions, not here: deriving them needs the contract code.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping nats allow_responses")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ Added nats_users.allow_responses for contract reply operations")
+		return nil
+	}, nil)
+}
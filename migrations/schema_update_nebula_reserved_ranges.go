@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_nebula_reserved_ranges adds `nebula_networks.reserved_ranges`, a
+// JSON list of addresses the overlay IP allocator must never hand out: single
+// addresses ("10.100.0.1"), CIDR blocks ("10.100.0.240/28") and inclusive runs
+// ("10.100.0.2-10.100.0.9").
+//
+// Typical entries are the lighthouses' well-known addresses, a block kept for
+// hand-assigned infrastructure, and anything an operator has promised to another
+// system. Before this the only record of those was a spreadsheet, and nothing
+// stopped a host being given one.
+//
+// The field is read by hooks/nebula_ipam.go, which also validates it on save —
+// every entry must parse and lie inside cidr_range — so a typo is refused at the
+// point it is made rather than quietly protecting nothing.
+//
+// No backfill. Nullable, referenced by no rule, and "nothing reserved" is the
+// behaviour every network has had until now.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping nebula_networks.reserved_ranges")
+			return nil
+		}
+
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+
+		log.Println("✅ nebula_networks.reserved_ranges added")
+		return nil
+	}, func(app core.App) error {
+		// Down: no-op. Dropping the column would discard every reservation an
+		// admin recorded, and the field is inert when empty.
+		return nil
+	})
+}
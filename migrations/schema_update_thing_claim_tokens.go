@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_thing_claim_tokens adds `thing_claim_tokens`, the one-time
+// tokens behind zero-touch enrollment (hooks/thing_enrollment.go).
+//
+// A claim token is bound to one Thing and lets whoever holds it, once and before
+// it expires, have that Thing's NATS and Nebula identities signed for public keys
+// the device generated itself. The record is the token's whole lifecycle: who
+// issued it and for how long, when and from where it was redeemed and with which
+// key, and who revoked it. Records are never deleted by the routes, so the
+// collection doubles as the enrollment history; pb-audit records every change to
+// it like any other.
+//
+// The history outlives the Thing. `thing` does not cascade, and is optional so
+// that it does not block the delete either: deleting a Thing clears it, and
+// `thing_code`, written at issue, still says which Thing the token was for.
+// `organization` is required and cascades, as on every other tenant
+// collection, so deleting an organization deletes its tokens.
+//
+// SECURITY: only `token_hash` is stored, and it is hidden. The token itself is
+// shown once, in the response to the owner/admin who issued it. All writes go
+// through the routes — create, update and delete rules are null — because
+// issuing, redeeming and revoking each restate checks a rule cannot express
+// (the Thing is in the caller's organization and has a code; the token is
+// unexpired, unused and unrevoked, decided in the same transaction that uses it).
+// Reads are owner/admin of the active organization.
+//
+// Additive import (deleteMissing=false); safe on fresh DBs.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping thing_claim_tokens")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ thing_claim_tokens collection added")
+		return nil
+	}, nil)
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// schema_update_thing_provisioned_identities adds `things.provisioned_identities`,
+// a hidden JSON field recording which NATS user and Nebula host the server minted
+// FOR that Thing, as opposed to ones an admin linked to it.
+//
+// The decommission route (hooks/thing_decommission.go) needs the difference. An
+// identity minted under `mode: auto` belongs to its Thing and should go when the
+// Thing goes; one attached under `mode: link` may be shared, or may predate the
+// Thing entirely, and deleting it would take down whatever else uses it. The
+// relation on its own cannot say which is which.
+//
+// Hidden, not merely absent from the forms. PocketBase refuses writes to a hidden
+// field from anyone but a superuser (forms/record_upsert.go), so the value can
+// only come from a server-side Save. A visible field would need a
+// `:changed = false` clause in every things write rule to stop a member marking a
+// shared identity as "minted for this Thing" and so getting it deleted along
+// with it — the deny-list shape this schema has been bitten by before.
+//
+// No backfill. Nothing recorded provenance before this, and guessing it from the
+// synthetic email shape would be wrong for exactly the records that matter — one
+// an admin re-pointed by hand. Existing Things therefore read as "everything
+// linked", which is the conservative answer: decommissioning one removes the
+// Thing and leaves its identities unless the caller asks for them explicitly.
+func init() {
+	m.Register(func(app core.App) error {
+		if len(SchemaJSON) == 0 {
+			log.Println("⚠️ SchemaJSON is empty, skipping things.provisioned_identities")
+			return nil
+		}
+		if err := app.ImportCollectionsByMarshaledJSON(SchemaJSON, false); err != nil {
+			return err
+		}
+		log.Println("✅ things.provisioned_identities added")
+		return nil
+	}, nil)
+}
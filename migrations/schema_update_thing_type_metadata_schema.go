@@ -26,14 +26,17 @@ import (
 // MetadataEditor treats absent, empty, and property-less schemas identically
 // and falls back to free-form key/value rows.
 //
-// Nor does this constrain what may be written. The schema drives form
-// RENDERING only — `things.metadata` stays free-form JSON and no rule or hook
-// validates a Thing's metadata against its type's schema. That is deliberate:
-// validation would make editing a type's schema retroactively invalidate
-// existing Things, and the write path (POST /api/org/things and the CRUD
-// update rule) would have to reject saves for a reason the member did not
-// cause and cannot fix. Extra keys are surfaced in the form and preserved on
-// save.
+// When this was added the schema drove form RENDERING only, because validating
+// on every save would make editing a type's schema retroactively invalidate
+// existing Things, and a member making an unrelated edit would be refused for a
+// reason they did not cause and cannot fix. It is now enforced
+// (hooks/metadata_validation.go) without that failure mode: a Thing's or
+// Location's metadata is checked against its type's schema on create, and on an
+// update only when the metadata or the type itself changes, through the console,
+// the record API and POST /api/org/things alike. A schema is itself checked when
+// its type is saved. Records a schema change left behind are not refused; the
+// conformance report (GET /api/org/metadata/conformance, `metadata-check`) lists
+// them. Extra keys are allowed unless the schema says otherwise.
 func init() {
 	m.Register(func(app core.App) error {
 		if len(SchemaJSON) == 0 {
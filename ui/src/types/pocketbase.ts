@@ -75,7 +75,8 @@ export interface ThingType extends BaseRecord {
   subject_prefix?: string
   operations?: string[] // Thing Type Operation IDs
   // Optional JSON Schema describing the inventory fields tracked for this class
-  // of device. Drives the Thing form's metadata editor; not validated on write.
+  // of device. Drives the Thing form's metadata editor and is enforced on
+  // metadata writes (hooks/metadata_validation.go).
   metadata_schema?: Record<string, any> | null
 }
 
@@ -90,7 +91,7 @@ export interface ThingTypeOperation extends BaseRecord {
 }
 
 // Message Schema
-export type MessageSchemaFormat = 'json_schema'
+export type MessageSchemaFormat = 'json_schema' | 'protobuf' | 'avro'
 
 export interface MessageSchema extends BaseRecord {
   organization?: string
@@ -98,7 +99,9 @@ export interface MessageSchema extends BaseRecord {
   name: string
   version: string
   format: MessageSchemaFormat
-  schema: Record<string, any> | string // JSON Schema document
+  // JSON Schema or Avro document; for protobuf { proto } | { files } | { file_descriptor_set }
+  schema: Record<string, any> | string
+  message_type?: string // Protobuf message or Avro type name; stored fully qualified by the server
   description?: string
 }
 
@@ -119,6 +122,16 @@ export interface Thing extends AuthRecord {
   active?: boolean
 }
 
+// One entry of LeafNode.kv_buckets; an unset field falls through to 'default',
+// then to leaf-sync's built-in shape.
+export interface LeafKVBucketSettings {
+  history?: number // 1-64
+  storage?: 'file' | 'memory'
+  replicas?: number // 1-5
+  max_bytes?: number // 0 = no cap
+  compression?: boolean
+}
+
 // Leaf Node (edge node) — a "special thing": one NATS identity, mirrors its
 // organization's config into local JetStream KV via the leaf-sync agent.
 export interface LeafNode extends AuthRecord {
@@ -129,6 +142,12 @@ export interface LeafNode extends AuthRecord {
   domain?: string // local JetStream domain (e.g. edge-<code>)
   synced_collections?: string[] // collections this node mirrors (allowlist-bound)
   location?: string // Location ID
+  // 'location' limits what the node can read to its location's subtree (enforced
+  // by the API rules); '' or 'organization' is the whole organization.
+  sync_scope?: '' | 'organization' | 'location'
+  // Per-collection settings of the KV buckets leaf-sync mirrors into, keyed by
+  // 'default' or a collection (see cmd/leaf-sync/README.md).
+  kv_buckets?: Record<string, LeafKVBucketSettings> | null
   nats_user?: string // set by the server-side provisioning hook
   nebula_host?: string
   metadata?: Record<string, any>
@@ -144,7 +163,8 @@ export interface LocationType extends BaseRecord {
   description?: string
   code?: string
   // Optional JSON Schema describing the inventory fields tracked for this class
-  // of place. Drives the Location form's metadata editor; not validated on write.
+  // of place. Drives the Location form's metadata editor and is enforced on
+  // metadata writes (hooks/metadata_validation.go).
   metadata_schema?: Record<string, any> | null
 }
 
@@ -198,6 +218,7 @@ export interface NatsUser extends AuthRecord {
   jwt?: string
   creds_file?: string
   bearer_token?: boolean
+  allow_responses?: boolean // may answer the requests it receives; set from a Thing's contract
   jwt_expires_at?: string
   regenerate?: boolean
   revoke?: boolean
@@ -274,6 +295,7 @@ export interface NebulaNetwork extends BaseRecord {
   name: string
   description?: string
   cidr_range: string
+  reserved_ranges?: string[] | null
   active?: boolean
   ca_id: string
   organization?: string